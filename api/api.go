@@ -19,10 +19,10 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
-	"encoding/base64"
-	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,31 +30,77 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/googlegenomics/htsget/internal/analytics"
 	"github.com/googlegenomics/htsget/internal/bam"
 	"github.com/googlegenomics/htsget/internal/bgzf"
 	"github.com/googlegenomics/htsget/internal/genomics"
+	"github.com/googlegenomics/htsget/internal/sam"
+	"github.com/googlegenomics/htsget/ticket"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
 const (
-	readsPath = "/reads/"
-	blockPath = "/block/"
+	readsPath      = "/reads/"
+	blockPath      = "/block/"
+	readyPath      = "/ready"
+	metadataPath   = "/metadata/"
+	indexStatsPath = "/index-stats/"
+	densityPath    = "/density/"
+	countPath      = "/count/"
+	sequencePath   = "/sequence/"
+
+	capabilitiesPath = "/capabilities"
+
+	// readyTimeout bounds the time spent checking bucket access when serving
+	// a readiness probe.
+	readyTimeout = 5 * time.Second
+
+	// Density windows default to 1Mbp and may not be smaller than the
+	// smallest bin in the index (16kbp).  Requests that would produce more than
+	// maximumDensityWindows windows are rejected.
+	defaultDensityWindow  = 1000000
+	minimumDensityWindow  = 1 << 14
+	maximumDensityWindows = 100000
+
+	// Record counts may be estimated by sampling at most maximumSampleBlocks
+	// BGZF blocks from the start of the region.
+	maximumSampleBlocks = 16
+
+	// POST reads requests may have a body of at most maximumReadsBodySize
+	// bytes that lists at most maximumRegions regions.
+	maximumReadsBodySize = 1 << 20
+	maximumRegions       = 1000
+
+	// unplacedReferenceName is the reference name that selects the unplaced
+	// unmapped reads.
+	unplacedReferenceName = "*"
 
 	eofMarkerDataURL = "data:;base64,H4sIBAAAAAAA/wYAQkMCABsAAwAAAAAAAAAAAA=="
+
+	// MaxBlockSizeLimit is the largest block size limit the server accepts.
+	// Larger limits are clamped to it since a single block must fit in the
+	// memory available to a request when it is re-encoded.
+	MaxBlockSizeLimit = 1024 * 1024 * 1024
+
+	defaultBreakerRatio    = 0.5
+	defaultBreakerCooldown = 30 * time.Second
 )
 
 var (
 	errInvalidOrUnspecifiedID = errors.New("invalid or unspecified ID")
 	errNoFormatSpecified      = errors.New("no format specified")
 	errMissingReferenceName   = errors.New("no reference name specified")
+	errUnplacedNotSupported   = errors.New("referenceName=* is only supported for reads")
 	errMissingOrInvalidToken  = errors.New("missing or invalid token")
 )
 
@@ -68,14 +114,60 @@ type NewStorageClientFunc func(*http.Request) (*storage.Client, http.Header, err
 type Server struct {
 	newStorageClient NewStorageClientFunc
 	blockSizeLimit   uint64
+	bucketLimits     map[string]uint64
+	classLimits      map[string]classLimits
+	maxSpan          uint32
+	bucketSpans      map[string]uint32
+	referenceAliases map[string][]string
 	whitelist        map[string]bool
+	strict           bool
+	advertisedURL    string
+	basePath         string
+	bearerTokenAuth  bool
+	iap              *iapVerifier
+	iapPermissions   map[string]map[string]bool
+	breaker          *circuitBreaker
+	readyClient      NewStorageClientFunc
+	ipFilter         *ipFilter
+	maxTimeout       time.Duration
+	indexTemplates   []indexTemplate
+	indexLocations   map[string]indexLocation
+	idAliases        idAliases
+	limiters         map[string]*limiter
+	inlineLimit      uint64
+	minimalHeaders   bool
+	inlineHeaders    bool
+	streamBuffer     int
+	signer           *urlSigner
+	ticketSigner     *ticketSigner
+	egress           *egressMeter
+	blockCache       *diskCache
+	headerCache      *headerCache
+	indexCache       *indexCache
+	serviceInfo      ServiceInfo
+	blockTokenKey    []byte
+	flights          flightGroup
 }
 
 // NewServer returns a new Server configured to use newStorageClient and
-// blockSizeLimit. The server will call storageClientFunc on each request to
-// determine which GCS storage client to use.
+// blockSizeLimit (which is clamped to MaxBlockSizeLimit). The server will call
+// storageClientFunc on each request to determine which GCS storage client to
+// use.
 func NewServer(newStorageClient NewStorageClientFunc, blockSizeLimit uint64) *Server {
-	return &Server{newStorageClient, blockSizeLimit, make(map[string]bool)}
+	return &Server{
+		newStorageClient: newStorageClient,
+		blockSizeLimit:   clampBlockSizeLimit(blockSizeLimit),
+		bucketLimits:     make(map[string]uint64),
+		classLimits:      make(map[string]classLimits),
+		bucketSpans:      make(map[string]uint32),
+		referenceAliases: make(map[string][]string),
+		whitelist:        make(map[string]bool),
+		breaker:          newCircuitBreaker(defaultBreakerRatio, defaultBreakerCooldown),
+		indexTemplates:   defaultIndexTemplates,
+		indexLocations:   make(map[string]indexLocation),
+		limiters:         make(map[string]*limiter),
+		serviceInfo:      defaultServiceInfo,
+	}
 }
 
 // Whitelist adds buckets to the set of buckets which the server is allowed to
@@ -87,12 +179,225 @@ func (server *Server) Whitelist(buckets []string) {
 	}
 }
 
+// SetBucketBlockSizeLimit overrides the block size limit passed to NewServer
+// for reads from bucket.  This allows, for example, small blocks for datasets
+// viewed interactively in a browser and large blocks for batch pipelines.
+// The limit is clamped to MaxBlockSizeLimit.
+func (server *Server) SetBucketBlockSizeLimit(bucket string, limit uint64) {
+	server.bucketLimits[bucket] = clampBlockSizeLimit(limit)
+}
+
+func clampBlockSizeLimit(limit uint64) uint64 {
+	if limit > MaxBlockSizeLimit {
+		log.Printf("Clamping block size limit %d to %d", limit, uint64(MaxBlockSizeLimit))
+		return MaxBlockSizeLimit
+	}
+	return limit
+}
+
+// SetMaxRegionSpan limits the number of bases that a single reads request
+// may cover, summed over all of its regions.  Requests for larger regions, for a whole reference, for the
+// whole readset or for the unplaced unmapped reads are rejected with
+// InvalidRange.  This prevents interactive
+// deployments from being asked for entire chromosomes.  A span of zero (the
+// default) removes the limit.
+func (server *Server) SetMaxRegionSpan(span uint32) {
+	server.maxSpan = span
+}
+
+// SetBucketMaxRegionSpan overrides the limit set with SetMaxRegionSpan for
+// reads from bucket.  A span of zero removes the limit for bucket.
+func (server *Server) SetBucketMaxRegionSpan(bucket string, span uint32) {
+	server.bucketSpans[bucket] = span
+}
+
+// SetCircuitBreaker configures the circuit breaker that protects the storage
+// backend.  Once at least ratio of recent storage operations have failed with
+// transient errors, requests are rejected with 503 Service Unavailable for the
+// cooldown period rather than waiting on a degraded backend.  A ratio of zero
+// disables the circuit breaker.
+func (server *Server) SetCircuitBreaker(ratio float64, cooldown time.Duration) {
+	if ratio <= 0 {
+		server.breaker = nil
+		return
+	}
+	server.breaker = newCircuitBreaker(ratio, cooldown)
+}
+
+// CheckBucketsWhenReady makes the readiness endpoint verify that each
+// whitelisted bucket can be accessed by a storage client created with
+// newStorageClient, so that misconfigured permissions are caught before
+// traffic arrives.  Passing nil disables the check.
+func (server *Server) CheckBucketsWhenReady(newStorageClient NewStorageClientFunc) {
+	server.readyClient = newStorageClient
+}
+
+// SetInlineLimit embeds chunks that re-encode to at most limit bytes directly
+// in tickets as data URLs, saving clients a block request for each one.  This
+// makes ticket requests slower, since the server must read the data, so it is
+// most useful when requests typically cover small regions.  Zero (the
+// default) disables inlining.
+func (server *Server) SetInlineLimit(limit uint64) {
+	server.inlineLimit = limit
+}
+
+// SetStreamBufferSize lets block responses read up to size bytes from storage
+// ahead of what the client has received, so that storage latency overlaps
+// with writing to the client.  The buffer is bounded, so a slow client holds
+// at most size bytes in memory however large its block is.  Zero (the
+// default) copies data to the client as it is read.
+func (server *Server) SetStreamBufferSize(size int) {
+	server.streamBuffer = size
+}
+
+// SetMinimalHeaders enables or disables minimal headers.  When enabled, the
+// header for a request that names a reference is generated by the server and
+// omits the @SQ lines for later references, which greatly shrinks the header
+// of draft assemblies with many contigs.  The reference list in the binary
+// header is always complete, so the data remains valid BAM.
+func (server *Server) SetMinimalHeaders(minimal bool) {
+	server.minimalHeaders = minimal
+}
+
+// SetInlineHeaders sets whether tickets embed the header as a data URL by
+// default, which saves clients a block request in the common case of reading
+// the header and a single region.  Clients can override the default with the
+// inlineHeader query parameter.  Tickets that copy the whole readset do not
+// separate the header, so they are unaffected.
+func (server *Server) SetInlineHeaders(inline bool) {
+	server.inlineHeaders = inline
+}
+
+// SetStrict enables or disables strict mode, which applies every validation
+// that the htsget specification mandates so that operators can test
+// interoperability.  In strict mode the server rejects requests that it would
+// otherwise answer with an empty ticket, such as a request for a reference
+// that has no entries in the index, rejects reads requests with query
+// parameters that the specification does not define, refuses to issue
+// tickets whose URLs do not use https and reports every error, including
+// internal ones, with the htsget error object.  It must be called before
+// Export.
+func (server *Server) SetStrict(strict bool) {
+	server.strict = strict
+}
+
+// SetAdvertisedURL sets the base URL used for block URLs in tickets (for
+// example "https://example.com/htsget").  By default the base URL is derived
+// from the Host header of each request, which is wrong when the server is
+// behind a proxy that rewrites the host or path.
+func (server *Server) SetAdvertisedURL(base string) {
+	server.advertisedURL = strings.TrimSuffix(base, "/")
+}
+
+// SetBasePath serves the API beneath path (for example "/tenant-a", giving
+// "/tenant-a/reads/" and so on), which allows several differently configured
+// servers to share a single mux.  It must be called before Export.
+func (server *Server) SetBasePath(path string) {
+	server.basePath = strings.TrimSuffix(path, "/")
+}
+
+// SetIPFilter restricts which clients may use the API by address.  Both
+// lists contain CIDR blocks (such as "10.0.0.0/8") or single addresses.  A
+// client in a denied network is always rejected; if allow is not empty, a
+// client outside all of the allowed networks is rejected too.  The readiness
+// endpoint is not filtered.  Passing two empty lists removes the filter.
+func (server *Server) SetIPFilter(allow, deny []string) error {
+	allowed, err := parseNetworks(allow)
+	if err != nil {
+		return fmt.Errorf("parsing allowed networks: %v", err)
+	}
+	denied, err := parseNetworks(deny)
+	if err != nil {
+		return fmt.Errorf("parsing denied networks: %v", err)
+	}
+	if len(allowed) == 0 && len(denied) == 0 {
+		server.ipFilter = nil
+		return nil
+	}
+	server.ipFilter = &ipFilter{allow: allowed, deny: denied}
+	return nil
+}
+
+// SetMaxRequestTimeout limits the timeout that clients may request with the
+// X-Htsget-Timeout header.  Larger values are reduced to max.  A max of zero
+// (the default) accepts any timeout.  Requests without the header are not
+// given a deadline.
+func (server *Server) SetMaxRequestTimeout(max time.Duration) {
+	server.maxTimeout = max
+}
+
 // Export registers the htsget API endpoint with mux and reads data using gcs.
 // Blocks returned from the endpoint will generally not exceed blockSizeLimit
 // bytes, though BAM chunks that already exceed this size will not be split.
 func (server *Server) Export(mux *http.ServeMux) {
-	mux.Handle(readsPath, forwardOrigin(server.serveReads))
-	mux.Handle(blockPath, forwardOrigin(server.serveBlocks))
+	handle := func(path string, handler http.Handler) {
+		if server.basePath != "" {
+			handler = http.StripPrefix(server.basePath, handler)
+		}
+		mux.Handle(server.basePath+path, handler)
+	}
+	handle(readsPath, server.wrap(server.limit(readsPath, server.serveReads)))
+	handle(blockPath, server.wrap(server.limit(blockPath, server.serveBlocks)))
+	handle(metadataPath, server.wrap(server.serveMetadata))
+	handle(indexStatsPath, server.wrap(server.serveIndexStats))
+	handle(densityPath, server.wrap(server.serveDensity))
+	handle(countPath, server.wrap(server.serveCount))
+	handle(planPath, server.wrap(server.serveChunkPlan))
+	handle(sequencePath, server.wrap(server.serveSequence))
+	handle(capabilitiesPath, server.wrap(server.serveCapabilities))
+	handle(readsServiceInfoPath, server.wrap(server.serveServiceInfo("reads", []string{"BAM"})))
+	// Variants are not served, but registries expect both documents.
+	handle(variantsServiceInfoPath, server.wrap(server.serveServiceInfo("variants", []string{})))
+	handle(readyPath, http.HandlerFunc(server.serveReady))
+}
+
+// wrap applies the request ID, client address filtering, identity
+// verification, client deadline and CORS handling that are common to all API
+// endpoints.
+func (server *Server) wrap(f func(http.ResponseWriter, *http.Request)) http.Handler {
+	handler := withRequestID(server.filterIPs(server.verifyIdentity(server.withDeadline(forwardOrigin(f)))))
+	if server.strict {
+		handler = withStrictErrors(handler)
+	}
+	return handler
+}
+
+// serveReady responds with 200 OK if the server is ready to accept traffic,
+// or 503 Service Unavailable with a list of problems if it is not.
+func (server *Server) serveReady(w http.ResponseWriter, req *http.Request) {
+	if server.readyClient == nil || len(server.whitelist) == 0 {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), readyTimeout)
+	defer cancel()
+
+	gcs, _, err := server.readyClient(req.WithContext(ctx))
+	if err != nil {
+		writeHTTPError(w, http.StatusServiceUnavailable, fmt.Errorf("creating storage client: %v", err))
+		return
+	}
+
+	var buckets []string
+	for bucket := range server.whitelist {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+
+	var problems []string
+	for _, bucket := range buckets {
+		if _, err := gcs.Bucket(bucket).Attrs(ctx); err != nil {
+			problems = append(problems, fmt.Sprintf("bucket %s: %v", bucket, err))
+		}
+	}
+	if len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
 }
 
 func (server *Server) serveReads(w http.ResponseWriter, req *http.Request) {
@@ -100,171 +405,1003 @@ func (server *Server) serveReads(w http.ResponseWriter, req *http.Request) {
 
 	track := analytics.TrackerFromContext(ctx)
 	track(analytics.Event("Reads", "Reads Request Received", "", nil))
+	fail := func(err error) {
+		track(analytics.Event("Reads", "Reads Error", errorCategory(ctx, err), nil))
+		writeError(w, err)
+	}
+
+	query := req.URL.Query()
+	if server.strict {
+		if err := checkQueryParameters(query); err != nil {
+			fail(newInvalidInputError("checking query", err))
+			return
+		}
+	}
+	query, err := expandSamtoolsRegion(query)
+	if err != nil {
+		fail(newInvalidInputError("parsing region", err))
+		return
+	}
+	query, regionQueries, err := parseReadsBody(w, req, query, server.strict)
+	if err != nil {
+		fail(newInvalidInputError("parsing request body", err))
+		return
+	}
+	bucket, object, err := server.resolveID(ctx, req.URL.Path[len(readsPath):])
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	preferred := query.Get("format")
+	if preferred != "" && !knownFormats[preferred] {
+		fail(newUnsupportedFormatError(fmt.Errorf("unknown format %q", preferred)))
+		return
+	}
+
+	headerOnly, err := parseClass(query)
+	if err != nil {
+		fail(newInvalidInputError("parsing class", err))
+		return
+	}
+	filter, err := parseFilter(query)
+	if err != nil {
+		fail(newInvalidInputError("parsing filter", err))
+		return
+	}
+	exact, err := parseExact(query)
+	if err != nil {
+		fail(newInvalidInputError("parsing exact", err))
+		return
+	}
+	inlineHeader := server.inlineHeaders
+	if v := query.Get("inlineHeader"); v != "" {
+		if inlineHeader, err = strconv.ParseBool(v); err != nil {
+			fail(newInvalidInputError("parsing inlineHeader", err))
+			return
+		}
+	}
+	var inflated bool
+	if v := query.Get(inflateParameter); v != "" {
+		if inflated, err = strconv.ParseBool(v); err != nil {
+			fail(newInvalidInputError("parsing inflate", err))
+			return
+		}
+	}
+
+	if err := server.checkWhitelist(bucket); err != nil {
+		fail(newPermissionDeniedError("checking whitelist", err))
+		return
+	}
+	if err := server.checkIdentity(ctx, bucket); err != nil {
+		fail(newPermissionDeniedError("checking permissions", err))
+		return
+	}
+
+	gcs, headers, err := server.newStorageClient(req)
+	if err != nil {
+		fail(newStorageError("creating client", err))
+		return
+	}
+
+	object, format, err := server.resolveReadset(ctx, gcs.Bucket(bucket), object, preferred)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := parseFormat(format); err != nil {
+		fail(newUnsupportedFormatError(err))
+		return
+	}
+	if path := query.Get(bedParameter); path != "" {
+		if regionQueries, err = server.readBEDRegions(ctx, gcs, path, regionQueries); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	writeTicket := func(urls []ticket.URL) {
+		if server.strict {
+			if err := checkTicketURLs(urls); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		if inflated {
+			if err := inflateDataURLs(urls); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		server.writeTicket(w, &ticket.Response{Ticket: &ticket.Ticket{
+			Format: format,
+			URLs:   urls,
+		}})
+
+		count := int64(len(urls))
+		track(analytics.Event("Reads", "Reads Response URL Count", "", &count))
+		track(analytics.Event("Reads", "Reads Response Sent", "", nil))
+	}
+
+	header, err := server.readHeader(ctx, headers, gcs.Bucket(bucket).Object(object))
+	if err != nil {
+		fail(err)
+		return
+	}
+	// A request for the whole readset is answered by copying the object, which
+	// does not need the index.  The header is still read first, since that is
+	// what checks that the object holds BAM data: without it, whole readset
+	// requests for SAM or BCF objects would be copied instead of failing with
+	// UnsupportedFormat.  The header cache, if any, avoids reading the data of
+	// objects that have been read before.
+	if isWholeReadset(regionQueries) && server.maxRegionSpanFor(bucket) == 0 && filter.IsZero() && !headerOnly && !inflated && query.Get("explain") != "true" {
+		urls, err := server.passthroughURLs(ctx, req, gcs.Bucket(bucket).Object(object), headers)
+		if err != nil {
+			fail(err)
+			return
+		}
+		writeTicket(urls)
+		return
+	}
+
+	regions, err := server.parseRegions(regionQueries, header, bucket)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if exact {
+		// Every record of a request for all mapped reads overlaps a region.
+		filter.Regions = regions
+		for _, region := range regions {
+			if region == genomics.AllMappedReads {
+				filter.Regions = nil
+			}
+		}
+	}
+
+	request := &readsRequest{
+		readIndex: func(ctx context.Context) ([]byte, error) {
+			return server.readBAMIndex(ctx, headers, gcs.Bucket(bucket).Object(object), nil, server.indexObjects(gcs, bucket, object))
+		},
+		blockSizeLimit: server.blockSizeLimitFor(req, bucket),
+		mergeGap:       server.mergeGapFor(req),
+		regions:        regions,
+		strict:         server.strict,
+		headerOnly:     headerOnly,
+	}
+
+	if query.Get("explain") == "true" {
+		explanation, err := request.explain(ctx)
+		if err != nil {
+			fail(err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"explain": explanation})
+		return
+	}
+
+	chunks, err := request.handle(ctx)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	base := server.blockURL(req, bucket, object)
+
+	var urls []ticket.URL
+	if last := lastReference(regions); server.minimalHeaders && header != nil && last >= 0 {
+		data, err := minimalHeaderURL(header, last)
+		if err != nil {
+			fail(err)
+			return
+		}
+		urls = append(urls, ticket.URL{URL: data, Class: ticket.ClassHeader})
+		chunks = chunks[1:]
+	} else if inlineHeader && header != nil {
+		data, err := headerDataURL(header)
+		if err != nil {
+			fail(err)
+			return
+		}
+		urls = append(urls, ticket.URL{URL: data, Class: ticket.ClassHeader})
+		chunks = chunks[1:]
+	}
+	// proxied returns the URL of the block endpoint that serves chunk.
+	proxied := func(chunk *bgzf.Chunk, class string, chunkFilter bam.Filter) (ticket.URL, error) {
+		var query interface{} = chunk
+		if !chunkFilter.IsZero() || inflated {
+			query = &blockQuery{Start: chunk.Start, End: chunk.End, Filter: chunkFilter, Inflate: inflated}
+		}
+		token, err := server.encodeBlockToken(bucket, object, query)
+		if err != nil {
+			return ticket.URL{}, err
+		}
+		return ticket.URL{
+			URL:     base + "?" + token,
+			Headers: flattenHeaders(headers),
+			Class:   class,
+		}, nil
+	}
+	for _, chunk := range chunks {
+		// The first URL always holds the header and never any reads.
+		class, chunkFilter := ticket.ClassBody, filter
+		if len(urls) == 0 {
+			class, chunkFilter = ticket.ClassHeader, bam.Filter{}
+		}
+
+		if server.inlineLimit > 0 {
+			data, err := inlineChunk(ctx, server.breaker, gcs.Bucket(bucket).Object(object), chunk, chunkFilter, server.inlineLimit)
+			if err != nil {
+				fail(err)
+				return
+			}
+			if data != "" {
+				urls = append(urls, ticket.URL{URL: data, Class: class})
+				continue
+			}
+		}
+
+		if server.signer != nil && class == ticket.ClassBody && chunkFilter.IsZero() && !inflated {
+			signed, err := server.signedChunkURLs(ctx, gcs.Bucket(bucket).Object(object), chunk, func(c *bgzf.Chunk) (ticket.URL, error) {
+				return proxied(c, class, chunkFilter)
+			})
+			if err != nil {
+				fail(err)
+				return
+			}
+			if signed != nil {
+				urls = append(urls, signed...)
+				continue
+			}
+		}
+
+		url, err := proxied(chunk, class, chunkFilter)
+		if err != nil {
+			fail(err)
+			return
+		}
+		urls = append(urls, url)
+	}
+	urls = append(urls, ticket.URL{URL: eofMarkerDataURL, Class: ticket.ClassBody})
+	writeTicket(urls)
+}
+
+// parseRegions parses each of regionQueries, resolving reference names with
+// header and limiting their span as configured for bucket.  The limit applies
+// to the total span of all the regions, so that a large request cannot be
+// split into many small regions of a single ticket.  Errors are returned as
+// apiErrors.
+func (server *Server) parseRegions(regionQueries []url.Values, header *bam.Header, bucket string) ([]genomics.Region, error) {
+	var (
+		maxSpan = server.maxRegionSpanFor(bucket)
+		length  uint32
+		total   uint64
+	)
+	resolve := func(name string) (*bam.Reference, error) {
+		reference, err := server.resolveReference(header, name)
+		if err == nil {
+			length = reference.Length
+		}
+		return reference, err
+	}
+	var regions []genomics.Region
+	for _, regionQuery := range regionQueries {
+		region, err := parseRegion(regionQuery, resolve, maxSpan)
+		if err != nil {
+			if _, ok := err.(*apiError); !ok {
+				err = newInvalidInputError("parsing region", err)
+			}
+			return nil, err
+		}
+
+		if region.End > 0 && region.Start > region.End {
+			return nil, newInvalidRangeError(fmt.Errorf("%s: start > end", region))
+		}
+
+		if maxSpan > 0 {
+			end := region.End
+			if end == 0 {
+				end = length
+			}
+			if end > region.Start {
+				total += uint64(end - region.Start)
+			}
+			if total > uint64(maxSpan) {
+				return nil, newInvalidRangeError(fmt.Errorf("regions span %d bases in total but at most %d are allowed; split them across several requests", total, maxSpan))
+			}
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
+
+// isWholeReadset reports whether regionQueries request the whole readset.
+func isWholeReadset(regionQueries []url.Values) bool {
+	if len(regionQueries) != 1 {
+		return false
+	}
+	for _, name := range []string{"referenceName", "start", "end"} {
+		if regionQueries[0].Get(name) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// passthroughURLs returns ticket URLs that cover the bytes of object, as it is
+// stored, in pieces of at most the block size limit for its bucket.  Unlike
+// tickets built from the index, the URLs include any unplaced unmapped reads
+// and are not marked with classes, since the end of the header is not known.
+func (server *Server) passthroughURLs(ctx context.Context, req *http.Request, object *storage.ObjectHandle, headers http.Header) ([]ticket.URL, error) {
+	attrs, err := objectAttrs(ctx, server.breaker, object)
+	if err != nil {
+		return nil, newStorageError("reading object attributes", err)
+	}
+
+	var (
+		urls  []ticket.URL
+		base  = server.blockURL(req, object.BucketName(), object.ObjectName())
+		limit = int64(server.blockSizeLimitFor(req, object.BucketName()))
+	)
+	// A limit of zero does not split the object at all.
+	if limit == 0 {
+		limit = attrs.Size
+	}
+	for offset := int64(0); offset < attrs.Size; offset += limit {
+		end := offset + limit
+		if end > attrs.Size {
+			end = attrs.Size
+		}
+		token, err := server.encodeBlockToken(object.BucketName(), object.ObjectName(), &blockQuery{Start: bgzf.Address(offset), End: bgzf.Address(end), Raw: true})
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, ticket.URL{
+			URL:     base + "?" + token,
+			Headers: flattenHeaders(headers),
+		})
+	}
+	return urls, nil
+}
+
+// blockURL returns the URL of the block endpoint for object, to which the
+// encoded chunk is appended as the query.
+func (server *Server) blockURL(req *http.Request, bucket, object string) string {
+	base := server.advertisedURL
+	if base == "" && req.Host != "" {
+		if req.TLS != nil {
+			base = "https://"
+		} else {
+			base = "http://"
+		}
+		base += req.Host
+	}
+	return base + server.basePath + blockPath + bucket + "/" + object
+}
+
+// flattenHeaders returns the headers to send with block requests in the form
+// used by tickets, or nil if there are none.
+func flattenHeaders(headers http.Header) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	// The htsget specification does not support multiple values for a single
+	// header.
+	flattened := make(map[string]string)
+	for k, v := range headers {
+		flattened[k] = v[0]
+	}
+	return flattened
+}
+
+// readset is a BAM readset whose header has been read.
+type readset struct {
+	bucket  *storage.BucketHandle
+	object  string
+	format  string
+	header  *bam.Header
+	indexes []*storage.ObjectHandle
+	headers http.Header
+	gcs     *storage.Client
+}
+
+// openReadset resolves the readset ID at the end of the request path (after
+// prefix), checks that it may be read and reads its header.  Errors are
+// returned as apiErrors where possible.
+func (server *Server) openReadset(req *http.Request, prefix string) (*readset, error) {
+	ctx := req.Context()
+
+	bucket, object, err := server.resolveID(ctx, req.URL.Path[len(prefix):])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := server.checkWhitelist(bucket); err != nil {
+		return nil, newPermissionDeniedError("checking whitelist", err)
+	}
+	if err := server.checkIdentity(ctx, bucket); err != nil {
+		return nil, newPermissionDeniedError("checking permissions", err)
+	}
+
+	gcs, headers, err := server.newStorageClient(req)
+	if err != nil {
+		return nil, newStorageError("creating client", err)
+	}
+
+	object, format, err := server.resolveReadset(ctx, gcs.Bucket(bucket), object, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := parseFormat(format); err != nil {
+		return nil, newUnsupportedFormatError(err)
+	}
+
+	header, err := server.readHeader(ctx, headers, gcs.Bucket(bucket).Object(object))
+	if err != nil {
+		return nil, err
+	}
+	return &readset{
+		bucket:  gcs.Bucket(bucket),
+		object:  object,
+		format:  format,
+		header:  header,
+		indexes: server.indexObjects(gcs, bucket, object),
+		headers: headers,
+		gcs:     gcs,
+	}, nil
+}
+
+// serveMetadata describes a readset without generating a ticket: its format,
+// the number of references it declares and the read groups in its header.
+func (server *Server) serveMetadata(w http.ResponseWriter, req *http.Request) {
+	readset, err := server.openReadset(req, metadataPath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	groups, err := sam.GetReadGroups(strings.NewReader(readset.header.Text))
+	if err != nil {
+		writeError(w, newInvalidInputError("parsing read groups", err))
+		return
+	}
+
+	readGroups := make([]map[string]string, 0, len(groups))
+	for _, group := range groups {
+		readGroups = append(readGroups, map[string]string{
+			"id":       group.ID,
+			"sample":   group.Sample,
+			"library":  group.Library,
+			"platform": group.Platform,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"format":         readset.format,
+			"referenceCount": len(readset.header.References),
+			"readGroups":     readGroups,
+		}})
+}
+
+// serveIndexStats summarizes the read counts recorded in a readset's index,
+// like samtools idxstats, without reading any alignment data.
+func (server *Server) serveIndexStats(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	readset, err := server.openReadset(req, indexStatsPath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	index, err := server.readBAMIndex(ctx, readset.headers, readset.bucket.Object(readset.object), nil, readset.indexes)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := requireBAI(index); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	stats, err := bam.ReadStats(bytes.NewReader(index))
+	if err != nil {
+		writeError(w, &parseError{"reading index", err})
+		return
+	}
+	if got, want := len(stats.References), len(readset.header.References); got != want {
+		writeError(w, &parseError{"reading index", fmt.Errorf("index has %d references but the header has %d", got, want)})
+		return
+	}
+
+	var (
+		references       []map[string]interface{}
+		mapped, unmapped uint64
+	)
+	for i, ref := range readset.header.References {
+		counts := stats.References[i]
+		references = append(references, map[string]interface{}{
+			"name":     ref.Name,
+			"length":   ref.Length,
+			"mapped":   counts.Mapped,
+			"unmapped": counts.Unmapped,
+		})
+		mapped += counts.Mapped
+		unmapped += counts.Unmapped
+	}
+
+	response := map[string]interface{}{
+		"references": references,
+		"mapped":     mapped,
+		"unmapped":   unmapped,
+	}
+	if stats.NoCoordinate != nil {
+		response["noCoordinate"] = *stats.NoCoordinate
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"indexStats": response})
+}
+
+// serveDensity returns the number and size of the index chunks in each
+// window of a reference, which genome browsers can render as a density track
+// before fetching any reads.
+func (server *Server) serveDensity(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	query := req.URL.Query()
+
+	name := query.Get("referenceName")
+	if name == "" {
+		writeError(w, newInvalidInputError("parsing query", errMissingReferenceName))
+		return
+	}
+	window := uint64(defaultDensityWindow)
+	if v := query.Get("window"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			writeError(w, newInvalidInputError("parsing window", err))
+			return
+		}
+		if n < minimumDensityWindow {
+			writeError(w, newInvalidInputError("parsing window", fmt.Errorf("window must be at least %d bases", minimumDensityWindow)))
+			return
+		}
+		window = n
+	}
+
+	readset, err := server.openReadset(req, densityPath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	reference, err := server.resolveReference(readset.header, name)
+	if err != nil {
+		writeError(w, newNotFoundError("resolving reference", err))
+		return
+	}
+	if windows := uint64(reference.Length) / window; windows > maximumDensityWindows {
+		writeError(w, newInvalidInputError("parsing window", fmt.Errorf("reference %q would have %d windows, at most %d are allowed", name, windows, maximumDensityWindows)))
+		return
+	}
+
+	index, err := server.readBAMIndex(ctx, readset.headers, readset.bucket.Object(readset.object), nil, readset.indexes)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := requireBAI(index); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	windows, err := bam.ReadDensity(bytes.NewReader(index), reference.ID, reference.Length, uint32(window))
+	if err != nil {
+		writeError(w, &parseError{"reading index", err})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"density": map[string]interface{}{
+			"referenceName": reference.Name,
+			"window":        window,
+			"windows":       windows,
+		}})
+}
+
+// serveCount estimates the number of reads that overlap a region without
+// reading them, so that clients can warn before requesting a large slice.  By
+// default the estimate scales the reference's mapped read count from the index
+// by the share of its compressed data that the region covers.  With
+// sample=N, the first N blocks of the region are read instead and their
+// density of records is applied to the whole region; this is also done (with
+// a single block) if the index does not record read counts.
+func (server *Server) serveCount(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	query, err := expandSamtoolsRegion(req.URL.Query())
+	if err != nil {
+		writeError(w, newInvalidInputError("parsing region", err))
+		return
+	}
+
+	if query.Get("referenceName") == "" {
+		writeError(w, newInvalidInputError("parsing query", errMissingReferenceName))
+		return
+	}
+	var sample int
+	if v := query.Get("sample"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, newInvalidInputError("parsing sample", err))
+			return
+		}
+		if n < 1 || n > maximumSampleBlocks {
+			writeError(w, newInvalidInputError("parsing sample", fmt.Errorf("sample must be between 1 and %d blocks", maximumSampleBlocks)))
+			return
+		}
+		sample = n
+	}
 
-	query := req.URL.Query()
-	if err := parseFormat(query.Get("format")); err != nil {
-		writeError(w, newUnsupportedFormatError(err))
+	readset, err := server.openReadset(req, countPath)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	bucket, object, err := parseID(req.URL.Path[len(readsPath):])
+	resolve := func(name string) (*bam.Reference, error) {
+		return server.resolveReference(readset.header, name)
+	}
+	region, err := parseRegion(query, resolve, 0)
 	if err != nil {
-		writeError(w, newInvalidInputError("parsing readset ID", err))
+		if _, ok := err.(*apiError); !ok {
+			err = newInvalidInputError("parsing region", err)
+		}
+		writeError(w, err)
 		return
 	}
-
-	if err := server.checkWhitelist(bucket); err != nil {
-		writeError(w, newPermissionDeniedError("checking whitelist", err))
+	if region == genomics.UnplacedUnmappedReads {
+		writeError(w, newInvalidInputError("parsing region", errUnplacedNotSupported))
+		return
+	}
+	if region.End > 0 && region.Start > region.End {
+		writeError(w, newInvalidRangeError(fmt.Errorf("%s: start > end", region)))
 		return
 	}
 
-	gcs, headers, err := server.newStorageClient(req)
+	index, err := server.readBAMIndex(ctx, readset.headers, readset.bucket.Object(readset.object), nil, readset.indexes)
 	if err != nil {
-		writeError(w, newStorageError("creating client", err))
+		writeError(w, err)
 		return
 	}
-
-	data, err := gcs.Bucket(bucket).Object(object).NewRangeReader(ctx, 0, int64(server.blockSizeLimit))
+	if err := requireBAI(index); err != nil {
+		writeError(w, err)
+		return
+	}
+	chunks, err := bam.Read(bytes.NewReader(index), region)
 	if err != nil {
-		writeError(w, newStorageError("opening data", err))
+		writeError(w, &parseError{"reading index", err})
 		return
 	}
-	defer data.Close()
-
-	region, err := parseRegion(query, data)
+	stats, err := bam.ReadStats(bytes.NewReader(index))
 	if err != nil {
-		writeError(w, newInvalidInputError("parsing region", err))
+		writeError(w, &parseError{"reading index", err})
 		return
 	}
-
-	if region.End > 0 && region.Start > region.End {
-		writeError(w, newInvalidRangeError(fmt.Errorf("%s: start > end", region)))
+	if int(region.ReferenceID) >= len(stats.References) {
+		writeError(w, &parseError{"reading index", fmt.Errorf("index has %d references but the header has more", len(stats.References))})
 		return
 	}
 
-	request := &readsRequest{
-		indexObjects: []*storage.ObjectHandle{gcs.Bucket(bucket).Object(object + ".bai"),
-			gcs.Bucket(bucket).Object(strings.TrimSuffix(object, ".bam") + ".bai"),
-		},
-		blockSizeLimit: server.blockSizeLimit,
-		region:         region,
+	size := bam.RegionBytes(chunks)
+	response := map[string]interface{}{
+		"referenceName": query.Get("referenceName"),
+		"start":         region.Start,
+		"bytes":         size,
+	}
+	if region.End > 0 {
+		response["end"] = region.End
 	}
 
-	chunks, err := request.handle(ctx)
-	if err != nil {
-		track(analytics.Event("Reads", "Reads Internal Error", "", nil))
-		writeError(w, err)
+	records, ok := bam.EstimateRecords(size, stats.References[region.ReferenceID])
+	if !ok && sample == 0 {
+		sample = 1
+	}
+	if sample == 0 || size == 0 {
+		response["method"] = "index"
+		response["records"] = records
+		writeJSON(w, http.StatusOK, map[string]interface{}{"count": response})
 		return
 	}
 
-	var base string
-	if req.Host != "" {
-		if req.TLS != nil {
-			base = "https://"
-		} else {
-			base = "http://"
+	start := chunks[1].Start
+	for _, chunk := range chunks[2:] {
+		if chunk.Start < start {
+			start = chunk.Start
 		}
-		base += req.Host
 	}
-	base += strings.Replace(req.URL.Path, readsPath, blockPath, 1)
-
-	var urls []map[string]interface{}
-	for _, chunk := range chunks {
-		var buf bytes.Buffer
-		if err := gob.NewEncoder(&buf).Encode(chunk); err != nil {
-			writeError(w, fmt.Errorf("encoding chunk: %v", err))
-			return
-		}
-
-		url := map[string]interface{}{
-			"url": fmt.Sprintf("%s?%s", base, base64.URLEncoding.EncodeToString(buf.Bytes())),
-		}
-		if len(headers) > 0 {
-			// The htsget specification does not support multiple values for a single
-			// header.
-			flattened := make(map[string]string)
-			for k, v := range headers {
-				flattened[k] = v[0]
-			}
-			url["headers"] = flattened
-		}
-		urls = append(urls, url)
+	r, err := newRangeReader(ctx, server.breaker, readset.bucket.Object(readset.object), int64(start.BlockOffset()), -1)
+	if err != nil {
+		writeError(w, newStorageError("opening readset", err))
+		return
 	}
-	urls = append(urls, map[string]interface{}{"url": eofMarkerDataURL})
-
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"htsget": map[string]interface{}{
-			"format": "BAM",
-			"urls":   urls,
-		}})
-
-	count := int64(len(urls))
-	track(analytics.Event("Reads", "Reads Response URL Count", "", &count))
-	track(analytics.Event("Reads", "Reads Response Sent", "", nil))
+	defer r.Close()
+	sampled, sampledBytes, err := bam.SampleRecords(r, start, sample)
+	if err != nil {
+		writeError(w, &parseError{"sampling records", err})
+		return
+	}
+	if sampledBytes > 0 {
+		records = uint64(float64(size) * float64(sampled) / float64(sampledBytes))
+	}
+	response["method"] = "sample"
+	response["records"] = records
+	response["sampledRecords"] = sampled
+	response["sampledBytes"] = sampledBytes
+	writeJSON(w, http.StatusOK, map[string]interface{}{"count": response})
 }
 
 func (server *Server) serveBlocks(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	track := analytics.TrackerFromContext(ctx)
+	fail := func(err error) {
+		track(analytics.Event("Blocks", "Blocks Error", errorCategory(ctx, err), nil))
+		writeError(w, err)
+	}
+
 	bucket, object, err := parseID(req.URL.Path[len(blockPath):])
 	if err != nil {
-		writeError(w, newInvalidInputError("parsing readset ID", err))
+		fail(newInvalidInputError("parsing readset ID", err))
 		return
 	}
 
 	if err := server.checkWhitelist(bucket); err != nil {
-		writeError(w, newPermissionDeniedError("checking whitelist", err))
+		fail(newPermissionDeniedError("checking whitelist", err))
+		return
+	}
+	if err := server.checkIdentity(ctx, bucket); err != nil {
+		fail(newPermissionDeniedError("checking permissions", err))
+		return
+	}
+	if err := server.checkAliasTarget(ctx, bucket, object); err != nil {
+		fail(err)
 		return
 	}
 
-	var chunk bgzf.Chunk
-	if err := decodeRawQuery(req.URL.RawQuery, &chunk); err != nil {
-		writeError(w, fmt.Errorf("decoding raw query: %v", err))
+	var query blockQuery
+	if err := server.decodeBlockToken(bucket, object, req.URL.RawQuery, &query); err != nil {
+		if _, ok := err.(*apiError); !ok {
+			err = fmt.Errorf("decoding raw query: %v", err)
+		}
+		fail(err)
 		return
 	}
+	chunk := bgzf.Chunk{Start: query.Start, End: query.End}
 
 	gcs, _, err := server.newStorageClient(req)
 	if err != nil {
-		writeError(w, fmt.Errorf("creating storage client: %v", err))
+		fail(fmt.Errorf("creating storage client: %v", err))
+		return
+	}
+
+	handle := gcs.Bucket(bucket).Object(object)
+	attrs, err := objectAttrs(ctx, server.breaker, handle)
+	if err != nil {
+		fail(newStorageError("reading object attributes", err))
+		return
+	}
+
+	// The chunk bytes depend only on the object generation and the chunk, so
+	// they make a strong validator that lets caches avoid refetching data.
+	etag := fmt.Sprintf(`"%x-%x-%x"`, attrs.Generation, uint64(chunk.Start), uint64(chunk.End))
+	if query.Raw {
+		etag = fmt.Sprintf(`"%x-%x-%x-raw"`, attrs.Generation, uint64(chunk.Start), uint64(chunk.End))
+	}
+	if f := query.Filter; !f.IsZero() {
+		var regions string
+		for _, region := range f.Regions {
+			regions += fmt.Sprintf("-%x:%x:%x", region.ReferenceID, region.Start, region.End)
+		}
+		etag = fmt.Sprintf(`"%x-%x-%x-%x-%x-%x-%x-%x-%x%s"`, attrs.Generation, uint64(chunk.Start), uint64(chunk.End), f.RequireFlags, f.ExcludeFlags, f.MinMappingQuality, f.Omit, f.Tags, f.NoTags, regions)
+	}
+	// Raw chunks are not BGZF compressed, so only other chunks can be sent
+	// inflated.  The cache holds the compressed data, under its own validator.
+	cacheKey := bucket + "/" + object + " " + etag
+	inflated := (query.Inflate || acceptsInflated(req)) && !query.Raw
+	if !query.Raw {
+		w.Header().Set("Vary", "Accept-Encoding")
+	}
+	if inflated {
+		etag = strings.TrimSuffix(etag, `"`) + `-inflated"`
+	}
+	w.Header().Set("ETag", etag)
+	if !attrs.Updated.IsZero() {
+		w.Header().Set("Last-Modified", attrs.Updated.UTC().Format(http.TimeFormat))
+	}
+	if notModified(req, etag, attrs.Updated) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	request := &blockRequest{
-		object: gcs.Bucket(bucket).Object(object),
-		chunk:  chunk,
+		// Pin the generation so that the data matches the validator.
+		object:  handle.Generation(attrs.Generation),
+		chunk:   chunk,
+		raw:     query.Raw,
+		filter:  query.Filter,
+		breaker: server.breaker,
+	}
+
+	// Only the block data is counted as egress, since writeError requires the
+	// original ResponseWriter.
+	blockWriter := w
+	if server.egress != nil {
+		counter := &egressWriter{ResponseWriter: w}
+		blockWriter = counter
+		defer func() {
+			if counter.started {
+				server.egress.add(bucket, object, counter.bytes)
+			}
+		}()
 	}
 
-	response, err := request.handle(req.Context())
+	// send writes the size bytes of block data in r, inflating them if
+	// requested, and reports whether it succeeded.
+	send := func(r io.Reader, size int64) bool {
+		if !inflated {
+			return server.writeBlock(blockWriter, req, r, size)
+		}
+		data, err := inflate(r, size)
+		if err != nil {
+			fail(&parseError{"inflating block", err})
+			return false
+		}
+		// The inflated size is only known once the data has been read.
+		return server.writeBlock(blockWriter, req, data, -1)
+	}
+
+	if server.blockCache != nil {
+		if cached, size, ok := server.blockCache.open(cacheKey); ok {
+			defer cached.Close()
+			send(cached, size)
+			return
+		}
+	}
+
+	response, size, err := request.handle(ctx)
 	if err != nil {
-		writeError(w, err)
+		fail(err)
 		return
 	}
 	defer response.Close()
 
+	if server.blockCache == nil || size < 0 || size > server.blockCache.maxEntrySize() {
+		send(response, size)
+		return
+	}
+	cacheWriter, err := server.blockCache.create()
+	if err != nil {
+		log.Printf("Request %s: %v", requestIDFromContext(ctx), err)
+		send(response, size)
+		return
+	}
+	if !send(io.TeeReader(response, cacheWriter), size) || cacheWriter.written != size {
+		cacheWriter.abort()
+		return
+	}
+	if err := cacheWriter.commit(cacheKey); err != nil {
+		log.Printf("Request %s: failed to cache block: %v", requestIDFromContext(ctx), err)
+	}
+}
+
+// writeBlock writes the size bytes of block data from r to w and reports
+// whether it succeeded.  A negative size is not sent as the Content-Length,
+// for data whose size is not known in advance.  The copy stops as soon as the
+// client disconnects, so that an aborted transfer does not keep reading from
+// storage.  Data is read through the stream buffer, if one is configured.
+func (server *Server) writeBlock(w http.ResponseWriter, req *http.Request, r io.Reader, size int64) bool {
 	w.Header().Add("Content-type", "application/octet-stream")
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
 	w.WriteHeader(http.StatusOK)
-	if _, err := io.Copy(w, response); err != nil {
-		log.Printf("Failed to copy response: %v", err)
-		return
+
+	ctx := req.Context()
+	r = &contextReader{ctx: ctx, r: r}
+	if server.streamBuffer > 0 {
+		buffered := newReadAhead(r, server.streamBuffer)
+		defer buffered.Close()
+		r = buffered
 	}
+	client := &clientWriter{w: w}
+	written, err := io.Copy(client, r)
+	if err == nil {
+		return true
+	}
+	// The status has already been sent, so the failure can only be recorded.
+	track := analytics.TrackerFromContext(ctx)
+	if client.err != nil || ctx.Err() == context.Canceled {
+		log.Printf("Request %s: client disconnected after %d of %d bytes: %v", requestIDFromContext(ctx), written, size, err)
+		track(analytics.Event("Blocks", "Blocks Aborted", categoryClientAbort, &written))
+		return false
+	}
+	log.Printf("Request %s: failed to copy response: %v", requestIDFromContext(ctx), err)
+	track(analytics.Event("Blocks", "Blocks Error", errorCategory(ctx, err), nil))
+	return false
 }
 
-func (server *Server) checkWhitelist(bucket string) error {
-	if len(server.whitelist) == 0 || server.whitelist[bucket] {
-		return nil
+// contextReader reads from r until ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
 	}
-	return fmt.Errorf("access to bucket %s is not allowed", bucket)
+	return r.r.Read(p)
 }
 
-func decodeRawQuery(rawQuery string, v interface{}) error {
-	b, err := base64.URLEncoding.DecodeString(rawQuery)
-	if err != nil {
-		return fmt.Errorf("base64: %v", err)
+// clientWriter records the first error writing to w, which shows that the
+// client has gone away.
+type clientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *clientWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// notModified reports whether the conditional headers in req show that the
+// client already has the current representation.  As in RFC 7232,
+// If-Modified-Since is ignored when If-None-Match is present.
+func notModified(req *http.Request, etag string, updated time.Time) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && !updated.IsZero() {
+		return !updated.Truncate(time.Second).After(since)
 	}
+	return false
+}
 
-	if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(v); err != nil {
-		return fmt.Errorf("gob: %v", err)
+// blockSizeLimitFor returns the block size limit that applies to req, which
+// reads from bucket.
+func (server *Server) blockSizeLimitFor(req *http.Request, bucket string) uint64 {
+	if limit, ok := server.bucketLimits[bucket]; ok {
+		return limit
+	}
+	if limit := server.classLimits[clientClass(req)].blockSizeLimit; limit > 0 {
+		return limit
 	}
+	return server.blockSizeLimit
+}
 
-	return nil
+// maxRegionSpanFor returns the maximum region span that applies to bucket.
+func (server *Server) maxRegionSpanFor(bucket string) uint32 {
+	if span, ok := server.bucketSpans[bucket]; ok {
+		return span
+	}
+	return server.maxSpan
+}
+
+func (server *Server) checkWhitelist(bucket string) error {
+	if len(server.whitelist) == 0 || server.whitelist[bucket] {
+		return nil
+	}
+	return fmt.Errorf("access to bucket %s is not allowed", bucket)
 }
 
 // parseID parses path and returns a GCS bucket and object, or an error.
@@ -277,6 +1414,83 @@ func parseID(path string) (string, string, error) {
 	return "", "", errInvalidOrUnspecifiedID
 }
 
+// knownFormats lists the formats defined by the htsget specification.
+var knownFormats = map[string]bool{"BAM": true, "CRAM": true, "VCF": true, "BCF": true}
+
+// representations lists the objects that are checked, in order, when a readset
+// ID does not have a recognized extension.  For example, the readset
+// bucket/sample may be stored as both bucket/sample.bam and bucket/sample.cram.
+var representations = []struct{ format, extension string }{
+	{"BAM", ".bam"},
+	{"CRAM", ".cram"},
+}
+
+// formatFromName returns the format implied by the extension of the object
+// name, or the empty string if the extension is not recognized.
+func formatFromName(object string) string {
+	switch {
+	case strings.HasSuffix(object, ".bam"):
+		return "BAM"
+	case strings.HasSuffix(object, ".cram"):
+		return "CRAM"
+	case strings.HasSuffix(object, ".vcf"), strings.HasSuffix(object, ".vcf.gz"):
+		return "VCF"
+	case strings.HasSuffix(object, ".bcf"):
+		return "BCF"
+	}
+	return ""
+}
+
+// resolveReadset returns the object that should be served for the readset
+// identified by object, along with its format.  If object has no recognized
+// extension, each of its representations is considered: the one matching the
+// preferred format is chosen if there is a preference, otherwise the smallest
+// representation that the server can serve.  If no representations exist,
+// object itself is served as BAM.
+func (server *Server) resolveReadset(ctx context.Context, bucket *storage.BucketHandle, object, preferred string) (string, string, error) {
+	if format := formatFromName(object); format != "" {
+		if preferred != "" && preferred != format {
+			return "", "", newUnsupportedFormatError(fmt.Errorf("readset is only available as %s", format))
+		}
+		return object, format, nil
+	}
+
+	var (
+		chosen, chosenFormat string
+		chosenSize           int64
+		found                []string
+	)
+	for _, rep := range representations {
+		attrs, err := objectAttrs(ctx, server.breaker, bucket.Object(object+rep.extension))
+		if err == storage.ErrObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return "", "", newStorageError("resolving readset", err)
+		}
+		found = append(found, rep.format)
+		if preferred == rep.format {
+			return object + rep.extension, rep.format, nil
+		}
+		if preferred != "" || parseFormat(rep.format) != nil {
+			continue
+		}
+		if chosen == "" || attrs.Size < chosenSize {
+			chosen, chosenFormat, chosenSize = object+rep.extension, rep.format, attrs.Size
+		}
+	}
+
+	switch {
+	case chosen != "":
+		return chosen, chosenFormat, nil
+	case len(found) > 0:
+		return "", "", newUnsupportedFormatError(fmt.Errorf("readset is only available as %s", strings.Join(found, ", ")))
+	case preferred != "":
+		return object, preferred, nil
+	}
+	return object, "BAM", nil
+}
+
 func parseFormat(format string) error {
 	if format != "" && format != "BAM" {
 		return fmt.Errorf("unsupported format %q", format)
@@ -284,25 +1498,291 @@ func parseFormat(format string) error {
 	return nil
 }
 
-func parseRegion(query url.Values, data io.Reader) (genomics.Region, error) {
+// detectFormat inspects the leading bytes of r (without consuming them) and
+// returns the name of the file format that was found.
+func detectFormat(r *bufio.Reader) (string, error) {
+	magic, err := r.Peek(bgzf.MaximumBlockSize)
+	if len(magic) < 4 {
+		return "", fmt.Errorf("reading magic: %v", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("CRAM")):
+		return "CRAM", nil
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		// BGZF files are gzip files with a "BC" extra subfield in each member.
+		if len(magic) < 14 || magic[3]&0x04 == 0 || magic[12] != 'B' || magic[13] != 'C' {
+			return "gzip", nil
+		}
+		gzr, err := gzip.NewReader(bytes.NewReader(magic))
+		if err != nil {
+			return "", fmt.Errorf("opening first block: %v", err)
+		}
+		data := make([]byte, 16)
+		n, _ := io.ReadFull(gzr, data)
+		return detectContent(data[:n], "BGZF"), nil
+	}
+	return detectContent(magic, "unknown"), nil
+}
+
+// detectContent returns the format of the decompressed data, or fallback if it
+// is not recognized.
+func detectContent(data []byte, fallback string) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("BAM\x01")):
+		return "BAM"
+	case bytes.HasPrefix(data, []byte("BCF\x02")):
+		return "BCF"
+	case bytes.HasPrefix(data, []byte("##fileformat=VCF")):
+		return "VCF"
+	case bytes.HasPrefix(data, []byte("@")):
+		return "SAM"
+	}
+	return fallback
+}
+
+// readsBody is the JSON body of a POST reads request.
+type readsBody struct {
+	Format  string       `json:"format"`
+	Class   string       `json:"class"`
+	Fields  []string     `json:"fields"`
+	Tags    []string     `json:"tags"`
+	NoTags  []string     `json:"notags"`
+	Regions []bodyRegion `json:"regions"`
+	BED     string       `json:"bed"`
+}
+
+type bodyRegion struct {
+	ReferenceName string  `json:"referenceName"`
+	Start         *uint32 `json:"start"`
+	End           *uint32 `json:"end"`
+}
+
+// parseReadsBody returns the parameters of a reads request along with one
+// query for each region that it requests.  The parameters of a GET request
+// are those in query, which also describes its only region.  The format,
+// class and regions of a POST request are taken from its JSON body instead,
+// and are added to the extension parameters (such as filters) in query.  The
+// body of a POST request may instead be a BED file listing the regions.  In
+// strict mode, bodies with unknown fields and BED files are rejected.
+func parseReadsBody(w http.ResponseWriter, req *http.Request, query url.Values, strict bool) (url.Values, []url.Values, error) {
+	if req.Method != http.MethodPost {
+		return query, []url.Values{query}, nil
+	}
+	if isBEDBody(req) {
+		if strict {
+			return nil, nil, errors.New("BED bodies are not part of the htsget specification")
+		}
+		if query.Get("class") == ticket.ClassHeader {
+			return nil, nil, errors.New("regions may not be used with class=header")
+		}
+		regions, err := bedRegionQueries(http.MaxBytesReader(w, req.Body, maximumBEDSize))
+		if err != nil {
+			return nil, nil, err
+		}
+		return query, regions, nil
+	}
+
+	var body readsBody
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maximumReadsBodySize))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(&body); err != nil {
+		return nil, nil, fmt.Errorf("decoding JSON: %v", err)
+	}
+	if len(body.Regions) > maximumRegions {
+		return nil, nil, fmt.Errorf("too many regions (%d > %d)", len(body.Regions), maximumRegions)
+	}
+	if body.Class == ticket.ClassHeader && len(body.Regions) > 0 {
+		return nil, nil, errors.New("regions may not be used with class=header")
+	}
+	if body.BED != "" {
+		if strict {
+			return nil, nil, errors.New("bed is not part of the htsget specification")
+		}
+		if len(body.Regions) > 0 {
+			return nil, nil, errors.New("regions may not be used with bed")
+		}
+	}
+
+	params := make(url.Values)
+	for name, values := range query {
+		params[name] = values
+	}
+	for name, value := range map[string]string{"format": body.Format, "class": body.Class, "fields": strings.Join(body.Fields, ","), bedParameter: body.BED} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+	for name, tags := range map[string][]string{"tags": body.Tags, "notags": body.NoTags} {
+		if tags != nil {
+			params.Set(name, strings.Join(tags, ","))
+		}
+	}
+
+	if len(body.Regions) == 0 {
+		return params, []url.Values{make(url.Values)}, nil
+	}
+	var regions []url.Values
+	for _, region := range body.Regions {
+		if region.ReferenceName == "" {
+			return nil, nil, errMissingReferenceName
+		}
+		regionQuery := url.Values{"referenceName": {region.ReferenceName}}
+		if region.Start != nil {
+			regionQuery.Set("start", strconv.FormatUint(uint64(*region.Start), 10))
+		}
+		if region.End != nil {
+			regionQuery.Set("end", strconv.FormatUint(uint64(*region.End), 10))
+		}
+		regions = append(regions, regionQuery)
+	}
+	return params, regions, nil
+}
+
+// lastReference returns the highest reference ID in regions, or -1 if one of
+// them covers every reference.
+func lastReference(regions []genomics.Region) int32 {
+	last := int32(-1)
+	for _, region := range regions {
+		if region.ReferenceID < 0 {
+			return -1
+		}
+		if region.ReferenceID > last {
+			last = region.ReferenceID
+		}
+	}
+	return last
+}
+
+// parseClass reports whether query requests only the header (class=header).
+// The specification does not allow a region to be combined with class=header,
+// and defines no other classes.
+func parseClass(query url.Values) (bool, error) {
+	switch class := query.Get("class"); class {
+	case "":
+		return false, nil
+	case ticket.ClassHeader:
+		for _, name := range []string{"referenceName", "start", "end", bedParameter} {
+			if query.Get(name) != "" {
+				return false, fmt.Errorf("%s may not be used with class=header", name)
+			}
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown class %q", class)
+	}
+}
+
+// parseFilter parses the record filter requested by the excludeFlags,
+// requireFlags and minMapQ query parameters, which are extensions to the
+// htsget specification, and the fields, tags and notags parameters.  Flags
+// may be given in decimal or, with a 0x prefix, in hexadecimal.
+func parseFilter(query url.Values) (bam.Filter, error) {
+	var filter bam.Filter
+	if v := query.Get("fields"); v != "" {
+		fields, err := bam.ParseFields(strings.Split(v, ","))
+		if err != nil {
+			return bam.Filter{}, fmt.Errorf("parsing fields: %v", err)
+		}
+		filter.Omit = bam.OptionalFields &^ fields
+	}
+	for _, p := range []struct {
+		name string
+		dest *string
+	}{{"tags", &filter.Tags}, {"notags", &filter.NoTags}} {
+		v := query.Get(p.name)
+		if v == "" {
+			continue
+		}
+		tags, err := bam.ParseTags(strings.Split(v, ","))
+		if err != nil {
+			return bam.Filter{}, fmt.Errorf("parsing %s: %v", p.name, err)
+		}
+		*p.dest = tags
+	}
+	if _, ok := query["tags"]; ok && filter.Tags == "" {
+		// An empty list of tags to include removes them all.
+		filter.Omit |= bam.FieldTAGS
+	}
+	for i := 0; i+2 <= len(filter.Tags); i += 2 {
+		for j := 0; j+2 <= len(filter.NoTags); j += 2 {
+			if tag := filter.Tags[i : i+2]; tag == filter.NoTags[j:j+2] {
+				return bam.Filter{}, fmt.Errorf("tag %s is in both tags and notags", tag)
+			}
+		}
+	}
+	for _, p := range []struct {
+		name string
+		bits int
+		dest func(uint64)
+	}{
+		{"requireFlags", 16, func(v uint64) { filter.RequireFlags = uint16(v) }},
+		{"excludeFlags", 16, func(v uint64) { filter.ExcludeFlags = uint16(v) }},
+		{"minMapQ", 8, func(v uint64) { filter.MinMappingQuality = uint8(v) }},
+	} {
+		v := query.Get(p.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := strconv.ParseUint(v, 0, p.bits)
+		if err != nil {
+			return bam.Filter{}, fmt.Errorf("parsing %s: %v", p.name, err)
+		}
+		p.dest(parsed)
+	}
+	return filter, nil
+}
+
+// parseExact reports whether query requests exact mode (exact=true), an
+// extension to the htsget specification in which records that do not overlap
+// the requested regions are removed by the server.
+func parseExact(query url.Values) (bool, error) {
+	v := query.Get("exact")
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// parseRegion parses the region requested by query, using resolve to look up
+// the reference by name.  If maxSpan is not zero, regions covering more than
+// maxSpan bases are rejected with an InvalidRange error.  The reference name
+// "*" selects the unplaced unmapped reads, which have no coordinates and so
+// cannot be combined with start or end; since their span cannot be bounded,
+// they are also rejected when maxSpan is not zero.
+func parseRegion(query url.Values, resolve func(string) (*bam.Reference, error), maxSpan uint32) (genomics.Region, error) {
 	var (
 		name  = query.Get("referenceName")
 		start = query.Get("start")
 		end   = query.Get("end")
 	)
 	if name == "" && start == "" && end == "" {
+		if maxSpan > 0 {
+			return genomics.Region{}, newInvalidRangeError(fmt.Errorf("requests for the whole readset are not allowed; specify referenceName, start and end covering at most %d bases", maxSpan))
+		}
 		return genomics.AllMappedReads, nil
 	}
 	if name == "" {
 		return genomics.Region{}, errMissingReferenceName
 	}
+	if name == unplacedReferenceName {
+		if start != "" || end != "" {
+			return genomics.Region{}, newInvalidInputError("parsing region", errors.New("start and end may not be used with referenceName=*"))
+		}
+		if maxSpan > 0 {
+			return genomics.Region{}, newInvalidRangeError(fmt.Errorf("requests for unplaced unmapped reads are not allowed when regions are limited to %d bases", maxSpan))
+		}
+		return genomics.UnplacedUnmappedReads, nil
+	}
 
-	id, err := bam.GetReferenceID(data, name)
+	reference, err := resolve(name)
 	if err != nil {
 		return genomics.Region{}, fmt.Errorf("resolving reference %q: %v", name, err)
 	}
 
-	region := genomics.Region{ReferenceID: id}
+	region := genomics.Region{ReferenceID: reference.ID}
 
 	if start != "" {
 		n, err := strconv.ParseUint(start, 10, 32)
@@ -320,6 +1800,23 @@ func parseRegion(query url.Values, data io.Reader) (genomics.Region, error) {
 		region.End = uint32(n)
 	}
 
+	if reference.Length > 0 && region.Start > reference.Length {
+		return genomics.Region{}, newInvalidRangeError(fmt.Errorf("start %d exceeds length of reference %q (%d)", region.Start, name, reference.Length))
+	}
+
+	if maxSpan > 0 {
+		end := region.End
+		if end == 0 {
+			end = reference.Length
+		}
+		if end == 0 {
+			return genomics.Region{}, newInvalidRangeError(fmt.Errorf("the length of reference %q is unknown; specify an end at most %d bases after start", name, maxSpan))
+		}
+		if end > region.Start && end-region.Start > maxSpan {
+			return genomics.Region{}, newInvalidRangeError(fmt.Errorf("region spans %d bases but at most %d are allowed; split it into smaller regions using start and end", end-region.Start, maxSpan))
+		}
+	}
+
 	return region, nil
 }
 
@@ -375,6 +1872,9 @@ func newStorageError(context string, err error) error {
 			return newInvalidAuthenticationError(context, err)
 		case http.StatusForbidden:
 			return newPermissionDeniedError(context, err)
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			// Pass on any requested delay so that clients back off too.
+			return &unavailableError{retryAfter: retryAfter(err)}
 		}
 	}
 	return err
@@ -382,13 +1882,30 @@ func newStorageError(context string, err error) error {
 
 // writeError writes either a JSON object or bare HTTP error describing err to
 // w.  A JSON object is written only when the error has a name and code defined
-// by the htsget specification.
+// by the htsget specification, or when the request is served in strict mode.
 func writeError(w http.ResponseWriter, err error) {
+	_, strict := w.(strictWriter)
+	if err, ok := err.(*unavailableError); ok {
+		if err.retryAfter > 0 {
+			// Round up so that clients never retry too early.
+			w.Header().Set("Retry-After", strconv.Itoa(int((err.retryAfter+time.Second-1)/time.Second)))
+		}
+		if strict {
+			writeError(w, &apiError{"ServiceUnavailable", http.StatusServiceUnavailable, err})
+			return
+		}
+		writeHTTPError(w, http.StatusServiceUnavailable, err)
+		return
+	}
 	if err, ok := err.(*apiError); ok {
-		writeJSON(w, err.code, map[string]interface{}{
-			"error":   err.name,
-			"message": fmt.Sprintf("%s: %v", http.StatusText(err.code), err.cause),
-		})
+		writeJSON(w, err.code, &ticket.ErrorResponse{Error: &ticket.Error{
+			Name:    err.name,
+			Message: fmt.Sprintf("%s: %v", http.StatusText(err.code), err.cause),
+		}})
+		return
+	}
+	if strict {
+		writeError(w, &apiError{"InternalError", http.StatusInternalServerError, err})
 		return
 	}
 
@@ -410,9 +1927,14 @@ var (
 	initializeDefaultStorageClient sync.Once
 )
 
-func newClientWithOptions(opts ...option.ClientOption) (*storage.Client, http.Header, error) {
+func newClientWithOptions(newTransport func() (http.RoundTripper, error)) (*storage.Client, http.Header, error) {
 	initializeDefaultStorageClient.Do(func() {
-		gcs, err := storage.NewClient(context.Background(), opts...)
+		transport, err := newTransport()
+		if err != nil {
+			log.Fatalf("Creating default storage transport: %v", err)
+		}
+		client := &http.Client{Transport: &requestIDTransport{base: transport}}
+		gcs, err := storage.NewClient(context.Background(), option.WithHTTPClient(client))
 		if err != nil {
 			log.Fatalf("Creating default storage client: %v", err)
 		}
@@ -424,14 +1946,22 @@ func newClientWithOptions(opts ...option.ClientOption) (*storage.Client, http.He
 // NewDefaultClient returns a storage client that uses the application default
 // credentials.  It caches the storage client for efficiency.
 func NewDefaultClient(_ *http.Request) (*storage.Client, http.Header, error) {
-	return newClientWithOptions()
+	return newClientWithOptions(func() (http.RoundTripper, error) {
+		source, err := google.DefaultTokenSource(context.Background(), storage.ScopeReadOnly)
+		if err != nil {
+			return nil, fmt.Errorf("finding default credentials: %v", err)
+		}
+		return &oauth2.Transport{Source: source}, nil
+	})
 }
 
 // NewPublicClient returns a storage client that does not use any form of
 // client authorization.  It can only be used to read publicly-readable
 // objects. It caches the storage client for efficiency.
 func NewPublicClient(_ *http.Request) (*storage.Client, http.Header, error) {
-	return newClientWithOptions(option.WithHTTPClient(http.DefaultClient))
+	return newClientWithOptions(func() (http.RoundTripper, error) {
+		return http.DefaultTransport, nil
+	})
 }
 
 // NewClientFromBearerToken constructs a storage client that uses the OAuth2
@@ -450,7 +1980,11 @@ func NewClientFromBearerToken(req *http.Request) (*storage.Client, http.Header,
 		TokenType:   fields[0],
 		AccessToken: fields[1],
 	}
-	client, err := storage.NewClient(req.Context(), option.WithTokenSource(oauth2.StaticTokenSource(&token)))
+	transport := &oauth2.Transport{
+		Source: oauth2.StaticTokenSource(&token),
+		Base:   &requestIDTransport{},
+	}
+	client, err := storage.NewClient(req.Context(), option.WithHTTPClient(&http.Client{Transport: transport}))
 	if err != nil {
 		return nil, nil, fmt.Errorf("creating client with token source: %v", err)
 	}
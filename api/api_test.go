@@ -15,19 +15,32 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/googlegenomics/htsget/internal/bam"
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/ticket"
 	"google.golang.org/api/option"
 )
 
@@ -56,6 +69,9 @@ func TestUnsupportedFormats(t *testing.T) {
 		{"unknown format", "/reads/bucket/object?format=XYZ"},
 		{"cram format", "/reads/bucket/object?format=CRAM"},
 		{"lowercase bam", "/reads/bucket/object?format=bam"},
+		{"cram extension", "/reads/bucket/object.cram"},
+		{"vcf extension", "/reads/bucket/object.vcf.gz"},
+		{"bcf extension", "/reads/bucket/object.bcf"},
 	}
 	ctx := context.Background()
 	for _, tc := range testCases {
@@ -66,48 +82,1319 @@ func TestUnsupportedFormats(t *testing.T) {
 	}
 }
 
+func TestFormatFromName(t *testing.T) {
+	testCases := []struct{ object, format string }{
+		{"sample.bam", "BAM"},
+		{"sample", ""},
+		{"dir/sample.cram", "CRAM"},
+		{"sample.vcf", "VCF"},
+		{"sample.vcf.gz", "VCF"},
+		{"sample.bcf", "BCF"},
+	}
+	for _, tc := range testCases {
+		if got := formatFromName(tc.object); got != tc.format {
+			t.Errorf("formatFromName(%q): got %q, want %q", tc.object, got, tc.format)
+		}
+	}
+}
+
+func TestResolveReadset(t *testing.T) {
+	testCases := []struct {
+		name, url string
+		status    int
+		block     string
+	}{
+		{"extension-less ID", "/reads/testdata/NA12878.chr20.sample", http.StatusOK, "/block/testdata/NA12878.chr20.sample.bam?"},
+		{"preferred BAM", "/reads/testdata/NA12878.chr20.sample?format=BAM", http.StatusOK, "/block/testdata/NA12878.chr20.sample.bam?"},
+		{"preferred CRAM", "/reads/testdata/NA12878.chr20.sample?format=CRAM", http.StatusBadRequest, ""},
+		{"extension mismatch", "/reads/testdata/NA12878.chr20.sample.bam?format=CRAM", http.StatusBadRequest, ""},
+	}
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := testQuery(ctx, t, tc.url)
+			if tc.status != http.StatusOK {
+				expectError(t, "UnsupportedFormat", tc.status, resp)
+				return
+			}
+			if got, want := resp.StatusCode, tc.status; got != want {
+				t.Fatalf("Wrong status code: got %v, want %v", got, want)
+			}
+
+			var body struct {
+				Container struct {
+					Format string `json:"format"`
+					URLs   []struct {
+						URL string `json:"url"`
+					} `json:"urls"`
+				} `json:"htsget"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if got, want := body.Container.Format, "BAM"; got != want {
+				t.Errorf("Wrong format: got %q, want %q", got, want)
+			}
+			if got := body.Container.URLs[0].URL; !strings.HasPrefix(got, tc.block) {
+				t.Errorf("Wrong block URL: got %q, want prefix %q", got, tc.block)
+			}
+		})
+	}
+}
+
+func TestUnsupportedObjectFormats(t *testing.T) {
+	testCases := []struct{ name, url string }{
+		{"plain SAM", "/reads/testdata/sample.sam"},
+		{"gzip compressed SAM", "/reads/testdata/sample.sam.gz"},
+		{"BCF", "/reads/testdata/sample.bcf"},
+		{"BAM index", "/reads/testdata/index.sample.bai"},
+	}
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expectError(t, "UnsupportedFormat", http.StatusBadRequest,
+				testQuery(ctx, t, tc.url))
+		})
+	}
+}
+
+func TestInvalidRange(t *testing.T) {
+	testCases := []struct {
+		name   string
+		url    string
+		strict bool
+	}{
+		{"start past reference end", "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&start=70000000", false},
+		{"reference without index data", "/reads/testdata/NA12878.chr20.sample.bam?referenceName=1", true},
+	}
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expectError(t, "InvalidRange", http.StatusBadRequest,
+				testQuery(ctx, t, tc.url, func(server *Server) {
+					server.SetStrict(tc.strict)
+				}))
+		})
+	}
+}
+
+func TestReferenceWithoutIndexData(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=1")
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("Wrong status code: got %v, want %v", got, want)
+	}
+}
+
 func TestMissingObject(t *testing.T) {
 	ctx := context.Background()
 	expectError(t, "NotFound", http.StatusNotFound,
 		testQuery(ctx, t, "/reads/foo/bar"))
 }
 
-func TestSimpleRead(t *testing.T) {
+func TestSimpleRead(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam")
+
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("Wrong status code: got %v, want %v", got, want)
+	}
+
+	var body struct {
+		Container struct {
+			URLs []struct {
+				URL string `json:"url"`
+			} `json:"urls"`
+		} `json:"htsget"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	var blocks int
+	for _, url := range body.Container.URLs {
+		if url.URL == eofMarkerDataURL {
+			continue
+		}
+		blocks++
+
+		resp := testQuery(ctx, t, url.URL)
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Errorf("Wrong status code: got %v, want %v", got, want)
+			continue
+		}
+		length, err := io.Copy(ioutil.Discard, resp.Body)
+		if err != nil {
+			t.Errorf("Failed to read response body: %v", err)
+			continue
+		}
+		if got, want := length, int64(testBlockSizeLimit); got > want {
+			t.Errorf("Data block too large: got %v, want at most %v", got, want)
+		}
+		if got, want := resp.ContentLength, length; got != want {
+			t.Errorf("Wrong Content-Length: got %v, want %v", got, want)
+		}
+	}
+	if blocks == 0 {
+		t.Error("Ticket did not contain any blocks")
+	}
+}
+
+func TestURLClasses(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20")
+
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %v, want %v", got, want)
+	}
+
+	var body struct {
+		Htsget struct {
+			URLs []struct {
+				URL   string `json:"url"`
+				Class string `json:"class"`
+			} `json:"urls"`
+		} `json:"htsget"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	urls := body.Htsget.URLs
+	if len(urls) < 3 {
+		t.Fatalf("Expected a header, body and EOF URL, got %d URLs", len(urls))
+	}
+	for i, url := range urls {
+		want := "body"
+		if i == 0 {
+			want = "header"
+		}
+		if url.Class != want {
+			t.Errorf("URL %d: wrong class: got %q, want %q", i, url.Class, want)
+		}
+	}
+	if got, want := urls[len(urls)-1].URL, eofMarkerDataURL; got != want {
+		t.Errorf("Wrong final URL: got %q, want %q", got, want)
+	}
+}
+
+func TestHeaderClass(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?class=header")
+
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %v, want %v", got, want)
+	}
+
+	var body ticket.Response
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	urls := body.Ticket.URLs
+	if got, want := len(urls), 2; got != want {
+		t.Fatalf("Wrong number of URLs: got %d, want %d", got, want)
+	}
+	if got, want := urls[0].Class, ticket.ClassHeader; got != want {
+		t.Errorf("Wrong class: got %q, want %q", got, want)
+	}
+	if got, want := urls[1].URL, eofMarkerDataURL; got != want {
+		t.Errorf("Wrong final URL: got %q, want %q", got, want)
+	}
+}
+
+func TestHeaderClass_Errors(t *testing.T) {
+	testCases := []struct {
+		name string
+		url  string
+	}{
+		{"unknown class", "/reads/testdata/NA12878.chr20.sample.bam?class=reads"},
+		{"with region", "/reads/testdata/NA12878.chr20.sample.bam?class=header&referenceName=20"},
+	}
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expectError(t, "InvalidInput", http.StatusBadRequest, testQuery(ctx, t, tc.url))
+		})
+	}
+}
+
+func TestUnplacedReads(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	header, _ := fetchTicketData(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?class=header")
+	data, _ := fetchTicketData(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=*")
+	if !bytes.HasPrefix(data, header[:len(header)-len(bgzf.EOFMarker)]) {
+		t.Errorf("Unplaced reads do not start with the header")
+	}
+
+	testCases := []struct {
+		name string
+		url  string
+	}{
+		{"with start", "/reads/testdata/NA12878.chr20.sample.bam?referenceName=*&start=0"},
+		{"with end", "/reads/testdata/NA12878.chr20.sample.bam?referenceName=*&end=100"},
+		{"count", "/count/testdata/NA12878.chr20.sample.bam?referenceName=*"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expectError(t, "InvalidInput", http.StatusBadRequest, testQuery(ctx, t, tc.url))
+		})
+	}
+}
+
+func TestSamtoolsRegion(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	want, _ := fetchTicketData(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&start=12290700&end=12290800")
+	got, _ := fetchTicketData(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?region=20:12,290,701-12,290,800")
+	if !bytes.Equal(got, want) {
+		t.Errorf("Samtools region returned different data")
+	}
+
+	expectError(t, "InvalidInput", http.StatusBadRequest, testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?region=20:0-100"))
+	expectError(t, "InvalidInput", http.StatusBadRequest, testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?region=20&start=0"))
+}
+
+func TestInlineChunks(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	fetch := func(configure ...func(*Server)) ([]byte, int) {
+		return fetchTicketData(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&start=0&end=100000", configure...)
+	}
+
+	want, inline := fetch()
+	if inline != 0 {
+		t.Errorf("Inlined %d chunks without a limit", inline)
+	}
+	got, inline := fetch(func(server *Server) { server.SetInlineLimit(1 << 20) })
+	if inline == 0 {
+		t.Errorf("No chunks were inlined")
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Inline data differs from block data: got %d bytes, want %d bytes", len(got), len(want))
+	}
+}
+
+func TestRecordFilters(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	const url = "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20"
+
+	// records returns the flags and mapping quality of each record in data.
+	records := func(data []byte) (flags []uint16, qualities []uint8) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to open data: %v", err)
+		}
+		if err := bam.SkipHeader(r); err != nil {
+			t.Fatalf("Failed to skip header: %v", err)
+		}
+		for {
+			var size int32
+			if err := binary.Read(r, binary.LittleEndian, &size); err == io.EOF {
+				return flags, qualities
+			} else if err != nil {
+				t.Fatalf("Failed to read record size: %v", err)
+			}
+			record := make([]byte, size)
+			if _, err := io.ReadFull(r, record); err != nil {
+				t.Fatalf("Failed to read record: %v", err)
+			}
+			flags = append(flags, binary.LittleEndian.Uint16(record[14:]))
+			qualities = append(qualities, record[9])
+		}
+	}
+
+	all, _ := fetchTicketData(ctx, t, url)
+	allFlags, _ := records(all)
+
+	testCases := []struct {
+		name   string
+		query  string
+		inline bool
+		keep   func(flags uint16, quality uint8) bool
+	}{
+		{"exclude reverse strand", "&excludeFlags=16", false, func(f uint16, q uint8) bool { return f&16 == 0 }},
+		{"require first in pair", "&requireFlags=0x40", false, func(f uint16, q uint8) bool { return f&0x40 != 0 }},
+		{"mapping quality", "&minMapQ=60", false, func(f uint16, q uint8) bool { return q >= 60 }},
+		{"inline", "&excludeFlags=16&minMapQ=60", true, func(f uint16, q uint8) bool { return f&16 == 0 && q >= 60 }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var configure []func(*Server)
+			if tc.inline {
+				configure = append(configure, func(server *Server) { server.SetInlineLimit(1 << 20) })
+			}
+			data, _ := fetchTicketData(ctx, t, url+tc.query, configure...)
+			flags, qualities := records(data)
+			if len(flags) == 0 || len(flags) == len(allFlags) {
+				t.Fatalf("Filter kept %d of %d records", len(flags), len(allFlags))
+			}
+			for i := range flags {
+				if !tc.keep(flags[i], qualities[i]) {
+					t.Errorf("Record %d (flags %#x, quality %d) should have been removed", i, flags[i], qualities[i])
+				}
+			}
+		})
+	}
+
+	expectError(t, "InvalidInput", http.StatusBadRequest, testQuery(ctx, t, url+"&minMapQ=300"))
+}
+
+func TestFields(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	const url = "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20"
+
+	all, _ := fetchTicketData(ctx, t, url)
+	data, _ := fetchTicketData(ctx, t, url+"&fields=QNAME,FLAG,POS")
+	want, got := bamRecords(t, all), bamRecords(t, data)
+	if len(got) != len(want) {
+		t.Fatalf("Wrong number of records: got %d, want %d", len(got), len(want))
+	}
+	for i, record := range got {
+		name := want[i][32 : 32+int(want[i][8])]
+		if !bytes.Equal(record, append(append([]byte(nil), record[:32]...), name...)) {
+			t.Fatalf("Record %d was not reduced to its fixed fields and name: got %d bytes", i, len(record))
+		}
+		if !bytes.Equal(record[:12], want[i][:12]) || !bytes.Equal(record[14:16], want[i][14:16]) {
+			t.Fatalf("Record %d has the wrong position or flags", i)
+		}
+	}
+
+	expectError(t, "InvalidInput", http.StatusBadRequest, testQuery(ctx, t, url+"&fields=QNAME,READ"))
+}
+
+func TestTags(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	const url = "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20"
+
+	// tags returns the optional fields of record.
+	tags := func(record []byte) []byte {
+		var (
+			name     = int(record[8])
+			cigarOps = int(binary.LittleEndian.Uint16(record[12:]))
+			bases    = int(binary.LittleEndian.Uint32(record[16:]))
+		)
+		return record[32+name+4*cigarOps+(bases+1)/2+bases:]
+	}
+	size := func(query string) int {
+		data, _ := fetchTicketData(ctx, t, url+query)
+		var total int
+		for _, record := range bamRecords(t, data) {
+			total += len(tags(record))
+		}
+		return total
+	}
+
+	all := size("")
+	if all == 0 {
+		t.Fatal("Test data has no tags")
+	}
+	if got := size("&tags="); got != 0 {
+		t.Errorf("Empty tags parameter kept %d bytes of tags", got)
+	}
+	if got := size("&tags=NM"); got == 0 || got >= all {
+		t.Errorf("Wrong size of NM tags: got %d bytes of %d", got, all)
+	}
+	if got := size("&notags=NM"); got == 0 || got >= all || got+size("&tags=NM") != all {
+		t.Errorf("Wrong size without NM tags: got %d bytes of %d", got, all)
+	}
+
+	req, err := http.NewRequest("POST", strings.Split(url, "?")[0], strings.NewReader(`{"tags": []}`))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	data, _ := fetchRequestData(ctx, t, req)
+	for i, record := range bamRecords(t, data) {
+		if len(tags(record)) != 0 {
+			t.Fatalf("Record %d has tags after a POST request for none", i)
+		}
+	}
+
+	for _, query := range []string{"&tags=NM&notags=MD,NM", "&tags=N", "&notags=NM,"} {
+		expectError(t, "InvalidInput", http.StatusBadRequest, testQuery(ctx, t, url+query))
+	}
+}
+
+func TestExactRegions(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	const (
+		url        = "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&start=12290700&end=12290800"
+		start, end = 12290700, 12290800
+	)
+
+	// overlapping counts the records in data that overlap the region.
+	overlapping := func(data []byte) (overlaps, total int) {
+		for _, record := range bamRecords(t, data) {
+			var (
+				position = int(int32(binary.LittleEndian.Uint32(record[4:])))
+				cigar    = 32 + int(record[8])
+				ops      = int(binary.LittleEndian.Uint16(record[12:]))
+				length   int
+			)
+			for i := 0; i < ops; i++ {
+				op := binary.LittleEndian.Uint32(record[cigar+4*i:])
+				if strings.IndexByte("MDN=X", "MIDNSHP=X"[op&0xf]) >= 0 {
+					length += int(op >> 4)
+				}
+			}
+			if length == 0 {
+				length = 1
+			}
+			if position < end && position+length > start {
+				overlaps++
+			}
+			total++
+		}
+		return overlaps, total
+	}
+
+	loose, _ := fetchTicketData(ctx, t, url)
+	looseOverlaps, looseTotal := overlapping(loose)
+	if looseOverlaps == 0 || looseOverlaps == looseTotal {
+		t.Fatalf("Test region is unsuitable: %d of %d records overlap it", looseOverlaps, looseTotal)
+	}
+	exact, _ := fetchTicketData(ctx, t, url+"&exact=true")
+	exactOverlaps, exactTotal := overlapping(exact)
+	if exactOverlaps != exactTotal {
+		t.Errorf("Exact mode kept %d records outside the region", exactTotal-exactOverlaps)
+	}
+	if exactOverlaps != looseOverlaps {
+		t.Errorf("Exact mode removed records inside the region: got %d, want %d", exactOverlaps, looseOverlaps)
+	}
+
+	expectError(t, "InvalidInput", http.StatusBadRequest, testQuery(ctx, t, url+"&exact=maybe"))
+}
+
+func TestPostReads(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	const url = "/reads/testdata/NA12878.chr20.sample.bam"
+
+	post := func(body string) *http.Request {
+		req, err := http.NewRequest("POST", url, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	region, _ := fetchTicketData(ctx, t, url+"?referenceName=20&start=10000000&end=10100000")
+	all, _ := fetchTicketData(ctx, t, url)
+	testCases := []struct {
+		name string
+		body string
+		want []byte
+	}{
+		{"single region", `{"format": "BAM", "regions": [{"referenceName": "20", "start": 10000000, "end": 10100000}]}`, region},
+		{"repeated region", `{"regions": [{"referenceName": "20", "start": 10000000, "end": 10100000}, {"referenceName": "20", "start": 10000000, "end": 10100000}]}`, region},
+		{"no regions", `{"format": "BAM"}`, all},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _ := fetchRequestData(ctx, t, post(tc.body))
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("Wrong data: got %d bytes, want %d bytes", len(got), len(tc.want))
+			}
+		})
+	}
+
+	errorCases := []struct {
+		name string
+		body string
+	}{
+		{"malformed", `{"regions": [`},
+		{"missing reference name", `{"regions": [{"start": 0}]}`},
+		{"negative start", `{"regions": [{"referenceName": "20", "start": -1}]}`},
+		{"header with regions", `{"class": "header", "regions": [{"referenceName": "20"}]}`},
+	}
+	for _, tc := range errorCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expectError(t, "InvalidInput", http.StatusBadRequest, testRequest(ctx, t, post(tc.body)))
+		})
+	}
+
+	strict := func(server *Server) {
+		server.SetStrict(true)
+		server.SetAdvertisedURL("https://example.com")
+	}
+	expectError(t, "InvalidInput", http.StatusBadRequest,
+		testRequest(ctx, t, post(`{"format": "BAM", "unknown": true}`), strict))
+}
+
+func TestInlineHeaders(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	const url = "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&start=10000000&end=10100000"
+	inlineByDefault := func(server *Server) { server.SetInlineHeaders(true) }
+
+	decompress := func(data []byte) []byte {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to open data: %v", err)
+		}
+		decompressed, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Failed to decompress data: %v", err)
+		}
+		return decompressed
+	}
+
+	want, inline := fetchTicketData(ctx, t, url)
+	if inline != 0 {
+		t.Fatalf("Inlined %d chunks by default", inline)
+	}
+	testCases := []struct {
+		name      string
+		query     string
+		configure []func(*Server)
+		inline    int
+	}{
+		{"query parameter", "&inlineHeader=true", nil, 1},
+		{"server default", "", []func(*Server){inlineByDefault}, 1},
+		{"overridden default", "&inlineHeader=false", []func(*Server){inlineByDefault}, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, inline := fetchTicketData(ctx, t, url+tc.query, tc.configure...)
+			if inline != tc.inline {
+				t.Errorf("Wrong number of inline chunks: got %d, want %d", inline, tc.inline)
+			}
+			if !bytes.Equal(decompress(got), decompress(want)) {
+				t.Errorf("Wrong data: got %d bytes, want %d bytes", len(got), len(want))
+			}
+		})
+	}
+
+	expectError(t, "InvalidInput", http.StatusBadRequest, testQuery(ctx, t, url+"&inlineHeader=maybe"))
+}
+
+func TestMinimalHeaders(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20", func(server *Server) {
+		server.SetMinimalHeaders(true)
+	})
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %v, want %v", got, want)
+	}
+
+	var body struct {
+		Htsget struct {
+			URLs []struct {
+				URL   string `json:"url"`
+				Class string `json:"class"`
+			} `json:"urls"`
+		} `json:"htsget"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	urls := body.Htsget.URLs
+	if len(urls) < 3 {
+		t.Fatalf("Expected a header, body and EOF URL, got %d URLs", len(urls))
+	}
+	if got, want := urls[0].Class, "header"; got != want {
+		t.Errorf("Wrong class: got %q, want %q", got, want)
+	}
+	if !strings.HasPrefix(urls[0].URL, "data:") {
+		t.Fatalf("Header was not served inline: %q", urls[0].URL)
+	}
+	encoded, err := base64.StdEncoding.DecodeString(urls[0].URL[strings.Index(urls[0].URL, ",")+1:])
+	if err != nil {
+		t.Fatalf("Failed to decode data URL: %v", err)
+	}
+	minimal, err := bam.GetHeader(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("Failed to read minimal header: %v", err)
+	}
+
+	f, err := os.Open("testdata/NA12878.chr20.sample.bam")
+	if err != nil {
+		t.Fatalf("Failed to open test data: %v", err)
+	}
+	defer f.Close()
+	original, err := bam.GetHeader(f)
+	if err != nil {
+		t.Fatalf("Failed to read original header: %v", err)
+	}
+
+	if !reflect.DeepEqual(minimal.References, original.References) {
+		t.Errorf("Minimal header has a different reference list")
+	}
+	if got, want := len(minimal.Text), len(original.Text); got >= want {
+		t.Errorf("Minimal header is not smaller: got %d bytes of text, want fewer than %d", got, want)
+	}
+	if !strings.Contains(minimal.Text, "@SQ\tSN:20\t") {
+		t.Errorf("Minimal header does not describe the requested reference")
+	}
+	if strings.Contains(minimal.Text, "@SQ\tSN:21\t") {
+		t.Errorf("Minimal header describes a later reference")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&explain=true")
+
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %v, want %v", got, want)
+	}
+
+	var body struct {
+		Explain *struct {
+			Trace struct {
+				Bins []struct {
+					ReferenceID int32 `json:"referenceId"`
+				} `json:"bins"`
+				References int `json:"referencesScanned"`
+				Candidates int `json:"candidates"`
+				Selected   int `json:"selected"`
+			} `json:"trace"`
+			CandidateChunks []string `json:"candidateChunks"`
+			MergedChunks    []string `json:"mergedChunks"`
+			EstimatedBytes  uint64   `json:"estimatedBytes"`
+		} `json:"explain"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if body.Explain == nil {
+		t.Fatal("Response does not contain an explanation")
+	}
+
+	e := body.Explain
+	if len(e.Trace.Bins) == 0 {
+		t.Errorf("No bins were reported")
+	}
+	for _, bin := range e.Trace.Bins {
+		if got, want := bin.ReferenceID, int32(19); got != want {
+			t.Errorf("Wrong reference for bin: got %d, want %d", got, want)
+		}
+	}
+	if e.Trace.References == 0 {
+		t.Errorf("No references were scanned")
+	}
+	if got, want := e.Trace.Selected, len(e.CandidateChunks)-1; got != want || e.Trace.Candidates < got {
+		t.Errorf("Wrong number of selected chunks: got %d of %d candidates, want %d", got, e.Trace.Candidates, want)
+	}
+	if len(e.MergedChunks) == 0 || len(e.MergedChunks) > len(e.CandidateChunks) {
+		t.Errorf("Wrong number of merged chunks: got %d (from %d candidates)", len(e.MergedChunks), len(e.CandidateChunks))
+	}
+	if e.EstimatedBytes == 0 {
+		t.Errorf("No estimated size was reported")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	resp := testQuery(context.Background(), t, "/capabilities", func(server *Server) {
+		server.SetBearerTokenAuth(true)
+		server.SetMaxRegionSpan(1000000)
+		server.SetBucketMaxRegionSpan("interactive", 1000)
+		server.SetBucketBlockSizeLimit("batch", 1<<30)
+		server.SetReadsConcurrencyLimit(10, 2, 5)
+	})
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %v, want %v", got, want)
+	}
+
+	var body struct {
+		Capabilities struct {
+			Formats           []string                     `json:"formats"`
+			Authentication    string                       `json:"authentication"`
+			MaxBlockSize      uint64                       `json:"maxBlockSize"`
+			MaxRegionSpan     uint32                       `json:"maxRegionSpan"`
+			BucketLimits      map[string]map[string]uint64 `json:"bucketLimits"`
+			ConcurrencyLimits map[string]struct {
+				Total     int `json:"total"`
+				PerClient int `json:"perClient"`
+				Queue     int `json:"queue"`
+			} `json:"concurrencyLimits"`
+		} `json:"capabilities"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	c := body.Capabilities
+	if got, want := c.Formats, []string{"BAM"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong formats: got %v, want %v", got, want)
+	}
+	if got, want := c.Authentication, "bearer"; got != want {
+		t.Errorf("Wrong authentication: got %q, want %q", got, want)
+	}
+	if got, want := c.MaxBlockSize, uint64(testBlockSizeLimit); got != want {
+		t.Errorf("Wrong maximum block size: got %d, want %d", got, want)
+	}
+	if got, want := c.MaxRegionSpan, uint32(1000000); got != want {
+		t.Errorf("Wrong maximum region span: got %d, want %d", got, want)
+	}
+	want := map[string]map[string]uint64{
+		"maxBlockSize":  {"batch": 1 << 30},
+		"maxRegionSpan": {"interactive": 1000},
+	}
+	if got := c.BucketLimits; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong bucket limits: got %v, want %v", got, want)
+	}
+	if got, ok := c.ConcurrencyLimits["reads"]; !ok || got.Total != 10 || got.PerClient != 2 || got.Queue != 5 {
+		t.Errorf("Wrong reads limit: got %+v (present %v)", got, ok)
+	}
+	if _, ok := c.ConcurrencyLimits["blocks"]; ok {
+		t.Errorf("Unset block limit was reported")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	resp := testQuery(ctx, t, "/metadata/testdata/NA12878.chr20.sample.bam")
+
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %v, want %v", got, want)
+	}
+
+	type readGroup struct {
+		ID       string `json:"id"`
+		Sample   string `json:"sample"`
+		Library  string `json:"library"`
+		Platform string `json:"platform"`
+	}
+	var body struct {
+		Metadata *struct {
+			Format         string      `json:"format"`
+			ReferenceCount int         `json:"referenceCount"`
+			ReadGroups     []readGroup `json:"readGroups"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if body.Metadata == nil {
+		t.Fatal("Response does not contain metadata")
+	}
+
+	m := body.Metadata
+	if got, want := m.Format, "BAM"; got != want {
+		t.Errorf("Wrong format: got %q, want %q", got, want)
+	}
+	if got, want := m.ReferenceCount, 86; got != want {
+		t.Errorf("Wrong reference count: got %d, want %d", got, want)
+	}
+	want := []readGroup{{ID: "SRR098401", Sample: "NA12878", Library: "Solexa-51024", Platform: "ILLUMINA"}}
+	if !reflect.DeepEqual(m.ReadGroups, want) {
+		t.Errorf("Wrong read groups: got %+v, want %+v", m.ReadGroups, want)
+	}
+}
+
+func TestIndexStats(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	resp := testQuery(ctx, t, "/index-stats/testdata/NA12878.chr20.sample.bam")
+
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %v, want %v", got, want)
+	}
+
+	type reference struct {
+		Name     string `json:"name"`
+		Length   uint32 `json:"length"`
+		Mapped   uint64 `json:"mapped"`
+		Unmapped uint64 `json:"unmapped"`
+	}
+	var body struct {
+		Stats *struct {
+			References   []reference `json:"references"`
+			Mapped       uint64      `json:"mapped"`
+			Unmapped     uint64      `json:"unmapped"`
+			NoCoordinate *uint64     `json:"noCoordinate"`
+		} `json:"indexStats"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if body.Stats == nil {
+		t.Fatal("Response does not contain index stats")
+	}
+
+	stats := body.Stats
+	if got, want := len(stats.References), 86; got != want {
+		t.Fatalf("Wrong number of references: got %d, want %d", got, want)
+	}
+	if got, want := stats.References[19], (reference{"20", 63025520, 487, 3}); got != want {
+		t.Errorf("Wrong stats for reference 20: got %+v, want %+v", got, want)
+	}
+	if stats.Mapped != 487 || stats.Unmapped != 3 {
+		t.Errorf("Wrong totals: got %d mapped and %d unmapped, want 487 and 3", stats.Mapped, stats.Unmapped)
+	}
+	if stats.NoCoordinate == nil || *stats.NoCoordinate != 0 {
+		t.Errorf("Wrong unplaced count: got %v, want 0", stats.NoCoordinate)
+	}
+}
+
+func TestDensity(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	testCases := []struct {
+		query   string
+		status  int
+		windows int
+	}{
+		{"referenceName=20", http.StatusOK, 64},
+		{"referenceName=chr20&window=10000000", http.StatusOK, 7},
+		{"referenceName=20&window=100", http.StatusBadRequest, 0},
+		{"referenceName=20&window=x", http.StatusBadRequest, 0},
+		{"", http.StatusBadRequest, 0},
+		{"referenceName=missing", http.StatusNotFound, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			resp := testQuery(ctx, t, "/density/testdata/NA12878.chr20.sample.bam?"+tc.query)
+			if got := resp.StatusCode; got != tc.status {
+				t.Fatalf("Wrong status code: got %d, want %d", got, tc.status)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Density struct {
+					ReferenceName string `json:"referenceName"`
+					Windows       []struct {
+						Chunks int `json:"chunks"`
+					} `json:"windows"`
+				} `json:"density"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if got, want := body.Density.ReferenceName, "20"; got != want {
+				t.Errorf("Wrong reference name: got %q, want %q", got, want)
+			}
+			if got := len(body.Density.Windows); got != tc.windows {
+				t.Errorf("Wrong number of windows: got %d, want %d", got, tc.windows)
+			}
+		})
+	}
+}
+
+func TestCount(t *testing.T) {
 	fakeClient := &http.Client{Transport: &fakeGCS{t}}
 	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
-	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam")
+
+	testCases := []struct {
+		query   string
+		status  int
+		method  string
+		records uint64
+	}{
+		{"referenceName=20", http.StatusOK, "index", 487},
+		{"referenceName=20&start=10000000&end=11000000", http.StatusOK, "index", 21},
+		{"referenceName=20&start=10000000&end=11000000&sample=2", http.StatusOK, "sample", 14},
+		{"referenceName=20&sample=0", http.StatusBadRequest, "", 0},
+		{"referenceName=20&sample=17", http.StatusBadRequest, "", 0},
+		{"referenceName=20&start=2&end=1", http.StatusBadRequest, "", 0},
+		{"start=1", http.StatusBadRequest, "", 0},
+		{"referenceName=missing", http.StatusBadRequest, "", 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			resp := testQuery(ctx, t, "/count/testdata/NA12878.chr20.sample.bam?"+tc.query)
+			if got := resp.StatusCode; got != tc.status {
+				t.Fatalf("Wrong status code: got %d, want %d", got, tc.status)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Count struct {
+					Method  string `json:"method"`
+					Records uint64 `json:"records"`
+				} `json:"count"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if got, want := body.Count.Method, tc.method; got != want {
+				t.Errorf("Wrong method: got %q, want %q", got, want)
+			}
+			if got, want := body.Count.Records, tc.records; got != want {
+				t.Errorf("Wrong number of records: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestAdvertisedURL(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam", func(server *Server) {
+		server.SetAdvertisedURL("https://example.com/htsget/")
+	})
 
 	if got, want := resp.StatusCode, http.StatusOK; got != want {
-		t.Errorf("Wrong status code: got %v, want %v", got, want)
+		t.Fatalf("Wrong status code: got %v, want %v", got, want)
 	}
 
 	var body struct {
-		URLs []struct {
-			URL string `json:"url"`
-		} `json:"urls"`
+		Container struct {
+			URLs []struct {
+				URL string `json:"url"`
+			} `json:"urls"`
+		} `json:"htsget"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
 		t.Fatalf("Failed to decode response: %v", err)
 	}
 
-	for _, url := range body.URLs {
+	const prefix = "https://example.com/htsget/block/testdata/NA12878.chr20.sample.bam?"
+	for _, url := range body.Container.URLs {
 		if url.URL == eofMarkerDataURL {
 			continue
 		}
+		if !strings.HasPrefix(url.URL, prefix) {
+			t.Errorf("Wrong block URL: got %q, want prefix %q", url.URL, prefix)
+		}
+	}
+}
 
-		resp := testQuery(ctx, t, url.URL)
-		if got, want := resp.StatusCode, http.StatusOK; got != want {
-			t.Errorf("Wrong status code: got %v, want %v", got, want)
+func TestBasePath(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	withBasePath := func(server *Server) {
+		server.SetBasePath("/tenant/")
+		server.SetAdvertisedURL("https://example.com/htsget")
+	}
+
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam", withBasePath)
+	if got, want := resp.StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("Wrong status code without the base path: got %v, want %v", got, want)
+	}
+
+	resp = testQuery(ctx, t, "/tenant/reads/testdata/NA12878.chr20.sample.bam", withBasePath)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %v, want %v", got, want)
+	}
+
+	var body struct {
+		Container struct {
+			URLs []struct {
+				URL string `json:"url"`
+			} `json:"urls"`
+		} `json:"htsget"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	const prefix = "https://example.com/htsget/tenant/block/testdata/NA12878.chr20.sample.bam?"
+	for _, url := range body.Container.URLs {
+		if url.URL == eofMarkerDataURL {
 			continue
 		}
-		length, err := io.Copy(ioutil.Discard, resp.Body)
-		if err != nil {
-			t.Errorf("Failed to read response body: %v", err)
+		if !strings.HasPrefix(url.URL, prefix) {
+			t.Errorf("Wrong block URL: got %q, want prefix %q", url.URL, prefix)
 			continue
 		}
-		if got, want := length, int64(testBlockSizeLimit); got > want {
-			t.Errorf("Data block too large: got %v, want at most %v", got, want)
+		block := strings.TrimPrefix(url.URL, "https://example.com/htsget")
+		if resp := testQuery(ctx, t, block, withBasePath); resp.StatusCode != http.StatusOK {
+			t.Errorf("Wrong status code for block %q: got %v, want %v", block, resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+// countingReader counts the reads from r.
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.r.Read(p)
+}
+
+// failingWriter is a ResponseWriter for a client that disconnects after the
+// first write.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.writes++; w.writes > 1 {
+		return 0, errors.New("connection reset by peer")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestWriteBlockClientAbort(t *testing.T) {
+	const size = 1 << 20
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testCases := []struct {
+		name  string
+		ctx   context.Context
+		w     http.ResponseWriter
+		ok    bool
+		reads int
+	}{
+		{"complete", context.Background(), httptest.NewRecorder(), true, -1},
+		{"cancelled", cancelled, httptest.NewRecorder(), false, 0},
+		{"write error", context.Background(), &failingWriter{ResponseRecorder: httptest.NewRecorder()}, false, 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/block/bucket/object", nil).WithContext(tc.ctx)
+			r := &countingReader{r: bytes.NewReader(make([]byte, size))}
+			if got := NewServer(nil, 0).writeBlock(tc.w, req, r, size); got != tc.ok {
+				t.Errorf("Wrong result: got %v, want %v", got, tc.ok)
+			}
+			if tc.reads >= 0 && r.reads != tc.reads {
+				t.Errorf("Wrong number of reads: got %d, want %d", r.reads, tc.reads)
+			}
+		})
+	}
+}
+
+func TestWriteBlockStreamBuffer(t *testing.T) {
+	const size = 1 << 20
+	server := NewServer(nil, 0)
+	server.SetStreamBufferSize(2 * readAheadChunkSize)
+	req := httptest.NewRequest("GET", "/block/bucket/object", nil)
+
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	w := httptest.NewRecorder()
+	if !server.writeBlock(w, req, bytes.NewReader(data), size) {
+		t.Errorf("Failed to write block")
+	}
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("Wrong block data: got %d bytes, want %d", w.Body.Len(), size)
+	}
+
+	// A client that stops reading leaves at most the buffer read from storage.
+	r := &countingReader{r: bytes.NewReader(data)}
+	if server.writeBlock(&failingWriter{ResponseRecorder: httptest.NewRecorder()}, req, r, size) {
+		t.Errorf("Writing to a disconnected client succeeded")
+	}
+	if r.reads > 4 {
+		t.Errorf("Read too far ahead of the client: got %d reads", r.reads)
+	}
+}
+
+func TestConditionalBlockRequests(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam")
+
+	var body struct {
+		Container struct {
+			URLs []struct {
+				URL string `json:"url"`
+			} `json:"urls"`
+		} `json:"htsget"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(body.Container.URLs) < 2 {
+		t.Fatalf("Ticket does not contain any block URLs")
+	}
+	block := body.Container.URLs[0].URL
+
+	resp = testQuery(ctx, t, block)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %v, want %v", got, want)
+	}
+	etag, modified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag == "" || modified == "" {
+		t.Fatalf("Missing validators: ETag %q, Last-Modified %q", etag, modified)
+	}
+
+	testCases := []struct {
+		name, header, value string
+		status              int
+	}{
+		{"matching etag", "If-None-Match", etag, http.StatusNotModified},
+		{"matching etag in list", "If-None-Match", `"other", ` + etag, http.StatusNotModified},
+		{"wildcard etag", "If-None-Match", "*", http.StatusNotModified},
+		{"different etag", "If-None-Match", `"other"`, http.StatusOK},
+		{"not modified since", "If-Modified-Since", modified, http.StatusNotModified},
+		{"modified since", "If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", block, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set(tc.header, tc.value)
+
+			resp := testRequest(ctx, t, req)
+			if got, want := resp.StatusCode, tc.status; got != want {
+				t.Errorf("Wrong status code: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestBucketBlockSizeLimit(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	count := func(configure ...func(*Server)) int {
+		resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam", configure...)
+		var body struct {
+			Container struct {
+				URLs []interface{} `json:"urls"`
+			} `json:"htsget"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return len(body.Container.URLs)
+	}
+
+	defaultCount := count()
+	if got := count(func(server *Server) {
+		server.SetBucketBlockSizeLimit("otherbucket", 1024*1024*1024)
+	}); got != defaultCount {
+		t.Errorf("Limit for another bucket changed the ticket: got %d URLs, want %d", got, defaultCount)
+	}
+	if got := count(func(server *Server) {
+		server.SetBucketBlockSizeLimit("testdata", 1024*1024*1024)
+	}); got >= defaultCount {
+		t.Errorf("Larger limit did not reduce the number of URLs: got %d, want fewer than %d", got, defaultCount)
+	}
+}
+
+func TestBlockSizeLimitCeiling(t *testing.T) {
+	server := NewServer(nil, 4*MaxBlockSizeLimit)
+	req := httptest.NewRequest("GET", "/reads/bucket/object", nil)
+	if got, want := server.blockSizeLimitFor(req, "bucket"), uint64(MaxBlockSizeLimit); got != want {
+		t.Errorf("Wrong default limit: got %d, want %d", got, want)
+	}
+	server.SetBucketBlockSizeLimit("bucket", MaxBlockSizeLimit+1)
+	if got, want := server.blockSizeLimitFor(req, "bucket"), uint64(MaxBlockSizeLimit); got != want {
+		t.Errorf("Wrong bucket limit: got %d, want %d", got, want)
+	}
+	server.SetBucketBlockSizeLimit("bucket", 1024)
+	if got, want := server.blockSizeLimitFor(req, "bucket"), uint64(1024); got != want {
+		t.Errorf("Wrong bucket limit: got %d, want %d", got, want)
+	}
+}
+
+func TestMaxRegionSpan(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	limit := func(span uint32) func(*Server) {
+		return func(server *Server) { server.SetMaxRegionSpan(span) }
+	}
+	testCases := []struct {
+		name      string
+		query     string
+		configure []func(*Server)
+		want      int
+	}{
+		{"no limit", "referenceName=20", nil, http.StatusOK},
+		{"within limit", "referenceName=20&start=1000&end=2000", []func(*Server){limit(1000)}, http.StatusOK},
+		{"exceeds limit", "referenceName=20&start=1000&end=2001", []func(*Server){limit(1000)}, http.StatusBadRequest},
+		{"whole reference", "referenceName=20", []func(*Server){limit(1000)}, http.StatusBadRequest},
+		{"open ended near end of reference", "referenceName=20&start=63025000", []func(*Server){limit(1000)}, http.StatusOK},
+		{"whole readset", "", []func(*Server){limit(1000)}, http.StatusBadRequest},
+		{"unplaced reads", "referenceName=*", []func(*Server){limit(1000)}, http.StatusBadRequest},
+		{"bucket override", "referenceName=20", []func(*Server){limit(1000), func(server *Server) {
+			server.SetBucketMaxRegionSpan("testdata", 0)
+		}}, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?"+tc.query, tc.configure...)
+			if got := resp.StatusCode; got != tc.want {
+				t.Fatalf("Wrong status code: got %d, want %d", got, tc.want)
+			}
+			if tc.want == http.StatusOK {
+				return
+			}
+			var body ticket.ErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if got, want := body.Error.Name, "InvalidRange"; got != want {
+				t.Errorf("Wrong error: got %q, want %q", got, want)
+			}
+		})
+	}
+
+	// Each of these regions is within the limit, but together they are not.
+	post := func(contentType, body string) *http.Request {
+		req, err := http.NewRequest("POST", "/reads/testdata/NA12878.chr20.sample.bam", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
 		}
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+	expectError(t, "InvalidRange", http.StatusBadRequest, testRequest(ctx, t, post("application/json",
+		`{"regions": [{"referenceName": "20", "start": 1000, "end": 1600}, {"referenceName": "20", "start": 5000, "end": 5600}]}`), limit(1000)))
+	expectError(t, "InvalidRange", http.StatusBadRequest, testRequest(ctx, t, post("text/x-bed",
+		"20\t1000\t1600\n20\t5000\t5600\n"), limit(1000)))
+	if got, want := testRequest(ctx, t, post("application/json",
+		`{"regions": [{"referenceName": "20", "start": 1000, "end": 1500}, {"referenceName": "20", "start": 5000, "end": 5500}]}`), limit(1000)).StatusCode, http.StatusOK; got != want {
+		t.Errorf("Wrong status code for regions within the limit: got %d, want %d", got, want)
+	}
+}
+
+func TestChunkEndPastEOF(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	want, err := ioutil.ReadFile("testdata/NA12878.chr20.sample.bam")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+
+	chunk := bgzf.Chunk{End: bgzf.NewAddress(uint64(len(want))+1024, 16)}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(chunk); err != nil {
+		t.Fatalf("Failed to encode chunk: %v", err)
+	}
+	url := "/block/testdata/NA12878.chr20.sample.bam?" + base64.URLEncoding.EncodeToString(buf.Bytes())
+
+	resp := testQuery(ctx, t, url)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %v, want %v", got, want)
+	}
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response body: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Wrong response body: got %d bytes, want %d bytes", len(got), len(want))
+	}
+	if got, want := resp.ContentLength, int64(len(want)); got != want {
+		t.Errorf("Wrong Content-Length: got %v, want %v", got, want)
 	}
 }
 
@@ -126,13 +1413,50 @@ func TestNoIndexFiles(t *testing.T) {
 	fakeClient := &http.Client{Transport: &fakeGCS{t}}
 	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
 
-	resp := testQuery(ctx, t, "/reads/testdata/noindex.sample.bam")
+	resp := testQuery(ctx, t, "/reads/testdata/noindex.sample.bam?referenceName=20")
 
 	if resp.StatusCode == http.StatusOK {
 		t.Error("Read succeeded with missing index file")
 	}
 }
 
+func TestWholeReadset(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	want, err := ioutil.ReadFile("testdata/NA12878.chr20.sample.bam")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		url       string
+		configure []func(*Server)
+	}{
+		{"indexed", "/reads/testdata/NA12878.chr20.sample.bam", nil},
+		// The index is not needed to copy the whole object.
+		{"without index", "/reads/testdata/noindex.sample.bam", nil},
+		{"no block size limit", "/reads/testdata/NA12878.chr20.sample.bam", []func(*Server){func(server *Server) {
+			server.SetBucketBlockSizeLimit("testdata", 0)
+		}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _ := fetchTicketData(ctx, t, tc.url, tc.configure...)
+			if !bytes.Equal(got, want) {
+				t.Errorf("Wrong data: got %d bytes, want the %d bytes of the object", len(got), len(want))
+			}
+		})
+	}
+
+	// Filtered requests still select chunks from the index.
+	data, _ := fetchTicketData(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?excludeFlags=0x400")
+	if bytes.Equal(data, want) {
+		t.Errorf("Filtered request returned the object unchanged")
+	}
+}
+
 // This test ensures that the undocumented error handling behaviour of the GCS
 // storage client does not change.
 func TestGoogleAPIInternalErrors(t *testing.T) {
@@ -163,11 +1487,97 @@ var (
 	testHTTPClientKey = testContextKey(0)
 )
 
-func testQuery(ctx context.Context, t *testing.T, url string) *http.Response {
+// fetchTicketData requests the ticket for url and returns the data it
+// describes along with the number of URLs that were served inline.
+func fetchTicketData(ctx context.Context, t *testing.T, url string, configure ...func(*Server)) ([]byte, int) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("Failed to parse URL %q: %v", url, err)
+	}
+	return fetchRequestData(ctx, t, req, configure...)
+}
+
+// fetchRequestData is like fetchTicketData but sends req to get the ticket.
+func fetchRequestData(ctx context.Context, t *testing.T, req *http.Request, configure ...func(*Server)) ([]byte, int) {
+	resp := testRequest(ctx, t, req, configure...)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %v, want %v", got, want)
+	}
+	var body struct {
+		Htsget struct {
+			URLs []struct {
+				URL string `json:"url"`
+			} `json:"urls"`
+		} `json:"htsget"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	var (
+		data   []byte
+		inline int
+	)
+	for _, url := range body.Htsget.URLs {
+		if strings.HasPrefix(url.URL, "data:") {
+			if url.URL != eofMarkerDataURL {
+				inline++
+			}
+			decoded, err := base64.StdEncoding.DecodeString(url.URL[strings.Index(url.URL, ",")+1:])
+			if err != nil {
+				t.Fatalf("Failed to decode data URL: %v", err)
+			}
+			data = append(data, decoded...)
+			continue
+		}
+		resp := testQuery(ctx, t, url.URL)
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("Wrong block status code: got %v, want %v", got, want)
+		}
+		block, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read block: %v", err)
+		}
+		data = append(data, block...)
+	}
+	return data, inline
+}
+
+// bamRecords returns the records in data, a BAM file, excluding their block
+// sizes.
+func bamRecords(t *testing.T, data []byte) [][]byte {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to open data: %v", err)
+	}
+	if err := bam.SkipHeader(r); err != nil {
+		t.Fatalf("Failed to skip header: %v", err)
+	}
+	var records [][]byte
+	for {
+		var size int32
+		if err := binary.Read(r, binary.LittleEndian, &size); err == io.EOF {
+			return records
+		} else if err != nil {
+			t.Fatalf("Failed to read record size: %v", err)
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(r, record); err != nil {
+			t.Fatalf("Failed to read record: %v", err)
+		}
+		records = append(records, record)
+	}
+}
+
+func testQuery(ctx context.Context, t *testing.T, url string, configure ...func(*Server)) *http.Response {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		t.Fatalf("Failed to parse URL %q: %v", url, err)
 	}
+	return testRequest(ctx, t, req, configure...)
+}
+
+func testRequest(ctx context.Context, t *testing.T, req *http.Request, configure ...func(*Server)) *http.Response {
 	req = req.WithContext(ctx)
 
 	client, ok := ctx.Value(testHTTPClientKey).(*http.Client)
@@ -185,6 +1595,9 @@ func testQuery(ctx context.Context, t *testing.T, url string) *http.Response {
 
 	mux := http.NewServeMux()
 	server := NewServer(newStorageClient, testBlockSizeLimit)
+	for _, f := range configure {
+		f(server)
+	}
 	server.Export(mux)
 
 	w := httptest.NewRecorder()
@@ -197,11 +1610,14 @@ func expectError(t *testing.T, name string, code int, resp *http.Response) {
 	if got, want := resp.StatusCode, code; got != want {
 		t.Errorf("Wrong status code: got %v, want %v", got, want)
 	}
-	body := make(map[string]interface{})
+	var body ticket.ErrorResponse
 	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
 		t.Errorf("Failed to parse response: %v", err)
 	}
-	if got, want := body["error"], name; got != want {
+	if body.Error == nil {
+		t.Fatalf("Error object is not wrapped in an htsget object")
+	}
+	if got, want := body.Error.Name, name; got != want {
 		t.Errorf("Wrong 'error' field value: got %v, want %v", got, want)
 	}
 }
@@ -216,11 +1632,38 @@ func (code fixedStatus) RoundTrip(*http.Request) (*http.Response, error) {
 	}, nil
 }
 
+// fakeObjectTime is the time that fakeGCS reports every object as last
+// updated, so that no index is older than its data.
+var fakeObjectTime = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
 type fakeGCS struct {
 	*testing.T
 }
 
 func (fake *fakeGCS) RoundTrip(req *http.Request) (*http.Response, error) {
+	return serveTestData(req, 1, fakeObjectTime)
+}
+
+// versionedGCS is like fakeGCS, but reports the generation and update time
+// that it returns for the name of each object.
+type versionedGCS func(name string) (int64, time.Time)
+
+func (versions versionedGCS) RoundTrip(req *http.Request) (*http.Response, error) {
+	generation, updated := versions(path.Base(req.URL.Path))
+	return serveTestData(req, generation, updated)
+}
+
+// isMetadataRequest reports whether req reads the attributes of an object
+// rather than its data.
+func isMetadataRequest(req *http.Request) bool {
+	return strings.Contains(req.URL.Path, "/storage/v1/b/") && req.URL.Query().Get("alt") != "media"
+}
+
+// serveTestData answers req from the test data file named by the last element
+// of its path, as an object with the given generation and update time.
+// Attributes are read from the JSON API and data from the download path (or
+// the JSON API with alt=media).
+func serveTestData(req *http.Request, generation int64, updated time.Time) (*http.Response, error) {
 	filename := "testdata/" + path.Base(req.URL.Path)
 
 	content, err := os.Open(filename)
@@ -231,7 +1674,77 @@ func (fake *fakeGCS) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 	defer content.Close()
 
+	info, err := content.Stat()
+	if err != nil {
+		return nil, err
+	}
+
 	w := httptest.NewRecorder()
-	http.ServeContent(w, req, filename, time.Now(), content)
+	if isMetadataRequest(req) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]string{
+			"name":           path.Base(req.URL.Path),
+			"size":           strconv.FormatInt(info.Size(), 10),
+			"generation":     strconv.FormatInt(generation, 10),
+			"metageneration": "1",
+			"updated":        updated.UTC().Format(time.RFC3339Nano),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return w.Result(), nil
+	}
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(generation, 10))
+	http.ServeContent(w, req, filename, updated, content)
 	return w.Result(), nil
 }
+
+func TestReadiness(t *testing.T) {
+	client := &http.Client{Transport: bucketStatus{"denied": http.StatusForbidden, "missing": http.StatusNotFound}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, client)
+	gcs, err := storage.NewClient(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		t.Fatalf("Failed to create storage client: %v", err)
+	}
+	readyClient := func(*http.Request) (*storage.Client, http.Header, error) {
+		return gcs, nil, nil
+	}
+
+	testCases := []struct {
+		name    string
+		buckets []string
+		check   bool
+		status  int
+	}{
+		{"no check", []string{"denied"}, false, http.StatusOK},
+		{"no whitelist", nil, true, http.StatusOK},
+		{"accessible buckets", []string{"a", "b"}, true, http.StatusOK},
+		{"forbidden bucket", []string{"a", "denied"}, true, http.StatusServiceUnavailable},
+		{"missing bucket", []string{"missing"}, true, http.StatusServiceUnavailable},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := testQuery(ctx, t, readyPath, func(server *Server) {
+				server.Whitelist(tc.buckets)
+				if tc.check {
+					server.CheckBucketsWhenReady(readyClient)
+				}
+			})
+			if got, want := resp.StatusCode, tc.status; got != want {
+				t.Errorf("Wrong status code: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// bucketStatus responds to bucket metadata requests with the status code
+// configured for the bucket, or 200 OK.
+type bucketStatus map[string]int
+
+func (status bucketStatus) RoundTrip(req *http.Request) (*http.Response, error) {
+	code, ok := status[path.Base(req.URL.Path)]
+	if !ok {
+		code = http.StatusOK
+	}
+	return fixedStatus(code).RoundTrip(req)
+}
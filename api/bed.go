@@ -0,0 +1,199 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// bedContentType is the media type of POST reads request bodies that are
+	// BED files rather than JSON.
+	bedContentType = "text/x-bed"
+
+	// bedParameter names a BED file in GCS (as gs://bucket/object) that lists
+	// the regions of a reads request.
+	bedParameter = "bed"
+
+	// BED files may be at most maximumBEDSize bytes and list at most
+	// maximumBEDRegions regions once overlapping intervals are merged.
+	maximumBEDSize    = 16 << 20
+	maximumBEDRegions = 10000
+)
+
+// bedInterval is a 0-based, end exclusive interval of a BED file.
+type bedInterval struct {
+	name       string
+	start, end uint32
+}
+
+// isBEDBody reports whether the body of req is a BED file.
+func isBEDBody(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == bedContentType
+}
+
+// parseBED returns the intervals listed in the BED file in r.  Only the first
+// three columns are used.  Blank lines, comments and track and browser lines
+// are skipped.
+func parseBED(r io.Reader) ([]bedInterval, error) {
+	var intervals []bedInterval
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "track") || strings.HasPrefix(text, "browser") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected reference, start and end", line)
+		}
+		start, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: parsing start: %v", line, err)
+		}
+		end, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: parsing end: %v", line, err)
+		}
+		if start > end {
+			return nil, fmt.Errorf("line %d: start > end", line)
+		}
+		intervals = append(intervals, bedInterval{fields[0], uint32(start), uint32(end)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading BED file: %v", err)
+	}
+	if len(intervals) == 0 {
+		return nil, errors.New("BED file lists no intervals")
+	}
+	return intervals, nil
+}
+
+// mergeBED sorts intervals by reference name and start, and merges those that
+// overlap or touch.
+func mergeBED(intervals []bedInterval) []bedInterval {
+	sorted := append([]bedInterval(nil), intervals...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].name != sorted[j].name {
+			return sorted[i].name < sorted[j].name
+		}
+		return sorted[i].start < sorted[j].start
+	})
+
+	var merged []bedInterval
+	for _, interval := range sorted {
+		if n := len(merged); n > 0 && merged[n-1].name == interval.name && interval.start <= merged[n-1].end {
+			if interval.end > merged[n-1].end {
+				merged[n-1].end = interval.end
+			}
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
+
+// bedRegionQueries returns one region query for each of the merged intervals
+// of the BED file in r.
+func bedRegionQueries(r io.Reader) ([]url.Values, error) {
+	intervals, err := parseBED(r)
+	if err != nil {
+		return nil, err
+	}
+	merged := mergeBED(intervals)
+	if len(merged) > maximumBEDRegions {
+		return nil, fmt.Errorf("too many regions (%d > %d)", len(merged), maximumBEDRegions)
+	}
+	regions := make([]url.Values, len(merged))
+	for i, interval := range merged {
+		regions[i] = url.Values{
+			"referenceName": {interval.name},
+			"start":         {strconv.FormatUint(uint64(interval.start), 10)},
+			"end":           {strconv.FormatUint(uint64(interval.end), 10)},
+		}
+	}
+	return regions, nil
+}
+
+// parseBEDPath returns the bucket and object named by path, which must have
+// the form gs://bucket/object.
+func parseBEDPath(path string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "gs://"), "/", 2)
+	if !strings.HasPrefix(path, "gs://") || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%q is not of the form gs://bucket/object", path)
+	}
+	return parts[0], parts[1], nil
+}
+
+// readBEDObject returns the region queries for the BED file in object.
+func readBEDObject(ctx context.Context, breaker *circuitBreaker, object *storage.ObjectHandle) ([]url.Values, error) {
+	r, err := newRangeReader(ctx, breaker, object, 0, maximumBEDSize+1)
+	if err != nil {
+		return nil, newStorageError("opening BED file", err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, newStorageError("reading BED file", err)
+	}
+	if len(data) > maximumBEDSize {
+		return nil, newInvalidInputError("reading BED file", fmt.Errorf("file is larger than %d bytes", maximumBEDSize))
+	}
+	regions, err := bedRegionQueries(bytes.NewReader(data))
+	if err != nil {
+		return nil, newInvalidInputError("parsing BED file", err)
+	}
+	return regions, nil
+}
+
+// readBEDRegions returns the region queries for the BED file at path, which
+// replace regionQueries.  The BED file must be readable by the client, like
+// the readset itself.
+func (server *Server) readBEDRegions(ctx context.Context, gcs *storage.Client, path string, regionQueries []url.Values) ([]url.Values, error) {
+	for _, query := range regionQueries {
+		for _, name := range []string{"referenceName", "start", "end"} {
+			if query.Get(name) != "" {
+				return nil, newInvalidInputError("parsing bed", fmt.Errorf("%s may not be used with bed", name))
+			}
+		}
+	}
+	bucket, object, err := parseBEDPath(path)
+	if err != nil {
+		return nil, newInvalidInputError("parsing bed", err)
+	}
+	if err := server.checkWhitelist(bucket); err != nil {
+		return nil, newPermissionDeniedError("checking whitelist", err)
+	}
+	if err := server.checkIdentity(ctx, bucket); err != nil {
+		return nil, newPermissionDeniedError("checking permissions", err)
+	}
+	return readBEDObject(ctx, server.breaker, gcs.Bucket(bucket).Object(object))
+}
@@ -0,0 +1,193 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBED(t *testing.T) {
+	bed := "track name=panel\n# comment\n\nchr1\t100\t200\tgene1\nchr2 0 50\n"
+	got, err := parseBED(strings.NewReader(bed))
+	if err != nil {
+		t.Fatalf("Failed to parse BED file: %v", err)
+	}
+	want := []bedInterval{{"chr1", 100, 200}, {"chr2", 0, 50}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong intervals: got %v, want %v", got, want)
+	}
+}
+
+func TestParseBED_InvalidInputs(t *testing.T) {
+	testCases := []struct {
+		name string
+		bed  string
+	}{
+		{"empty", ""},
+		{"comments only", "# nothing\n"},
+		{"missing end", "chr1\t100\n"},
+		{"negative start", "chr1\t-1\t100\n"},
+		{"non-numeric end", "chr1\t100\tend\n"},
+		{"start after end", "chr1\t200\t100\n"},
+		{"too large", "chr1\t0\t4294967296\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, err := parseBED(strings.NewReader(tc.bed)); err == nil {
+				t.Errorf("Expected an error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestMergeBED(t *testing.T) {
+	testCases := []struct {
+		name      string
+		intervals []bedInterval
+		want      []bedInterval
+	}{
+		{"disjoint", []bedInterval{{"1", 0, 10}, {"1", 20, 30}}, []bedInterval{{"1", 0, 10}, {"1", 20, 30}}},
+		{"unsorted", []bedInterval{{"2", 0, 10}, {"1", 20, 30}, {"1", 0, 10}}, []bedInterval{{"1", 0, 10}, {"1", 20, 30}, {"2", 0, 10}}},
+		{"overlapping", []bedInterval{{"1", 0, 15}, {"1", 10, 30}}, []bedInterval{{"1", 0, 30}}},
+		{"adjacent", []bedInterval{{"1", 0, 10}, {"1", 10, 20}}, []bedInterval{{"1", 0, 20}}},
+		{"contained", []bedInterval{{"1", 0, 100}, {"1", 10, 20}}, []bedInterval{{"1", 0, 100}}},
+		{"other reference", []bedInterval{{"1", 0, 10}, {"2", 5, 20}}, []bedInterval{{"1", 0, 10}, {"2", 5, 20}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := mergeBED(tc.intervals); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Wrong intervals: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseBEDPath(t *testing.T) {
+	testCases := []struct {
+		path           string
+		bucket, object string
+		ok             bool
+	}{
+		{"gs://bucket/panels/exome.bed", "bucket", "panels/exome.bed", true},
+		{"gs://bucket/", "", "", false},
+		{"gs:///exome.bed", "", "", false},
+		{"bucket/exome.bed", "", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			bucket, object, err := parseBEDPath(tc.path)
+			if !tc.ok {
+				if err == nil {
+					t.Errorf("Expected an error, got %q and %q", bucket, object)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse path: %v", err)
+			}
+			if bucket != tc.bucket || object != tc.object {
+				t.Errorf("Wrong object: got %q and %q, want %q and %q", bucket, object, tc.bucket, tc.object)
+			}
+		})
+	}
+}
+
+func TestBEDReads(t *testing.T) {
+	const (
+		url = "/reads/testdata/NA12878.chr20.sample.bam"
+		bed = "track name=panel\n20\t10000000\t10060000\n20\t10050000\t10100000\n"
+	)
+	// The BED file is served as gs://panels/panel.bed.
+	fake := &fakeGCS{t}
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if !strings.HasSuffix(req.URL.Path, "/panel.bed") {
+			return fake.RoundTrip(req)
+		}
+		w := httptest.NewRecorder()
+		w.WriteString(bed)
+		return w.Result(), nil
+	})}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, client)
+
+	post := func(url, contentType, body string) *http.Request {
+		req, err := http.NewRequest("POST", url, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+
+	want, _ := fetchTicketData(ctx, t, url+"?referenceName=20&start=10000000&end=10100000")
+	testCases := []struct {
+		name string
+		req  *http.Request
+	}{
+		{"BED body", post(url, "text/x-bed", bed)},
+		{"BED body with parameters", post(url, "text/x-bed; charset=utf-8", bed)},
+		{"JSON bed path", post(url, "application/json", `{"format": "BAM", "bed": "gs://panels/panel.bed"}`)},
+		{"query bed path", post(url+"?bed=gs://panels/panel.bed", "application/json", `{}`)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _ := fetchRequestData(ctx, t, tc.req)
+			if !bytes.Equal(got, want) {
+				t.Errorf("Wrong data: got %d bytes, want %d bytes", len(got), len(want))
+			}
+		})
+	}
+
+	errorCases := []struct {
+		name string
+		req  *http.Request
+		code int
+	}{
+		{"malformed BED body", post(url, "text/x-bed", "20\t100\n"), http.StatusBadRequest},
+		{"BED body with class=header", post(url+"?class=header", "text/x-bed", bed), http.StatusBadRequest},
+		{"bed with regions", post(url, "application/json", `{"bed": "gs://panels/panel.bed", "regions": [{"referenceName": "20"}]}`), http.StatusBadRequest},
+		{"bed with class=header", post(url, "application/json", `{"class": "header", "bed": "gs://panels/panel.bed"}`), http.StatusBadRequest},
+		{"malformed bed path", post(url, "application/json", `{"bed": "panel.bed"}`), http.StatusBadRequest},
+		{"missing BED file", post(url, "application/json", `{"bed": "gs://panels/missing.bed"}`), http.StatusNotFound},
+	}
+	for _, tc := range errorCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := testRequest(ctx, t, tc.req)
+			if got, want := resp.StatusCode, tc.code; got != want {
+				t.Errorf("Wrong status code: got %d, want %d", got, want)
+			}
+		})
+	}
+
+	t.Run("whitelist", func(t *testing.T) {
+		resp := testRequest(ctx, t, post(url, "application/json", `{"bed": "gs://panels/panel.bed"}`), func(server *Server) {
+			server.Whitelist([]string{"testdata"})
+		})
+		expectError(t, "PermissionDenied", http.StatusForbidden, resp)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		resp := testRequest(ctx, t, post(url, "text/x-bed", bed), func(server *Server) {
+			server.SetStrict(true)
+			server.SetAdvertisedURL("https://example.com")
+		})
+		expectError(t, "InvalidInput", http.StatusBadRequest, resp)
+	})
+}
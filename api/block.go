@@ -17,102 +17,240 @@ package api
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 
 	"cloud.google.com/go/storage"
+	"github.com/googlegenomics/htsget/internal/bam"
 	"github.com/googlegenomics/htsget/internal/bgzf"
+	"google.golang.org/api/googleapi"
 )
 
+// errPastEOF is returned when a block lies beyond the end of the object.  Some
+// tools write index files whose last chunk ends past the physical end of the
+// data, so this is not treated as a failure.
+var errPastEOF = errors.New("block starts past end of object")
+
+// blockQuery is the chunk encoded in the query of a block URL.  Raw chunks
+// hold plain byte offsets into an object that is not BGZF compressed, and are
+// served as they are.  Records that do not pass Filter are removed from the
+// chunk, and Inflate sends the chunk without BGZF compression.  Since gob
+// matches fields by name, queries encoded from a bgzf.Chunk decode as
+// unfiltered, compressed chunks that are not raw.
+type blockQuery struct {
+	Start, End bgzf.Address
+	Raw        bool
+	Filter     bam.Filter
+	Inflate    bool
+}
+
 type blockRequest struct {
-	object *storage.ObjectHandle
-	chunk  bgzf.Chunk
+	object  *storage.ObjectHandle
+	chunk   bgzf.Chunk
+	raw     bool
+	filter  bam.Filter
+	breaker *circuitBreaker
 }
 
-func (req *blockRequest) handle(ctx context.Context) (io.ReadCloser, error) {
+// handle returns a reader for the re-encoded chunk along with the exact number
+// of bytes that it will produce, or -1 if that is not known in advance.
+func (req *blockRequest) handle(ctx context.Context) (io.ReadCloser, int64, error) {
+	if req.raw {
+		return req.handleRaw(ctx)
+	}
+	if !req.filter.IsZero() {
+		return req.handleFiltered(ctx)
+	}
+
 	start, end := req.chunk.Start, req.chunk.End
 	head, tail := int64(start.BlockOffset()), int64(end.BlockOffset())
 
 	// The simple (unlikely) case is when the chunk resides in a single block.
 	if head == tail {
-		block, err := req.object.NewRangeReader(ctx, head, bgzf.MaximumBlockSize)
-		if err != nil {
-			return nil, newStorageError("opening block", err)
+		decoded, _, err := req.readBlock(ctx, head)
+		if err == errPastEOF {
+			return ioutil.NopCloser(bytes.NewReader(nil)), 0, nil
 		}
-		defer block.Close()
-
-		decoded, _, err := bgzf.DecodeBlock(block)
 		if err != nil {
-			return nil, fmt.Errorf("decoding block: %v", err)
+			return nil, 0, err
 		}
-		decoded = decoded[start.DataOffset():end.DataOffset()]
+		decoded = decoded[start.DataOffset():clamp(end.DataOffset(), len(decoded))]
 
 		encoded, err := bgzf.EncodeBlock(decoded)
 		if err != nil {
-			return nil, fmt.Errorf("encoding prefix: %v", err)
+			return nil, 0, fmt.Errorf("encoding prefix: %v", err)
 		}
-		return ioutil.NopCloser(bytes.NewReader(encoded)), nil
+		return ioutil.NopCloser(bytes.NewReader(encoded)), int64(len(encoded)), nil
 	}
 
 	var readers []io.Reader
 	var closers []io.Closer
+	var size int64
 
 	// Read the first block and reconstruct a prefix block.
 	if start.DataOffset() != 0 {
-		first, err := req.object.NewRangeReader(ctx, head, bgzf.MaximumBlockSize)
-		if err != nil {
-			return nil, newStorageError("opening first block", err)
+		decoded, length, err := req.readBlock(ctx, head)
+		if err == errPastEOF {
+			return ioutil.NopCloser(bytes.NewReader(nil)), 0, nil
 		}
-		defer first.Close()
-
-		decoded, length, err := bgzf.DecodeBlock(first)
 		if err != nil {
-			return nil, fmt.Errorf("decoding first block: %v", err)
+			return nil, 0, err
 		}
 
 		head += int64(length)
 
 		encoded, err := bgzf.EncodeBlock(decoded[start.DataOffset():])
 		if err != nil {
-			return nil, fmt.Errorf("encoding prefix: %v", err)
+			return nil, 0, fmt.Errorf("encoding prefix: %v", err)
 		}
 		readers = append(readers, ioutil.NopCloser(bytes.NewReader(encoded)))
+		size += int64(len(encoded))
 	}
 
-	// Read any intermediate blocks (no modification needed).
+	// Read any intermediate blocks (no modification needed).  If the chunk
+	// extends past the end of the object, the storage service returns only the
+	// bytes that exist.
 	if tail-head > 0 {
-		r, err := req.object.NewRangeReader(ctx, head, tail-head)
-		if err != nil {
-			return nil, newStorageError("opening body block", err)
+		r, err := newRangeReader(ctx, req.breaker, req.object, head, tail-head)
+		switch {
+		case isRangeNotSatisfiable(err):
+			// The body lies entirely beyond the end of the object.
+		case err != nil:
+			return nil, 0, newStorageError("opening body block", err)
+		default:
+			readers = append(readers, r)
+			closers = append(closers, r)
+			length := tail - head
+			if object := r.Attrs.Size; object > 0 && tail > object {
+				length = object - head
+			}
+			size += length
 		}
-		readers = append(readers, r)
-		closers = append(closers, r)
 	}
 
 	// Read the last block and reconstruct a suffix block.
 	if end.DataOffset() != 0 {
-		last, err := req.object.NewRangeReader(ctx, tail, bgzf.MaximumBlockSize)
-		if err != nil {
-			return nil, newStorageError("opening last block", err)
+		decoded, _, err := req.readBlock(ctx, tail)
+		switch {
+		case err == errPastEOF:
+			// The chunk ends beyond the physical end of the object, so there is no
+			// suffix to send.
+		case err != nil:
+			closeAll(closers)
+			return nil, 0, err
+		default:
+			encoded, err := bgzf.EncodeBlock(decoded[:clamp(end.DataOffset(), len(decoded))])
+			if err != nil {
+				closeAll(closers)
+				return nil, 0, fmt.Errorf("encoding suffix: %v", err)
+			}
+			readers = append(readers, ioutil.NopCloser(bytes.NewReader(encoded)))
+			size += int64(len(encoded))
 		}
-		defer last.Close()
-
-		decoded, _, err := bgzf.DecodeBlock(last)
-		if err != nil {
-			return nil, fmt.Errorf("decoding last block: %v", err)
-		}
-		encoded, err := bgzf.EncodeBlock(decoded[:end.DataOffset()])
-		if err != nil {
-			return nil, fmt.Errorf("encoding suffix: %v", err)
-		}
-		readers = append(readers, ioutil.NopCloser(bytes.NewReader(encoded)))
 	}
 
 	return &multiReadCloser{
 		Reader:  io.MultiReader(readers...),
 		closers: closers,
-	}, nil
+	}, size, nil
+}
+
+// handleFiltered returns a reader for the records of the chunk that pass the
+// filter, re-encoded as BGZF blocks as they are read.  The size of the
+// filtered chunk is not known in advance, so it is reported as -1.
+func (req *blockRequest) handleFiltered(ctx context.Context) (io.ReadCloser, int64, error) {
+	unfiltered := *req
+	unfiltered.filter = bam.Filter{}
+	r, _, err := unfiltered.handle(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Closing the returned reader stops the filter at its next write.
+	pr, pw := io.Pipe()
+	go func() {
+		defer r.Close()
+		w := bgzf.NewWriter(pw)
+		if err := req.filter.Apply(w, bgzf.NewReader(r)); err != nil {
+			pw.CloseWithError(fmt.Errorf("filtering records: %v", err))
+			return
+		}
+		if err := w.Close(); err != nil {
+			pw.CloseWithError(fmt.Errorf("encoding records: %v", err))
+			return
+		}
+		pw.Close()
+	}()
+	return pr, -1, nil
+}
+
+// handleRaw returns a reader for the bytes of a raw chunk, which may be fewer
+// than requested if the chunk extends past the end of the object.
+func (req *blockRequest) handleRaw(ctx context.Context) (io.ReadCloser, int64, error) {
+	start, end := int64(req.chunk.Start), int64(req.chunk.End)
+	if end <= start {
+		return ioutil.NopCloser(bytes.NewReader(nil)), 0, nil
+	}
+	r, err := newRangeReader(ctx, req.breaker, req.object, start, end-start)
+	if isRangeNotSatisfiable(err) {
+		return ioutil.NopCloser(bytes.NewReader(nil)), 0, nil
+	}
+	if err != nil {
+		return nil, 0, newStorageError("opening data", err)
+	}
+	length := end - start
+	if object := r.Attrs.Size; object > 0 && end > object {
+		length = object - start
+	}
+	return r, length, nil
+}
+
+// readBlock reads and decodes the single BGZF block that starts at offset.  It
+// returns errPastEOF if offset is at or beyond the end of the object.
+func (req *blockRequest) readBlock(ctx context.Context, offset int64) ([]byte, uint16, error) {
+	r, err := newRangeReader(ctx, req.breaker, req.object, offset, bgzf.MaximumBlockSize)
+	if isRangeNotSatisfiable(err) {
+		return nil, 0, errPastEOF
+	}
+	if err != nil {
+		return nil, 0, newStorageError("opening block", err)
+	}
+	defer r.Close()
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading block: %v", err)
+	}
+	if len(raw) == 0 {
+		return nil, 0, errPastEOF
+	}
+
+	decoded, length, err := bgzf.DecodeBlock(bytes.NewReader(raw))
+	if err != nil {
+		return nil, 0, fmt.Errorf("decoding block: %v", err)
+	}
+	return decoded, length, nil
+}
+
+// isRangeNotSatisfiable reports whether err indicates that a range request
+// started beyond the end of an object.
+func isRangeNotSatisfiable(err error) bool {
+	if err, ok := err.(*googleapi.Error); ok {
+		return err.Code == http.StatusRequestedRangeNotSatisfiable
+	}
+	return false
+}
+
+// clamp returns offset, limited to at most n.
+func clamp(offset uint16, n int) int {
+	if int(offset) > n {
+		return n
+	}
+	return int(offset)
 }
 
 type multiReadCloser struct {
@@ -122,8 +260,12 @@ type multiReadCloser struct {
 }
 
 func (mrc *multiReadCloser) Close() error {
+	return closeAll(mrc.closers)
+}
+
+func closeAll(closers []io.Closer) error {
 	var errors []error
-	for _, closer := range mrc.closers {
+	for _, closer := range closers {
 		if err := closer.Close(); err != nil {
 			errors = append(errors, err)
 		}
@@ -133,3 +275,51 @@ func (mrc *multiReadCloser) Close() error {
 	}
 	return nil
 }
+
+// inlineChunk returns a data URL holding the re-encoded chunk of object, with
+// the records that do not pass filter removed, or an empty string if the chunk
+// would be larger than limit bytes.
+func inlineChunk(ctx context.Context, breaker *circuitBreaker, object *storage.ObjectHandle, chunk *bgzf.Chunk, filter bam.Filter, limit uint64) (string, error) {
+	if estimateSize(chunk) > limit {
+		return "", nil
+	}
+
+	req := &blockRequest{object: object, chunk: *chunk, filter: filter, breaker: breaker}
+	response, size, err := req.handle(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer response.Close()
+	if size >= 0 && uint64(size) > limit {
+		return "", nil
+	}
+
+	// Filtered chunks have no size until they have been read.
+	data, err := ioutil.ReadAll(io.LimitReader(response, int64(limit)+1))
+	if err != nil {
+		return "", fmt.Errorf("reading chunk: %v", err)
+	}
+	if uint64(len(data)) > limit {
+		return "", nil
+	}
+	return "data:;base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// minimalHeaderURL returns a data URL holding a BGZF encoded copy of header
+// that omits the @SQ lines for references after last.
+func minimalHeaderURL(header *bam.Header, last int32) (string, error) {
+	return headerDataURL(header.TrimReferenceLines(last))
+}
+
+// headerDataURL returns a data URL holding a BGZF encoded copy of header.
+func headerDataURL(header *bam.Header) (string, error) {
+	raw, err := header.Encode()
+	if err != nil {
+		return "", fmt.Errorf("encoding header: %v", err)
+	}
+	encoded, err := bgzf.EncodeBlocks(raw)
+	if err != nil {
+		return "", fmt.Errorf("compressing header: %v", err)
+	}
+	return "data:;base64," + base64.StdEncoding.EncodeToString(encoded), nil
+}
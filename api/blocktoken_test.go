@@ -0,0 +1,84 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/ticket"
+)
+
+func TestBlockTokens(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	withKey := func(server *Server) {
+		server.SetBlockTokenKey([]byte("secret"))
+	}
+
+	// blockURL returns the URL of the first body block in the ticket for a
+	// region of the sample.
+	blockURL := func(configure ...func(*Server)) string {
+		resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20", configure...)
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("Wrong status code: got %v, want %v", got, want)
+		}
+		var body ticket.Response
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return body.Ticket.URLs[1].URL
+	}
+	signed, unsigned := blockURL(withKey), blockURL()
+	query := signed[strings.Index(signed, "?")+1:]
+	if !strings.Contains(query, ".") || strings.Contains(unsigned[strings.Index(unsigned, "?"):], ".") {
+		t.Fatalf("Wrong block URLs: got signed %q and unsigned %q", signed, unsigned)
+	}
+	token := query[:strings.Index(query, ".")]
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&bgzf.Chunk{End: bgzf.NewAddress(1000, 0)}); err != nil {
+		t.Fatalf("Failed to encode chunk: %v", err)
+	}
+	other := base64.URLEncoding.EncodeToString(buf.Bytes())
+
+	testCases := []struct {
+		name      string
+		url       string
+		configure []func(*Server)
+		code      int
+	}{
+		{"unsigned", unsigned, nil, http.StatusOK},
+		{"signed", signed, []func(*Server){withKey}, http.StatusOK},
+		{"other object", strings.Replace(signed, "NA12878.chr20.sample.bam", "index.sample.bam", 1), []func(*Server){withKey}, http.StatusForbidden},
+		{"missing signature", unsigned, []func(*Server){withKey}, http.StatusForbidden},
+		{"other chunk", strings.Replace(signed, token, other, 1), []func(*Server){withKey}, http.StatusForbidden},
+		{"wrong key", signed, []func(*Server){func(server *Server) { server.SetBlockTokenKey([]byte("other")) }}, http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := testQuery(ctx, t, tc.url, tc.configure...)
+			if got, want := resp.StatusCode, tc.code; got != want {
+				t.Errorf("Wrong status code: got %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// The circuit is only opened once at least this many storage operations
+	// have been attempted in the current window.
+	breakerMinimumRequests = 20
+
+	// The length of the window over which the error rate is measured.
+	breakerWindow = 10 * time.Second
+)
+
+// unavailableError is returned when the storage backend is considered
+// unhealthy and requests are being rejected without contacting it, or when
+// the backend itself asks for requests to be slowed down.
+type unavailableError struct {
+	retryAfter time.Duration
+}
+
+func (err *unavailableError) Error() string {
+	if err.retryAfter <= 0 {
+		return "storage backend unavailable, retry later"
+	}
+	return fmt.Sprintf("storage backend unavailable, retry after %v", err.retryAfter)
+}
+
+// circuitBreaker tracks the rate of transient storage failures and fails fast
+// once that rate exceeds a threshold, giving the backend time to recover.  A
+// nil *circuitBreaker allows all requests.
+type circuitBreaker struct {
+	ratio    float64
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	failures    int
+	openUntil   time.Time
+}
+
+func newCircuitBreaker(ratio float64, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{ratio: ratio, cooldown: cooldown, now: time.Now}
+}
+
+// allow returns an *unavailableError if the circuit is open.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now := b.now(); now.Before(b.openUntil) {
+		// Round up so that clients never retry before the circuit closes.
+		return &unavailableError{b.openUntil.Sub(now).Truncate(time.Second) + time.Second}
+	}
+	return nil
+}
+
+// record updates the error rate with the result of a storage operation and
+// opens the circuit if the rate is too high.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if now.Sub(b.windowStart) > breakerWindow {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if err != nil && isTransient(err) {
+		b.failures++
+	}
+	if b.requests >= breakerMinimumRequests && float64(b.failures) >= b.ratio*float64(b.requests) {
+		b.openUntil = now.Add(b.cooldown)
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+}
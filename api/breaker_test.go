@@ -0,0 +1,78 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	breaker := newCircuitBreaker(0.5, 30*time.Second)
+	breaker.now = func() time.Time { return now }
+
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	// Permanent errors do not count as backend failures.
+	for i := 0; i < breakerMinimumRequests; i++ {
+		breaker.record(errors.New("permanent"))
+	}
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("Circuit opened after permanent errors: %v", err)
+	}
+
+	now = now.Add(breakerWindow + time.Second)
+	for i := 0; i < breakerMinimumRequests/2; i++ {
+		breaker.record(nil)
+		if err := breaker.allow(); err != nil {
+			t.Fatalf("Circuit opened too early: %v", err)
+		}
+		breaker.record(unavailable)
+	}
+
+	err := breaker.allow()
+	if err == nil {
+		t.Fatalf("Circuit did not open")
+	}
+	if got, want := err.(*unavailableError).retryAfter, 31*time.Second; got != want {
+		t.Errorf("Wrong retry delay: got %v, want %v", got, want)
+	}
+
+	now = now.Add(30 * time.Second)
+	if err := breaker.allow(); err != nil {
+		t.Errorf("Circuit did not close after cooldown: %v", err)
+	}
+}
+
+func TestCircuitBreakerOpen(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam", func(server *Server) {
+		server.breaker.openUntil = time.Now().Add(time.Minute)
+	})
+
+	if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+		t.Errorf("Wrong status code: got %v, want %v", got, want)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "60" {
+		t.Errorf("Wrong Retry-After header: got %q, want %q", got, "60")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"time"
+)
+
+// SetBearerTokenAuth records whether requests must carry an OAuth2 bearer
+// token, which is advertised by the capabilities endpoint.  It does not change
+// how storage clients are created; that is up to the NewStorageClientFunc
+// passed to NewServer.
+func (server *Server) SetBearerTokenAuth(required bool) {
+	server.bearerTokenAuth = required
+}
+
+// serveCapabilities describes what the server supports and the limits it
+// applies, so that clients can adapt their requests without trial and error.
+// Limits that are overridden for individual buckets are reported both with
+// their default values and with the value for each of those buckets.
+func (server *Server) serveCapabilities(w http.ResponseWriter, req *http.Request) {
+	authentication := "none"
+	if server.bearerTokenAuth {
+		authentication = "bearer"
+	}
+	if server.iap != nil {
+		authentication = "iap"
+	}
+
+	limits := make(map[string]interface{})
+	for name, path := range map[string]string{"reads": readsPath, "blocks": blockPath} {
+		if l := server.limiters[path]; l != nil {
+			limits[name] = map[string]interface{}{
+				"total":     cap(l.slots),
+				"perClient": l.perClient,
+				"queue":     l.queue,
+			}
+		}
+	}
+
+	classes := make(map[string]interface{})
+	for class, l := range server.classLimits {
+		maxBlockSize := l.blockSizeLimit
+		if maxBlockSize == 0 {
+			maxBlockSize = server.blockSizeLimit
+		}
+		classes[class] = map[string]interface{}{
+			"maxBlockSize": maxBlockSize,
+			"mergeGap":     l.mergeGap,
+		}
+	}
+
+	bucketLimits := map[string]interface{}{
+		"maxBlockSize":  server.bucketLimits,
+		"maxRegionSpan": server.bucketSpans,
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"formats":           []string{"BAM"},
+			"endpoints":         []string{"reads", "metadata", "index-stats", "density", "count", "plan", "sequence", "service-info"},
+			"classes":           []string{"header", "body"},
+			"fields":            true,
+			"tags":              true,
+			"recordFilters":     []string{"requireFlags", "excludeFlags", "minMapQ"},
+			"authentication":    authentication,
+			"maxBlockSize":      server.blockSizeLimit,
+			"maxRegionSpan":     server.maxSpan,
+			"bucketLimits":      bucketLimits,
+			"maxRequestTimeout": server.maxTimeout / time.Second,
+			"inlineLimit":       server.inlineLimit,
+			"minimalHeaders":    server.minimalHeaders,
+			"inlineHeaders":     server.inlineHeaders,
+			"signedURLs":        server.signer != nil,
+			"inflatedBlocks":    true,
+			"strict":            server.strict,
+			"concurrencyLimits": limits,
+			"clientClasses":     classes,
+		}})
+}
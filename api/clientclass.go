@@ -0,0 +1,65 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Client classes, which can be given their own block size limits and merge
+// gaps with SetClassLimits.  Requests from browsers, which carry an Origin
+// header, are interactive; all other requests are batch requests.
+const (
+	InteractiveClients = "interactive"
+	BatchClients       = "batch"
+)
+
+// classLimits holds the chunking settings for a client class.
+type classLimits struct {
+	blockSizeLimit uint64
+	mergeGap       uint64
+}
+
+// SetClassLimits configures how tickets are chunked for requests from class.
+// A blockSizeLimit of zero keeps the limit passed to NewServer; limits set
+// with SetBucketBlockSizeLimit still take precedence.  Chunks that are at most
+// mergeGap bytes apart are merged, which fetches some unrequested records
+// (which clients must discard anyway) in exchange for fewer, larger requests.
+// Interactive clients are usually best served by small blocks and no gap, and
+// batch clients by large blocks and a gap of a few megabytes.
+func (server *Server) SetClassLimits(class string, blockSizeLimit, mergeGap uint64) error {
+	if class != InteractiveClients && class != BatchClients {
+		return fmt.Errorf("unknown client class %q", class)
+	}
+	if blockSizeLimit > 0 {
+		blockSizeLimit = clampBlockSizeLimit(blockSizeLimit)
+	}
+	server.classLimits[class] = classLimits{blockSizeLimit: blockSizeLimit, mergeGap: mergeGap}
+	return nil
+}
+
+// clientClass returns the class of the client that sent req.
+func clientClass(req *http.Request) string {
+	if req.Header.Get("Origin") != "" {
+		return InteractiveClients
+	}
+	return BatchClients
+}
+
+// mergeGapFor returns the merge gap that applies to req.
+func (server *Server) mergeGapFor(req *http.Request) uint64 {
+	return server.classLimits[clientClass(req)].mergeGap
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientClass(t *testing.T) {
+	req := httptest.NewRequest("GET", "/reads/bucket/object", nil)
+	if got, want := clientClass(req), BatchClients; got != want {
+		t.Errorf("Wrong class without an origin: got %q, want %q", got, want)
+	}
+	req.Header.Set("Origin", "https://igv.example.com")
+	if got, want := clientClass(req), InteractiveClients; got != want {
+		t.Errorf("Wrong class with an origin: got %q, want %q", got, want)
+	}
+}
+
+func TestClassLimits(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	configure := func(server *Server) {
+		if err := server.SetClassLimits(InteractiveClients, 1024, 0); err != nil {
+			t.Fatalf("SetClassLimits() returned error: %v", err)
+		}
+		if err := server.SetClassLimits(BatchClients, 0, 1<<20); err != nil {
+			t.Fatalf("SetClassLimits() returned error: %v", err)
+		}
+	}
+
+	type explanation struct {
+		BlockSizeLimit uint64   `json:"blockSizeLimit"`
+		MergeGap       uint64   `json:"mergeGap"`
+		MergedChunks   []string `json:"mergedChunks"`
+	}
+	explain := func(origin string) explanation {
+		req, err := http.NewRequest("GET", "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&explain=true", nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		var body struct {
+			Explain explanation `json:"explain"`
+		}
+		if err := json.NewDecoder(testRequest(ctx, t, req, configure).Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return body.Explain
+	}
+
+	interactive, batch := explain("https://igv.example.com"), explain("")
+	if got, want := interactive.BlockSizeLimit, uint64(1024); got != want {
+		t.Errorf("Wrong interactive block size limit: got %d, want %d", got, want)
+	}
+	if got, want := batch.BlockSizeLimit, uint64(testBlockSizeLimit); got != want {
+		t.Errorf("Wrong batch block size limit: got %d, want %d", got, want)
+	}
+	if got, want := batch.MergeGap, uint64(1<<20); got != want {
+		t.Errorf("Wrong batch merge gap: got %d, want %d", got, want)
+	}
+	if len(interactive.MergedChunks) <= len(batch.MergedChunks) {
+		t.Errorf("Interactive requests were not split more finely: got %d chunks, batch requests have %d", len(interactive.MergedChunks), len(batch.MergedChunks))
+	}
+
+	if err := NewServer(nil, 0).SetClassLimits("mobile", 1024, 0); err == nil {
+		t.Errorf("SetClassLimits() accepted an unknown class")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// timeoutHeader lets clients bound the time spent serving a request, given
+// either as a number of seconds or as a Go duration such as "1m30s".
+const timeoutHeader = "X-Htsget-Timeout"
+
+// parseTimeout parses the value of timeoutHeader.
+func parseTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds <= 0 {
+			return 0, errors.New("timeout must be positive")
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q", value)
+	}
+	if timeout <= 0 {
+		return 0, errors.New("timeout must be positive")
+	}
+	return timeout, nil
+}
+
+// withDeadline binds the timeout requested by the client (limited to the
+// server's maximum) to the request context, so that storage operations are
+// abandoned once it expires.
+func (server *Server) withDeadline(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		value := req.Header.Get(timeoutHeader)
+		if value == "" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		timeout, err := parseTimeout(value)
+		if err != nil {
+			writeError(w, newInvalidInputError("parsing "+timeoutHeader, err))
+			return
+		}
+		if server.maxTimeout > 0 && timeout > server.maxTimeout {
+			timeout = server.maxTimeout
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTimeout(t *testing.T) {
+	testCases := []struct {
+		value string
+		want  time.Duration
+		valid bool
+	}{
+		{"30", 30 * time.Second, true},
+		{"0.5", 500 * time.Millisecond, true},
+		{"1m30s", 90 * time.Second, true},
+		{"0", 0, false},
+		{"-5", 0, false},
+		{"-1s", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			got, err := parseTimeout(tc.value)
+			if (err == nil) != tc.valid {
+				t.Fatalf("Wrong validity: got error %v, want valid %v", err, tc.valid)
+			}
+			if got != tc.want {
+				t.Errorf("Wrong timeout: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWithDeadline(t *testing.T) {
+	testCases := []struct {
+		name       string
+		header     string
+		maxTimeout time.Duration
+		status     int
+		deadline   bool
+		remaining  time.Duration
+	}{
+		{"no header", "", time.Minute, http.StatusOK, false, 0},
+		{"within limit", "10", time.Minute, http.StatusOK, true, 10 * time.Second},
+		{"above limit", "1h", time.Minute, http.StatusOK, true, time.Minute},
+		{"no limit", "1h", 0, http.StatusOK, true, time.Hour},
+		{"invalid", "later", time.Minute, http.StatusBadRequest, false, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(nil, 0)
+			server.SetMaxRequestTimeout(tc.maxTimeout)
+
+			var (
+				deadline time.Time
+				ok       bool
+			)
+			handler := server.withDeadline(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				deadline, ok = req.Context().Deadline()
+			}))
+
+			req := httptest.NewRequest("GET", "/reads/bucket/object", nil)
+			if tc.header != "" {
+				req.Header.Set(timeoutHeader, tc.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if got := w.Code; got != tc.status {
+				t.Fatalf("Wrong status code: got %d, want %d", got, tc.status)
+			}
+			if ok != tc.deadline {
+				t.Fatalf("Wrong deadline presence: got %v, want %v", ok, tc.deadline)
+			}
+			if remaining := time.Until(deadline); ok && (remaining > tc.remaining || remaining < tc.remaining-time.Second) {
+				t.Errorf("Wrong deadline: %v remaining, want %v", remaining, tc.remaining)
+			}
+		})
+	}
+}
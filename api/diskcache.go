@@ -0,0 +1,224 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tempPrefix marks files in a disk cache directory that are still being
+// written.  Any left over from a previous run are removed on startup.
+const tempPrefix = "tmp-"
+
+// diskCache is a size-bounded cache of files in a local directory, evicting
+// the least recently used entries first.  It is safe for concurrent use.
+type diskCache struct {
+	dir   string
+	limit int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // Of *cacheEntry, most recently used first.
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	name string
+	size int64
+}
+
+// newDiskCache returns a cache that stores up to limit bytes in dir, which is
+// created if necessary.  Entries left in dir by a previous run are kept.
+func newDiskCache(dir string, limit int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading cache directory: %v", err)
+	}
+
+	c := &diskCache{
+		dir:     dir,
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	// Treat the most recently modified files as the most recently used.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), tempPrefix) {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		if file.Mode().IsRegular() {
+			c.add(file.Name(), file.Size())
+		}
+	}
+	return c, nil
+}
+
+// maxEntrySize is the size of the largest entry that is worth caching.  Larger
+// entries would evict too much of the cache.
+func (c *diskCache) maxEntrySize() int64 {
+	return c.limit / 8
+}
+
+func (c *diskCache) path(name string) string {
+	return filepath.Join(c.dir, name)
+}
+
+// fileName returns the name of the file that holds the entry for key.
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// open returns the cached file for key and its size, if there is one.
+func (c *diskCache) open(key string) (*os.File, int64, bool) {
+	name := fileName(key)
+
+	c.mu.Lock()
+	element, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(element)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, 0, false
+	}
+
+	f, err := os.Open(c.path(name))
+	if err != nil {
+		c.remove(name)
+		return nil, 0, false
+	}
+	return f, element.Value.(*cacheEntry).size, true
+}
+
+// create returns a writer for a new entry.  The entry is added to the cache by
+// calling commit once all of the data has been written.
+func (c *diskCache) create() (*cacheWriter, error) {
+	f, err := ioutil.TempFile(c.dir, tempPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("creating cache file: %v", err)
+	}
+	return &cacheWriter{File: f, cache: c}, nil
+}
+
+// add records that the file called name holds size bytes and evicts entries
+// until the cache fits within its limit.
+func (c *diskCache) add(name string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[name]; ok {
+		c.size -= element.Value.(*cacheEntry).size
+		c.lru.Remove(element)
+	}
+	c.entries[name] = c.lru.PushFront(&cacheEntry{name, size})
+	c.size += size
+
+	for c.size > c.limit {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*cacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.name)
+		c.size -= entry.size
+		if err := os.Remove(c.path(entry.name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to evict cache entry %s: %v", entry.name, err)
+		}
+	}
+}
+
+func (c *diskCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[name]; ok {
+		c.size -= element.Value.(*cacheEntry).size
+		c.lru.Remove(element)
+		delete(c.entries, name)
+	}
+}
+
+// cacheWriter writes a new cache entry to a temporary file.  Write errors
+// are recorded rather than returned, so that a full disk does not interrupt
+// the response that is being cached.
+type cacheWriter struct {
+	*os.File
+	cache   *diskCache
+	written int64
+	err     error
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		var n int
+		n, w.err = w.File.Write(p)
+		w.written += int64(n)
+	}
+	return len(p), nil
+}
+
+// commit adds the written data to the cache as the entry for key.
+func (w *cacheWriter) commit(key string) error {
+	if w.err != nil {
+		w.abort()
+		return fmt.Errorf("writing cache file: %v", w.err)
+	}
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return fmt.Errorf("closing cache file: %v", err)
+	}
+	name := fileName(key)
+	if err := os.Rename(w.Name(), w.cache.path(name)); err != nil {
+		os.Remove(w.Name())
+		return fmt.Errorf("renaming cache file: %v", err)
+	}
+	w.cache.add(name, w.written)
+	return nil
+}
+
+// abort discards the written data.
+func (w *cacheWriter) abort() {
+	w.File.Close()
+	os.Remove(w.Name())
+}
+
+// SetBlockCache caches up to limit bytes of block data in dir so that popular
+// regions are served from local disk rather than read from storage again.
+// Entries are keyed by object generation, so changed objects are never served
+// from the cache.  Blocks larger than an eighth of limit are not cached.
+func (server *Server) SetBlockCache(dir string, limit int64) error {
+	cache, err := newDiskCache(dir, limit)
+	if err != nil {
+		return err
+	}
+	server.blockCache = cache
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+)
+
+func putCacheEntry(t *testing.T, c *diskCache, key string, data []byte) {
+	w, err := c.create()
+	if err != nil {
+		t.Fatalf("Failed to create cache entry: %v", err)
+	}
+	w.Write(data)
+	if err := w.commit(key); err != nil {
+		t.Fatalf("Failed to commit cache entry: %v", err)
+	}
+}
+
+func readCacheEntry(c *diskCache, key string) ([]byte, bool) {
+	f, _, ok := c.open(key)
+	if !ok {
+		return nil, false
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	return data, err == nil
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newDiskCache(dir, 10)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	putCacheEntry(t, c, "a", []byte("aaaa"))
+	putCacheEntry(t, c, "b", []byte("bbbb"))
+	if got, ok := readCacheEntry(c, "a"); !ok || !bytes.Equal(got, []byte("aaaa")) {
+		t.Errorf("Wrong entry for a: got %q (found %v)", got, ok)
+	}
+
+	// Reading a made b the least recently used entry, so it is evicted.
+	putCacheEntry(t, c, "c", []byte("cccc"))
+	if _, ok := readCacheEntry(c, "b"); ok {
+		t.Errorf("Entry b was not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := readCacheEntry(c, key); !ok {
+			t.Errorf("Entry %s was evicted", key)
+		}
+	}
+
+	// An abandoned entry leaves nothing behind.
+	w, err := c.create()
+	if err != nil {
+		t.Fatalf("Failed to create cache entry: %v", err)
+	}
+	w.Write([]byte("partial"))
+	w.abort()
+
+	// A new cache over the same directory keeps the committed entries.
+	reopened, err := newDiskCache(dir, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen cache: %v", err)
+	}
+	if got, want := reopened.size, int64(8); got != want {
+		t.Errorf("Wrong size after reopening: got %d, want %d", got, want)
+	}
+	if got, ok := readCacheEntry(reopened, "c"); !ok || !bytes.Equal(got, []byte("cccc")) {
+		t.Errorf("Wrong entry for c after reopening: got %q (found %v)", got, ok)
+	}
+}
+
+func TestBlockCacheRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		mu    sync.Mutex
+		reads int
+	)
+	fake := &fakeGCS{t}
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Range") != "" {
+			mu.Lock()
+			reads++
+			mu.Unlock()
+		}
+		return fake.RoundTrip(req)
+	})}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, client)
+
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20")
+	var body struct {
+		Htsget struct {
+			URLs []struct {
+				URL string `json:"url"`
+			} `json:"urls"`
+		} `json:"htsget"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	block := body.Htsget.URLs[1].URL
+
+	cache, err := newDiskCache(dir, 1<<30)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	fetch := func() []byte {
+		resp := testQuery(ctx, t, block, func(server *Server) { server.blockCache = cache })
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("Wrong status code: got %d, want %d", got, want)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read block: %v", err)
+		}
+		return data
+	}
+
+	mu.Lock()
+	reads = 0
+	mu.Unlock()
+	want := fetch()
+	if reads == 0 {
+		t.Fatalf("First request did not read from storage")
+	}
+
+	reads = 0
+	if got := fetch(); !bytes.Equal(got, want) {
+		t.Errorf("Cached block differs: got %d bytes, want %d bytes", len(got), len(want))
+	}
+	if reads != 0 {
+		t.Errorf("Cached request made %d storage reads", reads)
+	}
+}
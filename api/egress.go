@@ -0,0 +1,262 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	egressPath  = "/admin/egress"
+	metricsPath = "/metrics"
+
+	// egressDateFormat is the layout of the UTC dates that egress is grouped
+	// by, which sort in date order as strings.
+	egressDateFormat = "2006-01-02"
+)
+
+// egressKey identifies the bytes sent for an object on a day.  The date is
+// empty for totals since the server started.
+type egressKey struct {
+	bucket, object, date string
+}
+
+// egressTotals counts the block responses and bytes sent.
+type egressTotals struct {
+	Blocks int64 `json:"blocks"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// egressMeter counts the block data sent for each object, both per day (for
+// a limited number of days) and in total since the server started.
+type egressMeter struct {
+	days int
+	now  func() time.Time
+
+	mu     sync.Mutex
+	today  string
+	daily  map[egressKey]*egressTotals
+	totals map[egressKey]*egressTotals
+}
+
+func newEgressMeter(days int) *egressMeter {
+	return &egressMeter{
+		days:   days,
+		now:    time.Now,
+		daily:  make(map[egressKey]*egressTotals),
+		totals: make(map[egressKey]*egressTotals),
+	}
+}
+
+// add records a block response of n bytes for object in bucket.
+func (m *egressMeter) add(bucket, object string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	date := m.now().UTC().Format(egressDateFormat)
+	if date != m.today {
+		m.today = date
+		m.expire()
+	}
+	addEgress(m.daily, egressKey{bucket, object, date}, egressTotals{Blocks: 1, Bytes: n})
+	addEgress(m.totals, egressKey{bucket, object, ""}, egressTotals{Blocks: 1, Bytes: n})
+}
+
+// addEgress adds delta to the totals for key in totals.
+func addEgress(totals map[egressKey]*egressTotals, key egressKey, delta egressTotals) {
+	t := totals[key]
+	if t == nil {
+		t = new(egressTotals)
+		totals[key] = t
+	}
+	t.Blocks += delta.Blocks
+	t.Bytes += delta.Bytes
+}
+
+// expire removes the daily totals that are older than the retention period.
+// It must be called with mu held.
+func (m *egressMeter) expire() {
+	oldest := m.now().UTC().AddDate(0, 0, 1-m.days).Format(egressDateFormat)
+	for key := range m.daily {
+		if key.date < oldest {
+			delete(m.daily, key)
+		}
+	}
+}
+
+// egressEntry is a row of the egress report.  Fields that the rows were not
+// grouped by are empty.
+type egressEntry struct {
+	Bucket string `json:"bucket"`
+	Object string `json:"object,omitempty"`
+	Date   string `json:"date,omitempty"`
+	egressTotals
+}
+
+// report returns the daily totals for days on or after since, optionally
+// limited to bucket and summed over each object (by=object) or bucket
+// (by=bucket), ordered by the number of bytes sent.
+func (m *egressMeter) report(bucket, since, by string) []egressEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+
+	groups := make(map[egressKey]*egressTotals)
+	for key, totals := range m.daily {
+		if (bucket != "" && key.bucket != bucket) || key.date < since {
+			continue
+		}
+		switch by {
+		case "bucket":
+			key.object, key.date = "", ""
+		case "object":
+			key.date = ""
+		}
+		addEgress(groups, key, *totals)
+	}
+
+	entries := make([]egressEntry, 0, len(groups))
+	for key, totals := range groups {
+		entries = append(entries, egressEntry{key.bucket, key.object, key.date, *totals})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Bucket+"/"+a.Object+" "+a.Date < b.Bucket+"/"+b.Object+" "+b.Date
+	})
+	return entries
+}
+
+// SetEgressAccounting counts the bytes of block data sent for each object,
+// keeping daily totals for the given number of days, so that heavily used
+// datasets can be charged back or placed behind a CDN.  The totals are
+// reported by the endpoints registered by ExportAdmin.  Zero (the default)
+// disables accounting.
+func (server *Server) SetEgressAccounting(days int) {
+	if days <= 0 {
+		server.egress = nil
+		return
+	}
+	server.egress = newEgressMeter(days)
+}
+
+// ExportAdmin registers the administrative endpoints with mux.  They report
+// on every readset that the server has served, so mux should only be
+// reachable by operators.
+func (server *Server) ExportAdmin(mux *http.ServeMux) {
+	mux.HandleFunc(server.basePath+egressPath, server.serveEgress)
+	mux.HandleFunc(server.basePath+metricsPath, server.serveMetrics)
+}
+
+// serveEgress reports the block data sent per object and day.  The bucket
+// and since (a YYYY-MM-DD date) parameters limit the days and data reported,
+// and by=object or by=bucket sums the days of each object or bucket.
+func (server *Server) serveEgress(w http.ResponseWriter, req *http.Request) {
+	if server.egress == nil {
+		http.Error(w, "egress accounting is disabled", http.StatusNotFound)
+		return
+	}
+	query := req.URL.Query()
+	since := query.Get("since")
+	if since != "" {
+		if _, err := time.Parse(egressDateFormat, since); err != nil {
+			http.Error(w, fmt.Sprintf("parsing since: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	by := query.Get("by")
+	if by != "" && by != "object" && by != "bucket" {
+		http.Error(w, fmt.Sprintf("unknown grouping %q (must be object or bucket)", by), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"egress": server.egress.report(query.Get("bucket"), since, by),
+	})
+}
+
+// serveMetrics writes the egress totals and index cache counts since the
+// server started in the Prometheus text format.
+func (server *Server) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if server.indexCache != nil {
+		hits, misses := server.indexCache.counts()
+		fmt.Fprintf(w, "# HELP htsget_index_cache_hits_total Indexes served from the index cache.\n# TYPE htsget_index_cache_hits_total counter\nhtsget_index_cache_hits_total %d\n", hits)
+		fmt.Fprintf(w, "# HELP htsget_index_cache_misses_total Indexes read from storage because they were not in the index cache.\n# TYPE htsget_index_cache_misses_total counter\nhtsget_index_cache_misses_total %d\n", misses)
+	}
+	if server.egress == nil {
+		return
+	}
+
+	server.egress.mu.Lock()
+	keys := make([]egressKey, 0, len(server.egress.totals))
+	totals := make(map[egressKey]egressTotals)
+	for key, t := range server.egress.totals {
+		keys = append(keys, key)
+		totals[key] = *t
+	}
+	server.egress.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].bucket != keys[j].bucket {
+			return keys[i].bucket < keys[j].bucket
+		}
+		return keys[i].object < keys[j].object
+	})
+
+	for _, metric := range []struct {
+		name, help string
+		value      func(egressTotals) int64
+	}{
+		{"htsget_egress_bytes_total", "Bytes of block data sent, by object.", func(t egressTotals) int64 { return t.Bytes }},
+		{"htsget_egress_blocks_total", "Block responses sent, by object.", func(t egressTotals) int64 { return t.Blocks }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s{bucket=\"%s\",object=\"%s\"} %d\n", metric.name, escapeLabel(key.bucket), escapeLabel(key.object), metric.value(totals[key]))
+		}
+	}
+}
+
+// labelEscaper escapes Prometheus label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// egressWriter counts the bytes of a block response written to its
+// ResponseWriter.
+type egressWriter struct {
+	http.ResponseWriter
+	started bool
+	bytes   int64
+}
+
+func (w *egressWriter) WriteHeader(code int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *egressWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,170 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEgressReport(t *testing.T) {
+	meter := newEgressMeter(3)
+	day := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	meter.now = func() time.Time { return day }
+
+	meter.add("a", "old.bam", 1000)
+	day = day.AddDate(0, 0, 1)
+	meter.add("a", "x.bam", 10)
+	meter.add("a", "x.bam", 20)
+	meter.add("b", "y.bam", 5)
+	day = day.AddDate(0, 0, 1)
+	meter.add("a", "x.bam", 40)
+	meter.add("a", "y.bam", 1)
+	day = day.AddDate(0, 0, 1)
+	meter.add("b", "y.bam", 100)
+
+	testCases := []struct {
+		name, bucket, since, by string
+		want                    []egressEntry
+	}{
+		{"daily", "", "", "", []egressEntry{
+			{"b", "y.bam", "2018-06-04", egressTotals{1, 100}},
+			{"a", "x.bam", "2018-06-03", egressTotals{1, 40}},
+			{"a", "x.bam", "2018-06-02", egressTotals{2, 30}},
+			{"b", "y.bam", "2018-06-02", egressTotals{1, 5}},
+			{"a", "y.bam", "2018-06-03", egressTotals{1, 1}},
+		}},
+		{"bucket", "a", "", "", []egressEntry{
+			{"a", "x.bam", "2018-06-03", egressTotals{1, 40}},
+			{"a", "x.bam", "2018-06-02", egressTotals{2, 30}},
+			{"a", "y.bam", "2018-06-03", egressTotals{1, 1}},
+		}},
+		{"since", "", "2018-06-03", "", []egressEntry{
+			{"b", "y.bam", "2018-06-04", egressTotals{1, 100}},
+			{"a", "x.bam", "2018-06-03", egressTotals{1, 40}},
+			{"a", "y.bam", "2018-06-03", egressTotals{1, 1}},
+		}},
+		{"by object", "", "", "object", []egressEntry{
+			{"b", "y.bam", "", egressTotals{2, 105}},
+			{"a", "x.bam", "", egressTotals{3, 70}},
+			{"a", "y.bam", "", egressTotals{1, 1}},
+		}},
+		{"by bucket", "", "", "bucket", []egressEntry{
+			{"b", "", "", egressTotals{2, 105}},
+			{"a", "", "", egressTotals{4, 71}},
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := meter.report(tc.bucket, tc.since, tc.by); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Wrong report: got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+
+	if got, want := *meter.totals[egressKey{"a", "old.bam", ""}], (egressTotals{1, 1000}); got != want {
+		t.Errorf("Wrong total for an expired day: got %+v, want %+v", got, want)
+	}
+}
+
+func TestEgressEndpoints(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	server := NewServer(nil, 0)
+	server.SetEgressAccounting(7)
+	share := func(s *Server) { s.egress = server.egress }
+
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20", share)
+	var ticket struct {
+		Htsget struct {
+			URLs []struct {
+				URL string `json:"url"`
+			} `json:"urls"`
+		} `json:"htsget"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ticket); err != nil {
+		t.Fatalf("Failed to decode ticket: %v", err)
+	}
+	var sent int64
+	for _, url := range ticket.Htsget.URLs {
+		if strings.HasPrefix(url.URL, "data:") {
+			continue
+		}
+		block, err := ioutil.ReadAll(testQuery(ctx, t, url.URL, share).Body)
+		if err != nil {
+			t.Fatalf("Failed to read block: %v", err)
+		}
+		sent += int64(len(block))
+	}
+
+	mux := http.NewServeMux()
+	server.ExportAdmin(mux)
+	get := func(url string) (int, string) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		body, err := ioutil.ReadAll(w.Result().Body)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return w.Code, string(body)
+	}
+
+	code, body := get("/admin/egress?by=object")
+	if code != http.StatusOK {
+		t.Fatalf("Wrong status code: got %d, want %d", code, http.StatusOK)
+	}
+	var report struct {
+		Egress []egressEntry `json:"egress"`
+	}
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if len(report.Egress) != 1 {
+		t.Fatalf("Wrong number of report entries: got %d, want 1", len(report.Egress))
+	}
+	entry := report.Egress[0]
+	if entry.Bucket != "testdata" || entry.Object != "NA12878.chr20.sample.bam" || entry.Blocks == 0 {
+		t.Errorf("Wrong report entry: %+v", entry)
+	}
+	if entry.Bytes == 0 || entry.Bytes != sent {
+		t.Errorf("Wrong number of bytes: got %d, want %d", entry.Bytes, sent)
+	}
+
+	code, body = get("/metrics")
+	want := `htsget_egress_bytes_total{bucket="testdata",object="NA12878.chr20.sample.bam"} `
+	if code != http.StatusOK || !strings.Contains(body, want) {
+		t.Errorf("Metrics do not contain %q:\n%s", want, body)
+	}
+
+	for _, url := range []string{"/admin/egress?since=yesterday", "/admin/egress?by=day"} {
+		if code, _ := get(url); code != http.StatusBadRequest {
+			t.Errorf("Wrong status code for %s: got %d, want %d", url, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got, want := escapeLabel("a\"b\\c\nd"), `a\"b\\c\nd`; got != want {
+		t.Errorf("Wrong escaped label: got %q, want %q", got, want)
+	}
+}
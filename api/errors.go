@@ -0,0 +1,94 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Error categories reported as the label of analytics error events.
+const (
+	categoryClientAbort        = "Client Abort"
+	categoryTimeout            = "Timeout"
+	categoryStorageAuth        = "Storage Authentication"
+	categoryPermissionDenied   = "Permission Denied"
+	categoryStorageUnavailable = "Storage Unavailable"
+	categoryMissingIndex       = "Missing Index"
+	categoryNotFound           = "Not Found"
+	categoryInvalidRequest     = "Invalid Request"
+	categoryParseError         = "Parse Error"
+	categoryInternal           = "Internal"
+)
+
+// missingIndexError is the cause of a NotFound error when none of the
+// candidate index objects for a readset exist.
+type missingIndexError struct {
+	err error
+}
+
+func (err *missingIndexError) Error() string {
+	return fmt.Sprintf("opening index: %v", err.err)
+}
+
+func newMissingIndexError(err error) error {
+	return &apiError{"NotFound", http.StatusNotFound, &missingIndexError{err}}
+}
+
+// parseError is returned when stored data, such as an index, cannot be
+// parsed.  It is still reported to clients as an internal error.
+type parseError struct {
+	context string
+	err     error
+}
+
+func (err *parseError) Error() string {
+	return fmt.Sprintf("%s: %v", err.context, err.err)
+}
+
+// errorCategory returns a short description of what caused err, for use in
+// analytics.  Failures caused by the client going away are identified using
+// the request context, since storage errors do not preserve their cause.
+func errorCategory(ctx context.Context, err error) string {
+	switch ctx.Err() {
+	case context.Canceled:
+		return categoryClientAbort
+	case context.DeadlineExceeded:
+		return categoryTimeout
+	}
+
+	switch err := err.(type) {
+	case *unavailableError:
+		return categoryStorageUnavailable
+	case *parseError:
+		return categoryParseError
+	case *apiError:
+		switch err.name {
+		case "InvalidAuthentication":
+			return categoryStorageAuth
+		case "PermissionDenied":
+			return categoryPermissionDenied
+		case "NotFound":
+			if _, ok := err.cause.(*missingIndexError); ok {
+				return categoryMissingIndex
+			}
+			return categoryNotFound
+		case "InvalidInput", "InvalidRange", "UnsupportedFormat":
+			return categoryInvalidRequest
+		}
+	}
+	return categoryInternal
+}
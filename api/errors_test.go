@@ -0,0 +1,60 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestErrorCategory(t *testing.T) {
+	cause := errors.New("cause")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	testCases := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want string
+	}{
+		{"client abort", canceled, cause, categoryClientAbort},
+		{"timeout", expired, cause, categoryTimeout},
+		{"unauthenticated", context.Background(), newStorageError("opening data", &googleapi.Error{Code: http.StatusUnauthorized}), categoryStorageAuth},
+		{"forbidden", context.Background(), newStorageError("opening data", &googleapi.Error{Code: http.StatusForbidden}), categoryPermissionDenied},
+		{"throttled", context.Background(), newStorageError("opening data", &googleapi.Error{Code: http.StatusTooManyRequests}), categoryStorageUnavailable},
+		{"missing index", context.Background(), newMissingIndexError(storage.ErrObjectNotExist), categoryMissingIndex},
+		{"missing object", context.Background(), newStorageError("opening data", storage.ErrObjectNotExist), categoryNotFound},
+		{"invalid input", context.Background(), newInvalidInputError("parsing readset ID", cause), categoryInvalidRequest},
+		{"invalid range", context.Background(), newInvalidRangeError(cause), categoryInvalidRequest},
+		{"unsupported format", context.Background(), newUnsupportedFormatError(cause), categoryInvalidRequest},
+		{"corrupt index", context.Background(), &parseError{"reading index", cause}, categoryParseError},
+		{"unknown", context.Background(), cause, categoryInternal},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := errorCategory(tc.ctx, tc.err); got != tc.want {
+				t.Errorf("Wrong category: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/googlegenomics/htsget/internal/bam"
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/fasta"
+	"github.com/googlegenomics/htsget/internal/genomics"
+	"github.com/googlegenomics/htsget/ticket"
+)
+
+// serveSequence returns a ticket for a region of a reference sequence in an
+// indexed FASTA file, which must have a .fai index.  Files compressed with
+// bgzip (named with a .gz or .bgz extension) must also have a .gzi index, and
+// their data is returned in BGZF blocks.  The first URL in the ticket holds a
+// FASTA header line naming the region, so that the concatenated data is itself
+// a FASTA file.
+func (server *Server) serveSequence(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	bucket, object, err := server.resolveID(ctx, req.URL.Path[len(sequencePath):])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := server.checkWhitelist(bucket); err != nil {
+		writeError(w, newPermissionDeniedError("checking whitelist", err))
+		return
+	}
+	if err := server.checkIdentity(ctx, bucket); err != nil {
+		writeError(w, newPermissionDeniedError("checking permissions", err))
+		return
+	}
+
+	query, err := expandSamtoolsRegion(req.URL.Query())
+	if err != nil {
+		writeError(w, newInvalidInputError("parsing region", err))
+		return
+	}
+	if query.Get("referenceName") == "" {
+		writeError(w, newInvalidInputError("parsing query", errMissingReferenceName))
+		return
+	}
+
+	gcs, headers, err := server.newStorageClient(req)
+	if err != nil {
+		writeError(w, newStorageError("creating client", err))
+		return
+	}
+	handle := gcs.Bucket(bucket).Object
+
+	index, err := server.readIndex(ctx, headers, []*storage.ObjectHandle{handle(object + ".fai")})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	sequences, err := fasta.ReadIndex(bytes.NewReader(index))
+	if err != nil {
+		writeError(w, &parseError{"reading index", err})
+		return
+	}
+
+	resolve := func(name string) (*bam.Reference, error) {
+		return server.resolveSequence(sequences, name)
+	}
+	region, err := parseRegion(query, resolve, server.maxRegionSpanFor(bucket))
+	if err != nil {
+		if _, ok := err.(*apiError); !ok {
+			err = newInvalidInputError("parsing region", err)
+		}
+		writeError(w, err)
+		return
+	}
+	if region == genomics.UnplacedUnmappedReads {
+		writeError(w, newInvalidInputError("parsing region", errUnplacedNotSupported))
+		return
+	}
+	sequence := sequences[region.ReferenceID]
+	start, end := uint64(region.Start), uint64(region.End)
+	if end == 0 || end > sequence.Length {
+		end = sequence.Length
+	}
+	if start > end {
+		writeError(w, newInvalidRangeError(fmt.Errorf("%s: start > end", region)))
+		return
+	}
+	begin, finish := sequence.Range(start, end)
+
+	compressed := strings.HasSuffix(object, ".gz") || strings.HasSuffix(object, ".bgz")
+	var blocks []fasta.Block
+	if compressed {
+		gzi, err := server.readIndex(ctx, headers, []*storage.ObjectHandle{handle(object + ".gzi")})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if blocks, err = fasta.ReadGZI(bytes.NewReader(gzi)); err != nil {
+			writeError(w, &parseError{"reading block index", err})
+			return
+		}
+	}
+
+	// The header and trailing line terminator are sent inline, compressed like
+	// the rest of the data.
+	inline := func(data string) (string, error) {
+		if !compressed {
+			return "data:;base64," + base64.StdEncoding.EncodeToString([]byte(data)), nil
+		}
+		encoded, err := bgzf.EncodeBlock([]byte(data))
+		if err != nil {
+			return "", fmt.Errorf("compressing data: %v", err)
+		}
+		return "data:;base64," + base64.StdEncoding.EncodeToString(encoded), nil
+	}
+
+	header, err := inline(fmt.Sprintf(">%s:%d-%d\n", sequence.Name, start+1, end))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	urls := []ticket.URL{{URL: header, Class: ticket.ClassHeader}}
+
+	base := server.blockURL(req, bucket, object)
+	limit := server.blockSizeLimitFor(req, bucket)
+	for offset := begin; offset < finish; offset += limit {
+		next := offset + limit
+		if next > finish {
+			next = finish
+		}
+		q := blockQuery{Start: bgzf.Address(offset), End: bgzf.Address(next), Raw: true}
+		if compressed {
+			q.Raw = false
+			if q.Start, err = fasta.Address(blocks, offset); err == nil {
+				q.End, err = fasta.Address(blocks, next)
+			}
+			if err != nil {
+				writeError(w, &parseError{"locating data", err})
+				return
+			}
+		}
+
+		token, err := server.encodeBlockToken(bucket, object, &q)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		urls = append(urls, ticket.URL{
+			URL:     base + "?" + token,
+			Headers: flattenHeaders(headers),
+			Class:   ticket.ClassBody,
+		})
+	}
+
+	if finish > begin {
+		trailer, err := inline("\n")
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		urls = append(urls, ticket.URL{URL: trailer, Class: ticket.ClassBody})
+	}
+	if compressed {
+		urls = append(urls, ticket.URL{URL: eofMarkerDataURL, Class: ticket.ClassBody})
+	}
+	if server.strict {
+		if err := checkTicketURLs(urls); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	server.writeTicket(w, &ticket.Response{Ticket: &ticket.Ticket{
+		Format: "FASTA",
+		URLs:   urls,
+	}})
+}
+
+// resolveSequence returns the sequence that is called name, or failing that
+// the first one that matches an alias of name, as a reference whose ID is its
+// position in sequences.
+func (server *Server) resolveSequence(sequences []*fasta.Sequence, name string) (*bam.Reference, error) {
+	candidates := append([]string{name}, server.referenceAliases[name]...)
+	candidates = append(candidates, builtinAliases(name)...)
+	for _, candidate := range candidates {
+		for i, sequence := range sequences {
+			if sequence.Name == candidate {
+				return &bam.Reference{ID: int32(i), Name: sequence.Name, Length: uint32(sequence.Length)}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no sequence named %q found", name)
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/googlegenomics/htsget/ticket"
+)
+
+// fetchSequence requests a ticket from url and returns the concatenated data
+// from its URLs.
+func fetchSequence(ctx context.Context, t *testing.T, url string, configure ...func(*Server)) []byte {
+	resp := testQuery(ctx, t, url, configure...)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %d, want %d", got, want)
+	}
+	var body ticket.Response
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if got, want := body.Ticket.Format, "FASTA"; got != want {
+		t.Errorf("Wrong format: got %q, want %q", got, want)
+	}
+
+	var data []byte
+	for _, u := range body.Ticket.URLs {
+		if strings.HasPrefix(u.URL, "data:;base64,") {
+			decoded, err := base64.StdEncoding.DecodeString(u.URL[len("data:;base64,"):])
+			if err != nil {
+				t.Fatalf("Failed to decode data URL: %v", err)
+			}
+			data = append(data, decoded...)
+			continue
+		}
+		resp := testQuery(ctx, t, u.URL, configure...)
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("Wrong status code for block: got %d, want %d", got, want)
+		}
+		block, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read block: %v", err)
+		}
+		data = append(data, block...)
+	}
+	return data
+}
+
+func TestSequence(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	fa, err := ioutil.ReadFile("testdata/sample.fa")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	lines := strings.Split(string(fa), "\n")
+	seq1 := lines[1] + lines[2] + lines[3]
+
+	// Small blocks split the data across several URLs.
+	smallBlocks := func(server *Server) {
+		server.SetBucketBlockSizeLimit("testdata", 16)
+	}
+
+	testCases := []struct {
+		query string
+		want  string
+	}{
+		{"referenceName=seq1", ">seq1:1-150\n" + lines[1] + "\n" + lines[2] + "\n" + lines[3] + "\n"},
+		{"referenceName=seq1&start=10&end=70", ">seq1:11-70\n" + seq1[10:60] + "\n" + seq1[60:70] + "\n"},
+		{"referenceName=seq1&start=100&end=1000", ">seq1:101-150\n" + seq1[100:120] + "\n" + seq1[120:] + "\n"},
+		{"referenceName=seq2&start=5&end=5", ">seq2:6-5\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			for _, object := range []string{"sample.fa", "sample.fa.gz"} {
+				data := fetchSequence(ctx, t, "/sequence/testdata/"+object+"?"+tc.query, smallBlocks)
+				if strings.HasSuffix(object, ".gz") {
+					r, err := gzip.NewReader(bytes.NewReader(data))
+					if err != nil {
+						t.Fatalf("Failed to open compressed data: %v", err)
+					}
+					if data, err = ioutil.ReadAll(r); err != nil {
+						t.Fatalf("Failed to decompress data: %v", err)
+					}
+				}
+				if got := string(data); got != tc.want {
+					t.Errorf("Wrong data from %s: got %q, want %q", object, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSequence_Errors(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	testCases := []struct {
+		path   string
+		status int
+	}{
+		{"/sequence/testdata/sample.fa", http.StatusBadRequest},
+		{"/sequence/testdata/sample.fa?referenceName=missing", http.StatusBadRequest},
+		{"/sequence/testdata/sample.fa?referenceName=seq1&start=200", http.StatusBadRequest},
+		{"/sequence/testdata/sample.fa?referenceName=seq1&start=20&end=10", http.StatusBadRequest},
+		{"/sequence/testdata/missing.fa?referenceName=seq1", http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			resp := testQuery(ctx, t, tc.path)
+			if got := resp.StatusCode; got != tc.status {
+				t.Errorf("Wrong status code: got %d, want %d", got, tc.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/googlegenomics/htsget/internal/bam"
+	"github.com/googlegenomics/htsget/internal/bgzf"
+)
+
+// flightGroup collapses concurrent calls that share a key into a single call
+// whose result is returned to every caller.  The zero value is ready to use.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+
+	// cancelled is set if the context of the caller that made the call was
+	// done when it returned, in which case the error says nothing about the
+	// other callers' requests.
+	cancelled bool
+}
+
+// do calls fn unless a call with the same key is already in progress, in
+// which case it waits for that call and returns its result instead.  If the
+// call failed because the context of the request that made it was cancelled,
+// callers whose own context is still live try again.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	for {
+		g.mu.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*flight)
+		}
+		if f, ok := g.calls[key]; ok {
+			g.mu.Unlock()
+			select {
+			case <-f.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if f.cancelled && ctx.Err() == nil {
+				continue
+			}
+			return f.value, f.err
+		}
+		f := &flight{done: make(chan struct{})}
+		g.calls[key] = f
+		g.mu.Unlock()
+
+		f.value, f.err = fn()
+		f.cancelled = f.err != nil && ctx.Err() != nil
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(f.done)
+		return f.value, f.err
+	}
+}
+
+// flightKey returns a key for reading objects on behalf of a request that was
+// made with headers.  Requests made with different credentials never share a
+// read, since one may be allowed to see an object that the other is not.
+func flightKey(headers http.Header, kind string, objects ...*storage.ObjectHandle) string {
+	sum := sha256.Sum256([]byte(headers.Get("Authorization")))
+	parts := []string{kind, hex.EncodeToString(sum[:])}
+	for _, object := range objects {
+		parts = append(parts, object.BucketName()+"/"+object.ObjectName())
+	}
+	return strings.Join(parts, " ")
+}
+
+// readIndex reads the whole of the first of objects that exists.  Concurrent
+// reads of the same index by requests with the same credentials share a single
+// storage read.
+func (server *Server) readIndex(ctx context.Context, headers http.Header, objects []*storage.ObjectHandle) ([]byte, error) {
+	return server.readIndexKey(ctx, flightKey(headers, "index", objects...), objects)
+}
+
+// readIndexKey is like readIndex, but shares reads between the requests that
+// use the same flight key.
+func (server *Server) readIndexKey(ctx context.Context, key string, objects []*storage.ObjectHandle) ([]byte, error) {
+	data, err := server.flights.do(ctx, key, func() (interface{}, error) {
+		index, err := openIndex(ctx, server.breaker, objects)
+		if err != nil {
+			return nil, err
+		}
+		defer index.Close()
+
+		data, err := ioutil.ReadAll(index)
+		if err != nil {
+			return nil, newStorageError("reading index", err)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data.([]byte), nil
+}
+
+// readHeader reads the header of the BAM file in object, using the header
+// cache if there is one.  Concurrent reads of the same header by requests with
+// the same credentials share a single storage read.
+func (server *Server) readHeader(ctx context.Context, headers http.Header, object *storage.ObjectHandle) (*bam.Header, error) {
+	key := flightKey(headers, "header", object)
+	var cacheKey string
+	if server.headerCache != nil {
+		// The attributes are read with the request's credentials, so a cached
+		// header is only returned to requests that may read the object.
+		attrs, err := objectAttrs(ctx, server.breaker, object)
+		if err != nil {
+			return nil, newStorageError("opening data", err)
+		}
+		cacheKey = fmt.Sprintf("%s/%s#%d", object.BucketName(), object.ObjectName(), attrs.Generation)
+		if cached, ok := server.headerCache.get(cacheKey); ok {
+			return cached.header, nil
+		}
+		// Pin the generation so that the cached header matches its key.
+		object = object.Generation(attrs.Generation)
+		key += fmt.Sprintf("#%d", attrs.Generation)
+	}
+
+	entry, err := server.flights.do(ctx, key, func() (interface{}, error) {
+		data, err := newRangeReader(ctx, server.breaker, object, 0, int64(server.blockSizeLimit))
+		if err != nil {
+			return nil, newStorageError("opening data", err)
+		}
+		defer data.Close()
+
+		r := bufio.NewReaderSize(data, bgzf.MaximumBlockSize)
+		if format, err := detectFormat(r); err != nil {
+			return nil, newInvalidInputError("detecting format", err)
+		} else if format != "BAM" {
+			return nil, newUnsupportedFormatError(fmt.Errorf("object contains %s data, only BAM is supported", format))
+		}
+
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, newInvalidInputError("reading header", fmt.Errorf("opening archive: %v", err))
+		}
+		var raw bytes.Buffer
+		header, err := bam.ParseHeader(io.TeeReader(gzr, &raw))
+		if err != nil {
+			return nil, newInvalidInputError("reading header", err)
+		}
+
+		entry := &cachedHeader{key: cacheKey, data: raw.Bytes(), header: header}
+		if server.headerCache != nil {
+			server.headerCache.add(entry)
+		}
+		return entry, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry.(*cachedHeader).header, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+func TestFlightGroup(t *testing.T) {
+	var (
+		group   flightGroup
+		calls   int32
+		started = make(chan struct{})
+		release = make(chan struct{})
+		once    sync.Once
+		wg      sync.WaitGroup
+	)
+	results := make([]interface{}, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, err := group.do(context.Background(), "key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				once.Do(func() { close(started) })
+				<-release
+				return "value", nil
+			})
+			if err != nil {
+				t.Errorf("do() returned error: %v", err)
+			}
+			results[i] = value
+		}(i)
+	}
+
+	// Wait for the first call to start before letting it finish, so that the
+	// others have a chance to join it.
+	<-started
+	close(release)
+	wg.Wait()
+
+	if calls > int32(len(results)) || calls < 1 {
+		t.Fatalf("Wrong number of calls: %d", calls)
+	}
+	for i, got := range results {
+		if got != "value" {
+			t.Errorf("Wrong result for caller %d: got %v", i, got)
+		}
+	}
+
+	// Once a call has finished, its result is not reused.
+	if _, err := group.do(context.Background(), "key", func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return "value", nil
+	}); err != nil {
+		t.Fatalf("do() returned error: %v", err)
+	}
+	if len(group.calls) != 0 {
+		t.Errorf("Finished calls were not removed: %v", group.calls)
+	}
+}
+
+func TestFlightGroup_CancelledCaller(t *testing.T) {
+	var group flightGroup
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		group.do(ctx, "key", func() (interface{}, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+	}()
+	<-started
+
+	// A caller that joins a call whose request is then cancelled makes the
+	// call again rather than failing.
+	result := make(chan interface{})
+	go func() {
+		value, err := group.do(context.Background(), "key", func() (interface{}, error) {
+			return "value", nil
+		})
+		if err != nil {
+			t.Errorf("do() returned error: %v", err)
+		}
+		result <- value
+	}()
+	cancel()
+	<-done
+	if got := <-result; got != "value" {
+		t.Errorf("Wrong result: got %v, want %q", got, "value")
+	}
+}
+
+func TestFlightKey(t *testing.T) {
+	gcs, err := storage.NewClient(context.Background(), option.WithHTTPClient(&http.Client{}))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	index := gcs.Bucket("bucket").Object("object.bai")
+	alice := http.Header{"Authorization": []string{"Bearer alice"}}
+	bob := http.Header{"Authorization": []string{"Bearer bob"}}
+
+	if flightKey(alice, "index", index) != flightKey(alice, "index", index) {
+		t.Errorf("Identical reads have different keys")
+	}
+	if flightKey(alice, "index", index) == flightKey(bob, "index", index) {
+		t.Errorf("Reads with different credentials have the same key")
+	}
+	if flightKey(alice, "index", index) == flightKey(alice, "header", index) {
+		t.Errorf("Index and header reads have the same key")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/googlegenomics/htsget/internal/bam"
+)
+
+// headerCache is a size-bounded, in-memory cache of the headers of recently
+// read objects, evicting the least recently used entries first.  Entries are
+// keyed by object generation.  It is safe for concurrent use.
+type headerCache struct {
+	limit int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // Of *cachedHeader, most recently used first.
+	entries map[string]*list.Element
+}
+
+// cachedHeader holds a parsed header along with the decompressed bytes it was
+// parsed from.
+type cachedHeader struct {
+	key    string
+	data   []byte
+	header *bam.Header
+}
+
+func newHeaderCache(limit int64) *headerCache {
+	return &headerCache{
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the entry for key, if there is one.
+func (c *headerCache) get(key string) (*cachedHeader, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cachedHeader), true
+}
+
+// add stores entry, evicting older entries to make room.  Entries larger than
+// the whole cache are not stored.
+func (c *headerCache) add(entry *cachedHeader) {
+	size := int64(len(entry.data))
+	if size > c.limit {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[entry.key]; ok {
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+	for c.size > c.limit {
+		oldest := c.lru.Back()
+		evicted := c.lru.Remove(oldest).(*cachedHeader)
+		delete(c.entries, evicted.key)
+		c.size -= int64(len(evicted.data))
+	}
+}
+
+// SetHeaderCache keeps up to limit bytes of decompressed headers in memory so
+// that requests for the same readset do not each read and parse its header
+// again.  Entries are keyed by object generation, so each request still reads
+// the object's attributes (with its own credentials, which also checks that it
+// may read the object) but changed objects are never served from the cache.
+func (server *Server) SetHeaderCache(limit int64) {
+	if limit <= 0 {
+		server.headerCache = nil
+		return
+	}
+	server.headerCache = newHeaderCache(limit)
+}
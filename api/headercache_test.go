@@ -0,0 +1,102 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/googlegenomics/htsget/internal/bam"
+)
+
+func TestHeaderCache(t *testing.T) {
+	c := newHeaderCache(10)
+	add := func(key, data string) {
+		c.add(&cachedHeader{key: key, data: []byte(data), header: &bam.Header{Text: data}})
+	}
+	add("a", "aaaa")
+	add("b", "bbbb")
+	if got, ok := c.get("a"); !ok || got.header.Text != "aaaa" {
+		t.Errorf("Wrong entry for a: got %+v (found %v)", got, ok)
+	}
+
+	// Reading a made b the least recently used entry, so it is evicted.
+	add("c", "cccc")
+	if _, ok := c.get("b"); ok {
+		t.Errorf("Entry b was not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("Entry %s was evicted", key)
+		}
+	}
+
+	add("d", "ddddddddddd")
+	if _, ok := c.get("d"); ok {
+		t.Errorf("Entry larger than the cache was stored")
+	}
+	if got, want := c.size, int64(8); got != want {
+		t.Errorf("Wrong cache size: got %d, want %d", got, want)
+	}
+}
+
+func TestHeaderCacheRequest(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		reads int
+	)
+	fake := &fakeGCS{t}
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if !isMetadataRequest(req) && strings.HasSuffix(req.URL.Path, ".bam") {
+			mu.Lock()
+			reads++
+			mu.Unlock()
+		}
+		return fake.RoundTrip(req)
+	})}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, client)
+
+	cache := newHeaderCache(1 << 20)
+	for i := 0; i < 3; i++ {
+		resp := testQuery(ctx, t, "/metadata/testdata/NA12878.chr20.sample.bam", func(server *Server) {
+			server.headerCache = cache
+		})
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("Wrong status code: got %d, want %d", got, want)
+		}
+	}
+	if got, want := reads, 1; got != want {
+		t.Errorf("Wrong number of header reads: got %d, want %d", got, want)
+	}
+
+	// The cached bytes are the decompressed header.
+	if got := len(cache.entries); got != 1 {
+		t.Fatalf("Wrong number of cache entries: got %d, want 1", got)
+	}
+	entry := cache.lru.Front().Value.(*cachedHeader)
+	if !strings.HasPrefix(string(entry.data), "BAM\x01") {
+		t.Errorf("Cached data does not start with the BAM magic: %q", entry.data[:4])
+	}
+	header, err := bam.ParseHeader(strings.NewReader(string(entry.data)))
+	if err != nil {
+		t.Fatalf("Failed to parse cached data: %v", err)
+	}
+	if got, want := len(header.References), len(entry.header.References); got != want {
+		t.Errorf("Wrong number of references: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/googlegenomics/htsget/internal/audit"
+)
+
+const (
+	// iapHeader holds the signed assertion that Identity-Aware Proxy adds to
+	// each request it forwards.
+	iapHeader = "X-Goog-IAP-JWT-Assertion"
+
+	iapIssuer  = "https://cloud.google.com/iap"
+	iapKeysURL = "https://www.gstatic.com/iap/verify/public_key-jwk"
+
+	// iapKeysLifetime is how long fetched keys are used before they are
+	// fetched again.  Keys are also fetched again if an assertion names an
+	// unknown key, but no more often than iapKeysMinRefresh.
+	iapKeysLifetime   = time.Hour
+	iapKeysMinRefresh = time.Minute
+
+	// iapLeeway allows for clock skew between the proxy and the server.
+	iapLeeway = 30 * time.Second
+)
+
+type identityKey struct{}
+
+// identityFromContext returns the verified identity of the user that made the
+// request, or "" if there is none.
+func identityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
+
+// iapVerifier verifies the assertions added to requests by Identity-Aware
+// Proxy.  It is safe for concurrent use.
+type iapVerifier struct {
+	audience string
+	keysURL  string
+	client   *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]*ecdsa.PublicKey
+	fetched time.Time
+}
+
+// verify checks the signature and claims of assertion and returns the email
+// address of the user it asserts.
+func (v *iapVerifier) verify(ctx context.Context, assertion string, now time.Time) (string, error) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed assertion")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", fmt.Errorf("decoding header: %v", err)
+	}
+	if header.Algorithm != "ES256" {
+		return "", fmt.Errorf("unsupported algorithm %q", header.Algorithm)
+	}
+	key, err := v.key(ctx, header.KeyID, now)
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return "", errors.New("malformed signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		return "", errors.New("invalid signature")
+	}
+
+	var claims struct {
+		Audience  string `json:"aud"`
+		Issuer    string `json:"iss"`
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		Email     string `json:"email"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("decoding claims: %v", err)
+	}
+	switch {
+	case claims.Audience != v.audience:
+		return "", fmt.Errorf("wrong audience %q", claims.Audience)
+	case claims.Issuer != iapIssuer:
+		return "", fmt.Errorf("wrong issuer %q", claims.Issuer)
+	case now.Add(iapLeeway).Before(time.Unix(claims.IssuedAt, 0)):
+		return "", errors.New("assertion issued in the future")
+	case now.Add(-iapLeeway).After(time.Unix(claims.ExpiresAt, 0)):
+		return "", errors.New("assertion expired")
+	case claims.Email == "":
+		return "", errors.New("assertion has no email address")
+	}
+	return strings.TrimPrefix(claims.Email, "accounts.google.com:"), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// key returns the public key with the given ID, fetching the current keys if
+// necessary.
+func (v *iapVerifier) key(ctx context.Context, id string, now time.Time) (*ecdsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, ok := v.keys[id]
+	age := now.Sub(v.fetched)
+	if age > iapKeysLifetime || (!ok && age > iapKeysMinRefresh) {
+		keys, err := v.fetchKeys(ctx)
+		if err != nil {
+			if ok {
+				// Keep using the old keys until they can be fetched again.
+				return key, nil
+			}
+			return nil, fmt.Errorf("fetching keys: %v", err)
+		}
+		v.keys, v.fetched = keys, now
+		key, ok = keys[id]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+func (v *iapVerifier) fetchKeys(ctx context.Context) (map[string]*ecdsa.PublicKey, error) {
+	req, err := http.NewRequest("GET", v.keysURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %v", err)
+	}
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %v", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			ID    string `json:"kid"`
+			Type  string `json:"kty"`
+			Curve string `json:"crv"`
+			X     string `json:"x"`
+			Y     string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decoding keys: %v", err)
+	}
+	keys := make(map[string]*ecdsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Type != "EC" || k.Curve != "P-256" {
+			continue
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("decoding key %q: %v", k.ID, err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("decoding key %q: %v", k.ID, err)
+		}
+		keys[k.ID] = &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+	}
+	return keys, nil
+}
+
+// SetIAPAuth requires each request to carry a valid Identity-Aware Proxy
+// assertion for audience (such as
+// "/projects/123/global/backendServices/456").  permissions maps identities
+// to the buckets they may read: an identity is an email address, "*@" and a
+// domain for every user in that domain, or "*" for every user.  Buckets must
+// also pass the whitelist, if there is one.  The verified email address is
+// recorded in access records.  Storage is read with the credentials chosen by
+// the NewStorageClientFunc passed to NewServer, which should normally be
+// NewDefaultClient.
+func (server *Server) SetIAPAuth(audience string, permissions map[string][]string) {
+	server.iap = &iapVerifier{
+		audience: audience,
+		keysURL:  iapKeysURL,
+		client:   http.DefaultClient,
+	}
+	server.iapPermissions = make(map[string]map[string]bool)
+	for identity, buckets := range permissions {
+		allowed := make(map[string]bool)
+		for _, bucket := range buckets {
+			allowed[bucket] = true
+		}
+		server.iapPermissions[strings.ToLower(identity)] = allowed
+	}
+}
+
+// verifyIdentity rejects requests that do not carry a valid Identity-Aware
+// Proxy assertion, if one is required, and otherwise records the identity of
+// the user in the request context.
+func (server *Server) verifyIdentity(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if server.iap == nil {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		assertion := req.Header.Get(iapHeader)
+		if assertion == "" {
+			writeError(w, newInvalidAuthenticationError("verifying identity", fmt.Errorf("no %s header", iapHeader)))
+			return
+		}
+		identity, err := server.iap.verify(req.Context(), assertion, time.Now())
+		if err != nil {
+			writeError(w, newInvalidAuthenticationError("verifying identity", err))
+			return
+		}
+		audit.SetIdentity(req.Context(), identity)
+		handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), identityKey{}, identity)))
+	})
+}
+
+// checkIdentity returns an error if the verified identity in ctx may not read
+// from bucket.  It allows everything if Identity-Aware Proxy is not in use.
+func (server *Server) checkIdentity(ctx context.Context, bucket string) error {
+	if server.iap == nil {
+		return nil
+	}
+	identity := strings.ToLower(identityFromContext(ctx))
+	for _, candidate := range identityPatterns(identity) {
+		if server.iapPermissions[candidate][bucket] {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s may not read bucket %s", identity, bucket)
+}
+
+// identityPatterns returns the patterns that match identity: the identity
+// itself, "*@" and its domain, and "*".
+func identityPatterns(identity string) []string {
+	patterns := []string{identity, "*"}
+	if at := strings.LastIndex(identity, "@"); at >= 0 {
+		patterns = append(patterns, "*"+identity[at:])
+	}
+	return patterns
+}
+
+// identityAllowed reports whether identity, which is empty if the user has not
+// been identified, matches one of allowed.
+func identityAllowed(identity string, allowed []string) bool {
+	if identity == "" {
+		return false
+	}
+	for _, pattern := range identityPatterns(strings.ToLower(identity)) {
+		for _, a := range allowed {
+			if a == pattern {
+				return true
+			}
+		}
+	}
+	return false
+}
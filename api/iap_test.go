@@ -0,0 +1,200 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testAudience = "/projects/123/global/backendServices/456"
+
+// testIAP serves a key set holding a single generated key and signs
+// assertions with it.
+type testIAP struct {
+	t      *testing.T
+	key    *ecdsa.PrivateKey
+	server *httptest.Server
+}
+
+func newTestIAP(t *testing.T) *testIAP {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	iap := &testIAP{t: t, key: key}
+	iap.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "test",
+				"kty": "EC",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+				"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+			}},
+		})
+	}))
+	return iap
+}
+
+func (iap *testIAP) sign(kid string, claims map[string]interface{}) string {
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			iap.t.Fatalf("Failed to encode assertion: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": "ES256", "kid": kid}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, iap.key, digest[:])
+	if err != nil {
+		iap.t.Fatalf("Failed to sign assertion: %v", err)
+	}
+	signature := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rb):], rb)
+	copy(signature[64-len(sb):], sb)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (iap *testIAP) verifier() *iapVerifier {
+	return &iapVerifier{audience: testAudience, keysURL: iap.server.URL, client: http.DefaultClient}
+}
+
+func claimsFor(email string, now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"aud":   testAudience,
+		"iss":   iapIssuer,
+		"iat":   now.Unix(),
+		"exp":   now.Add(10 * time.Minute).Unix(),
+		"email": "accounts.google.com:" + email,
+	}
+}
+
+func TestIAPVerifier(t *testing.T) {
+	iap := newTestIAP(t)
+	defer iap.server.Close()
+
+	now := time.Now()
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := claimsFor("user@example.com", now)
+		claims[key] = value
+		return claims
+	}
+	testCases := []struct {
+		name      string
+		assertion string
+		ok        bool
+	}{
+		{"valid", iap.sign("test", claimsFor("user@example.com", now)), true},
+		{"wrong audience", iap.sign("test", with("aud", "/projects/999/apps/other")), false},
+		{"wrong issuer", iap.sign("test", with("iss", "https://example.com")), false},
+		{"expired", iap.sign("test", with("exp", now.Add(-time.Hour).Unix())), false},
+		{"issued in the future", iap.sign("test", with("iat", now.Add(time.Hour).Unix())), false},
+		{"no email", iap.sign("test", with("email", "")), false},
+		{"unknown key", iap.sign("other", claimsFor("user@example.com", now)), false},
+		{"tampered", iap.sign("test", claimsFor("user@example.com", now)) + "x", false},
+		{"malformed", "not-a-jwt", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			identity, err := iap.verifier().verify(context.Background(), tc.assertion, now)
+			if tc.ok && err != nil {
+				t.Fatalf("verify() returned error: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatalf("verify() succeeded for identity %q, want error", identity)
+			}
+			if tc.ok && identity != "user@example.com" {
+				t.Errorf("Wrong identity: got %q, want %q", identity, "user@example.com")
+			}
+		})
+	}
+}
+
+func TestIAPRequests(t *testing.T) {
+	iap := newTestIAP(t)
+	defer iap.server.Close()
+
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	withIAP := func(server *Server) {
+		server.SetIAPAuth(testAudience, map[string][]string{
+			"Alice@example.com": {"testdata"},
+			"*@trusted.org":     {"testdata"},
+			"*":                 {"public"},
+		})
+		server.iap.keysURL = iap.server.URL
+	}
+
+	testCases := []struct {
+		name   string
+		email  string
+		status int
+	}{
+		{"no assertion", "", http.StatusUnauthorized},
+		{"permitted user", "alice@example.com", http.StatusOK},
+		{"permitted domain", "bob@trusted.org", http.StatusOK},
+		{"other user", "carol@example.com", http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/reads/testdata/NA12878.chr20.sample.bam", nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			if tc.email != "" {
+				req.Header.Set(iapHeader, iap.sign("test", claimsFor(tc.email, time.Now())))
+			}
+			resp := testRequest(ctx, t, req, withIAP)
+			if got, want := resp.StatusCode, tc.status; got != want {
+				t.Errorf("Wrong status code: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestIdentityAllowed(t *testing.T) {
+	allowed := []string{"alice@example.com", "*@trusted.org"}
+	testCases := []struct {
+		identity string
+		want     bool
+	}{
+		{"Alice@example.com", true},
+		{"bob@trusted.org", true},
+		{"carol@example.com", false},
+		{"", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.identity, func(t *testing.T) {
+			if got := identityAllowed(tc.identity, allowed); got != tc.want {
+				t.Errorf("Wrong result: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+	if !identityAllowed("anyone@example.com", []string{"*"}) {
+		t.Errorf("Expected * to allow every identity")
+	}
+}
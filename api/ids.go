@@ -0,0 +1,274 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// idAliases maps stable readset IDs to the bucket/object paths that currently
+// hold the data.  It is safe for concurrent use.
+type idAliases struct {
+	mu         sync.RWMutex
+	targets    map[string]idAlias
+	shortcuts  []string // IDs ending in "*", longest first.
+	byTarget   map[string][]idAlias
+	patterns   []idAlias // Aliases whose targets contain "*".
+	generation int64
+}
+
+// idAlias is the target of a readset ID.  If the ID ends in "*" the alias is
+// a dataset shortcut: it matches every ID that starts with the rest of the
+// ID, and the remainder of the matching ID replaces the "*" in target.  If
+// identities is not empty, only users whose verified identity matches one of
+// them (as for SetIAPAuth) may use the alias, or read its target unless
+// another alias targets it without restriction.
+type idAlias struct {
+	target     string
+	identities []string
+}
+
+// lookup returns the alias that id refers to, with any "*" in its target
+// replaced, if id is an alias or matches a shortcut.
+func (aliases *idAliases) lookup(id string) (idAlias, bool) {
+	aliases.mu.RLock()
+	defer aliases.mu.RUnlock()
+	if alias, ok := aliases.targets[id]; ok {
+		return alias, true
+	}
+	for _, shortcut := range aliases.shortcuts {
+		prefix := strings.TrimSuffix(shortcut, "*")
+		if rest := strings.TrimPrefix(id, prefix); rest != id && rest != "" {
+			alias := aliases.targets[shortcut]
+			alias.target = strings.Replace(alias.target, "*", rest, 1)
+			return alias, true
+		}
+	}
+	return idAlias{}, false
+}
+
+// matches reports whether path is the target of alias, or matches it with a
+// non-empty replacement for the "*".
+func (alias idAlias) matches(path string) bool {
+	i := strings.Index(alias.target, "*")
+	if i < 0 {
+		return path == alias.target
+	}
+	prefix, suffix := alias.target[:i], alias.target[i+1:]
+	return len(path) > len(prefix)+len(suffix) && strings.HasPrefix(path, prefix) && strings.HasSuffix(path, suffix)
+}
+
+// allowedIdentities returns the identities that may read the bucket/object
+// path if every alias that targets it is restricted, and reports whether that
+// is the case.
+func (aliases *idAliases) allowedIdentities(path string) ([]string, bool) {
+	aliases.mu.RLock()
+	defer aliases.mu.RUnlock()
+
+	var identities []string
+	for _, candidates := range [][]idAlias{aliases.byTarget[path], aliases.patterns} {
+		for _, alias := range candidates {
+			if !alias.matches(path) {
+				continue
+			}
+			if len(alias.identities) == 0 {
+				return nil, false
+			}
+			identities = append(identities, alias.identities...)
+		}
+	}
+	return identities, len(identities) > 0
+}
+
+func (aliases *idAliases) set(targets map[string]idAlias, generation int64) {
+	var (
+		shortcuts []string
+		patterns  []idAlias
+		byTarget  = make(map[string][]idAlias)
+	)
+	for id, alias := range targets {
+		if strings.HasSuffix(id, "*") {
+			shortcuts = append(shortcuts, id)
+			patterns = append(patterns, alias)
+		} else {
+			byTarget[alias.target] = append(byTarget[alias.target], alias)
+		}
+	}
+	sort.Slice(shortcuts, func(i, j int) bool {
+		return len(shortcuts[i]) > len(shortcuts[j])
+	})
+
+	aliases.mu.Lock()
+	defer aliases.mu.Unlock()
+	aliases.targets = targets
+	aliases.shortcuts = shortcuts
+	aliases.byTarget = byTarget
+	aliases.patterns = patterns
+	aliases.generation = generation
+}
+
+func (aliases *idAliases) currentGeneration() int64 {
+	aliases.mu.RLock()
+	defer aliases.mu.RUnlock()
+	return aliases.generation
+}
+
+// reload reads the alias mapping from object if it has changed since it was
+// last loaded.  It reports whether a new mapping was loaded.
+func (aliases *idAliases) reload(ctx context.Context, breaker *circuitBreaker, object *storage.ObjectHandle) (bool, error) {
+	attrs, err := objectAttrs(ctx, breaker, object)
+	if err != nil {
+		return false, fmt.Errorf("reading attributes: %v", err)
+	}
+	if attrs.Generation != 0 && attrs.Generation == aliases.currentGeneration() {
+		return false, nil
+	}
+
+	r, err := newRangeReader(ctx, breaker, object.Generation(attrs.Generation), 0, -1)
+	if err != nil {
+		return false, fmt.Errorf("opening: %v", err)
+	}
+	defer r.Close()
+
+	targets, err := parseIDAliases(r)
+	if err != nil {
+		return false, err
+	}
+	aliases.set(targets, attrs.Generation)
+	return true, nil
+}
+
+// parseIDAliases reads a mapping from readset IDs to bucket/object paths from
+// r.  Each line holds an ID and its path separated by whitespace, optionally
+// followed by "allow=" and a comma-separated list of the identities that may
+// use the ID.  An ID may end in "*" if its path contains a single "*".  Blank
+// lines and lines starting with # are ignored.
+func parseIDAliases(r io.Reader) (map[string]idAlias, error) {
+	targets := make(map[string]idAlias)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 && (len(fields) != 3 || !strings.HasPrefix(fields[2], "allow=")) {
+			return nil, fmt.Errorf("line %d: expected an ID, a bucket/object path and optionally allowed identities", line)
+		}
+		id, alias := fields[0], idAlias{target: fields[1]}
+		if len(fields) == 3 {
+			for _, identity := range strings.Split(strings.TrimPrefix(fields[2], "allow="), ",") {
+				if identity == "" {
+					return nil, fmt.Errorf("line %d: empty identity", line)
+				}
+				alias.identities = append(alias.identities, strings.ToLower(identity))
+			}
+		}
+
+		wildcards := strings.Count(alias.target, "*")
+		if strings.HasSuffix(id, "*") {
+			if strings.Count(id, "*") != 1 || wildcards != 1 {
+				return nil, fmt.Errorf("line %d: a shortcut must end in a single * and its path must contain a single *", line)
+			}
+		} else if strings.Contains(id, "*") || wildcards != 0 {
+			return nil, fmt.Errorf("line %d: * may only end an ID", line)
+		}
+		if _, _, err := parseID(strings.Replace(alias.target, "*", "x", 1)); err != nil {
+			return nil, fmt.Errorf("line %d: invalid path %q", line, alias.target)
+		}
+		if _, ok := targets[id]; ok {
+			return nil, fmt.Errorf("line %d: duplicate ID %q", line, id)
+		}
+		targets[id] = alias
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading: %v", err)
+	}
+	return targets, nil
+}
+
+// WatchIDAliases loads a mapping from readset IDs to bucket/object paths from
+// object and checks it for changes every interval until ctx is done.  This
+// lets dataset curators publish stable IDs (such as /reads/NA12878) without
+// redeploying the server.  The mapping must load successfully the first time;
+// if a later reload fails the previous mapping stays in use.  IDs that are not
+// in the mapping are interpreted as bucket/object paths as usual.
+func (server *Server) WatchIDAliases(ctx context.Context, object *storage.ObjectHandle, interval time.Duration) error {
+	name := fmt.Sprintf("gs://%s/%s", object.BucketName(), object.ObjectName())
+	if _, err := server.idAliases.reload(ctx, server.breaker, object); err != nil {
+		return fmt.Errorf("loading ID aliases from %s: %v", name, err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			changed, err := server.idAliases.reload(ctx, server.breaker, object)
+			if err != nil {
+				log.Printf("Failed to reload ID aliases from %s: %v", name, err)
+			} else if changed {
+				log.Printf("Reloaded ID aliases from %s", name)
+			}
+		}
+	}()
+	return nil
+}
+
+// resolveID returns the bucket and object named by a readset ID, which is
+// either an alias loaded by WatchIDAliases or a bucket/object path.  Errors
+// are returned as apiErrors.
+func (server *Server) resolveID(ctx context.Context, id string) (string, string, error) {
+	if alias, ok := server.idAliases.lookup(id); ok {
+		if len(alias.identities) > 0 && !identityAllowed(identityFromContext(ctx), alias.identities) {
+			return "", "", newPermissionDeniedError("checking permissions", fmt.Errorf("ID %s may not be used by %q", id, identityFromContext(ctx)))
+		}
+		id = alias.target
+	}
+	bucket, object, err := parseID(id)
+	if err != nil {
+		return "", "", newInvalidInputError("parsing readset ID", err)
+	}
+	if err := server.checkAliasTarget(ctx, bucket, object); err != nil {
+		return "", "", err
+	}
+	return bucket, object, nil
+}
+
+// checkAliasTarget returns an error if the object is only the target of
+// aliases whose allowed identities do not include that of the request, so that
+// the restrictions of an alias cannot be avoided by naming its target (or
+// fetching its blocks) directly.  Errors are returned as apiErrors.
+func (server *Server) checkAliasTarget(ctx context.Context, bucket, object string) error {
+	identities, restricted := server.idAliases.allowedIdentities(bucket + "/" + object)
+	if restricted && !identityAllowed(identityFromContext(ctx), identities) {
+		return newPermissionDeniedError("checking permissions", fmt.Errorf("gs://%s/%s may not be read by %q", bucket, object, identityFromContext(ctx)))
+	}
+	return nil
+}
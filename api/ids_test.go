@@ -0,0 +1,185 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+)
+
+func TestParseIDAliases(t *testing.T) {
+	input := `# Stable IDs for the 1000 Genomes samples.
+NA12878	testdata/NA12878.chr20.sample.bam
+
+  NA12891   other-bucket/path/to/NA12891.bam
+1000genomes/*  genomics-public-data/1000-genomes/bam/*.bam  allow=Alice@example.com,*@trusted.org
+`
+	got, err := parseIDAliases(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Failed to parse aliases: %v", err)
+	}
+	want := map[string]idAlias{
+		"NA12878": {target: "testdata/NA12878.chr20.sample.bam"},
+		"NA12891": {target: "other-bucket/path/to/NA12891.bam"},
+		"1000genomes/*": {
+			target:     "genomics-public-data/1000-genomes/bam/*.bam",
+			identities: []string{"alice@example.com", "*@trusted.org"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong aliases: got %v, want %v", got, want)
+	}
+}
+
+func TestParseIDAliases_Errors(t *testing.T) {
+	testCases := []struct {
+		name, input string
+	}{
+		{"missing path", "NA12878\n"},
+		{"extra field", "NA12878 bucket/object extra\n"},
+		{"no object", "NA12878 bucket\n"},
+		{"duplicate", "NA12878 bucket/a.bam\nNA12878 bucket/b.bam\n"},
+		{"empty identity", "NA12878 bucket/object allow=a@example.com,\n"},
+		{"wildcard inside ID", "data/*/x bucket/*.bam\n"},
+		{"wildcard without target", "data/* bucket/object.bam\n"},
+		{"target without wildcard", "data bucket/*.bam\n"},
+		{"two wildcards", "data/* bucket/*/*.bam\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseIDAliases(strings.NewReader(tc.input)); err == nil {
+				t.Errorf("Expected an error parsing %q", tc.input)
+			}
+		})
+	}
+}
+
+func TestIDAliasLookup(t *testing.T) {
+	var aliases idAliases
+	aliases.set(map[string]idAlias{
+		"NA12878":       {target: "bucket/exact.bam"},
+		"1000genomes/*": {target: "bucket/bam/*.bam"},
+		"1000genomes/high_coverage/*": {
+			target:     "bucket/high_coverage/*.cram.bam",
+			identities: []string{"*"},
+		},
+	}, 1)
+
+	testCases := []struct {
+		id, want string
+		ok       bool
+	}{
+		{"NA12878", "bucket/exact.bam", true},
+		{"1000genomes/NA12878", "bucket/bam/NA12878.bam", true},
+		{"1000genomes/high_coverage/NA12878", "bucket/high_coverage/NA12878.cram.bam", true},
+		{"1000genomes/", "", false},
+		{"NA12891", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.id, func(t *testing.T) {
+			alias, ok := aliases.lookup(tc.id)
+			if ok != tc.ok || alias.target != tc.want {
+				t.Errorf("Wrong lookup: got (%q, %v), want (%q, %v)", alias.target, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func TestIDAliasRequest(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	aliases := func(server *Server) {
+		server.idAliases.set(map[string]idAlias{
+			"NA12878":      {target: "testdata/NA12878.chr20.sample.bam"},
+			"samples/*":    {target: "testdata/*.sample.bam"},
+			"restricted/*": {target: "testdata/*.sample.bam", identities: []string{"alice@example.com"}},
+		}, 1)
+	}
+
+	testCases := []struct {
+		name string
+		url  string
+		code int
+	}{
+		{"alias", "/reads/NA12878?referenceName=chr20", http.StatusOK},
+		{"path", "/reads/testdata/NA12878.chr20.sample.bam?referenceName=chr20", http.StatusOK},
+		{"unknown alias", "/reads/NA12891?referenceName=chr20", http.StatusBadRequest},
+		{"shortcut", "/reads/samples/NA12878.chr20?referenceName=chr20", http.StatusOK},
+		{"restricted shortcut", "/reads/restricted/NA12878.chr20?referenceName=chr20", http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := testQuery(ctx, t, tc.url, aliases)
+			if got, want := resp.StatusCode, tc.code; got != want {
+				t.Errorf("Wrong status code: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestIDAliasRestrictsTarget(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	aliases := func(server *Server) {
+		server.idAliases.set(map[string]idAlias{
+			"private":  {target: "testdata/NA12878.chr20.sample.bam", identities: []string{"alice@example.com"}},
+			"public":   {target: "testdata/noindex.sample.bam"},
+			"shared/*": {target: "testdata/no*.sample.bam", identities: []string{"bob@example.com"}},
+		}, 1)
+	}
+
+	const target = "testdata/NA12878.chr20.sample.bam"
+	var chunk bytes.Buffer
+	if err := gob.NewEncoder(&chunk).Encode(bgzf.Chunk{End: bgzf.NewAddress(1024, 0)}); err != nil {
+		t.Fatalf("Failed to encode chunk: %v", err)
+	}
+	block := "/block/" + target + "?" + base64.URLEncoding.EncodeToString(chunk.Bytes())
+
+	testCases := []struct {
+		name     string
+		url      string
+		identity string
+		code     int
+	}{
+		{"target without identity", "/reads/" + target + "?referenceName=chr20", "", http.StatusForbidden},
+		{"target as another user", "/reads/" + target + "?referenceName=chr20", "bob@example.com", http.StatusForbidden},
+		{"target as allowed user", "/reads/" + target + "?referenceName=chr20", "alice@example.com", http.StatusOK},
+		{"metadata of target", "/metadata/" + target, "", http.StatusForbidden},
+		{"block of target", block, "", http.StatusForbidden},
+		{"block as allowed user", block, "alice@example.com", http.StatusOK},
+		// An unrestricted alias leaves its target open to everyone.
+		{"target of public alias", "/reads/testdata/noindex.sample.bam", "", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := ctx
+			if tc.identity != "" {
+				ctx = context.WithValue(ctx, identityKey{}, tc.identity)
+			}
+			resp := testQuery(ctx, t, tc.url, aliases)
+			if got, want := resp.StatusCode, tc.code; got != want {
+				t.Errorf("Wrong status code: got %d, want %d", got, want)
+			}
+		})
+	}
+}
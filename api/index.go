@@ -0,0 +1,319 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// defaultIndexTemplates find indexes named after the data object with either
+// .bai appended or replacing the .bam extension, falling back to a CSI index
+// with .csi appended (as used for references too long for BAI).
+var defaultIndexTemplates = mustParseIndexTemplates("{object}.bai", "{object%.bam}.bai", "{object}.csi")
+
+// indexTemplate describes how to derive the name of an index object from the
+// name of the data object.  The template is literal text containing at least
+// one {object} variable, which expands to the data object name, or
+// {object%suffix}, which expands to the name with suffix removed.
+type indexTemplate []templatePart
+
+// templatePart is either literal text or, if object is set, the data object
+// name with trim removed from its end.
+type templatePart struct {
+	text   string
+	object bool
+	trim   string
+}
+
+func parseIndexTemplate(template string) (indexTemplate, error) {
+	var (
+		parsed    indexTemplate
+		hasObject bool
+		unparsed  = template
+	)
+	for unparsed != "" {
+		open := strings.IndexAny(unparsed, "{}")
+		if open < 0 {
+			parsed = append(parsed, templatePart{text: unparsed})
+			break
+		}
+		if unparsed[open] == '}' {
+			return nil, errors.New("unexpected }")
+		}
+		if open > 0 {
+			parsed = append(parsed, templatePart{text: unparsed[:open]})
+		}
+		unparsed = unparsed[open+1:]
+
+		end := strings.IndexByte(unparsed, '}')
+		if end < 0 {
+			return nil, errors.New("unterminated variable")
+		}
+		variable := unparsed[:end]
+		unparsed = unparsed[end+1:]
+
+		parts := strings.SplitN(variable, "%", 2)
+		if parts[0] != "object" {
+			return nil, fmt.Errorf("unknown variable %q", parts[0])
+		}
+		part := templatePart{object: true}
+		if len(parts) == 2 {
+			if parts[1] == "" {
+				return nil, fmt.Errorf("empty suffix in %q", variable)
+			}
+			part.trim = parts[1]
+		}
+		parsed = append(parsed, part)
+		hasObject = true
+	}
+	if !hasObject {
+		return nil, errors.New("template does not contain {object}")
+	}
+	return parsed, nil
+}
+
+func mustParseIndexTemplates(templates ...string) []indexTemplate {
+	var parsed []indexTemplate
+	for _, template := range templates {
+		t, err := parseIndexTemplate(template)
+		if err != nil {
+			panic(fmt.Sprintf("parsing index template %q: %v", template, err))
+		}
+		parsed = append(parsed, t)
+	}
+	return parsed
+}
+
+// expand returns the name of the index for the data object called object.
+func (template indexTemplate) expand(object string) string {
+	var name string
+	for _, part := range template {
+		if part.object {
+			name += strings.TrimSuffix(object, part.trim)
+		} else {
+			name += part.text
+		}
+	}
+	return name
+}
+
+// SetIndexTemplates replaces the patterns used to locate the index of a BAM
+// file.  Each template is tried in order and the first index that exists is
+// used.  Templates contain {object}, which expands to the name of the BAM
+// object, or {object%suffix}, which expands to the name with suffix removed
+// (for example "{object%.bam}.bai" or "indexes/{object}.bai").
+func (server *Server) SetIndexTemplates(templates []string) error {
+	var parsed []indexTemplate
+	for _, template := range templates {
+		t, err := parseIndexTemplate(template)
+		if err != nil {
+			return fmt.Errorf("parsing index template %q: %v", template, err)
+		}
+		parsed = append(parsed, t)
+	}
+	if len(parsed) == 0 {
+		return errors.New("no index templates specified")
+	}
+	server.indexTemplates = parsed
+	return nil
+}
+
+// indexLocation is where the indexes for a data bucket are stored.
+type indexLocation struct {
+	bucket, prefix string
+}
+
+// SetBucketIndexLocation stores the indexes for BAM files in bucket in
+// indexBucket rather than alongside the data.  The index names produced by the
+// index templates are prefixed by prefix, which may be empty.
+func (server *Server) SetBucketIndexLocation(bucket, indexBucket, prefix string) {
+	server.indexLocations[bucket] = indexLocation{indexBucket, prefix}
+}
+
+// indexObjects returns the objects that may hold the index for the BAM file
+// object in bucket, in the order they should be tried.
+func (server *Server) indexObjects(gcs *storage.Client, bucket, object string) []*storage.ObjectHandle {
+	location, ok := server.indexLocations[bucket]
+	if !ok {
+		location = indexLocation{bucket: bucket}
+	}
+
+	var (
+		objects []*storage.ObjectHandle
+		seen    = make(map[string]bool)
+	)
+	for _, template := range server.indexTemplates {
+		name := location.prefix + template.expand(object)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		objects = append(objects, gcs.Bucket(location.bucket).Object(name))
+	}
+	return objects
+}
+
+// readBAMIndex reads the first of objects that exists, like readIndex, and
+// returns its decompressed content as a BAI or CSI index for the BAM file in
+// data.  The format is identified from the content rather than the object
+// name, so that a compressed BAI index is accepted and a tabix index stored
+// under a .bai name is reported as such rather than as a corrupt index.  The
+// attributes of data are read for the age check unless dataAttrs holds them
+// already.
+func (server *Server) readBAMIndex(ctx context.Context, headers http.Header, data *storage.ObjectHandle, dataAttrs *storage.ObjectAttrs, objects []*storage.ObjectHandle) ([]byte, error) {
+	key := flightKey(headers, "index", objects...)
+	var (
+		cacheKey, alias string
+		index           *storage.ObjectHandle
+		indexAttrs      *storage.ObjectAttrs
+	)
+	if server.indexCache != nil && dataAttrs == nil {
+		// The cached age check only holds for the generation of the data it was
+		// made against, so the index is not cached if that is unknown.
+		dataAttrs, _ = objectAttrs(ctx, server.breaker, data)
+	}
+	if server.indexCache != nil && dataAttrs != nil {
+		// Requests with the same credentials for the same generation of the
+		// data share an alias, which skips looking up the generation of the
+		// index and checking its age again.
+		dataKey := fmt.Sprintf(" for %s/%s#%d", data.BucketName(), data.ObjectName(), dataAttrs.Generation)
+		alias = key + dataKey
+		if cached, ok := server.indexCache.resolve(alias); ok {
+			return cached.index()
+		}
+		if index, indexAttrs = firstIndexAttrs(ctx, server.breaker, objects); indexAttrs != nil {
+			cacheKey = fmt.Sprintf("%s/%s#%d", index.BucketName(), index.ObjectName(), indexAttrs.Generation) + dataKey
+			if cached, ok := server.indexCache.get(cacheKey); ok {
+				server.indexCache.alias(alias, cacheKey)
+				return cached.index()
+			}
+			// Pin the generation so that the cached index matches its key.
+			objects = []*storage.ObjectHandle{index.Generation(indexAttrs.Generation)}
+			key = flightKey(headers, "index", objects...) + fmt.Sprintf("#%d", indexAttrs.Generation)
+		}
+	}
+
+	raw, err := server.readIndexKey(ctx, key, objects)
+	if err != nil {
+		return nil, err
+	}
+	if indexAttrs == nil {
+		index, indexAttrs = firstIndexAttrs(ctx, server.breaker, objects)
+	}
+	stale := server.checkIndexAge(ctx, data, dataAttrs, index, indexAttrs)
+	format, decoded, err := detectIndexFormat(raw)
+	if err != nil {
+		return nil, &parseError{"reading index", err}
+	}
+	switch format {
+	case "BAI", "CSI":
+		if cacheKey != "" {
+			server.indexCache.add(cacheKey, decoded, stale)
+			server.indexCache.alias(alias, cacheKey)
+		}
+		if stale != nil {
+			return nil, stale
+		}
+		return decoded, nil
+	case "TBI":
+		return nil, newUnsupportedFormatError(fmt.Errorf("index contains %s data, only BAI and CSI are supported", format))
+	}
+	return nil, &parseError{"reading index", errors.New("unrecognized index format")}
+}
+
+// requireBAI returns an error unless index, as returned by readBAMIndex, is a
+// BAI index.  The read counts and linear index that index statistics are
+// computed from are only read from BAI indexes.
+func requireBAI(index []byte) error {
+	if bytes.HasPrefix(index, []byte("CSI\x01")) {
+		return newUnsupportedFormatError(errors.New("index contains CSI data, only BAI is supported for index statistics"))
+	}
+	return nil
+}
+
+// firstIndexAttrs returns the first of objects that exists along with its
+// attributes, or a nil object and attributes if none can be found.  Errors are
+// left for the read of the index to report.
+func firstIndexAttrs(ctx context.Context, breaker *circuitBreaker, objects []*storage.ObjectHandle) (*storage.ObjectHandle, *storage.ObjectAttrs) {
+	for _, object := range objects {
+		if attrs, err := objectAttrs(ctx, breaker, object); err == nil {
+			return object, attrs
+		}
+	}
+	return nil, nil
+}
+
+// checkIndexAge compares the update times of data and index, either of whose
+// attributes may be nil if they have not been read yet.  An index that was last
+// updated before its data was almost certainly built for an earlier version of
+// it, so its offsets point at the wrong blocks, which shows up as corrupt
+// slices far from the cause.  In strict mode such an index is an error;
+// otherwise it is logged and used anyway.  Failures to read the attributes are
+// ignored, since they only stop the check.
+func (server *Server) checkIndexAge(ctx context.Context, data *storage.ObjectHandle, dataAttrs *storage.ObjectAttrs, index *storage.ObjectHandle, indexAttrs *storage.ObjectAttrs) error {
+	if index == nil || indexAttrs == nil || indexAttrs.Updated.IsZero() {
+		return nil
+	}
+	if dataAttrs == nil {
+		var err error
+		if dataAttrs, err = objectAttrs(ctx, server.breaker, data); err != nil {
+			return nil
+		}
+	}
+	if dataAttrs.Updated.IsZero() || !indexAttrs.Updated.Before(dataAttrs.Updated) {
+		return nil
+	}
+	err := fmt.Errorf("index gs://%s/%s (updated %v) predates gs://%s/%s (updated %v) and must be rebuilt",
+		index.BucketName(), index.ObjectName(), indexAttrs.Updated.UTC(),
+		data.BucketName(), data.ObjectName(), dataAttrs.Updated.UTC())
+	if server.strict {
+		return &parseError{"checking index", err}
+	}
+	log.Printf("Warning: %v", err)
+	return nil
+}
+
+// detectIndexFormat returns the name of the index format of data, by its
+// magic, and the decompressed index.  CSI and tabix indexes are always BGZF
+// compressed, and any index compressed with gzip is decompressed before its
+// magic is checked.
+func detectIndexFormat(data []byte) (string, []byte, error) {
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gzr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", nil, fmt.Errorf("opening archive: %v", err)
+		}
+		if data, err = ioutil.ReadAll(gzr); err != nil {
+			return "", nil, fmt.Errorf("decompressing index: %v", err)
+		}
+	}
+
+	for _, format := range []string{"BAI", "CSI", "TBI"} {
+		if bytes.HasPrefix(data, []byte(format+"\x01")) {
+			return format, data, nil
+		}
+	}
+	return "unknown", data, nil
+}
@@ -0,0 +1,333 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIndexTemplate(t *testing.T) {
+	testCases := []struct {
+		template, object, want string
+	}{
+		{"{object}.bai", "dir/sample.bam", "dir/sample.bam.bai"},
+		{"{object%.bam}.bai", "dir/sample.bam", "dir/sample.bai"},
+		{"{object%.bam}.bai", "dir/sample", "dir/sample.bai"},
+		{"indexes/{object}.bai", "dir/sample.bam", "indexes/dir/sample.bam.bai"},
+		{"{object}/{object%.bam}.bai", "sample.bam", "sample.bam/sample.bai"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.template, func(t *testing.T) {
+			template, err := parseIndexTemplate(tc.template)
+			if err != nil {
+				t.Fatalf("Failed to parse template: %v", err)
+			}
+			if got := template.expand(tc.object); got != tc.want {
+				t.Errorf("Wrong index name: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIndexTemplate_Errors(t *testing.T) {
+	testCases := []string{
+		"",
+		"sample.bai",
+		"{object",
+		"object}.bai",
+		"{name}.bai",
+		"{object%}.bai",
+	}
+	for _, tc := range testCases {
+		t.Run(tc, func(t *testing.T) {
+			if _, err := parseIndexTemplate(tc); err == nil {
+				t.Errorf("Expected an error parsing %q", tc)
+			}
+		})
+	}
+}
+
+func TestIndexTemplateRequest(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	testCases := []struct {
+		name      string
+		templates []string
+		code      int
+	}{
+		{"default", nil, http.StatusOK},
+		{"second template matches", []string{"{object}.idx", "{object%.sample.bam}.sample.bam.bai"}, http.StatusOK},
+		{"no template matches", []string{"{object}.idx", "{object%.bam}.bai"}, http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=chr20", func(server *Server) {
+				if tc.templates == nil {
+					return
+				}
+				if err := server.SetIndexTemplates(tc.templates); err != nil {
+					t.Fatalf("Failed to set index templates: %v", err)
+				}
+			})
+			if got, want := resp.StatusCode, tc.code; got != want {
+				t.Errorf("Wrong status code: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestBucketIndexLocation(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		indexes []string
+	)
+	fake := &fakeGCS{t}
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		// Only reads are recorded, not metadata requests.
+		if !isMetadataRequest(req) && strings.HasSuffix(req.URL.Path, ".bai") {
+			mu.Lock()
+			indexes = append(indexes, req.URL.Path)
+			mu.Unlock()
+		}
+		return fake.RoundTrip(req)
+	})}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, client)
+
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=chr20", func(server *Server) {
+		server.SetBucketIndexLocation("testdata", "indexes", "bam/")
+		server.SetBucketIndexLocation("other", "other-indexes", "")
+	})
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("Wrong status code: got %d, want %d", got, want)
+	}
+	if got, want := indexes, []string{"/indexes/bam/NA12878.chr20.sample.bam.bai"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong index requests: got %q, want %q", got, want)
+	}
+}
+
+// gzipped returns data compressed with gzip.
+func gzipped(t *testing.T, data []byte) []byte {
+	var buffer bytes.Buffer
+	gzw := gzip.NewWriter(&buffer)
+	if _, err := gzw.Write(data); err != nil {
+		t.Fatalf("Failed to compress data: %v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatalf("Failed to compress data: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDetectIndexFormat(t *testing.T) {
+	testCases := []struct {
+		name   string
+		data   []byte
+		format string
+		index  string
+	}{
+		{"BAI", []byte("BAI\x01rest"), "BAI", "BAI\x01rest"},
+		{"compressed BAI", gzipped(t, []byte("BAI\x01rest")), "BAI", "BAI\x01rest"},
+		{"CSI", gzipped(t, []byte("CSI\x01rest")), "CSI", "CSI\x01rest"},
+		{"tabix", gzipped(t, []byte("TBI\x01rest")), "TBI", "TBI\x01rest"},
+		{"unknown", []byte("not an index"), "unknown", "not an index"},
+		{"empty", nil, "unknown", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			format, index, err := detectIndexFormat(tc.data)
+			if err != nil {
+				t.Fatalf("detectIndexFormat failed: %v", err)
+			}
+			if format != tc.format {
+				t.Errorf("Wrong format: got %q, want %q", format, tc.format)
+			}
+			if string(index) != tc.index {
+				t.Errorf("Wrong index: got %q, want %q", index, tc.index)
+			}
+		})
+	}
+
+	if _, _, err := detectIndexFormat([]byte{0x1f, 0x8b, 0}); err == nil {
+		t.Errorf("detectIndexFormat succeeded with a corrupt archive")
+	}
+}
+
+func TestMislabeledIndex(t *testing.T) {
+	bai, err := ioutil.ReadFile("testdata/NA12878.chr20.sample.bam.bai")
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	const url = "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&start=0&end=12290800"
+
+	// serveIndex responds to index requests with index and to other requests
+	// with the test data.
+	serveIndex := func(index []byte) context.Context {
+		fake := &fakeGCS{t}
+		client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if !strings.HasSuffix(req.URL.Path, ".bai") {
+				return fake.RoundTrip(req)
+			}
+			w := httptest.NewRecorder()
+			w.Write(index)
+			return w.Result(), nil
+		})}
+		return context.WithValue(context.Background(), testHTTPClientKey, client)
+	}
+
+	want, _ := fetchTicketData(serveIndex(bai), t, url)
+	got, _ := fetchTicketData(serveIndex(gzipped(t, bai)), t, url)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Compressed index returned different data")
+	}
+
+	expectError(t, "UnsupportedFormat", http.StatusBadRequest, testQuery(serveIndex(gzipped(t, []byte("TBI\x01"))), t, url))
+	if got, want := testQuery(serveIndex([]byte("not an index")), t, url).StatusCode, http.StatusInternalServerError; got != want {
+		t.Errorf("Wrong status code for an unrecognized index: got %d, want %d", got, want)
+	}
+}
+
+func TestCSIIndex(t *testing.T) {
+	const url = "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&start=0&end=12290800"
+
+	// The CSI index in the test data is used once the BAI index is missing.
+	fake := &fakeGCS{t}
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, ".bai") {
+			w := httptest.NewRecorder()
+			http.NotFound(w, req)
+			return w.Result(), nil
+		}
+		return fake.RoundTrip(req)
+	})}
+	withoutBAI := context.WithValue(context.Background(), testHTTPClientKey, client)
+
+	want, _ := fetchTicketData(context.WithValue(context.Background(), testHTTPClientKey, &http.Client{Transport: fake}), t, url)
+	got, _ := fetchTicketData(withoutBAI, t, url)
+	if len(got) == 0 || !bytes.Equal(got, want) {
+		t.Errorf("CSI index returned different data (%d bytes, want %d)", len(got), len(want))
+	}
+
+	// Index statistics are only read from BAI indexes.
+	expectError(t, "UnsupportedFormat", http.StatusBadRequest, testQuery(withoutBAI, t, "/index-stats/testdata/NA12878.chr20.sample.bam"))
+}
+
+func TestStaleIndex(t *testing.T) {
+	const url = "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&start=0&end=12290800"
+	updated := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// withIndexAge reports the data as last updated at updated and the index
+	// as updated age later.
+	withIndexAge := func(age time.Duration) context.Context {
+		client := &http.Client{Transport: versionedGCS(func(name string) (int64, time.Time) {
+			if strings.HasSuffix(name, ".bai") {
+				return 1, updated.Add(age)
+			}
+			return 1, updated
+		})}
+		return context.WithValue(context.Background(), testHTTPClientKey, client)
+	}
+
+	testCases := []struct {
+		name   string
+		age    time.Duration
+		strict bool
+		code   int
+	}{
+		{"newer index", time.Hour, false, http.StatusOK},
+		{"newer index, strict", time.Hour, true, http.StatusOK},
+		{"same time", 0, true, http.StatusOK},
+		{"stale index", -time.Hour, false, http.StatusOK},
+		{"stale index, strict", -time.Hour, true, http.StatusInternalServerError},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := testQuery(withIndexAge(tc.age), t, url, func(server *Server) {
+				server.SetStrict(tc.strict)
+				server.SetAdvertisedURL("https://example.com")
+			})
+			if got, want := resp.StatusCode, tc.code; got != want {
+				t.Errorf("Wrong status code: got %d, want %d", got, want)
+			}
+		})
+	}
+
+	// The result of the check is cached along with the index.
+	cache := newIndexCache(1<<20, 0)
+	for i := 0; i < 2; i++ {
+		resp := testQuery(withIndexAge(-time.Hour), t, url, func(server *Server) {
+			server.SetStrict(true)
+			server.indexCache = cache
+		})
+		if got, want := resp.StatusCode, http.StatusInternalServerError; got != want {
+			t.Errorf("Wrong status code for request %d: got %d, want %d", i, got, want)
+		}
+	}
+	if hits, misses := cache.counts(); hits != 1 || misses != 1 {
+		t.Errorf("Wrong counts: got %d hits and %d misses, want 1 and 1", hits, misses)
+	}
+}
+
+func TestStaleIndexAfterRewrite(t *testing.T) {
+	const url = "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&start=0&end=12290800"
+	indexed := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// The data starts out older than its index.
+	var (
+		mu          sync.Mutex
+		generation  = int64(1)
+		dataUpdated = indexed.Add(-time.Hour)
+	)
+	client := &http.Client{Transport: versionedGCS(func(name string) (int64, time.Time) {
+		if strings.HasSuffix(name, ".bai") {
+			return 1, indexed
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return generation, dataUpdated
+	})}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, client)
+
+	cache := newIndexCache(1<<20, 0)
+	query := func() int {
+		resp := testQuery(ctx, t, url, func(server *Server) {
+			server.SetStrict(true)
+			server.SetAdvertisedURL("https://example.com")
+			server.indexCache = cache
+		})
+		return resp.StatusCode
+	}
+	if got, want := query(), http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %d, want %d", got, want)
+	}
+
+	// Rewriting the data leaves the cached index behind it.
+	mu.Lock()
+	generation, dataUpdated = 2, indexed.Add(time.Hour)
+	mu.Unlock()
+	if got, want := query(), http.StatusInternalServerError; got != want {
+		t.Errorf("Wrong status code after rewriting the data: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// indexCache is a size-bounded, in-memory cache of recently read indexes,
+// evicting the least recently used entries first.  Entries are keyed by the
+// generations of the index object and of the data it indexes, and expire after
+// a fixed time.  Aliases map the unpinned names of an index, as read with
+// particular credentials for a generation of the data, to the entry they last
+// resolved to for a short time, so that repeated requests can skip looking up
+// the generation of the index.  It is safe for concurrent use.
+type indexCache struct {
+	limit int64
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu           sync.Mutex
+	size         int64
+	hits, misses int64
+	lru          *list.List // Of *cachedIndex, most recently used first.
+	entries      map[string]*list.Element
+}
+
+// aliasTTL is the longest time that an alias is used before the generation of
+// the index is looked up again, which bounds how long a rebuilt index can go
+// unnoticed.
+const aliasTTL = 30 * time.Second
+
+// cachedIndex holds a decompressed index, the result of checking its age
+// against the data it indexes and the time it expires.  An alias holds the key
+// of the entry it refers to in target instead.
+type cachedIndex struct {
+	key     string
+	data    []byte
+	stale   error
+	target  string
+	expires time.Time
+}
+
+// size returns the number of bytes that entry counts against the limit.
+func (entry *cachedIndex) size() int64 {
+	if entry.target != "" {
+		return int64(len(entry.key) + len(entry.target))
+	}
+	return int64(len(entry.data))
+}
+
+// index returns the cached index, or the error that its age check reported.
+func (entry *cachedIndex) index() ([]byte, error) {
+	if entry.stale != nil {
+		return nil, entry.stale
+	}
+	return entry.data, nil
+}
+
+func newIndexCache(limit int64, ttl time.Duration) *indexCache {
+	return &indexCache{
+		limit:   limit,
+		ttl:     ttl,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the entry stored for key, if there is one that has not expired.
+// Every call counts as either a hit or a miss.
+func (c *indexCache) get(key string) (*cachedIndex, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.lookup(key)
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return entry, true
+}
+
+// resolve is like get, but returns the entry that the alias name refers to.
+// Only hits are counted, since a miss is followed by a call to get.
+func (c *indexCache) resolve(name string) (*cachedIndex, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	alias, ok := c.lookup(name)
+	if !ok || alias.target == "" {
+		return nil, false
+	}
+	entry, ok := c.lookup(alias.target)
+	if !ok {
+		return nil, false
+	}
+	c.hits++
+	return entry, true
+}
+
+// lookup returns the entry for key, removing it if it has expired.  It must be
+// called with mu held.
+func (c *indexCache) lookup(key string) (*cachedIndex, bool) {
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cachedIndex)
+	if !entry.expires.IsZero() && !c.now().Before(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry, true
+}
+
+// add stores data as the index for key, along with stale, the result of its
+// age check, evicting older entries to make room.  Indexes larger than the
+// whole cache are not stored.
+func (c *indexCache) add(key string, data []byte, stale error) {
+	c.store(&cachedIndex{key: key, data: data, stale: stale}, c.ttl)
+}
+
+// alias makes name refer to the entry for key for at most aliasTTL.
+func (c *indexCache) alias(name, key string) {
+	ttl := aliasTTL
+	if c.ttl > 0 && c.ttl < ttl {
+		ttl = c.ttl
+	}
+	c.store(&cachedIndex{key: name, target: key}, ttl)
+}
+
+// store adds entry to the cache, to expire after ttl (zero keeps it until it
+// is evicted).
+func (c *indexCache) store(entry *cachedIndex, ttl time.Duration) {
+	size := entry.size()
+	if size > c.limit {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ttl > 0 {
+		entry.expires = c.now().Add(ttl)
+	}
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+	for c.size > c.limit {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops element from the cache.  It must be called with mu held.
+func (c *indexCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cachedIndex)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// counts returns the number of lookups that were and were not answered from
+// the cache.
+func (c *indexCache) counts() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// SetIndexCache keeps up to limit bytes of decompressed indexes in memory so
+// that requests for the same readset do not each read and parse its index
+// again.  Entries are keyed by the generations of the index object and of the
+// BAM file, so that neither a rebuilt index nor rewritten data is served an
+// outdated entry, and hold the result of checking the index against the age of
+// its data.  They are dropped after ttl (zero keeps them until they are
+// evicted) so that the indexes of replaced or deleted objects do not hold
+// memory on a lightly loaded server.  A request reads the index object's
+// attributes with its own credentials, which also checks that it may read the
+// index, unless a request with the same credentials did so for the same data
+// within aliasTTL, so a rebuilt index can take that long to be noticed.  The hits and misses are reported by the metrics endpoint.
+func (server *Server) SetIndexCache(limit int64, ttl time.Duration) {
+	if limit <= 0 {
+		server.indexCache = nil
+		return
+	}
+	server.indexCache = newIndexCache(limit, ttl)
+}
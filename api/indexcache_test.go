@@ -0,0 +1,143 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIndexCache(t *testing.T) {
+	c := newIndexCache(10, time.Minute)
+	now := time.Unix(0, 0)
+	c.now = func() time.Time { return now }
+
+	c.add("a", []byte("aaaa"), nil)
+	c.add("b", []byte("bbbb"), nil)
+	if got, ok := c.get("a"); !ok || string(got.data) != "aaaa" {
+		t.Errorf("Wrong entry for a: got %v (found %v)", got, ok)
+	}
+
+	// Reading a made b the least recently used entry, so it is evicted.
+	c.add("c", []byte("cccc"), nil)
+	if _, ok := c.get("b"); ok {
+		t.Errorf("Entry b was not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("Entry %s was evicted", key)
+		}
+	}
+
+	c.add("d", []byte("ddddddddddd"), nil)
+	if _, ok := c.get("d"); ok {
+		t.Errorf("Entry larger than the cache was stored")
+	}
+	if got, want := c.size, int64(8); got != want {
+		t.Errorf("Wrong cache size: got %d, want %d", got, want)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("a"); ok {
+		t.Errorf("Expired entry a was returned")
+	}
+	if got, want := c.size, int64(4); got != want {
+		t.Errorf("Wrong cache size after expiry: got %d, want %d", got, want)
+	}
+
+	hits, misses := c.counts()
+	if hits != 3 || misses != 3 {
+		t.Errorf("Wrong counts: got %d hits and %d misses, want 3 and 3", hits, misses)
+	}
+}
+
+func TestIndexCacheAlias(t *testing.T) {
+	c := newIndexCache(100, time.Hour)
+	now := time.Unix(0, 0)
+	c.now = func() time.Time { return now }
+
+	c.add("a#1", []byte("aaaa"), nil)
+	c.alias("a", "a#1")
+	if got, ok := c.resolve("a"); !ok || string(got.data) != "aaaa" {
+		t.Errorf("Wrong entry for alias a: got %v (found %v)", got, ok)
+	}
+	if _, ok := c.resolve("a#1"); ok {
+		t.Errorf("Entry a#1 was resolved as an alias")
+	}
+
+	// Aliases expire well before the entries they refer to.
+	now = now.Add(aliasTTL)
+	if _, ok := c.resolve("a"); ok {
+		t.Errorf("Expired alias a was resolved")
+	}
+	if _, ok := c.get("a#1"); !ok {
+		t.Errorf("Entry a#1 expired with its alias")
+	}
+
+	hits, misses := c.counts()
+	if hits != 2 || misses != 0 {
+		t.Errorf("Wrong counts: got %d hits and %d misses, want 2 and 0", hits, misses)
+	}
+}
+
+func TestIndexCacheRequest(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		reads int
+	)
+	fake := &fakeGCS{t}
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if !isMetadataRequest(req) && strings.HasSuffix(req.URL.Path, ".bai") {
+			mu.Lock()
+			reads++
+			mu.Unlock()
+		}
+		return fake.RoundTrip(req)
+	})}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, client)
+
+	cache := newIndexCache(1<<20, 0)
+	for i := 0; i < 3; i++ {
+		resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=chr20&start=0&end=100000", func(server *Server) {
+			server.indexCache = cache
+		})
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("Wrong status code: got %d, want %d", got, want)
+		}
+	}
+	if got, want := reads, 1; got != want {
+		t.Errorf("Wrong number of index reads: got %d, want %d", got, want)
+	}
+	if hits, misses := cache.counts(); hits != 2 || misses != 1 {
+		t.Errorf("Wrong counts: got %d hits and %d misses, want 2 and 1", hits, misses)
+	}
+
+	// The cached bytes are the decompressed index, which the later requests
+	// found through an alias.
+	if got := len(cache.entries); got != 2 {
+		t.Fatalf("Wrong number of cache entries: got %d, want 2", got)
+	}
+	entry := cache.lru.Front().Value.(*cachedIndex)
+	if !strings.HasPrefix(string(entry.data), "BAI\x01") {
+		t.Errorf("Cached data does not start with the BAI magic: %q", entry.data[:4])
+	}
+	if !strings.Contains(entry.key, "NA12878.chr20.sample.bam.bai#") {
+		t.Errorf("Cache key %q does not name the index generation", entry.key)
+	}
+}
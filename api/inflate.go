@@ -0,0 +1,96 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/googlegenomics/htsget/ticket"
+)
+
+// inflateParameter is the reads query parameter that asks for block data
+// without BGZF compression.
+const inflateParameter = "inflate"
+
+// dataURLPrefix starts the data URLs that tickets embed data in.
+const dataURLPrefix = "data:;base64,"
+
+// acceptsInflated reports whether the Accept-Encoding header of req asks for
+// block data without BGZF compression, which is written as the element
+// identity;bgzf=no.  Browser-based readers can then skip BGZF inflation.
+func acceptsInflated(req *http.Request) bool {
+	for _, header := range req.Header["Accept-Encoding"] {
+		for _, element := range strings.Split(header, ",") {
+			params := strings.Split(element, ";")
+			if strings.TrimSpace(params[0]) != "identity" {
+				continue
+			}
+			for _, param := range params[1:] {
+				if strings.Replace(param, " ", "", -1) == "bgzf=no" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// inflate returns a reader for the decompressed contents of the size bytes of
+// BGZF data in r.  A negative size means that r may hold no data at all.
+func inflate(r io.Reader, size int64) (io.Reader, error) {
+	if size == 0 {
+		return bytes.NewReader(nil), nil
+	}
+	if size < 0 {
+		buffered := bufio.NewReader(r)
+		if _, err := buffered.Peek(1); err == io.EOF {
+			return bytes.NewReader(nil), nil
+		}
+		r = buffered
+	}
+	// BGZF blocks are gzip members, which the reader joins.
+	return gzip.NewReader(r)
+}
+
+// inflateDataURLs replaces the BGZF data embedded in the data URLs of urls
+// with its decompressed contents.
+func inflateDataURLs(urls []ticket.URL) error {
+	for i, u := range urls {
+		if !strings.HasPrefix(u.URL, dataURLPrefix) {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(u.URL[len(dataURLPrefix):])
+		if err != nil {
+			return fmt.Errorf("decoding data URL: %v", err)
+		}
+		r, err := inflate(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return fmt.Errorf("inflating data URL: %v", err)
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return fmt.Errorf("inflating data URL: %v", err)
+		}
+		urls[i].URL = dataURLPrefix + base64.StdEncoding.EncodeToString(data)
+	}
+	return nil
+}
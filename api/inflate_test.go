@@ -0,0 +1,159 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/googlegenomics/htsget/ticket"
+)
+
+func TestAcceptsInflated(t *testing.T) {
+	testCases := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"identity", false},
+		{"gzip, deflate", false},
+		{"identity;bgzf=no", true},
+		{"gzip, identity; bgzf=no", true},
+		{"identity;q=0.5;bgzf=no", true},
+		{"gzip;bgzf=no", false},
+		{"identity;bgzf=yes", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.header, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/block/bucket/object", nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			if tc.header != "" {
+				req.Header.Set("Accept-Encoding", tc.header)
+			}
+			if got := acceptsInflated(req); got != tc.want {
+				t.Errorf("Wrong result: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInflatedBlocks(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	const url = "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&start=10000000&end=10100000"
+
+	compressed, _ := fetchTicketData(ctx, t, url)
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("Failed to open data: %v", err)
+	}
+	want, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to inflate data: %v", err)
+	}
+
+	t.Run("query", func(t *testing.T) {
+		got, _ := fetchTicketData(ctx, t, url+"&inflate=true")
+		if !bytes.Equal(got, want) {
+			t.Errorf("Wrong data: got %d bytes, want %d bytes", len(got), len(want))
+		}
+	})
+
+	t.Run("accept-encoding", func(t *testing.T) {
+		var body struct {
+			Htsget struct {
+				URLs []struct {
+					URL string `json:"url"`
+				} `json:"urls"`
+			} `json:"htsget"`
+		}
+		if err := json.NewDecoder(testQuery(ctx, t, url).Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+
+		var got []byte
+		for _, u := range body.Htsget.URLs {
+			if strings.HasPrefix(u.URL, dataURLPrefix) {
+				data, err := base64.StdEncoding.DecodeString(u.URL[len(dataURLPrefix):])
+				if err != nil {
+					t.Fatalf("Failed to decode data URL: %v", err)
+				}
+				r, err := inflate(bytes.NewReader(data), int64(len(data)))
+				if err != nil {
+					t.Fatalf("Failed to inflate data URL: %v", err)
+				}
+				data, _ = ioutil.ReadAll(r)
+				got = append(got, data...)
+				continue
+			}
+
+			req, err := http.NewRequest("GET", u.URL, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("Accept-Encoding", "identity;bgzf=no")
+			resp := testRequest(ctx, t, req)
+			if got, want := resp.StatusCode, http.StatusOK; got != want {
+				t.Fatalf("Wrong block status code: got %d, want %d", got, want)
+			}
+			if got := resp.Header.Get("Content-Length"); got != "" {
+				t.Errorf("Unexpected Content-Length %q", got)
+			}
+			if got := resp.Header.Get("ETag"); !strings.HasSuffix(got, `-inflated"`) {
+				t.Errorf("Wrong ETag: got %q", got)
+			}
+			if got, want := resp.Header.Get("Vary"), "Accept-Encoding"; got != want {
+				t.Errorf("Wrong Vary header: got %q, want %q", got, want)
+			}
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Failed to read block: %v", err)
+			}
+			got = append(got, data...)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Wrong data: got %d bytes, want %d bytes", len(got), len(want))
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		expectError(t, "InvalidInput", http.StatusBadRequest, testQuery(ctx, t, url+"&inflate=maybe"))
+	})
+}
+
+func TestInflateDataURLs(t *testing.T) {
+	urls := []ticket.URL{
+		{URL: eofMarkerDataURL},
+		{URL: "https://example.com/block"},
+	}
+	if err := inflateDataURLs(urls); err != nil {
+		t.Fatalf("Failed to inflate data URLs: %v", err)
+	}
+	if got, want := urls[0].URL, dataURLPrefix; got != want {
+		t.Errorf("Wrong EOF marker URL: got %q, want %q", got, want)
+	}
+	if got, want := urls[1].URL, "https://example.com/block"; got != want {
+		t.Errorf("Wrong block URL: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipFilter decides which client addresses may use the API.  Addresses in a
+// denied network are always rejected; if any networks are allowed, addresses
+// outside all of them are rejected too.
+type ipFilter struct {
+	allow, deny []*net.IPNet
+}
+
+// permits reports whether a client at ip may use the API.  A nil ip (such as
+// a client connected via a unix socket) only matches an empty allow list.
+func (f *ipFilter) permits(ip net.IP) bool {
+	if ip == nil {
+		return len(f.allow) == 0
+	}
+	for _, network := range f.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, network := range f.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses a list of CIDR blocks.  Bare addresses are treated as
+// networks containing just that address.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", network)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", network, err)
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
+}
+
+// clientIP returns the address of the client that sent req, or nil if it is
+// not connected over IP.
+func clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// filterIPs rejects requests from clients that are not permitted by the
+// server's IP filter before they reach handler.
+func (server *Server) filterIPs(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if server.ipFilter != nil {
+			if ip := clientIP(req); !server.ipFilter.permits(ip) {
+				writeError(w, newPermissionDeniedError("checking client address", fmt.Errorf("%q is not allowed", req.RemoteAddr)))
+				return
+			}
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	testCases := []struct {
+		name        string
+		allow, deny []string
+		remoteAddr  string
+		want        int
+	}{
+		{"no filter", nil, nil, "192.0.2.1:1234", http.StatusOK},
+		{"allowed network", []string{"10.0.0.0/8"}, nil, "10.1.2.3:1234", http.StatusOK},
+		{"outside allowed networks", []string{"10.0.0.0/8"}, nil, "192.0.2.1:1234", http.StatusForbidden},
+		{"allowed address", []string{"192.0.2.1"}, nil, "192.0.2.1:1234", http.StatusOK},
+		{"denied network", nil, []string{"192.0.2.0/24"}, "192.0.2.1:1234", http.StatusForbidden},
+		{"outside denied networks", nil, []string{"192.0.2.0/24"}, "198.51.100.1:1234", http.StatusOK},
+		{"deny overrides allow", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, "10.1.2.3:1234", http.StatusForbidden},
+		{"IPv6", []string{"2001:db8::/32"}, nil, "[2001:db8::1]:1234", http.StatusOK},
+		{"unix socket with allow list", []string{"10.0.0.0/8"}, nil, "@", http.StatusForbidden},
+		{"unix socket with deny list", nil, []string{"10.0.0.0/8"}, "@", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(nil, 0)
+			if err := server.SetIPFilter(tc.allow, tc.deny); err != nil {
+				t.Fatalf("Failed to set IP filter: %v", err)
+			}
+			handler := server.filterIPs(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+			req := httptest.NewRequest("GET", "/reads/bucket/object", nil)
+			req.RemoteAddr = tc.remoteAddr
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if got := w.Code; got != tc.want {
+				t.Errorf("Wrong status code: got %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetIPFilter_InvalidNetworks(t *testing.T) {
+	for _, network := range []string{"10.0.0.0/33", "not-an-address", "10.0.0"} {
+		t.Run(network, func(t *testing.T) {
+			if err := NewServer(nil, 0).SetIPFilter([]string{network}, nil); err == nil {
+				t.Errorf("Expected an error for %q", network)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// overloadRetryAfter is the delay suggested to clients whose requests are
+// rejected because too many are in flight.
+const overloadRetryAfter = time.Second
+
+var (
+	errServerBusy = errors.New("too many requests in flight, retry later")
+	errClientBusy = errors.New("too many requests in flight from this client, retry later")
+)
+
+// limiter bounds the number of requests that are handled concurrently, both
+// in total and for each client.  Requests beyond the total limit wait in a
+// queue of bounded length; requests beyond the queue length or the per-client
+// limit are rejected.  A nil *limiter allows all requests.
+type limiter struct {
+	slots     chan struct{}
+	perClient int
+	queue     int
+
+	mu      sync.Mutex
+	waiting int
+	clients map[string]int
+}
+
+// newLimiter returns a limiter that allows total concurrent requests (or any
+// number, if total is zero), perClient concurrent requests from a single
+// client (or any number, if perClient is zero) and queues up to queue requests
+// while waiting for a slot.
+func newLimiter(total, perClient, queue int) *limiter {
+	l := &limiter{
+		perClient: perClient,
+		queue:     queue,
+		clients:   make(map[string]int),
+	}
+	if total > 0 {
+		l.slots = make(chan struct{}, total)
+	}
+	return l
+}
+
+// acquire waits for a slot for a request from client.  On success, the
+// returned function must be called once the request has been handled.
+func (l *limiter) acquire(ctx context.Context, client string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	if l.perClient > 0 && l.clients[client] >= l.perClient {
+		l.mu.Unlock()
+		return nil, errClientBusy
+	}
+	l.clients[client]++
+	l.mu.Unlock()
+
+	if err := l.wait(ctx); err != nil {
+		l.releaseClient(client)
+		return nil, err
+	}
+	return func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+		l.releaseClient(client)
+	}, nil
+}
+
+// wait claims one of the total slots, queueing if none are free.
+func (l *limiter) wait(ctx context.Context) error {
+	if l.slots == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.waiting >= l.queue {
+		l.mu.Unlock()
+		return errServerBusy
+	}
+	l.waiting++
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+	}()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *limiter) releaseClient(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+}
+
+// SetReadsConcurrencyLimit bounds the number of ticket requests handled at
+// once to total, of which at most perClient may come from a single client
+// address.  Up to queue requests wait for a free slot; any others receive a
+// 503 Service Unavailable response.  Zero disables the corresponding limit.
+func (server *Server) SetReadsConcurrencyLimit(total, perClient, queue int) {
+	server.limiters[readsPath] = newLimiter(total, perClient, queue)
+}
+
+// SetBlockConcurrencyLimit is like SetReadsConcurrencyLimit but applies to
+// block requests, which can each hold a whole block in memory.
+func (server *Server) SetBlockConcurrencyLimit(total, perClient, queue int) {
+	server.limiters[blockPath] = newLimiter(total, perClient, queue)
+}
+
+// limit applies the concurrency limit for path to f.  The limiter is looked
+// up for each request so that limits may be set after Export is called.
+func (server *Server) limit(path string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var client string
+		if ip := clientIP(req); ip != nil {
+			client = ip.String()
+		}
+		release, err := server.limiters[path].acquire(req.Context(), client)
+		if err == errServerBusy || err == errClientBusy {
+			w.Header().Set("Retry-After", strconv.Itoa(int(overloadRetryAfter/time.Second)))
+			writeHTTPError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		if err != nil {
+			// The client gave up or its deadline passed while queued.
+			writeHTTPError(w, http.StatusServiceUnavailable, fmt.Errorf("waiting for a free slot: %v", err))
+			return
+		}
+		defer release()
+		f(w, req)
+	}
+}
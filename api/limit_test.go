@@ -0,0 +1,134 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Queue(t *testing.T) {
+	l := newLimiter(1, 0, 1)
+	ctx := context.Background()
+
+	release, err := l.acquire(ctx, "a")
+	if err != nil {
+		t.Fatalf("Failed to acquire first slot: %v", err)
+	}
+
+	queued := make(chan error)
+	go func() {
+		release, err := l.acquire(ctx, "b")
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+
+	// Wait for the second request to join the queue.
+	for {
+		l.mu.Lock()
+		waiting := l.waiting
+		l.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := l.acquire(ctx, "c"); err != errServerBusy {
+		t.Errorf("Wrong error with a full queue: got %v, want %v", err, errServerBusy)
+	}
+
+	release()
+	if err := <-queued; err != nil {
+		t.Errorf("Queued request failed: %v", err)
+	}
+}
+
+func TestLimiter_PerClient(t *testing.T) {
+	l := newLimiter(0, 1, 0)
+	ctx := context.Background()
+
+	release, err := l.acquire(ctx, "a")
+	if err != nil {
+		t.Fatalf("Failed to acquire slot: %v", err)
+	}
+	if _, err := l.acquire(ctx, "a"); err != errClientBusy {
+		t.Errorf("Wrong error for a busy client: got %v, want %v", err, errClientBusy)
+	}
+	other, err := l.acquire(ctx, "b")
+	if err != nil {
+		t.Errorf("Failed to acquire slot for another client: %v", err)
+	} else {
+		other()
+	}
+
+	release()
+	if release, err := l.acquire(ctx, "a"); err != nil {
+		t.Errorf("Failed to acquire slot after release: %v", err)
+	} else {
+		release()
+	}
+	if got := len(l.clients); got != 0 {
+		t.Errorf("Clients not released: %v", l.clients)
+	}
+}
+
+func TestLimiter_Canceled(t *testing.T) {
+	l := newLimiter(1, 0, 1)
+	release, err := l.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Failed to acquire first slot: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.acquire(ctx, "b"); err != context.Canceled {
+		t.Errorf("Wrong error: got %v, want %v", err, context.Canceled)
+	}
+	if l.waiting != 0 || l.clients["b"] != 0 {
+		t.Errorf("Canceled request was not released: waiting %d, clients %v", l.waiting, l.clients)
+	}
+}
+
+func TestConcurrencyLimitRequest(t *testing.T) {
+	server := NewServer(nil, testBlockSizeLimit)
+	server.SetBlockConcurrencyLimit(1, 0, 0)
+
+	started, done := make(chan struct{}), make(chan struct{})
+	handler := server.limit(blockPath, func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-done
+	})
+
+	go handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/block/bucket/object", nil))
+	<-started
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/block/bucket/object", nil))
+	close(done)
+
+	if got, want := w.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("Wrong status code: got %d, want %d", got, want)
+	}
+	if got, want := w.Header().Get("Retry-After"), "1"; got != want {
+		t.Errorf("Wrong Retry-After header: got %q, want %q", got, want)
+	}
+}
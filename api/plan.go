@@ -0,0 +1,170 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/ticket"
+)
+
+// planPath is the endpoint that returns the chunks a reads request would
+// select, so that clients can fetch the byte ranges from GCS themselves.
+const planPath = "/plan/"
+
+// plannedChunk is a chunk of a chunk plan.  The virtual offsets delimit the
+// records of the chunk, and the byte range covers the whole BGZF blocks that
+// contain them (or, for a chunk that ends inside a block, as much of the
+// object as the last block could occupy).
+type plannedChunk struct {
+	Class        string `json:"class"`
+	VirtualStart uint64 `json:"virtualStart"`
+	VirtualEnd   uint64 `json:"virtualEnd"`
+	ByteStart    uint64 `json:"byteStart"`
+	ByteEnd      uint64 `json:"byteEnd"`
+}
+
+// chunkPlan is the response of the plan endpoint.
+type chunkPlan struct {
+	Object     string         `json:"object"`
+	Generation int64          `json:"generation"`
+	Size       int64          `json:"size"`
+	Chunks     []plannedChunk `json:"chunks"`
+}
+
+// planChunk returns the planned chunk for chunk of an object of size bytes.
+func planChunk(chunk *bgzf.Chunk, class string, size uint64) plannedChunk {
+	end := chunk.End.BlockOffset()
+	if chunk.End.DataOffset() != 0 {
+		end += bgzf.MaximumBlockSize
+	}
+	if end > size {
+		end = size
+	}
+	return plannedChunk{
+		Class:        class,
+		VirtualStart: uint64(chunk.Start),
+		VirtualEnd:   uint64(chunk.End),
+		ByteStart:    chunk.Start.BlockOffset(),
+		ByteEnd:      end,
+	}
+}
+
+// serveChunkPlan responds with the chunks that a reads request for the same
+// readset and regions would select, along with the byte ranges of the object
+// that hold them, as JSON or (with output=csv) as CSV.  The regions are given
+// as for reads requests.
+func (server *Server) serveChunkPlan(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	query, err := expandSamtoolsRegion(req.URL.Query())
+	if err != nil {
+		writeError(w, newInvalidInputError("parsing region", err))
+		return
+	}
+	query, regionQueries, err := parseReadsBody(w, req, query, false)
+	if err != nil {
+		writeError(w, newInvalidInputError("parsing request body", err))
+		return
+	}
+	output := query.Get("output")
+	if output != "" && output != "json" && output != "csv" {
+		writeError(w, newInvalidInputError("parsing output", fmt.Errorf("unknown output %q", output)))
+		return
+	}
+	headerOnly, err := parseClass(query)
+	if err != nil {
+		writeError(w, newInvalidInputError("parsing class", err))
+		return
+	}
+
+	readset, err := server.openReadset(req, planPath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	object := readset.bucket.Object(readset.object)
+	bucket := object.BucketName()
+
+	if path := query.Get(bedParameter); path != "" {
+		if regionQueries, err = server.readBEDRegions(ctx, readset.gcs, path, regionQueries); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	regions, err := server.parseRegions(regionQueries, readset.header, bucket)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	attrs, err := objectAttrs(ctx, server.breaker, object)
+	if err != nil {
+		writeError(w, newStorageError("opening data", err))
+		return
+	}
+	request := &readsRequest{
+		readIndex: func(ctx context.Context) ([]byte, error) {
+			return server.readBAMIndex(ctx, readset.headers, object, attrs, readset.indexes)
+		},
+		blockSizeLimit: server.blockSizeLimitFor(req, bucket),
+		mergeGap:       server.mergeGapFor(req),
+		regions:        regions,
+		strict:         server.strict,
+		headerOnly:     headerOnly,
+	}
+	chunks, err := request.handle(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	plan := &chunkPlan{
+		Object:     fmt.Sprintf("gs://%s/%s", bucket, readset.object),
+		Generation: attrs.Generation,
+		Size:       attrs.Size,
+	}
+	for i, chunk := range chunks {
+		// The first chunk always holds the header and never any reads.
+		class := ticket.ClassBody
+		if i == 0 {
+			class = ticket.ClassHeader
+		}
+		plan.Chunks = append(plan.Chunks, planChunk(chunk, class, uint64(attrs.Size)))
+	}
+
+	if output != "csv" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"plan": plan})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"class", "virtualStart", "virtualEnd", "byteStart", "byteEnd"})
+	for _, chunk := range plan.Chunks {
+		cw.Write([]string{
+			chunk.Class,
+			strconv.FormatUint(chunk.VirtualStart, 10),
+			strconv.FormatUint(chunk.VirtualEnd, 10),
+			strconv.FormatUint(chunk.ByteStart, 10),
+			strconv.FormatUint(chunk.ByteEnd, 10),
+		})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+)
+
+func TestPlanChunk(t *testing.T) {
+	const size = 200000
+	testCases := []struct {
+		name               string
+		chunk              bgzf.Chunk
+		byteStart, byteEnd uint64
+	}{
+		{"block boundary", bgzf.Chunk{Start: 0x1000 << 16, End: 0x3000 << 16}, 0x1000, 0x3000},
+		{"inside blocks", bgzf.Chunk{Start: 0x1000<<16 | 10, End: 0x3000<<16 | 20}, 0x1000, 0x3000 + bgzf.MaximumBlockSize},
+		{"near the end", bgzf.Chunk{Start: 0x1000 << 16, End: 190000<<16 | 20}, 0x1000, size},
+		{"to the end", bgzf.Chunk{Start: 0x1000 << 16, End: bgzf.LastAddress}, 0x1000, size},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := planChunk(&tc.chunk, "body", size)
+			if got.VirtualStart != uint64(tc.chunk.Start) || got.VirtualEnd != uint64(tc.chunk.End) {
+				t.Errorf("Wrong virtual offsets: got %x-%x, want %s", got.VirtualStart, got.VirtualEnd, &tc.chunk)
+			}
+			if got.ByteStart != tc.byteStart || got.ByteEnd != tc.byteEnd {
+				t.Errorf("Wrong byte range: got %d-%d, want %d-%d", got.ByteStart, got.ByteEnd, tc.byteStart, tc.byteEnd)
+			}
+		})
+	}
+}
+
+func TestChunkPlan(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	const region = "NA12878.chr20.sample.bam?referenceName=20&start=10000000&end=10100000"
+
+	info, err := os.Stat("testdata/NA12878.chr20.sample.bam")
+	if err != nil {
+		t.Fatalf("Failed to stat test data: %v", err)
+	}
+
+	var explanation struct {
+		Explain struct {
+			MergedChunks []string `json:"mergedChunks"`
+		} `json:"explain"`
+	}
+	resp := testQuery(ctx, t, "/reads/testdata/"+region+"&explain=true")
+	if err := json.NewDecoder(resp.Body).Decode(&explanation); err != nil {
+		t.Fatalf("Failed to decode explanation: %v", err)
+	}
+
+	var body struct {
+		Plan chunkPlan `json:"plan"`
+	}
+	resp = testQuery(ctx, t, "/plan/testdata/"+region)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("Wrong status code: got %d, want %d", got, want)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode plan: %v", err)
+	}
+	plan := body.Plan
+	if got, want := plan.Object, "gs://testdata/NA12878.chr20.sample.bam"; got != want {
+		t.Errorf("Wrong object: got %q, want %q", got, want)
+	}
+	if got, want := plan.Size, info.Size(); got != want {
+		t.Errorf("Wrong size: got %d, want %d", got, want)
+	}
+
+	var chunks []string
+	for i, chunk := range plan.Chunks {
+		if wantClass := map[bool]string{true: "header", false: "body"}[i == 0]; chunk.Class != wantClass {
+			t.Errorf("Chunk %d: wrong class: got %q, want %q", i, chunk.Class, wantClass)
+		}
+		if chunk.ByteStart != chunk.VirtualStart>>16 || chunk.ByteEnd > uint64(plan.Size) || chunk.ByteStart > chunk.ByteEnd {
+			t.Errorf("Chunk %d: wrong byte range %d-%d", i, chunk.ByteStart, chunk.ByteEnd)
+		}
+		c := bgzf.Chunk{Start: bgzf.Address(chunk.VirtualStart), End: bgzf.Address(chunk.VirtualEnd)}
+		chunks = append(chunks, c.String())
+	}
+	if got, want := strings.Join(chunks, ","), strings.Join(explanation.Explain.MergedChunks, ","); got != want {
+		t.Errorf("Wrong chunks: got %s, want %s", got, want)
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		resp := testQuery(ctx, t, "/plan/testdata/"+region+"&output=csv")
+		records, err := csv.NewReader(resp.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("Failed to read CSV: %v", err)
+		}
+		if got, want := len(records), len(plan.Chunks)+1; got != want {
+			t.Fatalf("Wrong number of records: got %d, want %d", got, want)
+		}
+		for i, chunk := range plan.Chunks {
+			want := []string{chunk.Class, strconv.FormatUint(chunk.VirtualStart, 10), strconv.FormatUint(chunk.VirtualEnd, 10), strconv.FormatUint(chunk.ByteStart, 10), strconv.FormatUint(chunk.ByteEnd, 10)}
+			if got := records[i+1]; strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("Wrong record %d: got %q, want %q", i, got, want)
+			}
+		}
+	})
+
+	t.Run("header only", func(t *testing.T) {
+		var body struct {
+			Plan chunkPlan `json:"plan"`
+		}
+		resp := testQuery(ctx, t, "/plan/testdata/NA12878.chr20.sample.bam?class=header")
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode plan: %v", err)
+		}
+		if got := len(body.Plan.Chunks); got != 1 {
+			t.Errorf("Wrong number of chunks: got %d, want 1", got)
+		}
+	})
+
+	t.Run("unknown output", func(t *testing.T) {
+		expectError(t, "InvalidInput", http.StatusBadRequest, testQuery(ctx, t, "/plan/testdata/"+region+"&output=xml"))
+	})
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"io"
+	"sync"
+)
+
+// readAheadChunkSize is the size of each buffer that a readAhead fills.
+const readAheadChunkSize = 32 * 1024
+
+// readAhead reads from an underlying reader in a separate goroutine, up to a
+// fixed number of bytes ahead of its consumer.  This lets storage reads
+// continue while a response is written to a slow client, without buffering
+// more than the configured amount of data for it.
+type readAhead struct {
+	ready   chan []byte
+	free    chan []byte
+	done    chan struct{}
+	stopped sync.WaitGroup
+
+	// err is the error that ended the underlying reader.  It is written
+	// before ready is closed.
+	err error
+
+	buffer  []byte
+	current []byte
+}
+
+// newReadAhead starts reading from r into buffers holding at most size bytes
+// in total.  Close must be called to stop reading.
+func newReadAhead(r io.Reader, size int) *readAhead {
+	chunk, slots := readAheadChunkSize, size/readAheadChunkSize
+	if slots < 1 {
+		chunk, slots = size, 1
+	}
+	ra := &readAhead{
+		ready: make(chan []byte, slots),
+		free:  make(chan []byte, slots),
+		done:  make(chan struct{}),
+	}
+	for i := 0; i < slots; i++ {
+		ra.free <- make([]byte, chunk)
+	}
+	ra.stopped.Add(1)
+	go ra.fill(r)
+	return ra
+}
+
+// fill copies data from r into free buffers until r fails or ra is closed.
+func (ra *readAhead) fill(r io.Reader) {
+	defer ra.stopped.Done()
+	for {
+		var buffer []byte
+		select {
+		case buffer = <-ra.free:
+		case <-ra.done:
+			return
+		}
+
+		n, err := r.Read(buffer)
+		if n > 0 {
+			select {
+			case ra.ready <- buffer[:n]:
+			case <-ra.done:
+				return
+			}
+		} else {
+			ra.free <- buffer
+		}
+		if err != nil {
+			ra.err = err
+			close(ra.ready)
+			return
+		}
+	}
+}
+
+func (ra *readAhead) Read(p []byte) (int, error) {
+	if len(ra.current) == 0 {
+		if ra.buffer != nil {
+			ra.free <- ra.buffer[:cap(ra.buffer)]
+			ra.buffer = nil
+		}
+		buffer, ok := <-ra.ready
+		if !ok {
+			return 0, ra.err
+		}
+		ra.buffer, ra.current = buffer, buffer
+	}
+	n := copy(p, ra.current)
+	ra.current = ra.current[n:]
+	return n, nil
+}
+
+// Close stops reading ahead and waits for any read of the underlying reader
+// that is in progress, so that the reader may be closed safely afterwards.
+func (ra *readAhead) Close() error {
+	close(ra.done)
+	ra.stopped.Wait()
+	return nil
+}
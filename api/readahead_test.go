@@ -0,0 +1,93 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadAhead(t *testing.T) {
+	data := make([]byte, 100*1024+7)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	testCases := []struct {
+		name string
+		size int
+		r    io.Reader
+	}{
+		{"smaller than a chunk", 1000, bytes.NewReader(data)},
+		{"one chunk", readAheadChunkSize, bytes.NewReader(data)},
+		{"several chunks", 3 * readAheadChunkSize, bytes.NewReader(data)},
+		{"larger than the data", 1 << 20, bytes.NewReader(data)},
+		{"short reads", 2 * readAheadChunkSize, iotest.HalfReader(bytes.NewReader(data))},
+		{"single byte reads", 2 * readAheadChunkSize, iotest.OneByteReader(bytes.NewReader(data))},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ra := newReadAhead(tc.r, tc.size)
+			defer ra.Close()
+			got, err := ioutil.ReadAll(iotest.OneByteReader(ra))
+			if err != nil {
+				t.Fatalf("Failed to read data: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Wrong data: got %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestReadAhead_Errors(t *testing.T) {
+	failure := errors.New("storage failed")
+	ra := newReadAhead(io.MultiReader(bytes.NewReader([]byte("data")), &errorReader{failure}), readAheadChunkSize)
+	defer ra.Close()
+	got, err := ioutil.ReadAll(ra)
+	if err != failure {
+		t.Errorf("Wrong error: got %v, want %v", err, failure)
+	}
+	if string(got) != "data" {
+		t.Errorf("Wrong data before the error: got %q, want %q", got, "data")
+	}
+}
+
+func TestReadAhead_Bounded(t *testing.T) {
+	const slots = 4
+	r := &countingReader{r: bytes.NewReader(make([]byte, 1<<20))}
+	ra := newReadAhead(r, slots*readAheadChunkSize)
+	if _, err := io.ReadFull(ra, make([]byte, 10)); err != nil {
+		t.Fatalf("Failed to read data: %v", err)
+	}
+	// Close waits for the reading goroutine, so the count is stable
+	// afterwards.  The consumer holds one buffer and the rest may be filled.
+	ra.Close()
+	if r.reads > slots+1 {
+		t.Errorf("Read ahead too far: got %d reads, want at most %d", r.reads, slots+1)
+	}
+}
+
+// errorReader fails every read with err.
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -15,8 +15,10 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"strings"
 
 	"cloud.google.com/go/storage"
 	"github.com/googlegenomics/htsget/internal/bam"
@@ -25,28 +27,163 @@ import (
 )
 
 type readsRequest struct {
-	indexObjects   []*storage.ObjectHandle
+	readIndex      func(context.Context) ([]byte, error)
 	blockSizeLimit uint64
-	region         genomics.Region
+	mergeGap       uint64
+	regions        []genomics.Region
+	strict         bool
+
+	// headerOnly restricts the response to the header (class=header).
+	headerOnly bool
 }
 
 func (req *readsRequest) handle(ctx context.Context) ([]*bgzf.Chunk, error) {
-	var index *storage.Reader
-	var err error
-	for _, object := range req.indexObjects {
-		index, err = object.NewReader(ctx)
-		if err == nil {
-			break
+	chunks, _, err := req.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return req.selectChunks(chunks), nil
+}
+
+// selectChunks returns the chunks that are sent for the request: the header
+// chunk alone if only the header was requested, and otherwise all of chunks
+// merged by mergeChunks.
+func (req *readsRequest) selectChunks(chunks []*bgzf.Chunk) []*bgzf.Chunk {
+	if req.headerOnly && len(chunks) > 0 {
+		return chunks[:1]
+	}
+	return mergeChunks(chunks, req.blockSizeLimit, req.mergeGap)
+}
+
+// mergeChunks merges the body chunks in chunks (all but the first, which
+// holds the header) that are at most gap bytes apart without exceeding
+// sizeLimit.  The header is kept separate so that its URL can be marked with
+// the header class.
+func mergeChunks(chunks []*bgzf.Chunk, sizeLimit, gap uint64) []*bgzf.Chunk {
+	if len(chunks) <= 1 {
+		return chunks
+	}
+	return append([]*bgzf.Chunk{chunks[0]}, trimOverlaps(bgzf.MergeWithin(chunks[1:], sizeLimit, gap))...)
+}
+
+// trimOverlaps removes the parts of the chunks in sorted (which must be sorted
+// by their start) that are covered by earlier chunks, so that no record is
+// sent twice.  Merge leaves overlapping chunks separate when joining them
+// would exceed the size limit, which is common when several regions select
+// the same data.  Chunks always end at a record boundary, so the trimmed
+// chunks still start at one.
+func trimOverlaps(sorted []*bgzf.Chunk) []*bgzf.Chunk {
+	var (
+		trimmed []*bgzf.Chunk
+		end     bgzf.Address
+	)
+	for _, chunk := range sorted {
+		if len(trimmed) > 0 && chunk.Start < end {
+			if chunk.End <= end {
+				continue
+			}
+			chunk = &bgzf.Chunk{Start: end, End: chunk.End}
 		}
+		trimmed = append(trimmed, chunk)
+		end = chunk.End
 	}
+	return trimmed
+}
+
+// explanation describes how the chunks for a request were selected.
+type explanation struct {
+	Region          string     `json:"region"`
+	BlockSizeLimit  uint64     `json:"blockSizeLimit"`
+	MergeGap        uint64     `json:"mergeGap"`
+	Trace           *bam.Trace `json:"trace"`
+	CandidateChunks []string   `json:"candidateChunks"`
+	MergedChunks    []string   `json:"mergedChunks"`
+	EstimatedBytes  uint64     `json:"estimatedBytes"`
+}
+
+// explain performs the same work as handle but returns a description of the
+// selection and merge decisions instead of the chunks themselves.
+func (req *readsRequest) explain(ctx context.Context) (*explanation, error) {
+	chunks, trace, err := req.read(ctx)
 	if err != nil {
-		return nil, newStorageError("opening index", err)
+		return nil, err
+	}
+
+	var regions []string
+	for _, region := range req.regions {
+		regions = append(regions, region.String())
 	}
-	defer index.Close()
+	e := &explanation{
+		Region:         strings.Join(regions, " "),
+		BlockSizeLimit: req.blockSizeLimit,
+		MergeGap:       req.mergeGap,
+		Trace:          trace,
+	}
+	for _, chunk := range chunks {
+		e.CandidateChunks = append(e.CandidateChunks, chunk.String())
+	}
+	for _, chunk := range req.selectChunks(chunks) {
+		e.MergedChunks = append(e.MergedChunks, chunk.String())
+		e.EstimatedBytes += estimateSize(chunk)
+	}
+	return e, nil
+}
 
-	chunks, err := bam.Read(index, req.region)
+// estimateSize returns an upper bound on the number of compressed bytes that
+// will be sent for chunk.
+func estimateSize(chunk *bgzf.Chunk) uint64 {
+	start, end := chunk.Start.BlockOffset(), chunk.End.BlockOffset()
+	if start == end {
+		return uint64(chunk.End.DataOffset() - chunk.Start.DataOffset())
+	}
+	return end - start + bgzf.MaximumBlockSize
+}
+
+// read returns the header chunk followed by the chunks that every region
+// selects from a single copy of the index.  The trace describes the first
+// region, which is the only one in requests that can be explained.
+func (req *readsRequest) read(ctx context.Context) ([]*bgzf.Chunk, *bam.Trace, error) {
+	index, err := req.readIndex(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("reading index: %v", err)
+		return nil, nil, err
+	}
+
+	var (
+		chunks []*bgzf.Chunk
+		trace  *bam.Trace
+	)
+	for _, region := range req.regions {
+		selected, t, err := bam.ReadWithTrace(bytes.NewReader(index), region, req.strict)
+		if err == bam.ErrNoReferenceData {
+			return nil, nil, newInvalidRangeError(fmt.Errorf("%s: %v", region, err))
+		}
+		if err != nil {
+			return nil, nil, &parseError{"reading index", err}
+		}
+		// Every region selects the same header chunk.
+		if chunks == nil {
+			chunks, trace = selected, t
+			continue
+		}
+		chunks = append(chunks, selected[1:]...)
+	}
+	return chunks, trace, nil
+}
+
+// openIndex opens the first of objects that exists.
+func openIndex(ctx context.Context, breaker *circuitBreaker, objects []*storage.ObjectHandle) (*storage.Reader, error) {
+	var (
+		index *storage.Reader
+		err   error
+	)
+	for _, object := range objects {
+		index, err = newRangeReader(ctx, breaker, object, 0, -1)
+		if err == nil {
+			return index, nil
+		}
+	}
+	if err == storage.ErrObjectNotExist {
+		return nil, newMissingIndexError(err)
 	}
-	return bgzf.Merge(chunks, req.blockSizeLimit), nil
+	return nil, newStorageError("opening index", err)
 }
@@ -0,0 +1,45 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+)
+
+func TestTrimOverlaps(t *testing.T) {
+	chunk := func(start, end bgzf.Address) *bgzf.Chunk {
+		return &bgzf.Chunk{Start: start, End: end}
+	}
+	testCases := []struct {
+		name        string
+		input, want []*bgzf.Chunk
+	}{
+		{"disjoint", []*bgzf.Chunk{chunk(0, 10), chunk(20, 30)}, []*bgzf.Chunk{chunk(0, 10), chunk(20, 30)}},
+		{"adjacent", []*bgzf.Chunk{chunk(0, 10), chunk(10, 30)}, []*bgzf.Chunk{chunk(0, 10), chunk(10, 30)}},
+		{"overlapping", []*bgzf.Chunk{chunk(0, 20), chunk(10, 30)}, []*bgzf.Chunk{chunk(0, 20), chunk(20, 30)}},
+		{"contained", []*bgzf.Chunk{chunk(0, 30), chunk(10, 20), chunk(25, 40)}, []*bgzf.Chunk{chunk(0, 30), chunk(30, 40)}},
+		{"duplicate", []*bgzf.Chunk{chunk(0, 10), chunk(0, 10)}, []*bgzf.Chunk{chunk(0, 10)}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := trimOverlaps(tc.input); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Wrong chunks: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/googlegenomics/htsget/internal/bam"
+	"github.com/googlegenomics/htsget/internal/sam"
+)
+
+// AddReferenceAliases declares that names all refer to the same reference
+// sequence.  If a request names a reference that is not in a readset's header,
+// the server tries the other names in its group before failing.  This is in
+// addition to the built-in aliases, which add or remove a "chr" prefix (and
+// treat "chrM" and "MT" as equivalent), and to any alternate names declared
+// by AN tags in the header itself.
+func (server *Server) AddReferenceAliases(names []string) {
+	for _, name := range names {
+		for _, alias := range names {
+			if alias != name {
+				server.referenceAliases[name] = append(server.referenceAliases[name], alias)
+			}
+		}
+	}
+}
+
+// resolveReference returns the reference from header that is called name, or
+// failing that, the first one that matches an alias of name.
+func (server *Server) resolveReference(header *bam.Header, name string) (*bam.Reference, error) {
+	byName := make(map[string]*bam.Reference)
+	for _, ref := range header.References {
+		byName[ref.Name] = ref
+	}
+	if ref, ok := byName[name]; ok {
+		return ref, nil
+	}
+
+	for _, alias := range server.referenceAliases[name] {
+		if ref, ok := byName[alias]; ok {
+			return ref, nil
+		}
+	}
+
+	if ref, err := sam.GetReference(strings.NewReader(header.Text), name); err == nil {
+		if ref, ok := byName[ref.Name]; ok {
+			return ref, nil
+		}
+	}
+
+	for _, alias := range builtinAliases(name) {
+		if ref, ok := byName[alias]; ok {
+			return ref, nil
+		}
+	}
+	return nil, fmt.Errorf("no reference named %q found", name)
+}
+
+// builtinAliases returns the names commonly used for the same reference as
+// name by the UCSC and Ensembl/NCBI naming conventions.
+func builtinAliases(name string) []string {
+	switch name {
+	case "chrM":
+		return []string{"MT", "M"}
+	case "MT", "M":
+		return []string{"chrM"}
+	}
+	if trimmed := strings.TrimPrefix(name, "chr"); trimmed != name {
+		return []string{trimmed}
+	}
+	return []string{"chr" + name}
+}
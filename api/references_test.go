@@ -0,0 +1,87 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/googlegenomics/htsget/internal/bam"
+)
+
+func TestResolveReference(t *testing.T) {
+	header := &bam.Header{
+		Text: "@SQ\tSN:1\tLN:100\n" +
+			"@SQ\tSN:chr2\tLN:100\n" +
+			"@SQ\tSN:MT\tLN:100\n" +
+			"@SQ\tSN:NC_000024.10\tLN:100\tAN:Y,chrY\n" +
+			"@SQ\tSN:HLA-A*01:01:01:01\tLN:100\n",
+		References: []*bam.Reference{
+			{ID: 0, Name: "1", Length: 100},
+			{ID: 1, Name: "chr2", Length: 100},
+			{ID: 2, Name: "MT", Length: 100},
+			{ID: 3, Name: "NC_000024.10", Length: 100},
+			{ID: 4, Name: "HLA-A*01:01:01:01", Length: 100},
+		},
+	}
+
+	server := NewServer(nil, 0)
+	server.AddReferenceAliases([]string{"HLA-A*01:01:01:01", "HLA-A1"})
+
+	testCases := []struct {
+		name string
+		want int32
+	}{
+		{"1", 0},
+		{"chr1", 0},
+		{"2", 1},
+		{"chr2", 1},
+		{"chrM", 2},
+		{"M", -1},
+		{"Y", 3},
+		{"chrY", 3},
+		{"HLA-A1", 4},
+		{"3", -1},
+		{"chr3", -1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := server.resolveReference(header, tc.name)
+			if tc.want < 0 {
+				if err == nil {
+					t.Fatalf("Expected an error, got reference %q", ref.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to resolve reference: %v", err)
+			}
+			if got := ref.ID; got != tc.want {
+				t.Errorf("Wrong reference: got %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReferenceAliasRequest(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam?referenceName=chr20")
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("Wrong status code: got %d, want %d", got, want)
+	}
+}
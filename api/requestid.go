@@ -0,0 +1,84 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+
+	// userAgent identifies the server in outbound storage requests.
+	userAgent = "googlegenomics-htsget"
+)
+
+type requestIDKey struct{}
+
+// requestIDFromContext returns the ID of the request being served with ctx,
+// or the empty string if there is none.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID assigns each request an ID (reusing the one supplied by the
+// client or a proxy, if any), echoes it in the response and makes it available
+// to outbound storage requests via the request context.
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if id == "" {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
+		handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDTransport adds the request ID and the server user agent to
+// outbound storage requests so that storage access logs can be correlated
+// with server logs.
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it is given.
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = make(http.Header, len(req.Header)+2)
+	for k, v := range req.Header {
+		clone.Header[k] = v
+	}
+
+	if id := requestIDFromContext(req.Context()); id != "" {
+		clone.Header.Set(requestIDHeader, id)
+	}
+	agent := userAgent
+	if existing := req.Header.Get("User-Agent"); existing != "" {
+		agent += " " + existing
+	}
+	clone.Header.Set("User-Agent", agent)
+
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(clone)
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRequestIDPropagation(t *testing.T) {
+	testCases := []struct {
+		name, id string
+	}{
+		{"supplied by client", "client-supplied-id"},
+		{"generated", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := &headerRecorder{next: &fakeGCS{t}}
+			client := &http.Client{Transport: &requestIDTransport{base: recorder}}
+			ctx := context.WithValue(context.Background(), testHTTPClientKey, client)
+
+			req, err := http.NewRequest("GET", "/reads/testdata/NA12878.chr20.sample.bam", nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			if tc.id != "" {
+				req.Header.Set(requestIDHeader, tc.id)
+			}
+			resp := testRequest(ctx, t, req)
+			if got, want := resp.StatusCode, http.StatusOK; got != want {
+				t.Fatalf("Wrong status code: got %v, want %v", got, want)
+			}
+
+			id := resp.Header.Get(requestIDHeader)
+			if id == "" || tc.id != "" && id != tc.id {
+				t.Errorf("Wrong response request ID: got %q, want %q", id, tc.id)
+			}
+			if len(recorder.headers) == 0 {
+				t.Fatalf("No storage requests were made")
+			}
+			for _, header := range recorder.headers {
+				if got := header.Get(requestIDHeader); got != id {
+					t.Errorf("Wrong storage request ID: got %q, want %q", got, id)
+				}
+				if got := header.Get("User-Agent"); !strings.HasPrefix(got, userAgent) {
+					t.Errorf("Wrong storage user agent: got %q, want prefix %q", got, userAgent)
+				}
+			}
+		})
+	}
+}
+
+// headerRecorder records the headers of each request before passing it to
+// next.
+type headerRecorder struct {
+	next http.RoundTripper
+
+	mu      sync.Mutex
+	headers []http.Header
+}
+
+func (r *headerRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	r.headers = append(r.headers, req.Header)
+	r.mu.Unlock()
+	return r.next.RoundTrip(req)
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	// retryAttempts is the maximum number of times a storage operation is
+	// attempted before its error is returned.
+	retryAttempts = 4
+
+	// retryBackoff is the delay before the first retry.  It doubles after each
+	// failed attempt.
+	retryBackoff = 100 * time.Millisecond
+)
+
+// newRangeReader is like object.NewRangeReader but retries transient failures
+// and fails fast if breaker is open.
+func newRangeReader(ctx context.Context, breaker *circuitBreaker, object *storage.ObjectHandle, offset, length int64) (*storage.Reader, error) {
+	var r *storage.Reader
+	err := retry(ctx, breaker, func() error {
+		var err error
+		r, err = object.NewRangeReader(ctx, offset, length)
+		return err
+	})
+	return r, err
+}
+
+// objectAttrs is like object.Attrs but retries transient failures and fails
+// fast if breaker is open.
+func objectAttrs(ctx context.Context, breaker *circuitBreaker, object *storage.ObjectHandle) (*storage.ObjectAttrs, error) {
+	var attrs *storage.ObjectAttrs
+	err := retry(ctx, breaker, func() error {
+		var err error
+		attrs, err = object.Attrs(ctx)
+		return err
+	})
+	return attrs, err
+}
+
+// retry calls f until it succeeds, returns an error that is not transient, or
+// retryAttempts calls have been made.  It returns the last error from f, or an
+// *unavailableError if breaker is (or becomes) open.
+func retry(ctx context.Context, breaker *circuitBreaker, f func() error) error {
+	delay := retryBackoff
+	for attempt := 1; ; attempt++ {
+		if err := breaker.allow(); err != nil {
+			return err
+		}
+		err := f()
+		breaker.record(err)
+		if err == nil || attempt >= retryAttempts || !isTransient(err) {
+			return err
+		}
+		// Retrying sooner than the backend asked would only add to its load.
+		if retryAfter(err) > delay {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// isTransient reports whether err is likely to succeed if retried.
+func isTransient(err error) bool {
+	switch err := err.(type) {
+	case *googleapi.Error:
+		return err.Code == http.StatusTooManyRequests || err.Code >= 500
+	case net.Error:
+		if err.Temporary() || err.Timeout() {
+			return true
+		}
+	}
+	return err == io.ErrUnexpectedEOF || strings.Contains(err.Error(), "connection reset by peer")
+}
+
+// retryAfter returns the delay requested by the Retry-After header of a
+// storage error, or zero if there is none.
+func retryAfter(err error) time.Duration {
+	e, ok := err.(*googleapi.Error)
+	if !ok || e.Header == nil {
+		return 0
+	}
+	value := e.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
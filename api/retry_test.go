@@ -0,0 +1,162 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetry(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = 0
+
+	var (
+		unavailable = &googleapi.Error{Code: http.StatusServiceUnavailable}
+		tooMany     = &googleapi.Error{Code: http.StatusTooManyRequests}
+		forbidden   = &googleapi.Error{Code: http.StatusForbidden}
+		permanent   = errors.New("permanent")
+		throttled   = &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"30"}}}
+	)
+	testCases := []struct {
+		name   string
+		errors []error
+		calls  int
+		err    error
+	}{
+		{"success", []error{nil}, 1, nil},
+		{"unavailable then success", []error{unavailable, nil}, 2, nil},
+		{"rate limited then success", []error{tooMany, tooMany, nil}, 3, nil},
+		{"unexpected EOF then success", []error{io.ErrUnexpectedEOF, nil}, 2, nil},
+		{"always unavailable", []error{unavailable, unavailable, unavailable, unavailable, unavailable}, retryAttempts, unavailable},
+		{"forbidden", []error{forbidden, nil}, 1, forbidden},
+		{"permanent", []error{permanent, nil}, 1, permanent},
+		{"rate limited with long Retry-After", []error{throttled, nil}, 1, throttled},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int
+			err := retry(context.Background(), nil, func() error {
+				calls++
+				return tc.errors[calls-1]
+			})
+			if err != tc.err {
+				t.Errorf("Wrong error: got %v, want %v", err, tc.err)
+			}
+			if calls != tc.calls {
+				t.Errorf("Wrong number of calls: got %d, want %d", calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestRetryTransientStorageErrors(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = 0
+
+	client := &http.Client{Transport: &flakyTransport{
+		failures: 2,
+		next:     &fakeGCS{t},
+	}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, client)
+	resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam")
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("Wrong status code: got %v, want %v", got, want)
+	}
+}
+
+func TestRetryAfterPropagation(t *testing.T) {
+	testCases := []struct {
+		name       string
+		code       int
+		retryAfter string
+		want       string
+	}{
+		{"rate limited", http.StatusTooManyRequests, "30", "30"},
+		{"unavailable", http.StatusServiceUnavailable, "120", "120"},
+		{"HTTP date", http.StatusServiceUnavailable, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), "3600"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int
+			client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				calls++
+				return &http.Response{
+					Status:     http.StatusText(tc.code),
+					StatusCode: tc.code,
+					Header:     http.Header{"Retry-After": {tc.retryAfter}},
+					Body:       http.NoBody,
+				}, nil
+			})}
+			ctx := context.WithValue(context.Background(), testHTTPClientKey, client)
+			resp := testQuery(ctx, t, "/reads/testdata/NA12878.chr20.sample.bam")
+
+			if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+				t.Errorf("Wrong status code: got %v, want %v", got, want)
+			}
+			got, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+			if err != nil {
+				t.Fatalf("Invalid Retry-After header %q: %v", resp.Header.Get("Retry-After"), err)
+			}
+			// Allow for the time taken to serve the request.
+			if want, _ := strconv.Atoi(tc.want); got < want-1 || got > want {
+				t.Errorf("Wrong Retry-After header: got %d, want %d", got, want)
+			}
+			if calls != 1 {
+				t.Errorf("Wrong number of storage requests: got %d, want 1", calls)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// flakyTransport fails the first requests for each URL with a 503 status code
+// and then passes requests to next.
+type flakyTransport struct {
+	failures int
+	next     http.RoundTripper
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func (flaky *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	flaky.mu.Lock()
+	if flaky.attempts == nil {
+		flaky.attempts = make(map[string]int)
+	}
+	key := req.Method + " " + req.URL.String() + " " + req.Header.Get("Range")
+	flaky.attempts[key]++
+	fail := flaky.attempts[key] <= flaky.failures
+	flaky.mu.Unlock()
+
+	if fail {
+		return fixedStatus(http.StatusServiceUnavailable).RoundTrip(req)
+	}
+	return flaky.next.RoundTrip(req)
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// samtoolsRegionParameter is the query parameter that accepts a region written
+// the way samtools does, as name[:beg[-[end]]] with 1-based, inclusive
+// coordinates that may contain commas (for example chr20:1,000,001-2,000,000).
+const samtoolsRegionParameter = "region"
+
+// expandSamtoolsRegion returns query with a samtools region, if present,
+// replaced by the equivalent referenceName, start and end parameters.  The
+// beginning is shifted by one to give the 0-based start; the inclusive end is
+// already the exclusive end of the 0-based interval.
+func expandSamtoolsRegion(query url.Values) (url.Values, error) {
+	region := query.Get(samtoolsRegionParameter)
+	if region == "" {
+		return query, nil
+	}
+	for _, name := range []string{"referenceName", "start", "end"} {
+		if query.Get(name) != "" {
+			return nil, fmt.Errorf("%s may not be used with %s", name, samtoolsRegionParameter)
+		}
+	}
+
+	name, start, end, err := parseSamtoolsRegion(region)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s %q: %v", samtoolsRegionParameter, region, err)
+	}
+
+	expanded := make(url.Values)
+	for key, values := range query {
+		if key != samtoolsRegionParameter {
+			expanded[key] = values
+		}
+	}
+	expanded.Set("referenceName", name)
+	if start != "" {
+		expanded.Set("start", start)
+	}
+	if end != "" {
+		expanded.Set("end", end)
+	}
+	return expanded, nil
+}
+
+// parseSamtoolsRegion splits region into a reference name and the 0-based
+// start and end, either of which is empty if region does not give it.  The
+// range follows the last colon.  As in samtools, a name that holds colons,
+// such as an HLA allele, must be enclosed in braces.
+func parseSamtoolsRegion(region string) (name, start, end string, err error) {
+	var span string
+	if strings.HasPrefix(region, "{") {
+		brace := strings.Index(region, "}")
+		if brace < 0 {
+			return "", "", "", errors.New("missing closing brace")
+		}
+		name, span = region[1:brace], region[brace+1:]
+		if span != "" && !strings.HasPrefix(span, ":") {
+			return "", "", "", errors.New("unexpected text after closing brace")
+		}
+		span = strings.TrimPrefix(span, ":")
+	} else if colon := strings.LastIndex(region, ":"); colon >= 0 {
+		name, span = region[:colon], region[colon+1:]
+	} else {
+		name = region
+	}
+	if name == "" {
+		return "", "", "", errors.New("missing reference name")
+	}
+	if span == "" {
+		return name, "", "", nil
+	}
+	span = strings.Replace(span, ",", "", -1)
+
+	beg, last := span, ""
+	dash := strings.Index(span, "-")
+	if dash >= 0 {
+		beg, last = span[:dash], span[dash+1:]
+	}
+	first, err := strconv.ParseUint(beg, 10, 32)
+	if err != nil {
+		return "", "", "", fmt.Errorf("parsing beginning: %v", err)
+	}
+	if first == 0 {
+		return "", "", "", errors.New("positions start at 1")
+	}
+	start = strconv.FormatUint(first-1, 10)
+
+	if last != "" {
+		n, err := strconv.ParseUint(last, 10, 32)
+		if err != nil {
+			return "", "", "", fmt.Errorf("parsing end: %v", err)
+		}
+		if n < first {
+			return "", "", "", errors.New("end precedes beginning")
+		}
+		end = strconv.FormatUint(n, 10)
+	}
+	return name, start, end, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestExpandSamtoolsRegion(t *testing.T) {
+	testCases := []struct {
+		name  string
+		query string
+		want  url.Values
+	}{
+		{"no region", "format=BAM", url.Values{"format": {"BAM"}}},
+		{"name only", "region=chr20", url.Values{"referenceName": {"chr20"}}},
+		{"beginning", "region=chr20:101", url.Values{"referenceName": {"chr20"}, "start": {"100"}}},
+		{"open range", "region=chr20:101-", url.Values{"referenceName": {"chr20"}, "start": {"100"}}},
+		{"range", "region=chr20:101-200", url.Values{"referenceName": {"chr20"}, "start": {"100"}, "end": {"200"}}},
+		{"single base", "region=chr20:101-101", url.Values{"referenceName": {"chr20"}, "start": {"100"}, "end": {"101"}}},
+		{"commas", "region=chr20:1,000,001-2,000,000", url.Values{"referenceName": {"chr20"}, "start": {"1000000"}, "end": {"2000000"}}},
+		{"braces", "region={chr20}:101-200", url.Values{"referenceName": {"chr20"}, "start": {"100"}, "end": {"200"}}},
+		{"name with colon", "region={HLA-A*01:01}", url.Values{"referenceName": {"HLA-A*01:01"}}},
+		{"name with colon and range", "region={HLA-A*01:01}:1-10", url.Values{"referenceName": {"HLA-A*01:01"}, "start": {"0"}, "end": {"10"}}},
+		{"unplaced", "region=*", url.Values{"referenceName": {"*"}}},
+		{"other parameters", "region=chr20:1-10&format=BAM", url.Values{"referenceName": {"chr20"}, "start": {"0"}, "end": {"10"}, "format": {"BAM"}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatalf("Failed to parse query: %v", err)
+			}
+			got, err := expandSamtoolsRegion(query)
+			if err != nil {
+				t.Fatalf("expandSamtoolsRegion(%q) failed: %v", tc.query, err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expandSamtoolsRegion(%q) = %v, want %v", tc.query, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExpandSamtoolsRegion_InvalidInputs(t *testing.T) {
+	testCases := []struct {
+		name  string
+		query string
+	}{
+		{"with referenceName", "region=chr20&referenceName=chr20"},
+		{"with start", "region=chr20&start=0"},
+		{"with end", "region=chr20:1&end=100"},
+		{"missing name", "region=:1-100"},
+		{"empty braces", "region={}:1-100"},
+		{"unclosed brace", "region={HLA-A*01:01:1-10"},
+		{"text after brace", "region={chr20}x:1-10"},
+		{"bad beginning", "region=chr20:x-10"},
+		{"zero beginning", "region=chr20:0-100"},
+		{"bad end", "region=chr20:1-x"},
+		{"end before beginning", "region=chr20:100-99"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatalf("Failed to parse query: %v", err)
+			}
+			if _, err := expandSamtoolsRegion(query); err == nil {
+				t.Errorf("expandSamtoolsRegion(%q) succeeded", tc.query)
+			}
+		})
+	}
+}
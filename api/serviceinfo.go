@@ -0,0 +1,112 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+)
+
+const (
+	readsServiceInfoPath    = readsPath + "service-info"
+	variantsServiceInfoPath = "/variants/service-info"
+
+	// htsgetVersion is the version of the htsget specification that the
+	// server implements.
+	htsgetVersion = "1.3.0"
+)
+
+// ServiceInfo describes the service in the GA4GH service-info responses of
+// the server.  Empty fields are omitted, except that ID, Name and
+// Organization have defaults that describe this implementation.
+type ServiceInfo struct {
+	// ID uniquely identifies the service, in reverse domain name notation
+	// (such as "org.example.htsget").
+	ID          string
+	Name        string
+	Description string
+
+	OrganizationName string
+	OrganizationURL  string
+
+	ContactURL       string
+	DocumentationURL string
+	// Environment describes the deployment, such as "prod" or "test".
+	Environment string
+	Version     string
+}
+
+var defaultServiceInfo = ServiceInfo{
+	ID:               "com.github.googlegenomics.htsget",
+	Name:             "htsget",
+	OrganizationName: "Google",
+	OrganizationURL:  "https://github.com/googlegenomics/htsget",
+}
+
+// SetServiceInfo sets the description of the service that is returned by the
+// service-info endpoints.  Empty ID, Name and organization fields keep their
+// defaults.
+func (server *Server) SetServiceInfo(info ServiceInfo) {
+	if info.ID == "" {
+		info.ID = defaultServiceInfo.ID
+	}
+	if info.Name == "" {
+		info.Name = defaultServiceInfo.Name
+	}
+	if info.OrganizationName == "" && info.OrganizationURL == "" {
+		info.OrganizationName = defaultServiceInfo.OrganizationName
+		info.OrganizationURL = defaultServiceInfo.OrganizationURL
+	}
+	server.serviceInfo = info
+}
+
+// serveServiceInfo returns a handler that responds with the GA4GH
+// service-info document for the datatype ("reads" or "variants"), which lists
+// formats as the formats that the server can return for it.
+func (server *Server) serveServiceInfo(datatype string, formats []string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		info := server.serviceInfo
+		response := map[string]interface{}{
+			"id":   info.ID,
+			"name": info.Name,
+			"type": map[string]string{
+				"group":    "org.ga4gh",
+				"artifact": "htsget",
+				"version":  htsgetVersion,
+			},
+			"organization": map[string]string{
+				"name": info.OrganizationName,
+				"url":  info.OrganizationURL,
+			},
+			"htsget": map[string]interface{}{
+				"datatype":                  datatype,
+				"formats":                   formats,
+				"fieldsParametersEffective": false,
+				"tagsParametersEffective":   false,
+			},
+		}
+		for name, value := range map[string]string{
+			"description":      info.Description,
+			"contactUrl":       info.ContactURL,
+			"documentationUrl": info.DocumentationURL,
+			"environment":      info.Environment,
+			"version":          info.Version,
+		} {
+			if value != "" {
+				response[name] = value
+			}
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
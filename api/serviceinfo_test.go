@@ -0,0 +1,88 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestServiceInfo(t *testing.T) {
+	configured := func(server *Server) {
+		server.SetServiceInfo(ServiceInfo{
+			ID:               "org.example.htsget",
+			OrganizationName: "Example",
+			OrganizationURL:  "https://example.org",
+			ContactURL:       "mailto:htsget@example.org",
+			Environment:      "test",
+		})
+	}
+
+	testCases := []struct {
+		name         string
+		url          string
+		configure    []func(*Server)
+		id           string
+		organization string
+		contact      string
+		datatype     string
+		formats      []string
+	}{
+		{"reads", "/reads/service-info", nil, "com.github.googlegenomics.htsget", "Google", "", "reads", []string{"BAM"}},
+		{"variants", "/variants/service-info", nil, "com.github.googlegenomics.htsget", "Google", "", "variants", []string{}},
+		{"configured", "/reads/service-info", []func(*Server){configured}, "org.example.htsget", "Example", "mailto:htsget@example.org", "reads", []string{"BAM"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := testQuery(context.Background(), t, tc.url, tc.configure...)
+			if got, want := resp.StatusCode, http.StatusOK; got != want {
+				t.Fatalf("Wrong status code: got %v, want %v", got, want)
+			}
+
+			var body struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+				Type struct {
+					Group    string `json:"group"`
+					Artifact string `json:"artifact"`
+					Version  string `json:"version"`
+				} `json:"type"`
+				Organization struct {
+					Name string `json:"name"`
+				} `json:"organization"`
+				ContactURL string `json:"contactUrl"`
+				Htsget     struct {
+					Datatype string   `json:"datatype"`
+					Formats  []string `json:"formats"`
+				} `json:"htsget"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if body.ID != tc.id || body.Name != "htsget" || body.Organization.Name != tc.organization || body.ContactURL != tc.contact {
+				t.Errorf("Wrong service description: got %+v", body)
+			}
+			if body.Type.Group != "org.ga4gh" || body.Type.Artifact != "htsget" || body.Type.Version != htsgetVersion {
+				t.Errorf("Wrong service type: got %+v", body.Type)
+			}
+			if body.Htsget.Datatype != tc.datatype || !reflect.DeepEqual(body.Htsget.Formats, tc.formats) {
+				t.Errorf("Wrong htsget details: got %+v", body.Htsget)
+			}
+		})
+	}
+}
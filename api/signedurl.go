@@ -0,0 +1,123 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/ticket"
+)
+
+// maximumSignedURLExpiry is the longest lifetime that GCS allows for V4
+// signed URLs.
+const maximumSignedURLExpiry = 7 * 24 * time.Hour
+
+// urlSigner signs GCS URLs with a service account key.
+type urlSigner struct {
+	accessID   string
+	privateKey []byte
+	expiry     time.Duration
+}
+
+// SetSignedURLs makes tickets send clients directly to GCS for the body
+// blocks that need no re-encoding, using V4 signed URLs with a Range header,
+// rather than proxying all of the data through the block endpoint.  Only the
+// partial blocks at the ends of each chunk are still served by the server.
+// The URLs are signed as the service account accessID with its PEM encoded
+// privateKey and are valid for expiry (at most seven days), during which
+// anyone holding the ticket can read the data.  Chunks with record filters,
+// fields or exact regions are always proxied, since they must be re-encoded.
+func (server *Server) SetSignedURLs(accessID string, privateKey []byte, expiry time.Duration) error {
+	if accessID == "" || len(privateKey) == 0 {
+		return errors.New("both a service account and a private key are required")
+	}
+	if expiry <= 0 || expiry > maximumSignedURLExpiry {
+		return fmt.Errorf("expiry must be positive and at most %v", maximumSignedURLExpiry)
+	}
+	server.signer = &urlSigner{accessID, privateKey, expiry}
+	return nil
+}
+
+// signedChunkURLs returns ticket URLs for chunk of object that fetch its whole
+// BGZF blocks directly from GCS, with blockURL used for the partial blocks at
+// either end.  It returns nil if the chunk holds no whole blocks.
+func (server *Server) signedChunkURLs(ctx context.Context, object *storage.ObjectHandle, chunk *bgzf.Chunk, blockURL func(*bgzf.Chunk) (ticket.URL, error)) ([]ticket.URL, error) {
+	var (
+		head = int64(chunk.Start.BlockOffset())
+		tail = int64(chunk.End.BlockOffset())
+	)
+	if head == tail {
+		return nil, nil
+	}
+
+	// The first block is re-encoded from the start of the chunk, so the
+	// signed range begins at the following block.
+	var prefix *bgzf.Chunk
+	if chunk.Start.DataOffset() != 0 {
+		r, err := newRangeReader(ctx, server.breaker, object, head, bgzf.HeaderSize)
+		if err != nil {
+			return nil, newStorageError("opening block", err)
+		}
+		size, err := bgzf.ReadBlockSize(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading block size: %v", err)
+		}
+		prefix = &bgzf.Chunk{Start: chunk.Start, End: bgzf.NewAddress(uint64(head)+uint64(size), 0)}
+		head += int64(size)
+	}
+	if head >= tail {
+		return nil, nil
+	}
+
+	var urls []ticket.URL
+	if prefix != nil {
+		url, err := blockURL(prefix)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+
+	signed, err := storage.SignedURL(object.BucketName(), object.ObjectName(), &storage.SignedURLOptions{
+		GoogleAccessID: server.signer.accessID,
+		PrivateKey:     server.signer.privateKey,
+		Method:         "GET",
+		Expires:        time.Now().Add(server.signer.expiry),
+		Scheme:         storage.SigningSchemeV4,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("signing URL: %v", err)
+	}
+	urls = append(urls, ticket.URL{
+		URL:     signed,
+		Headers: map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", head, tail-1)},
+		Class:   ticket.ClassBody,
+	})
+
+	if chunk.End.DataOffset() != 0 {
+		url, err := blockURL(&bgzf.Chunk{Start: bgzf.NewAddress(uint64(tail), 0), End: chunk.End})
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigningKey returns a PEM encoded RSA private key.
+func testSigningKey(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func TestSignedURLs(t *testing.T) {
+	fake := &fakeGCS{t}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, &http.Client{Transport: fake})
+	key := testSigningKey(t)
+	// The test blocks are about 20KiB, so larger chunks are needed for them
+	// to span whole blocks.
+	limit := func(server *Server) {
+		server.SetBucketBlockSizeLimit("testdata", 1<<20)
+	}
+	sign := func(server *Server) {
+		limit(server)
+		if err := server.SetSignedURLs("htsget@example.iam.gserviceaccount.com", key, time.Hour); err != nil {
+			t.Fatalf("Failed to enable signed URLs: %v", err)
+		}
+	}
+
+	// fetch returns the data of the ticket for url and the number of signed
+	// URLs in it.
+	fetch := func(url string) ([]byte, int) {
+		var body struct {
+			Htsget struct {
+				URLs []struct {
+					URL     string            `json:"url"`
+					Headers map[string]string `json:"headers"`
+				} `json:"urls"`
+			} `json:"htsget"`
+		}
+		if err := json.NewDecoder(testQuery(ctx, t, url, sign).Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode ticket: %v", err)
+		}
+
+		var (
+			data   []byte
+			signed int
+		)
+		for _, u := range body.Htsget.URLs {
+			var resp *http.Response
+			switch {
+			case strings.HasPrefix(u.URL, "data:"):
+				decoded, err := base64.StdEncoding.DecodeString(u.URL[strings.Index(u.URL, ",")+1:])
+				if err != nil {
+					t.Fatalf("Failed to decode data URL: %v", err)
+				}
+				data = append(data, decoded...)
+				continue
+			case strings.HasPrefix(u.URL, "https://storage.googleapis.com/"):
+				signed++
+				if !strings.HasPrefix(u.Headers["Range"], "bytes=") {
+					t.Errorf("Signed URL has no range: %v", u.Headers)
+				}
+				req, err := http.NewRequest("GET", u.URL, nil)
+				if err != nil {
+					t.Fatalf("Failed to parse URL %q: %v", u.URL, err)
+				}
+				for name, value := range u.Headers {
+					req.Header.Set(name, value)
+				}
+				if resp, err = fake.RoundTrip(req); err != nil {
+					t.Fatalf("Failed to fetch signed URL: %v", err)
+				}
+			default:
+				resp = testQuery(ctx, t, u.URL)
+			}
+			block, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Failed to read block: %v", err)
+			}
+			data = append(data, block...)
+		}
+		return data, signed
+	}
+
+	testCases := []struct {
+		name   string
+		url    string
+		signed bool
+	}{
+		{"region", "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20", true},
+		{"filtered", "/reads/testdata/NA12878.chr20.sample.bam?referenceName=20&fields=QNAME,FLAG", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			want, _ := fetchTicketData(ctx, t, tc.url, limit)
+			got, signed := fetch(tc.url)
+			if got, want := signed > 0, tc.signed; got != want {
+				t.Errorf("Wrong use of signed URLs: got %v, want %v", got, want)
+			}
+			if len(got) != len(want) || string(got) != string(want) {
+				t.Errorf("Wrong data: got %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestSetSignedURLs_InvalidInputs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		accessID string
+		key      []byte
+		expiry   time.Duration
+	}{
+		{"no account", "", []byte("key"), time.Hour},
+		{"no key", "htsget@example.iam.gserviceaccount.com", nil, time.Hour},
+		{"no expiry", "htsget@example.iam.gserviceaccount.com", []byte("key"), 0},
+		{"long expiry", "htsget@example.iam.gserviceaccount.com", []byte("key"), 8 * 24 * time.Hour},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := NewServer(nil, 0).SetSignedURLs(tc.accessID, tc.key, tc.expiry); err == nil {
+				t.Errorf("SetSignedURLs succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/googlegenomics/htsget/ticket"
+)
+
+// specQueryParameters are the query parameters that the htsget specification
+// defines for reads requests.
+var specQueryParameters = map[string]bool{
+	"format":        true,
+	"class":         true,
+	"referenceName": true,
+	"start":         true,
+	"end":           true,
+	"fields":        true,
+	"tags":          true,
+	"notags":        true,
+}
+
+// strictWriter marks the response to a request served in strict mode, so that
+// writeError reports every error using the htsget error object.
+type strictWriter struct {
+	http.ResponseWriter
+}
+
+// withStrictErrors marks responses written by handler as strict.
+func withStrictErrors(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(strictWriter{w}, req)
+	})
+}
+
+// checkQueryParameters returns an error if query holds a parameter that is
+// not defined by the htsget specification.
+func checkQueryParameters(query url.Values) error {
+	for name := range query {
+		if !specQueryParameters[name] {
+			return fmt.Errorf("unknown query parameter %q", name)
+		}
+	}
+	return nil
+}
+
+// checkTicketURLs returns an error if a URL in urls is neither an https nor a
+// data URL, as the htsget specification requires.
+func checkTicketURLs(urls []ticket.URL) error {
+	for _, u := range urls {
+		if !strings.HasPrefix(u.URL, "https://") && !strings.HasPrefix(u.URL, "data:") {
+			return fmt.Errorf("ticket URL %q does not use https (set an https advertised URL)", u.URL)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestStrict(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+	const url = "/reads/testdata/NA12878.chr20.sample.bam?referenceName=chr20"
+
+	testCases := []struct {
+		name       string
+		url        string
+		advertised string
+		strict     bool
+		code       int
+		error      string
+	}{
+		{"lenient", url + "&explain=false", "", false, http.StatusOK, ""},
+		{"https", url, "https://example.com", true, http.StatusOK, ""},
+		{"unknown parameter", url + "&explain=false", "https://example.com", true, http.StatusBadRequest, "InvalidInput"},
+		{"http", url, "http://example.com", true, http.StatusInternalServerError, "InternalError"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := testQuery(ctx, t, tc.url, func(server *Server) {
+				server.SetStrict(tc.strict)
+				if tc.advertised != "" {
+					server.SetAdvertisedURL(tc.advertised)
+				}
+			})
+			if tc.error != "" {
+				expectError(t, tc.error, tc.code, resp)
+				return
+			}
+			if got, want := resp.StatusCode, tc.code; got != want {
+				t.Errorf("Wrong status code: got %d, want %d", got, want)
+			}
+		})
+	}
+}
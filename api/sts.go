@@ -0,0 +1,182 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+const (
+	stsEndpoint = "https://sts.googleapis.com/v1/token"
+
+	// stsExpiryMargin is how long before their expiry exchanged tokens are
+	// replaced, so that a token never expires part way through a request.
+	stsExpiryMargin = time.Minute
+
+	// stsMaxCachedTokens bounds the number of exchanged tokens that are kept.
+	// Expired tokens are discarded first; if that is not enough, the whole
+	// cache is cleared.
+	stsMaxCachedTokens = 10000
+)
+
+// tokenExchanger exchanges external tokens for Google access tokens using the
+// Security Token Service and caches the results until shortly before they
+// expire.  It is safe for concurrent use.
+type tokenExchanger struct {
+	audience string
+	endpoint string
+	client   *http.Client
+
+	mu     sync.Mutex
+	tokens map[[sha256.Size]byte]*oauth2.Token
+}
+
+// NewClientFromExchangedToken returns a NewStorageClientFunc for servers whose
+// users authenticate with an external identity provider.  The OIDC token in
+// the bearer token of each request is exchanged for a short-lived Google
+// access token using workload identity federation, and the storage client
+// reads data with that access token.  audience names the workload identity
+// pool provider that trusts the external provider, as in
+// "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider".
+// Like NewClientFromBearerToken, the returned headers hold the original bearer
+// token so that block requests are authenticated in the same way.
+func NewClientFromExchangedToken(audience string) NewStorageClientFunc {
+	exchanger := &tokenExchanger{
+		audience: audience,
+		endpoint: stsEndpoint,
+		client:   http.DefaultClient,
+		tokens:   make(map[[sha256.Size]byte]*oauth2.Token),
+	}
+	return exchanger.newClient
+}
+
+func (e *tokenExchanger) newClient(req *http.Request) (*storage.Client, http.Header, error) {
+	authorization := req.Header.Get("Authorization")
+
+	fields := strings.Split(authorization, " ")
+	if len(fields) != 2 || fields[0] != "Bearer" {
+		return nil, nil, errMissingOrInvalidToken
+	}
+
+	token, err := e.token(req.Context(), fields[1], time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	transport := &oauth2.Transport{
+		Source: oauth2.StaticTokenSource(token),
+		Base:   &requestIDTransport{},
+	}
+	client, err := storage.NewClient(req.Context(), option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating client with token source: %v", err)
+	}
+
+	return client, map[string][]string{
+		"Authorization": []string{authorization},
+	}, nil
+}
+
+// token returns a Google access token in exchange for subject, using a cached
+// token if there is one that remains valid.
+func (e *tokenExchanger) token(ctx context.Context, subject string, now time.Time) (*oauth2.Token, error) {
+	key := sha256.Sum256([]byte(subject))
+
+	e.mu.Lock()
+	token, ok := e.tokens[key]
+	e.mu.Unlock()
+	if ok && now.Add(stsExpiryMargin).Before(token.Expiry) {
+		return token, nil
+	}
+
+	token, err := e.exchange(ctx, subject, now)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.tokens) >= stsMaxCachedTokens {
+		for k, t := range e.tokens {
+			if !now.Before(t.Expiry) {
+				delete(e.tokens, k)
+			}
+		}
+		if len(e.tokens) >= stsMaxCachedTokens {
+			e.tokens = make(map[[sha256.Size]byte]*oauth2.Token)
+		}
+	}
+	e.tokens[key] = token
+	return token, nil
+}
+
+// exchange asks the Security Token Service for an access token in exchange
+// for subject.  A token that the service rejects is reported as
+// errMissingOrInvalidToken.
+func (e *tokenExchanger) exchange(ctx context.Context, subject string, now time.Time) (*oauth2.Token, error) {
+	form := url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"audience":             {e.audience},
+		"scope":                {storage.ScopeReadOnly},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"subject_token":        {subject},
+		"subject_token_type":   {"urn:ietf:params:oauth:token-type:jwt"},
+	}
+	req, err := http.NewRequest("POST", e.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("creating token exchange request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("exchanging token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized:
+		return nil, errMissingOrInvalidToken
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("exchanging token: unexpected response status: %v", resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding token exchange response: %v", err)
+	}
+	if body.AccessToken == "" {
+		return nil, fmt.Errorf("exchanging token: no access token in response")
+	}
+	return &oauth2.Token{
+		AccessToken: body.AccessToken,
+		TokenType:   body.TokenType,
+		Expiry:      now.Add(time.Duration(body.ExpiresIn) * time.Second),
+	}, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const testPoolAudience = "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/idp"
+
+// fakeSTS exchanges the subject token "valid" for access tokens that are
+// numbered in the order they were issued.
+func fakeSTS(t *testing.T, exchanges *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			t.Errorf("Failed to parse form: %v", err)
+		}
+		if got, want := req.PostForm.Get("audience"), testPoolAudience; got != want {
+			t.Errorf("Wrong audience: got %q, want %q", got, want)
+		}
+		if req.PostForm.Get("subject_token") != "valid" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		*exchanges++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": strconv.Itoa(*exchanges),
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+}
+
+func TestTokenExchanger(t *testing.T) {
+	var exchanges int
+	sts := fakeSTS(t, &exchanges)
+	defer sts.Close()
+
+	e := &tokenExchanger{
+		audience: testPoolAudience,
+		endpoint: sts.URL,
+		client:   http.DefaultClient,
+		tokens:   make(map[[sha256.Size]byte]*oauth2.Token),
+	}
+	ctx, now := context.Background(), time.Now()
+
+	testCases := []struct {
+		name    string
+		subject string
+		now     time.Time
+		want    string
+	}{
+		{"first use", "valid", now, "1"},
+		{"cached", "valid", now.Add(30 * time.Minute), "1"},
+		{"close to expiry", "valid", now.Add(time.Hour - time.Second), "2"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := e.token(ctx, tc.subject, tc.now)
+			if err != nil {
+				t.Fatalf("token() returned error: %v", err)
+			}
+			if got := token.AccessToken; got != tc.want {
+				t.Errorf("Wrong access token: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := e.token(ctx, "rejected", now); err != errMissingOrInvalidToken {
+		t.Errorf("Wrong error for a rejected token: got %v, want %v", err, errMissingOrInvalidToken)
+	}
+}
+
+func TestNewClientFromExchangedToken(t *testing.T) {
+	var exchanges int
+	sts := fakeSTS(t, &exchanges)
+	defer sts.Close()
+
+	e := &tokenExchanger{
+		audience: testPoolAudience,
+		endpoint: sts.URL,
+		client:   http.DefaultClient,
+		tokens:   make(map[[sha256.Size]byte]*oauth2.Token),
+	}
+
+	req := httptest.NewRequest("GET", "/reads/bucket/object", nil)
+	if _, _, err := e.newClient(req); err != errMissingOrInvalidToken {
+		t.Errorf("Wrong error without a token: got %v, want %v", err, errMissingOrInvalidToken)
+	}
+
+	req.Header.Set("Authorization", "Bearer valid")
+	_, headers, err := e.newClient(req)
+	if err != nil {
+		t.Fatalf("newClient() returned error: %v", err)
+	}
+	// Block requests must carry the external token, not the exchanged one.
+	if got, want := headers.Get("Authorization"), "Bearer valid"; got != want {
+		t.Errorf("Wrong authorization header: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/googlegenomics/htsget/ticket"
+)
+
+// ticketSigner signs the body of ticket responses.
+type ticketSigner struct {
+	key   *ecdsa.PrivateKey
+	keyID string
+}
+
+// SetTicketSigningKey makes the server sign every ticket it returns with key,
+// which must use the P-256 curve.  The signature is a detached JWS over the
+// response body, returned in the ticket.SignatureHeader header and naming
+// keyID, so that clients can check that a ticket relayed by an intermediary
+// really came from this server.  A nil key (the default) disables signing.
+func (server *Server) SetTicketSigningKey(key *ecdsa.PrivateKey, keyID string) error {
+	if key == nil {
+		server.ticketSigner = nil
+		return nil
+	}
+	if key.Curve != elliptic.P256() {
+		return errors.New("ticket signing keys must use the P-256 curve")
+	}
+	server.ticketSigner = &ticketSigner{key, keyID}
+	return nil
+}
+
+// writeTicket writes response as JSON to w, signing the exact bytes of the
+// body if the server signs tickets.
+func (server *Server) writeTicket(w http.ResponseWriter, response *ticket.Response) {
+	if server.ticketSigner == nil {
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(response); err != nil {
+		writeError(w, &parseError{"encoding ticket", err})
+		return
+	}
+	signature, err := ticket.Sign(body.Bytes(), server.ticketSigner.key, server.ticketSigner.keyID)
+	if err != nil {
+		writeError(w, &parseError{"signing ticket", err})
+		return
+	}
+
+	w.Header().Set(ticket.SignatureHeader, signature)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		w.Header().Add("Access-Control-Expose-Headers", ticket.SignatureHeader)
+	}
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body.Bytes())
+}
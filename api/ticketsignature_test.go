@@ -0,0 +1,99 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/googlegenomics/htsget/ticket"
+)
+
+func TestTicketSignature(t *testing.T) {
+	fakeClient := &http.Client{Transport: &fakeGCS{t}}
+	ctx := context.WithValue(context.Background(), testHTTPClientKey, fakeClient)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	sign := func(server *Server) {
+		if err := server.SetTicketSigningKey(key, "test-key"); err != nil {
+			t.Fatalf("Failed to enable ticket signing: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name string
+		url  string
+	}{
+		{"reads", "/reads/testdata/NA12878.chr20.sample.bam?referenceName=chr20"},
+		{"sequence", "/sequence/testdata/sample.fa?referenceName=seq1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.url, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("Origin", "https://portal.example.com")
+			resp := testRequest(ctx, t, req, sign)
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Wrong status: got %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+
+			signature := resp.Header.Get(ticket.SignatureHeader)
+			keyID, err := ticket.Verify(body, signature, &key.PublicKey)
+			if err != nil {
+				t.Fatalf("Failed to verify signature %q: %v", signature, err)
+			}
+			if keyID != "test-key" {
+				t.Errorf("Wrong key ID: got %q, want %q", keyID, "test-key")
+			}
+			if got := resp.Header.Get("Access-Control-Expose-Headers"); got != ticket.SignatureHeader {
+				t.Errorf("Wrong exposed headers: got %q, want %q", got, ticket.SignatureHeader)
+			}
+		})
+	}
+
+	t.Run("unsigned", func(t *testing.T) {
+		resp := testQuery(ctx, t, testCases[0].url)
+		defer resp.Body.Close()
+		if got := resp.Header.Get(ticket.SignatureHeader); got != "" {
+			t.Errorf("Unexpected signature %q", got)
+		}
+	})
+}
+
+func TestSetTicketSigningKey_WrongCurve(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	server := NewServer(nil, testBlockSizeLimit)
+	if err := server.SetTicketSigningKey(key, ""); err == nil {
+		t.Error("Expected an error for a P-384 key")
+	}
+}
@@ -13,9 +13,13 @@ import (
 func init() {
 	mux := http.NewServeMux()
 	server := api.NewServer(newAppEngineClient, 8*1024*1024)
+	server.SetBearerTokenAuth(true)
 	if list := os.Getenv("BUCKET_WHITELIST"); list != "" {
 		server.Whitelist(strings.Split(list, ","))
 	}
+	if base := os.Getenv("ADVERTISED_URL"); base != "" {
+		server.SetAdvertisedURL(base)
+	}
 	server.Export(mux)
 	http.HandleFunc("/", mux.ServeHTTP)
 }
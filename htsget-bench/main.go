@@ -0,0 +1,268 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary generates load against an htsget server and reports latency
+// percentiles and throughput.  It is intended for capacity planning and for
+// detecting performance regressions.
+//
+// Each iteration requests a ticket for a randomly selected readset and
+// (optionally) region, then fetches some or all of the URLs in the ticket:
+//
+//	htsget-bench -server=http://localhost:8080 -c=16 -n=1000 \
+//	  -ids=bucket/a.bam,bucket/b.bam -references=1,2,20 -region_size=100000
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/googlegenomics/htsget/ticket"
+)
+
+var (
+	server      = flag.String("server", "http://localhost:80", "base URL of the htsget server")
+	ids         = flag.String("ids", "", "comma-separated list of readset IDs (bucket/object) to request")
+	format      = flag.String("format", "", "format to request (if empty, the server default is used)")
+	concurrency = flag.Int("c", 8, "number of concurrent workers")
+	requests    = flag.Int("n", 100, "total number of ticket requests to issue")
+	duration    = flag.Duration("duration", 0, "if set, run for this long instead of a fixed number of requests")
+
+	references = flag.String("references", "", "comma-separated list of reference names to pick regions from (if empty, whole files are requested)")
+	maxStart   = flag.Uint("max_start", 50000000, "largest region start position to generate")
+	regionSize = flag.Uint("region_size", 100000, "width of generated regions (0 requests whole references)")
+	wholeFile  = flag.Float64("whole_file", 0, "fraction of requests that ask for the whole file")
+	blocks     = flag.Float64("blocks", 1, "fraction of ticket URLs to fetch (0 only requests tickets)")
+
+	bearerToken = flag.String("bearer_token", "", "OAuth2 bearer token to send with each request")
+	seed        = flag.Int64("seed", 1, "random number generator seed")
+)
+
+// sample records the outcome of a single HTTP request.
+type sample struct {
+	latency time.Duration
+	bytes   int64
+	err     error
+}
+
+// recorder accumulates samples for a single class of request.
+type recorder struct {
+	mu      sync.Mutex
+	samples []sample
+}
+
+func (r *recorder) add(s sample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = append(r.samples, s)
+}
+
+func main() {
+	flag.Parse()
+
+	if *ids == "" {
+		log.Fatalf("You must specify at least one readset with -ids.")
+	}
+	readsets := strings.Split(*ids, ",")
+	var names []string
+	if *references != "" {
+		names = strings.Split(*references, ",")
+	}
+
+	var (
+		tickets, data recorder
+		work          = make(chan *rand.Rand)
+		wg            sync.WaitGroup
+	)
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rng := range work {
+				target := ticketURL(rng, readsets, names)
+				urls, s := fetchTicket(target)
+				tickets.add(s)
+				if s.err != nil {
+					log.Printf("Ticket request for %s failed: %v", target, s.err)
+					continue
+				}
+				for _, u := range urls {
+					// Inline data URLs require no request.
+					if strings.HasPrefix(u.URL, "data:") || rng.Float64() >= *blocks {
+						continue
+					}
+					s := fetchData(u.URL, u.Headers)
+					data.add(s)
+					if s.err != nil {
+						log.Printf("Data request failed: %v", s.err)
+					}
+				}
+			}
+		}()
+	}
+
+	start := time.Now()
+	deadline := start.Add(*duration)
+	for i := 0; ; i++ {
+		if *duration > 0 && time.Now().After(deadline) || *duration == 0 && i >= *requests {
+			break
+		}
+		work <- rand.New(rand.NewSource(*seed + int64(i)))
+	}
+	close(work)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("Elapsed time: %v (%d workers)\n\n", elapsed.Round(time.Millisecond), *concurrency)
+	report(os.Stdout, "Tickets", tickets.samples, elapsed)
+	report(os.Stdout, "Data", data.samples, elapsed)
+}
+
+// ticketURL returns a randomly generated ticket request URL.
+func ticketURL(rng *rand.Rand, readsets, references []string) string {
+	target := fmt.Sprintf("%s/reads/%s", strings.TrimSuffix(*server, "/"), readsets[rng.Intn(len(readsets))])
+
+	query := url.Values{}
+	if *format != "" {
+		query.Set("format", *format)
+	}
+	if len(references) > 0 && rng.Float64() >= *wholeFile {
+		query.Set("referenceName", references[rng.Intn(len(references))])
+		if *regionSize > 0 {
+			start := uint(rng.Int63n(int64(*maxStart) + 1))
+			query.Set("start", strconv.FormatUint(uint64(start), 10))
+			query.Set("end", strconv.FormatUint(uint64(start+*regionSize), 10))
+		}
+	}
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	return target
+}
+
+func fetchTicket(target string) ([]ticket.URL, sample) {
+	start := time.Now()
+	resp, err := get(target, nil)
+	if err != nil {
+		return nil, sample{latency: time.Since(start), err: err}
+	}
+	defer resp.Body.Close()
+
+	var response ticket.Response
+	body, err := ioutil.ReadAll(resp.Body)
+	s := sample{latency: time.Since(start), bytes: int64(len(body)), err: err}
+	if s.err == nil {
+		if err := json.Unmarshal(body, &response); err != nil {
+			s.err = fmt.Errorf("decoding ticket: %v", err)
+		} else if response.Ticket == nil {
+			s.err = errors.New("decoding ticket: missing htsget object")
+		}
+	}
+	if s.err != nil {
+		return nil, s
+	}
+	return response.Ticket.URLs, s
+}
+
+func fetchData(target string, headers map[string]string) sample {
+	start := time.Now()
+	resp, err := get(target, headers)
+	if err != nil {
+		return sample{latency: time.Since(start), err: err}
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	return sample{latency: time.Since(start), bytes: n, err: err}
+}
+
+func get(target string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %v", err)
+	}
+	if *bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*bearerToken)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response status: %q", resp.Status)
+	}
+	return resp, nil
+}
+
+// report writes a summary of samples to w.
+func report(w io.Writer, title string, samples []sample, elapsed time.Duration) {
+	var (
+		latencies []time.Duration
+		bytes     int64
+		errors    int
+	)
+	for _, s := range samples {
+		if s.err != nil {
+			errors++
+			continue
+		}
+		latencies = append(latencies, s.latency)
+		bytes += s.bytes
+	}
+
+	fmt.Fprintf(w, "%s: %d requests, %d errors\n", title, len(latencies)+errors, errors)
+	if len(latencies) == 0 {
+		fmt.Fprintln(w)
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	seconds := elapsed.Seconds()
+	fmt.Fprintf(w, "  throughput: %.1f requests/s, %.1f MB/s\n",
+		float64(len(latencies))/seconds, float64(bytes)/seconds/(1024*1024))
+	for _, p := range []float64{50, 90, 99} {
+		fmt.Fprintf(w, "  p%-3v %v\n", p, percentile(latencies, p).Round(time.Microsecond))
+	}
+	fmt.Fprintf(w, "  max  %v\n\n", latencies[len(latencies)-1].Round(time.Microsecond))
+}
+
+// percentile returns the p-th percentile of the sorted values.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
@@ -16,23 +16,38 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/md5"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"cloud.google.com/go/storage"
+	"github.com/googlegenomics/htsget/internal/bam"
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/ticket"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
@@ -42,28 +57,328 @@ const (
 )
 
 var (
-	reference = flag.String("r", "", "reference name")
-	output    = flag.String("o", "", "output filename")
+	regionsBED = flag.String("regions-bed", "", "BED file listing regions to fetch (0-based, end exclusive)")
+	output     = flag.String("o", "", "output filename (or gs://bucket/object to write directly to GCS)")
+	withIndex  = flag.Bool("with-index", false, "also write a BAI index for the output (to the output name plus .bai)")
+	pinOnly    = flag.Bool("pin-only", false, "with -pin-sha256, trust a pinned server certificate without validating its CA chain")
+	checksums  = flag.String("checksums", "", "comma-separated list of checksums (md5, sha256) to write for the output (to the output name plus .md5 or .sha256)")
+
+	splitSize        = flag.Int64("split-size", 0, "if set, fetch blobs larger than this many bytes in pieces of this size over several connections, if the block server supports range requests")
+	splitConnections = flag.Int("split-connections", 4, "with -split-size, the number of pieces of a blob fetched at once (each is held in memory)")
+
+	format          = flag.String("format", "", "the format to request (BAM, CRAM, VCF or BCF); by default the server chooses, which is BAM for reads")
+	start           = flag.String("start", "", "with a single -r naming only a reference, the 0-based start of the region to fetch")
+	end             = flag.String("end", "", "with a single -r naming only a reference, the 0-based, exclusive end of the region to fetch")
+	separateRegions = flag.Bool("separate-regions", false, "with several regions, request each one separately and merge them on the client (repeating reads that overlap more than one) instead of sending a single POST request, for servers that do not support POST")
+
+	retries    = flag.Int("retries", 3, "the number of times a failed ticket or block request is retried (transfers of blocks resume where they stopped, if the server supports range requests)")
+	retryDelay = flag.Duration("retry-delay", time.Second, "the delay before the first retry, which doubles for each later one")
+
+	ticketPublicKey = flag.String("ticket-public-key", "", "if set, a PEM encoded P-256 public key file; tickets must carry a valid signature by this key")
+
+	parallel = flag.Int("parallel", 1, "the number of ticket URLs downloaded at once (blobs fetched ahead of the output are held in temporary files)")
 )
 
+// checksumAlgorithms maps the names accepted by -checksums to hash
+// constructors.  The names double as manifest file extensions.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+}
+
+func init() {
+	flag.Var(&regions, "r", "region to fetch, as a reference name optionally followed by :start-end (may be repeated)")
+	flag.Var(&pins, "pin-sha256", "base64 SHA-256 fingerprint of the server's public key, optionally prefixed by sha256// (may be repeated)")
+}
+
+// region is a genomic region in the form used by htsget query parameters.
+type region struct {
+	reference  string
+	start, end string
+}
+
+func (r region) String() string {
+	if r.start == "" && r.end == "" {
+		return r.reference
+	}
+	return fmt.Sprintf("%s:%s-%s", r.reference, r.start, r.end)
+}
+
+// addTo returns target with the htsget query parameters that select r.
+func (r region) addTo(target string) string {
+	target = addParameter(target, "referenceName", r.reference)
+	if r.start != "" {
+		target = addParameter(target, "start", r.start)
+	}
+	if r.end != "" {
+		target = addParameter(target, "end", r.end)
+	}
+	return target
+}
+
+// regionsFlag collects the regions passed via repeated -r flags.
+type regionsFlag []region
+
+var regions regionsFlag
+
+func (f *regionsFlag) String() string {
+	var names []string
+	for _, r := range *f {
+		names = append(names, r.String())
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *regionsFlag) Set(value string) error {
+	r := region{reference: value}
+	// Reference names may themselves contain colons, so only a trailing
+	// numeric range is treated as coordinates.
+	if i := strings.LastIndex(value, ":"); i > 0 {
+		if bounds := strings.SplitN(value[i+1:], "-", 2); len(bounds) == 2 && isNumber(bounds[0]) && isNumber(bounds[1]) {
+			r = region{reference: value[:i], start: bounds[0], end: bounds[1]}
+		}
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// pinsFlag collects the public key fingerprints passed via repeated
+// -pin-sha256 flags.
+type pinsFlag [][]byte
+
+var pins pinsFlag
+
+// pinnedHosts holds the hosts whose keys are checked against pins, or nil if
+// there are no pins.
+var pinnedHosts map[string]bool
+
+func (f *pinsFlag) String() string {
+	var encoded []string
+	for _, pin := range *f {
+		encoded = append(encoded, "sha256//"+base64.StdEncoding.EncodeToString(pin))
+	}
+	return strings.Join(encoded, ",")
+}
+
+func (f *pinsFlag) Set(value string) error {
+	pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "sha256//"))
+	if err != nil {
+		return fmt.Errorf("decoding fingerprint: %v", err)
+	}
+	if len(pin) != sha256.Size {
+		return fmt.Errorf("fingerprint is %d bytes, want %d", len(pin), sha256.Size)
+	}
+	*f = append(*f, pin)
+	return nil
+}
+
+// pinTLSConfig returns a copy of config that checks the public key of servers
+// in hosts against pins.  Other hosts (such as the OAuth2 token endpoint) only
+// have their certificate chain validated.  The check is part of the handshake,
+// so it also applies to connections tunnelled through a proxy.  Servers named
+// by IP address send no server name to check, so their keys must always match
+// a pin.  If skipCA is true, pinned servers are trusted without validating
+// their certificate chain.
+func pinTLSConfig(config *tls.Config, hosts map[string]bool, pins [][]byte, skipCA bool) *tls.Config {
+	c := config.Clone()
+	pinned := func(cs tls.ConnectionState) bool {
+		return cs.ServerName == "" || hosts[cs.ServerName]
+	}
+	if !skipCA {
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if pinned(cs) {
+				return checkPins(cs.PeerCertificates, pins)
+			}
+			return nil
+		}
+		return c
+	}
+
+	// Chain validation is turned off for every host, so it is repeated here
+	// for the hosts that are not pinned.
+	c.InsecureSkipVerify = true
+	c.VerifyConnection = func(cs tls.ConnectionState) error {
+		if pinned(cs) {
+			return checkPins(cs.PeerCertificates, pins)
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		options := x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Roots:         config.RootCAs,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			options.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(options)
+		return err
+	}
+	return c
+}
+
+// newTransport returns a copy of http.DefaultTransport, which keeps its proxy
+// settings, timeouts and HTTP/2 support, that uses config for TLS.
+func newTransport(config *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return transport
+}
+
+// warnUnpinned logs a warning for each host of urls that is not pinned, since
+// data fetched from it is only protected by the usual certificate checks.
+func warnUnpinned(urls []ticket.URL) {
+	warned := make(map[string]bool)
+	for i, blob := range urls {
+		if strings.HasPrefix(blob.URL, "data:") {
+			continue
+		}
+		u, err := url.Parse(blob.URL)
+		if err != nil || pinnedHosts[u.Hostname()] || warned[u.Hostname()] {
+			continue
+		}
+		warned[u.Hostname()] = true
+		log.Printf("Warning: blob %d is served by %q, whose certificate is not pinned", i, u.Hostname())
+	}
+}
+
+// checkPins returns an error unless the public key of the leaf certificate in
+// certs matches one of pins.
+func checkPins(certs []*x509.Certificate, pins [][]byte) error {
+	if len(certs) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	sum := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(sum[:], pin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("server public key sha256//%s does not match any pin", base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
+}
+
+// readBED returns the regions listed in the BED file read from r.
+func readBED(r io.Reader) ([]region, error) {
+	var regions []region
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "track") || strings.HasPrefix(text, "browser") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 3 || !isNumber(fields[1]) || !isNumber(fields[2]) {
+			return nil, fmt.Errorf("line %d: expected reference, start and end", line)
+		}
+		regions = append(regions, region{reference: fields[0], start: fields[1], end: fields[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading BED file: %v", err)
+	}
+	return regions, nil
+}
+
 func main() {
 	flag.Parse()
 
-	w := io.Writer(os.Stdout)
-	if *output != "" {
-		f, err := os.Create(*output)
+	if *regionsBED != "" {
+		f, err := os.Open(*regionsBED)
 		if err != nil {
-			log.Fatalf("Failed to open output file: %v", err)
+			log.Fatalf("Failed to open BED file: %v", err)
 		}
-		defer f.Close()
+		bed, err := readBED(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to read %q: %v", *regionsBED, err)
+		}
+		regions = append(regions, bed...)
+	}
 
-		w = f
+	if *format != "" {
+		if _, ok := formatWriters[*format]; !ok {
+			log.Fatalf("Unsupported format %q", *format)
+		}
+		if *format != "BAM" && (*withIndex || *separateRegions) {
+			log.Fatalf("The -with-index and -separate-regions flags only support BAM")
+		}
+	}
+
+	if *start != "" || *end != "" {
+		if len(regions) != 1 || regions[0].start != "" || regions[0].end != "" {
+			log.Fatalf("The -start and -end flags require a single -r flag naming only a reference")
+		}
+		for _, bound := range []string{*start, *end} {
+			if bound != "" && !isNumber(bound) {
+				log.Fatalf("Invalid region bound %q", bound)
+			}
+		}
+		regions[0].start, regions[0].end = *start, *end
+	}
+
+	if *ticketPublicKey != "" {
+		key, err := readTicketPublicKey(*ticketPublicKey)
+		if err != nil {
+			log.Fatalf("Failed to read ticket public key: %v", err)
+		}
+		ticketKey = key
 	}
 
 	ctx := context.Background()
 
+	w, err := openOutput(ctx, *output)
+	if err != nil {
+		log.Fatalf("Failed to open output: %v", err)
+	}
+
+	// The index from the server describes the original file rather than the
+	// slice that is being downloaded, so a new index is built from the data as
+	// it is written.
+	data := io.Writer(w)
+
+	manifests, err := newManifests(*checksums)
+	if err != nil {
+		log.Fatalf("Invalid -checksums flag: %v", err)
+	}
+	if len(manifests) > 0 {
+		if *output == "" {
+			log.Fatalf("The -checksums flag requires an output name (-o)")
+		}
+		writers := []io.Writer{data}
+		for _, m := range manifests {
+			writers = append(writers, m.hash)
+		}
+		data = io.MultiWriter(writers...)
+	}
+
+	var index *indexer
+	if *withIndex {
+		if *output == "" {
+			log.Fatalf("The -with-index flag requires an output name (-o)")
+		}
+		if flag.NArg() > 1 {
+			log.Fatalf("The -with-index flag can only be used with a single URL")
+		}
+		bai, err := openOutput(ctx, *output+".bai")
+		if err != nil {
+			log.Fatalf("Failed to open index output: %v", err)
+		}
+		index = newIndexer(bai)
+		data = io.MultiWriter(data, index)
+	}
+
+	if *pinOnly && len(pins) == 0 {
+		log.Fatalf("The -pin-only flag requires at least one -pin-sha256 fingerprint")
+	}
+
 	// For compatibility with other tools, read the standard cURL certificate
 	// authority override from the environment.
+	tlsConfig := &tls.Config{}
 	if bundle := os.Getenv("CURL_CA_BUNDLE"); bundle != "" {
 		pem, err := ioutil.ReadFile(bundle)
 		if err != nil {
@@ -76,15 +391,33 @@ func main() {
 		if !pool.AppendCertsFromPEM(pem) {
 			log.Fatalf("Failed to add certificates from bundle %q", bundle)
 		}
+		tlsConfig.RootCAs = pool
 		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					RootCAs: pool,
-				}},
+			Transport: newTransport(tlsConfig),
 		})
 		log.Printf("Using CA override bundle from %q", bundle)
 	}
 
+	// Pins apply to the htsget servers named on the command line, which usually
+	// also serve the block URLs in their tickets.
+	if len(pins) > 0 {
+		hosts := make(map[string]bool)
+		for _, target := range flag.Args() {
+			u, err := url.Parse(target)
+			if err != nil {
+				log.Fatalf("Failed to parse URL %q: %v", target, err)
+			}
+			if u.Scheme != "https" {
+				log.Fatalf("Certificate pinning requires an https URL, got %q", target)
+			}
+			hosts[u.Hostname()] = true
+		}
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+			Transport: newTransport(pinTLSConfig(tlsConfig, hosts, pins, *pinOnly)),
+		})
+		pinnedHosts = hosts
+	}
+
 	client, err := google.DefaultClient(ctx, scope)
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
@@ -92,48 +425,536 @@ func main() {
 
 	for _, target := range flag.Args() {
 		log.Printf("Fetching %q", target)
-		if *reference != "" {
-			target = addParameter(target, "referenceName", *reference)
+
+		// A single region (or none) is requested in the query and multiple
+		// regions in the body of a POST request, and the data is streamed
+		// unmodified.  With -separate-regions, multiple regions are requested one
+		// at a time and merged into a single BAM file instead.
+		if len(regions) > 1 && *separateRegions {
+			if err := fetchMerged(ctx, client, target, regions, data); err != nil {
+				log.Fatalf("Failed to fetch data: %v", err)
+			}
+			continue
 		}
-		resp, err := client.Get(target)
+		req, err := newTicketRequest(target, regions, *format)
 		if err != nil {
-			log.Fatalf("Request failed: %v", err)
+			log.Fatalf("Failed to create request: %v", err)
+		}
+		if err := fetchTicketData(ctx, client, req, data); err != nil {
+			log.Fatalf("Failed to fetch data: %v", err)
 		}
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			log.Fatalf("Unexpected response: %v", errorFromResponse(resp))
+	// For GCS outputs, the object is only created once the writer is closed
+	// successfully.
+	if err := w.Close(); err != nil {
+		log.Fatalf("Failed to close output: %v", err)
+	}
+	if index != nil {
+		if err := index.Close(); err != nil {
+			log.Fatalf("Failed to write index: %v", err)
 		}
+		log.Printf("Wrote index to %q", *output+".bai")
+	}
+	for _, m := range manifests {
+		name := *output + "." + m.algorithm
+		if err := m.write(ctx, name, *output); err != nil {
+			log.Fatalf("Failed to write checksum manifest: %v", err)
+		}
+		log.Printf("Wrote %s checksum to %q", m.algorithm, name)
+	}
+}
+
+// manifest accumulates a checksum of the output for a sidecar file in the
+// format used by md5sum and sha256sum.
+type manifest struct {
+	algorithm string
+	hash      hash.Hash
+}
 
-		var ticket struct {
-			Container struct {
-				URLs []struct {
-					URL     string            `json:"url"`
-					Headers map[string]string `json:"headers"`
-				} `json:"urls"`
-			} `json:"htsget"`
+// newManifests returns a manifest for each algorithm in the comma-separated
+// list names.
+func newManifests(names string) ([]*manifest, error) {
+	var manifests []*manifest
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
 		}
-		if err := json.NewDecoder(resp.Body).Decode(&ticket); err != nil {
-			log.Fatalf("Failed to decode response: %v", err)
+		newHash, ok := checksumAlgorithms[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported checksum %q", name)
 		}
+		seen[name] = true
+		manifests = append(manifests, &manifest{algorithm: name, hash: newHash()})
+	}
+	return manifests, nil
+}
+
+// write writes the checksum to the output called name, describing the file
+// called target.  Only the base name of target is recorded so that the
+// manifest can be verified after both files are copied elsewhere.
+func (m *manifest) write(ctx context.Context, name, target string) error {
+	w, err := openOutput(ctx, name)
+	if err != nil {
+		return fmt.Errorf("opening %q: %v", name, err)
+	}
+	if _, err := fmt.Fprintf(w, "%x  %s\n", m.hash.Sum(nil), path.Base(target)); err != nil {
+		w.Close()
+		return fmt.Errorf("writing %q: %v", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("closing %q: %v", name, err)
+	}
+	return nil
+}
+
+// indexer builds a BAI index from the BAM data written to it.
+type indexer struct {
+	*io.PipeWriter
+
+	bai  io.WriteCloser
+	done chan error
+}
+
+func newIndexer(bai io.WriteCloser) *indexer {
+	r, w := io.Pipe()
+	index := &indexer{PipeWriter: w, bai: bai, done: make(chan error, 1)}
+	go func() {
+		err := bam.WriteIndex(bai, r)
+		// Unblock any pending writes if indexing stopped early.
+		r.CloseWithError(err)
+		index.done <- err
+	}()
+	return index
+}
+
+// Close signals the end of the data and waits for the index to be written.
+func (index *indexer) Close() error {
+	index.PipeWriter.Close()
+	if err := <-index.done; err != nil {
+		index.bai.Close()
+		return err
+	}
+	return index.bai.Close()
+}
+
+// ticketKey is the key that must have signed tickets, if any.
+var ticketKey *ecdsa.PublicKey
+
+// readTicketPublicKey reads the PEM encoded ECDSA public key from the file at
+// path.
+func readTicketPublicKey(path string) (*ecdsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%q does not contain a PEM encoded key", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %v", path, err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%q is not an ECDSA key", path)
+	}
+	return ecKey, nil
+}
 
-		log.Printf("Received ticket with %d URLs", len(ticket.Container.URLs))
+// bodyRegion is a region in the JSON body of a POST reads request.
+type bodyRegion struct {
+	ReferenceName string  `json:"referenceName"`
+	Start         *uint64 `json:"start,omitempty"`
+	End           *uint64 `json:"end,omitempty"`
+}
 
-		for i, blob := range ticket.Container.URLs {
-			r, err := fetchBlob(ctx, blob.URL, blob.Headers)
+// newTicketRequest returns the ticket request for regions of target in format
+// (or the server's default if empty): a GET request with the region in its
+// query if there is at most one, and otherwise a POST request that lists them
+// in its body.
+func newTicketRequest(target string, regions []region, format string) (*http.Request, error) {
+	if len(regions) <= 1 {
+		if format != "" {
+			target = addParameter(target, "format", format)
+		}
+		if len(regions) == 1 {
+			target = regions[0].addTo(target)
+		}
+		return http.NewRequest("GET", target, nil)
+	}
+
+	body := struct {
+		Format  string       `json:"format,omitempty"`
+		Regions []bodyRegion `json:"regions"`
+	}{Format: format}
+	for _, r := range regions {
+		region := bodyRegion{ReferenceName: r.reference}
+		for _, bound := range []struct {
+			value string
+			dst   **uint64
+		}{{r.start, &region.Start}, {r.end, &region.End}} {
+			if bound.value == "" {
+				continue
+			}
+			v, err := strconv.ParseUint(bound.value, 10, 64)
 			if err != nil {
-				log.Fatalf("Blob %d: failed to fetch data: %v", i, err)
+				return nil, fmt.Errorf("region %s: %v", r, err)
 			}
-			defer r.Close()
+			*bound.dst = &v
+		}
+		body.Regions = append(body.Regions, region)
+	}
+	data, err := json.Marshal(&body)
+	if err != nil {
+		return nil, fmt.Errorf("encoding regions: %v", err)
+	}
+	req, err := http.NewRequest("POST", target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
 
-			n, err := io.Copy(w, r)
-			if err != nil {
-				log.Fatalf("Blob %d: copying data to disk: %v", i, err)
+// fetchTicketData requests a ticket with req and writes the data from each of
+// its URLs to w.
+func fetchTicketData(ctx context.Context, client *http.Client, req *http.Request, w io.Writer) error {
+	var (
+		resp *http.Response
+		body []byte
+	)
+	// The ticket is small, so a response that breaks off is simply requested
+	// again.
+	err := retry(ctx, func() error {
+		var err error
+		resp, err = doWithRetry(ctx, client, req)
+		if err != nil {
+			return permanent(fmt.Errorf("request failed: %v", err))
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return permanent(fmt.Errorf("unexpected response: %v", errorFromResponse(resp)))
+		}
+		if body, err = ioutil.ReadAll(resp.Body); err != nil {
+			return fmt.Errorf("reading response: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if ticketKey != nil {
+		signature := resp.Header.Get(ticket.SignatureHeader)
+		if signature == "" {
+			return errors.New("ticket is not signed")
+		}
+		keyID, err := ticket.Verify(body, signature, ticketKey)
+		if err != nil {
+			return fmt.Errorf("verifying ticket: %v", err)
+		}
+		log.Printf("Verified ticket signature (key %q)", keyID)
+	}
+
+	var response ticket.Response
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("decoding response: %v", err)
+	}
+	if response.Ticket == nil {
+		return errors.New("decoding response: missing htsget object")
+	}
+
+	log.Printf("Received %s ticket with %d URLs", response.Ticket.Format, len(response.Ticket.URLs))
+	if pinnedHosts != nil {
+		warnUnpinned(response.Ticket.URLs)
+	}
+
+	// The index is built from BAM records, so it cannot describe other formats.
+	if *withIndex && response.Ticket.Format != "BAM" {
+		return fmt.Errorf("cannot index %s data", response.Ticket.Format)
+	}
+	newWriter, ok := formatWriters[response.Ticket.Format]
+	if !ok {
+		return fmt.Errorf("unsupported format %q", response.Ticket.Format)
+	}
+	cat := newWriter(w)
+	if *parallel > 1 {
+		if err := appendParallel(ctx, cat, response.Ticket.URLs); err != nil {
+			return err
+		}
+		return cat.Close()
+	}
+	for i, blob := range response.Ticket.URLs {
+		r, err := fetchBlob(ctx, blob.URL, blob.Headers)
+		if err != nil {
+			return fmt.Errorf("blob %d: fetching data: %v", i, err)
+		}
+		n, err := cat.Append(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("blob %d: copying data to output: %v", i, err)
+		}
+		log.Printf("Blob %d: wrote %d bytes", i, n)
+	}
+	return cat.Close()
+}
+
+// blobWriter joins the blobs of a ticket into a single file and terminates it
+// as its format requires.
+type blobWriter interface {
+	Append(r io.Reader) (int64, error)
+	Close() error
+}
+
+// formatWriters return the blobWriter for each supported format.  BAM, VCF and
+// BCF data is BGZF compressed, so the blocks are validated as they are joined,
+// and the EOF marker is only written once all of them have been received.
+var formatWriters = map[string]func(io.Writer) blobWriter{
+	"BAM":  func(w io.Writer) blobWriter { return bgzf.NewConcatenator(w) },
+	"VCF":  func(w io.Writer) blobWriter { return bgzf.NewConcatenator(w) },
+	"BCF":  func(w io.Writer) blobWriter { return bgzf.NewConcatenator(w) },
+	"CRAM": func(w io.Writer) blobWriter { return &cramWriter{w: w} },
+}
+
+// cramEOF holds the EOF container that terminates CRAM files of each major
+// version.
+var cramEOF = map[byte][]byte{
+	2: []byte("\x0b\x00\x00\x00\xff\xff\xff\xff\xff\xe0\x45\x4f\x46\x00\x00\x00\x00\x01\x00\x00\x01\x00\x06\x06\x01\x00\x01\x00\x01\x00"),
+	3: []byte("\x0f\x00\x00\x00\xff\xff\xff\xff\x0f\xe0\x45\x4f\x46\x00\x00\x00\x00\x01\x00\x05\xbd\xd9\x4f\x00\x01\x00\x06\x06\x01\x00\x01\x00\x01\x00\xee\x63\x01\x4b"),
+}
+
+// cramWriter joins the blobs of a CRAM ticket, which are copied unmodified.
+// Servers normally send the EOF container as the last blob; Close only writes
+// one if the data does not already end with it.
+type cramWriter struct {
+	w io.Writer
+	// definition holds the start of the file definition, which contains the
+	// CRAM magic and version, and tail the last bytes written.
+	definition []byte
+	tail       []byte
+}
+
+func (c *cramWriter) Append(r io.Reader) (int64, error) {
+	return io.Copy(c, r)
+}
+
+func (c *cramWriter) Write(p []byte) (int, error) {
+	if n := 6 - len(c.definition); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		c.definition = append(c.definition, p[:n]...)
+	}
+	// Only as many bytes as the longest EOF container are kept.
+	n := len(cramEOF[3])
+	if len(p) >= n {
+		c.tail = append(c.tail[:0], p[len(p)-n:]...)
+	} else {
+		c.tail = append(c.tail, p...)
+		if len(c.tail) > n {
+			c.tail = c.tail[len(c.tail)-n:]
+		}
+	}
+	return c.w.Write(p)
+}
+
+func (c *cramWriter) Close() error {
+	if len(c.definition) < 6 || string(c.definition[:4]) != "CRAM" {
+		return errors.New("data is not a CRAM file")
+	}
+	eof, ok := cramEOF[c.definition[4]]
+	if !ok {
+		return fmt.Errorf("unsupported CRAM version %d.%d", c.definition[4], c.definition[5])
+	}
+	if bytes.HasSuffix(c.tail, eof) {
+		return nil
+	}
+	_, err := c.w.Write(eof)
+	return err
+}
+
+// appendParallel downloads the blobs of urls, up to -parallel at a time, and
+// appends them to cat in order.  Each blob is downloaded to a temporary file,
+// which is removed once it has been appended, so at most -parallel blobs are
+// held on disk.
+func appendParallel(ctx context.Context, cat blobWriter, urls []ticket.URL) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	type blob struct {
+		f   *os.File
+		err error
+	}
+	blobs := make([]chan blob, len(urls))
+	for i := range blobs {
+		blobs[i] = make(chan blob, 1)
+	}
+	defer func() {
+		// Remove the blobs that were downloaded but not appended.
+		cancel()
+		wg.Wait()
+		for _, c := range blobs {
+			select {
+			case b := <-c:
+				if b.f != nil {
+					removeTemp(b.f)
+				}
+			default:
+			}
+		}
+	}()
+
+	slots := make(chan struct{}, *parallel)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, u := range urls {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
 			}
-			log.Printf("Blob %d: wrote %d bytes", i, n)
+			wg.Add(1)
+			go func(i int, u ticket.URL) {
+				defer wg.Done()
+				f, err := downloadBlob(ctx, u)
+				blobs[i] <- blob{f, err}
+			}(i, u)
 		}
+	}()
+
+	for i, c := range blobs {
+		var b blob
+		select {
+		case b = <-c:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if b.err != nil {
+			return fmt.Errorf("blob %d: fetching data: %v", i, b.err)
+		}
+		n, err := cat.Append(b.f)
+		removeTemp(b.f)
+		<-slots
+		if err != nil {
+			return fmt.Errorf("blob %d: copying data to output: %v", i, err)
+		}
+		log.Printf("Blob %d: wrote %d bytes", i, n)
+	}
+	return nil
+}
+
+// downloadBlob writes the data of u to a temporary file and returns the file,
+// positioned at its start.
+func downloadBlob(ctx context.Context, u ticket.URL) (*os.File, error) {
+	r, err := fetchBlob(ctx, u.URL, u.Headers)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	f, err := ioutil.TempFile("", "htsget-blob-")
+	if err != nil {
+		return nil, fmt.Errorf("creating temporary file: %v", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		removeTemp(f)
+		return nil, fmt.Errorf("downloading data: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		removeTemp(f)
+		return nil, fmt.Errorf("rewinding temporary file: %v", err)
+	}
+	return f, nil
+}
+
+// removeTemp closes and removes the temporary file f.
+func removeTemp(f *os.File) {
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		log.Printf("Failed to remove temporary file: %v", err)
 	}
 }
 
+// fetchMerged fetches each region from target in turn and writes a single
+// BAM file containing the header from the first region followed by the reads
+// from every region.  Reads that overlap more than one region are repeated.
+func fetchMerged(ctx context.Context, client *http.Client, target string, regions []region, w io.Writer) error {
+	bw := bgzf.NewWriter(w)
+	for i, region := range regions {
+		log.Printf("Fetching region %s", region)
+
+		r, pw := io.Pipe()
+		req, err := http.NewRequest("GET", region.addTo(target), nil)
+		if err != nil {
+			return fmt.Errorf("region %s: creating request: %v", region, err)
+		}
+		go func() {
+			pw.CloseWithError(fetchTicketData(ctx, client, req, pw))
+		}()
+
+		err = copyRegion(bw, r, i > 0)
+		r.CloseWithError(errors.New("region copy finished"))
+		if err != nil {
+			return fmt.Errorf("region %s: %v", region, err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		return fmt.Errorf("writing final block: %v", err)
+	}
+	_, err := w.Write(bgzf.EOFMarker)
+	return err
+}
+
+// copyRegion decompresses the BAM data in r and writes it to w, omitting the
+// header if skipHeader is true.
+func copyRegion(w io.Writer, r io.Reader, skipHeader bool) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("opening data: %v", err)
+	}
+	if skipHeader {
+		if err := bam.SkipHeader(gz); err != nil {
+			return fmt.Errorf("skipping header: %v", err)
+		}
+	}
+	if _, err := io.Copy(w, gz); err != nil {
+		return fmt.Errorf("copying reads: %v", err)
+	}
+	return nil
+}
+
+// openOutput returns a writer for the named output.  An empty name selects
+// standard output and names of the form gs://bucket/object are streamed to
+// GCS without staging a local copy.
+func openOutput(ctx context.Context, name string) (io.WriteCloser, error) {
+	if name == "" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	path := strings.TrimPrefix(name, "gs://")
+	if path == name {
+		return os.Create(name)
+	}
+
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid GCS path %q", name)
+	}
+	gcs, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating storage client: %v", err)
+	}
+	return gcs.Bucket(parts[0]).Object(parts[1]).NewWriter(ctx), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
 func addParameter(input, name, value string) string {
 	values := url.Values{}
 	values.Set(name, value)
@@ -189,22 +1010,318 @@ func fetchBlob(ctx context.Context, target string, headers map[string]string) (i
 		client = c
 	}
 
-	resp, err := client.Do(req)
+	// A ticket that already asks for part of a URL is not split further.
+	if _, ok := headers["Range"]; *splitSize > 0 && !ok {
+		return fetchSplit(ctx, client, req)
+	}
+
+	resp, err := doWithRetry(ctx, client, req)
 	if err != nil {
 		return nil, fmt.Errorf("fetching data: %v", err)
 	}
-	return resp.Body, nil
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching data: unexpected response status: %v", resp.Status)
+	}
+	return &resumingReader{ctx: ctx, client: client, req: req, body: resp.Body}, nil
+}
+
+// fetchSplit fetches the data for req in pieces of -split-size bytes, up to
+// -split-connections at a time, and returns the reassembled data.  If the
+// server ignores the range of the first piece, its response is returned as
+// it is.
+func fetchSplit(ctx context.Context, client *http.Client, req *http.Request) (io.ReadCloser, error) {
+	resp, err := doWithRetry(ctx, client, withRange(ctx, req, 0, *splitSize))
+	if err != nil {
+		return nil, fmt.Errorf("fetching data: %v", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The blob is empty.
+		resp.Body.Close()
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	case http.StatusOK:
+		return resp.Body, nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching data: unexpected response status: %v", resp.Status)
+	}
+
+	var start, end, total int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("parsing Content-Range %q: %v", resp.Header.Get("Content-Range"), err)
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(copyPieces(ctx, client, req, w, resp.Body, total))
+	}()
+	return r, nil
+}
+
+// copyPieces writes first (the first piece of the data for req) followed by
+// the rest of the total bytes, which are fetched in parallel.
+func copyPieces(ctx context.Context, client *http.Client, req *http.Request, w io.Writer, first io.ReadCloser, total int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type piece struct {
+		data []byte
+		err  error
+	}
+	var pieces []chan piece
+	for start := *splitSize; start < total; start += *splitSize {
+		pieces = append(pieces, make(chan piece, 1))
+	}
+
+	// Each slot holds one piece in memory until it has been written.
+	slots := make(chan struct{}, *splitConnections)
+	go func() {
+		for i := range pieces {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int) {
+				start := *splitSize * int64(i+1)
+				data, err := fetchPiece(ctx, client, req, start, *splitSize)
+				if err == nil && int64(len(data)) != *splitSize && start+int64(len(data)) != total {
+					err = fmt.Errorf("received %d bytes", len(data))
+				}
+				pieces[i] <- piece{data, err}
+			}(i)
+		}
+	}()
+
+	_, err := io.Copy(w, first)
+	first.Close()
+	if err != nil {
+		return err
+	}
+	for i, c := range pieces {
+		p := <-c
+		<-slots
+		if p.err != nil {
+			return fmt.Errorf("piece %d: %v", i+1, p.err)
+		}
+		if _, err := w.Write(p.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fetchPiece(ctx context.Context, client *http.Client, req *http.Request, start, length int64) ([]byte, error) {
+	var data []byte
+	// Pieces are small enough to simply fetch again if their transfer fails.
+	err := retry(ctx, func() error {
+		resp, err := doWithRetry(ctx, client, withRange(ctx, req, start, length))
+		if err != nil {
+			return permanent(fmt.Errorf("fetching data: %v", err))
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			return permanent(fmt.Errorf("unexpected response status: %v", resp.Status))
+		}
+		data, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	return data, err
+}
+
+// errPermanent marks errors that retry does not retry.
+type errPermanent struct {
+	err error
+}
+
+func (e errPermanent) Error() string { return e.err.Error() }
+
+// permanent wraps err so that retry returns it at once.
+func permanent(err error) error {
+	return errPermanent{err}
+}
+
+// retry calls f until it succeeds, returns a permanent error or has been
+// retried -retries times, waiting -retry-delay before the first retry and
+// twice as long before each later one.
+func retry(ctx context.Context, f func() error) error {
+	delay := *retryDelay
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if p, ok := err.(errPermanent); ok {
+			return p.err
+		}
+		if attempt >= *retries {
+			return err
+		}
+		log.Printf("Retrying in %v after error: %v", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// isRetryableStatus reports whether a response with status code is worth
+// retrying.
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// doWithRetry sends req, retrying failed requests and responses with a
+// retryable status.
+func doWithRetry(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	var resp *http.Response
+	err := retry(ctx, func() error {
+		attempt := req.WithContext(ctx)
+		if req.GetBody != nil {
+			// The body of the previous attempt has been consumed.
+			body, err := req.GetBody()
+			if err != nil {
+				return permanent(err)
+			}
+			attempt.Body = body
+		}
+		r, err := client.Do(attempt)
+		if err != nil {
+			return err
+		}
+		if isRetryableStatus(r.StatusCode) {
+			r.Body.Close()
+			return fmt.Errorf("unexpected response status: %v", r.Status)
+		}
+		resp = r
+		return nil
+	})
+	return resp, err
+}
+
+// resumingReader reads the body of the response to req.  If the transfer
+// breaks off it requests the rest of the data with a range request and
+// continues from there.
+type resumingReader struct {
+	ctx    context.Context
+	client *http.Client
+	req    *http.Request
+	body   io.ReadCloser
+	read   int64
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.read += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if err := r.resume(err); err != nil {
+		return n, err
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return r.Read(p)
+}
+
+// resume replaces the body, whose transfer failed with cause, with one that
+// starts after the data read so far.
+func (r *resumingReader) resume(cause error) error {
+	r.body.Close()
+	r.body = ioutil.NopCloser(bytes.NewReader(nil))
+	return retry(r.ctx, func() error {
+		log.Printf("Resuming transfer at byte %d after error: %v", r.read, cause)
+		value, err := resumeRange(r.req.Header.Get("Range"), r.read)
+		if err != nil {
+			return permanent(fmt.Errorf("resuming transfer: %v", err))
+		}
+		req := r.req.WithContext(r.ctx)
+		req.Header = make(http.Header)
+		for name, values := range r.req.Header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Range", value)
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			cause = err
+			return err
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent:
+		case resp.StatusCode == http.StatusOK && r.req.Header.Get("Range") == "":
+			// The server ignored the range, so the data that has
+			// already been read is skipped.
+			if _, err := io.CopyN(ioutil.Discard, resp.Body, r.read); err != nil {
+				resp.Body.Close()
+				cause = err
+				return err
+			}
+		case isRetryableStatus(resp.StatusCode):
+			resp.Body.Close()
+			cause = fmt.Errorf("unexpected response status: %v", resp.Status)
+			return cause
+		default:
+			resp.Body.Close()
+			return permanent(fmt.Errorf("resuming transfer: unexpected response status: %v", resp.Status))
+		}
+		r.body = resp.Body
+		return nil
+	})
+}
+
+func (r *resumingReader) Close() error {
+	return r.body.Close()
+}
+
+// resumeRange returns the value of a Range header that asks for the data
+// selected by value (a Range header, or the empty string for all of the data)
+// after its first offset bytes.
+func resumeRange(value string, offset int64) (string, error) {
+	if value == "" {
+		return fmt.Sprintf("bytes=%d-", offset), nil
+	}
+	bounds := strings.SplitN(strings.TrimPrefix(value, "bytes="), "-", 2)
+	if len(bounds) != 2 || !strings.HasPrefix(value, "bytes=") {
+		return "", fmt.Errorf("unsupported range %q", value)
+	}
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("unsupported range %q", value)
+	}
+	return fmt.Sprintf("bytes=%d-%s", start+offset, bounds[1]), nil
+}
+
+// withRange returns a copy of req that asks for length bytes from start.
+func withRange(ctx context.Context, req *http.Request, start, length int64) *http.Request {
+	r := req.WithContext(ctx)
+	r.Header = make(http.Header)
+	for name, values := range req.Header {
+		r.Header[name] = values
+	}
+	r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+	return r
 }
 
 func errorFromResponse(resp *http.Response) error {
 	switch resp.StatusCode {
 	case http.StatusBadRequest:
-		v := make(map[string]string)
+		var v ticket.ErrorResponse
 		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
 			return fmt.Errorf("bad request: parsing response body: %v", err)
 		}
-		if message, ok := v["message"]; ok {
-			return fmt.Errorf("bad request: %v", message)
+		if v.Error != nil {
+			return fmt.Errorf("bad request: %v", v.Error.Message)
 		}
 	}
 	return fmt.Errorf("unexpected response status: %q", resp.Status)
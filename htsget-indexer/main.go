@@ -0,0 +1,215 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary scans a GCS bucket (or a local directory) for data files that
+// do not have an index and generates the missing index files so that the data
+// can be served by htsget-server.
+//
+// Usage:
+//
+//	htsget-indexer [-n] gs://bucket/prefix
+//	htsget-indexer [-n] /path/to/directory
+//
+// Only BAM files can currently be indexed.  CRAM and VCF files without an
+// index are reported but left untouched.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/googlegenomics/htsget/internal/bam"
+	"google.golang.org/api/iterator"
+)
+
+var (
+	dryRun = flag.Bool("n", false, "report missing indexes without generating them")
+)
+
+// store provides access to a set of named objects.
+type store interface {
+	list(ctx context.Context) ([]string, error)
+	open(ctx context.Context, name string) (io.ReadCloser, error)
+	// write stores the output of generate as the named object.  Nothing is
+	// stored if generate returns an error.
+	write(ctx context.Context, name string, generate func(io.Writer) error) error
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] gs://bucket/prefix | directory\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	target := flag.Arg(0)
+	var objects store
+	if path := strings.TrimPrefix(target, "gs://"); path != target {
+		parts := strings.SplitN(path, "/", 2)
+		gcs, err := storage.NewClient(ctx)
+		if err != nil {
+			log.Fatalf("Failed to create storage client: %v", err)
+		}
+		bucket := &bucketStore{bucket: gcs.Bucket(parts[0])}
+		if len(parts) == 2 {
+			bucket.prefix = parts[1]
+		}
+		objects = bucket
+	} else {
+		objects = directoryStore(target)
+	}
+
+	names, err := objects.list(ctx)
+	if err != nil {
+		log.Fatalf("Failed to list %q: %v", target, err)
+	}
+
+	exists := make(map[string]bool)
+	for _, name := range names {
+		exists[name] = true
+	}
+
+	var failures int
+	for _, name := range names {
+		switch {
+		case strings.HasSuffix(name, ".bam"):
+			if exists[name+".bai"] || exists[strings.TrimSuffix(name, ".bam")+".bai"] {
+				continue
+			}
+			if *dryRun {
+				log.Printf("%s: missing index", name)
+				continue
+			}
+			log.Printf("%s: generating %s.bai", name, name)
+			if err := indexBAM(ctx, objects, name); err != nil {
+				log.Printf("%s: failed to generate index: %v", name, err)
+				failures++
+			}
+		case strings.HasSuffix(name, ".cram"):
+			if !exists[name+".crai"] {
+				log.Printf("%s: missing index (CRAM indexing is not supported)", name)
+			}
+		case strings.HasSuffix(name, ".vcf.gz"), strings.HasSuffix(name, ".bcf"):
+			if !exists[name+".tbi"] && !exists[name+".csi"] {
+				log.Printf("%s: missing index (VCF indexing is not supported)", name)
+			}
+		}
+	}
+	if failures > 0 {
+		log.Fatalf("Failed to generate %d indexes", failures)
+	}
+}
+
+func indexBAM(ctx context.Context, objects store, name string) error {
+	data, err := objects.open(ctx, name)
+	if err != nil {
+		return fmt.Errorf("opening data: %v", err)
+	}
+	defer data.Close()
+
+	return objects.write(ctx, name+".bai", func(index io.Writer) error {
+		return bam.WriteIndex(index, data)
+	})
+}
+
+type bucketStore struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func (s *bucketStore) list(ctx context.Context) ([]string, error) {
+	var names []string
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: s.prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, attrs.Name)
+	}
+}
+
+func (s *bucketStore) open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.bucket.Object(name).NewReader(ctx)
+}
+
+func (s *bucketStore) write(ctx context.Context, name string, generate func(io.Writer) error) error {
+	// Cancelling the context prevents a partially written object from being
+	// committed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := s.bucket.Object(name).NewWriter(ctx)
+	if err := generate(w); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+type directoryStore string
+
+func (s directoryStore) list(ctx context.Context) ([]string, error) {
+	var names []string
+	err := filepath.Walk(string(s), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			names = append(names, path)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (s directoryStore) open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (s directoryStore) write(ctx context.Context, name string, generate func(io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := generate(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
@@ -16,27 +16,118 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/googlegenomics/htsget/api"
 	"github.com/googlegenomics/htsget/internal/analytics"
+	"github.com/googlegenomics/htsget/internal/audit"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/oauth2/google"
 )
 
 var (
 	port      = flag.Int("port", 80, "HTTP service port")
-	blockSize = flag.Uint64("block_size", 1024*1024*1024, "block size soft limit")
+	blockSize = flag.Uint64("block_size", api.MaxBlockSizeLimit, "block size soft limit (at most 1GiB)")
+
+	bucketBlockSizes = flag.String("bucket_block_sizes", "", "comma-separated list of bucket=bytes pairs that override -block_size for individual buckets")
+
+	interactiveBlockSize = flag.Uint64("interactive_block_size", 0, "if set, the block size soft limit for requests from browsers (with an Origin header)")
+	interactiveMergeGap  = flag.Uint64("interactive_merge_gap", 0, "chunks at most this many bytes apart are merged for requests from browsers")
+	batchBlockSize       = flag.Uint64("batch_block_size", 0, "if set, the block size soft limit for requests without an Origin header")
+	batchMergeGap        = flag.Uint64("batch_merge_gap", 0, "chunks at most this many bytes apart are merged for requests without an Origin header")
+
+	maxRegionSpan     = flag.Uint("max_region_span", 0, "if set, the maximum number of bases a single request may cover")
+	bucketRegionSpans = flag.String("bucket_max_region_spans", "", "comma-separated list of bucket=bases pairs that override -max_region_span for individual buckets")
+
+	indexTemplates       = flag.String("index_templates", "", "comma-separated list of templates for index object names, such as {object}.bai or {object%.bam}.bai, tried in order")
+	bucketIndexLocations = flag.String("bucket_index_locations", "", "comma-separated list of bucket=index-bucket/prefix pairs that read the indexes for a bucket from another bucket")
+
+	idAliases         = flag.String("id_aliases", "", "if set, a gs://bucket/object file mapping readset IDs to bucket/object paths, one pair per line")
+	idAliasesInterval = flag.Duration("id_aliases_interval", time.Minute, "how often to check the -id_aliases file for changes")
+
+	referenceAliases = flag.String("reference_aliases", "", "file listing equivalent reference names, one group per line separated by whitespace")
 
 	secure    = flag.Bool("secure", false, "serve in HTTPS-only mode and forward client bearer tokens")
 	httpsCert = flag.String("https_cert", "", "HTTPS certificate file")
 	httpsKey  = flag.String("https_key", "", "HTTPS key file")
 
+	stsAudience = flag.String("sts_audience", "", "if set, in secure mode, exchange bearer tokens from an external identity provider for Google access tokens using this workload identity pool provider")
+
+	iapAudience    = flag.String("iap_audience", "", "if set, require Identity-Aware Proxy assertions for this audience and read storage with the server's own credentials")
+	iapPermissions = flag.String("iap_permissions", "", "file listing the buckets each Identity-Aware Proxy identity may read, one identity per line")
+
 	buckets = flag.String("buckets", "", "if set, restricts reads to a comma-separated list of buckets")
 
+	allowNetworks = flag.String("allow_networks", "", "if set, restricts access to clients in a comma-separated list of CIDR blocks")
+	denyNetworks  = flag.String("deny_networks", "", "comma-separated list of CIDR blocks whose clients are refused access")
+
+	readyCheckBuckets = flag.Bool("ready_check_buckets", false, "if set, the /ready endpoint verifies that each bucket passed via -buckets is accessible")
+
+	breakerRatio    = flag.Float64("circuit_breaker_ratio", 0.5, "fraction of failing storage requests that causes the server to fail fast with 503 (0 disables)")
+	breakerCooldown = flag.Duration("circuit_breaker_cooldown", 30*time.Second, "how long to fail fast once the circuit breaker opens")
+
+	maxReads         = flag.Int("max_concurrent_reads", 0, "if set, the maximum number of ticket requests handled at once")
+	maxClientReads   = flag.Int("max_client_concurrent_reads", 0, "if set, the maximum number of ticket requests handled at once for a single client address")
+	maxBlocks        = flag.Int("max_concurrent_blocks", 0, "if set, the maximum number of block requests handled at once")
+	maxClientBlocks  = flag.Int("max_client_concurrent_blocks", 0, "if set, the maximum number of block requests handled at once for a single client address")
+	concurrencyQueue = flag.Int("concurrency_queue", 100, "how many requests of each kind may wait for a free slot before further requests are refused")
+
+	maxTimeout = flag.Duration("max_request_timeout", 0, "if set, the largest timeout clients may request with the X-Htsget-Timeout header")
+
+	blockCacheDir  = flag.String("block_cache_dir", "", "if set, a local directory used to cache block data")
+	blockCacheSize = flag.Int64("block_cache_size", 10<<30, "the maximum number of bytes stored in -block_cache_dir")
+
+	streamBufferSize = flag.Int("stream_buffer_size", 1<<20, "the maximum number of bytes of each block response read from storage ahead of the client (0 disables read-ahead)")
+
+	headerCacheSize = flag.Int64("header_cache_size", 64<<20, "the maximum number of bytes of decompressed headers kept in memory (0 disables the cache)")
+
+	indexCacheSize = flag.Int64("index_cache_size", 256<<20, "the maximum number of bytes of decompressed indexes kept in memory (0 disables the cache)")
+	indexCacheTTL  = flag.Duration("index_cache_ttl", 10*time.Minute, "how long indexes are kept in the index cache (0 keeps them until they are evicted)")
+
+	minimalHeaders = flag.Bool("minimal_headers", false, "generate headers that omit the @SQ lines after the requested reference")
+	inlineLimit    = flag.Uint64("inline_limit", 0, "if set, chunks that re-encode to at most this many bytes are embedded in tickets as data URLs")
+	inlineHeaders  = flag.Bool("inline_headers", false, "embed the header in tickets as a data URL unless the request sets inlineHeader=false")
+
+	advertisedURL = flag.String("advertised_url", "", "if set, the public base URL (such as https://example.com/htsget) used for block URLs in tickets")
+	blockTokenKey = flag.String("block_token_key", "", "if set, a file holding a secret key used to sign block URLs so that they cannot be used for other objects")
+
+	signingKey      = flag.String("signing_key", "", "if set, a service account JSON key file used to sign GCS URLs that tickets use for whole body blocks instead of the block endpoint")
+	signedURLExpiry = flag.Duration("signed_url_expiry", time.Hour, "how long URLs signed with -signing_key remain valid (at most 7 days)")
+
+	ticketSigningKey   = flag.String("ticket_signing_key", "", "if set, a PEM encoded P-256 private key file used to sign every ticket response")
+	ticketSigningKeyID = flag.String("ticket_signing_key_id", "", "the key ID named by ticket signatures")
+
+	strict = flag.Bool("strict", false, "apply every validation mandated by the htsget specification, for testing interoperability")
+
+	serviceID               = flag.String("service_id", "", "the ID reported by the service-info endpoints, in reverse domain name notation (such as org.example.htsget)")
+	serviceName             = flag.String("service_name", "", "the name reported by the service-info endpoints")
+	serviceDescription      = flag.String("service_description", "", "the description reported by the service-info endpoints")
+	serviceOrganization     = flag.String("service_organization", "", "the name of the organization reported by the service-info endpoints")
+	serviceOrganizationURL  = flag.String("service_organization_url", "", "the URL of the organization reported by the service-info endpoints")
+	serviceContactURL       = flag.String("service_contact_url", "", "the contact URL (such as mailto:htsget@example.org) reported by the service-info endpoints")
+	serviceDocumentationURL = flag.String("service_documentation_url", "", "the documentation URL reported by the service-info endpoints")
+	serviceEnvironment      = flag.String("service_environment", "", "the environment (such as prod or test) reported by the service-info endpoints")
+
 	// Enable or disable anonymous usage tracking.
 	//
 	// If enabled, anonymous information about requests handled by the server is
@@ -45,26 +136,92 @@ var (
 	// This information helps Google determine how well the software is
 	// performing and where improvements should be made.  No user identifying
 	// information is ever sent to Google.
-	trackUsage = flag.Bool("track_usage", false, "anonymous usage tracking")
+	trackUsage      = flag.Bool("track_usage", false, "anonymous usage tracking")
+	trackUsageSpool = flag.String("track_usage_spool", "", "if set, a local directory that holds usage data until it has been sent")
+
+	bigQueryTable = flag.String("bigquery_table", "", "if set, stream a record of each request into this BigQuery table (project.dataset.table)")
+
+	adminListen = flag.String("admin_listen", "", "if set, an address (in the form accepted by -listen) that serves the administrative endpoints, such as the egress report")
+	egressDays  = flag.Int("egress_days", 30, "the number of days of egress totals kept for the -admin_listen report")
+
+	tenantsFile = flag.String("tenants", "", "if set, a JSON file listing additional tenants, each served beneath its own path")
+
+	listen listenFlag
 )
 
+func init() {
+	flag.Var(&listen, "listen", "address to serve on, as http://host:port, https://host:port, h2c://host:port (HTTP/2 without TLS) or unix:/path/to/socket (may be repeated; overrides -port)")
+}
+
+// listenFlag collects the addresses passed via repeated -listen flags.
+type listenFlag []string
+
+func (f *listenFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listenFlag) Set(value string) error {
+	if !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") && !strings.HasPrefix(value, "h2c://") && !strings.HasPrefix(value, "unix:") {
+		return fmt.Errorf("unsupported listen address %q", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
 func main() {
 	flag.Parse()
 
-	if *secure && (*httpsCert == "" || *httpsKey == "") {
-		log.Fatalf("You must specify both -https_cert and -https_key in secure mode.")
+	if len(listen) == 0 {
+		scheme := "http://"
+		if *secure {
+			scheme = "https://"
+		}
+		listen = listenFlag{fmt.Sprintf("%s:%d", scheme, *port)}
 	}
 
-	newStorageClient := api.NewPublicClient
-	if *secure {
-		newStorageClient = api.NewClientFromBearerToken
+	if *adminListen != "" {
+		var admin listenFlag
+		if err := admin.Set(*adminListen); err != nil {
+			log.Fatalf("Invalid -admin_listen: %v", err)
+		}
 	}
 
-	server := api.NewServer(newStorageClient, *blockSize)
-	server.Export(http.DefaultServeMux)
+	for _, address := range append(listen, *adminListen) {
+		if strings.HasPrefix(address, "https://") && (*httpsCert == "" || *httpsKey == "") {
+			log.Fatalf("You must specify both -https_cert and -https_key to serve HTTPS.")
+		}
+	}
 
+	if *blockSize > api.MaxBlockSizeLimit {
+		log.Fatalf("-block_size must be at most %d", uint64(api.MaxBlockSizeLimit))
+	}
+	if *interactiveBlockSize > api.MaxBlockSizeLimit || *batchBlockSize > api.MaxBlockSizeLimit {
+		log.Fatalf("-interactive_block_size and -batch_block_size must be at most %d", uint64(api.MaxBlockSizeLimit))
+	}
+	if *maxRegionSpan > math.MaxUint32 {
+		log.Fatalf("-max_region_span must be at most %d", uint32(math.MaxUint32))
+	}
+
+	defaultTenant := tenant{Secure: *secure, BlockSize: *blockSize, STSAudience: *stsAudience}
 	if *buckets != "" {
-		server.Whitelist(strings.Split(*buckets, ","))
+		defaultTenant.Buckets = strings.Split(*buckets, ",")
+	}
+	adminMux := http.NewServeMux()
+	export := func(server *api.Server) {
+		server.Export(http.DefaultServeMux)
+		server.ExportAdmin(adminMux)
+	}
+	export(newServer(defaultTenant))
+
+	if *tenantsFile != "" {
+		tenants, err := readTenants(*tenantsFile)
+		if err != nil {
+			log.Fatalf("Failed to read tenants: %v", err)
+		}
+		for _, t := range tenants {
+			log.Printf("Serving tenant %s", t.Path)
+			export(newServer(t))
+		}
 	}
 
 	handler := http.Handler(http.DefaultServeMux)
@@ -72,21 +229,455 @@ func main() {
 		log.Printf("Enabling anonymous usage tracking")
 
 		client := analytics.NewClient("UA-103022118-1", uuid.New().String())
+		send := client.Send
+		if *trackUsageSpool != "" {
+			spool, err := analytics.NewSpool(client, *trackUsageSpool, 1000)
+			if err != nil {
+				log.Fatalf("Failed to initialize usage spool: %v", err)
+			}
+			go func() {
+				if err := spool.Flush(); err != nil {
+					log.Printf("Failed to send spooled hits to analytics: %v", err)
+				}
+			}()
+			send = spool.Send
+		}
 		handler = analytics.TrackingHandler(handler, func(hits []analytics.Hit) {
-			if err := client.Send(hits); err != nil {
+			if err := send(hits); err != nil {
 				log.Printf("Failed to send %d hits to analytics: %v", len(hits), err)
 			}
 		})
 	}
 
-	address := fmt.Sprintf(":%d", *port)
-	if *secure {
-		if err := http.ListenAndServeTLS(address, *httpsCert, *httpsKey, handler); err != nil {
-			log.Fatalf("HTTPS server returned an error: %v", err)
+	if *bigQueryTable != "" {
+		client, err := google.DefaultClient(context.Background(), audit.BigQueryScope)
+		if err != nil {
+			log.Fatalf("Failed to create BigQuery client: %v", err)
+		}
+		exporter, err := audit.NewBigQueryExporter(client, *bigQueryTable)
+		if err != nil {
+			log.Fatalf("Failed to create access record exporter: %v", err)
+		}
+		log.Printf("Exporting access records to %s", *bigQueryTable)
+		handler = audit.Handler(handler, exporter.Export)
+	}
+
+	errors := make(chan error, len(listen)+1)
+	for _, address := range listen {
+		go func(address string) {
+			errors <- serve(address, handler)
+		}(address)
+	}
+	if *adminListen != "" {
+		go func() {
+			errors <- serve(*adminListen, adminMux)
+		}()
+	}
+	log.Fatalf("Server returned an error: %v", <-errors)
+}
+
+// newServer returns a server for t that is configured using the flags that
+// apply to every tenant.
+func newServer(t tenant) *api.Server {
+	newStorageClient := api.NewPublicClient
+	switch {
+	case *iapAudience != "" && t.Secure:
+		log.Fatalf("Tenant %q cannot use both -iap_audience and secure mode", t.Path)
+	case *iapAudience != "":
+		newStorageClient = api.NewDefaultClient
+	case t.Secure && t.STSAudience != "":
+		newStorageClient = api.NewClientFromExchangedToken(t.STSAudience)
+	case t.Secure:
+		newStorageClient = api.NewClientFromBearerToken
+	}
+	server := api.NewServer(newStorageClient, t.BlockSize)
+	server.SetBearerTokenAuth(t.Secure)
+	server.SetBasePath(t.Path)
+	if len(t.Buckets) > 0 {
+		server.Whitelist(t.Buckets)
+	}
+	if *iapAudience != "" {
+		permissions, err := readPermissions(*iapPermissions)
+		if err != nil {
+			log.Fatalf("Failed to read Identity-Aware Proxy permissions: %v", err)
+		}
+		server.SetIAPAuth(*iapAudience, permissions)
+	}
+	if *allowNetworks != "" || *denyNetworks != "" {
+		if err := server.SetIPFilter(strings.Split(*allowNetworks, ","), strings.Split(*denyNetworks, ",")); err != nil {
+			log.Fatalf("Invalid IP filter: %v", err)
+		}
+	}
+	if *indexTemplates != "" {
+		if err := server.SetIndexTemplates(strings.Split(*indexTemplates, ",")); err != nil {
+			log.Fatalf("Invalid -index_templates: %v", err)
+		}
+	}
+	if *bucketIndexLocations != "" {
+		for _, setting := range strings.Split(*bucketIndexLocations, ",") {
+			parts := strings.SplitN(setting, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("Invalid -bucket_index_locations entry %q (want bucket=index-bucket/prefix)", setting)
+			}
+			location := strings.SplitN(strings.TrimPrefix(parts[1], "gs://"), "/", 2)
+			if location[0] == "" {
+				log.Fatalf("Invalid index location for bucket %q: no bucket specified", parts[0])
+			}
+			var prefix string
+			if len(location) == 2 {
+				prefix = location[1]
+			}
+			server.SetBucketIndexLocation(parts[0], location[0], prefix)
+		}
+	}
+	if *bucketBlockSizes != "" {
+		for _, setting := range strings.Split(*bucketBlockSizes, ",") {
+			parts := strings.SplitN(setting, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("Invalid -bucket_block_sizes entry %q (want bucket=bytes)", setting)
+			}
+			limit, err := strconv.ParseUint(parts[1], 10, 64)
+			if err != nil {
+				log.Fatalf("Invalid block size for bucket %q: %v", parts[0], err)
+			}
+			if limit > api.MaxBlockSizeLimit {
+				log.Fatalf("Block size for bucket %q must be at most %d", parts[0], uint64(api.MaxBlockSizeLimit))
+			}
+			server.SetBucketBlockSizeLimit(parts[0], limit)
+		}
+	}
+	if *interactiveBlockSize > 0 || *interactiveMergeGap > 0 {
+		if err := server.SetClassLimits(api.InteractiveClients, *interactiveBlockSize, *interactiveMergeGap); err != nil {
+			log.Fatalf("Failed to set interactive limits: %v", err)
+		}
+	}
+	if *batchBlockSize > 0 || *batchMergeGap > 0 {
+		if err := server.SetClassLimits(api.BatchClients, *batchBlockSize, *batchMergeGap); err != nil {
+			log.Fatalf("Failed to set batch limits: %v", err)
+		}
+	}
+	if *referenceAliases != "" {
+		groups, err := readAliases(*referenceAliases)
+		if err != nil {
+			log.Fatalf("Failed to read reference aliases: %v", err)
+		}
+		for _, names := range groups {
+			server.AddReferenceAliases(names)
+		}
+	}
+	server.SetMaxRegionSpan(uint32(*maxRegionSpan))
+	if *bucketRegionSpans != "" {
+		for _, setting := range strings.Split(*bucketRegionSpans, ",") {
+			parts := strings.SplitN(setting, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("Invalid -bucket_max_region_spans entry %q (want bucket=bases)", setting)
+			}
+			span, err := strconv.ParseUint(parts[1], 10, 32)
+			if err != nil {
+				log.Fatalf("Invalid region span for bucket %q: %v", parts[0], err)
+			}
+			server.SetBucketMaxRegionSpan(parts[0], uint32(span))
+		}
+	}
+	if *readyCheckBuckets {
+		// Probes do not carry bearer tokens, so secure mode uses the server's own
+		// credentials to check access.
+		readyClient := api.NewPublicClient
+		if t.Secure {
+			readyClient = api.NewDefaultClient
+		}
+		server.CheckBucketsWhenReady(readyClient)
+	}
+	server.SetCircuitBreaker(*breakerRatio, *breakerCooldown)
+	if *idAliases != "" {
+		parts := strings.SplitN(strings.TrimPrefix(*idAliases, "gs://"), "/", 2)
+		if !strings.HasPrefix(*idAliases, "gs://") || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("Invalid -id_aliases %q (want gs://bucket/object)", *idAliases)
+		}
+		// Like the readiness probe, secure mode reads the mapping using the
+		// server's own credentials.
+		newClient := api.NewPublicClient
+		if t.Secure {
+			newClient = api.NewDefaultClient
+		}
+		gcs, _, err := newClient(nil)
+		if err != nil {
+			log.Fatalf("Failed to create storage client for ID aliases: %v", err)
+		}
+		object := gcs.Bucket(parts[0]).Object(parts[1])
+		if err := server.WatchIDAliases(context.Background(), object, *idAliasesInterval); err != nil {
+			log.Fatalf("Failed to watch ID aliases: %v", err)
+		}
+	}
+	server.SetMaxRequestTimeout(*maxTimeout)
+	if *maxReads > 0 || *maxClientReads > 0 {
+		server.SetReadsConcurrencyLimit(*maxReads, *maxClientReads, *concurrencyQueue)
+	}
+	if *maxBlocks > 0 || *maxClientBlocks > 0 {
+		server.SetBlockConcurrencyLimit(*maxBlocks, *maxClientBlocks, *concurrencyQueue)
+	}
+	server.SetInlineLimit(*inlineLimit)
+	if *blockCacheDir != "" {
+		if err := server.SetBlockCache(filepath.Join(*blockCacheDir, t.cacheSubdirectory()), *blockCacheSize); err != nil {
+			log.Fatalf("Failed to initialize block cache: %v", err)
+		}
+	}
+	server.SetStreamBufferSize(*streamBufferSize)
+	if *adminListen != "" {
+		server.SetEgressAccounting(*egressDays)
+	}
+	server.SetHeaderCache(*headerCacheSize)
+	server.SetIndexCache(*indexCacheSize, *indexCacheTTL)
+	server.SetMinimalHeaders(*minimalHeaders)
+	server.SetInlineHeaders(*inlineHeaders)
+	server.SetStrict(*strict)
+	if *blockTokenKey != "" {
+		key, err := readBlockTokenKey(*blockTokenKey)
+		if err != nil {
+			log.Fatalf("Failed to read block token key: %v", err)
+		}
+		server.SetBlockTokenKey(key)
+	}
+	if *signingKey != "" {
+		accessID, key, err := readSigningKey(*signingKey)
+		if err != nil {
+			log.Fatalf("Failed to read signing key: %v", err)
+		}
+		if err := server.SetSignedURLs(accessID, key, *signedURLExpiry); err != nil {
+			log.Fatalf("Failed to enable signed URLs: %v", err)
+		}
+	}
+	if *ticketSigningKey != "" {
+		key, err := readTicketSigningKey(*ticketSigningKey)
+		if err != nil {
+			log.Fatalf("Failed to read ticket signing key: %v", err)
+		}
+		if err := server.SetTicketSigningKey(key, *ticketSigningKeyID); err != nil {
+			log.Fatalf("Failed to enable ticket signing: %v", err)
+		}
+	}
+	server.SetServiceInfo(api.ServiceInfo{
+		ID:               *serviceID,
+		Name:             *serviceName,
+		Description:      *serviceDescription,
+		OrganizationName: *serviceOrganization,
+		OrganizationURL:  *serviceOrganizationURL,
+		ContactURL:       *serviceContactURL,
+		DocumentationURL: *serviceDocumentationURL,
+		Environment:      *serviceEnvironment,
+	})
+	if *advertisedURL != "" {
+		server.SetAdvertisedURL(*advertisedURL)
+	}
+
+	return server
+}
+
+// tenant holds the settings that differ between tenants.  The default tenant
+// is described by flags and served at the root; others are read from the
+// -tenants file.
+type tenant struct {
+	Path      string   `json:"path"`
+	Buckets   []string `json:"buckets"`
+	Secure    bool     `json:"secure"`
+	BlockSize uint64   `json:"block_size"`
+
+	// STSAudience, if set, is the workload identity pool provider used to
+	// exchange external bearer tokens in secure mode.
+	STSAudience string `json:"sts_audience"`
+}
+
+// cacheSubdirectory returns the directory, relative to -block_cache_dir, that
+// holds the tenant's cached blocks.
+func (t tenant) cacheSubdirectory() string {
+	return strings.Replace(strings.Trim(t.Path, "/"), "/", "_", -1)
+}
+
+// readTenants reads a JSON list of tenants from the file at path.  Tenants
+// that do not specify a block size or STS audience use -block_size and
+// -sts_audience.
+func readTenants(path string) ([]tenant, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tenants []tenant
+	if err := json.NewDecoder(f).Decode(&tenants); err != nil {
+		return nil, fmt.Errorf("decoding %q: %v", path, err)
+	}
+	paths := make(map[string]bool)
+	for i := range tenants {
+		t := &tenants[i]
+		t.Path = "/" + strings.Trim(t.Path, "/")
+		if t.Path == "/" {
+			return nil, fmt.Errorf("tenant %d: no path specified", i)
+		}
+		if paths[t.Path] {
+			return nil, fmt.Errorf("tenant %d: duplicate path %q", i, t.Path)
+		}
+		paths[t.Path] = true
+		if t.BlockSize == 0 {
+			t.BlockSize = *blockSize
 		}
-	} else {
-		if err := http.ListenAndServe(address, handler); err != nil {
-			log.Fatalf("HTTP server returned an error: %v", err)
+		if t.STSAudience == "" {
+			t.STSAudience = *stsAudience
 		}
+		if t.BlockSize > api.MaxBlockSizeLimit {
+			return nil, fmt.Errorf("tenant %s: block size must be at most %d", t.Path, uint64(api.MaxBlockSizeLimit))
+		}
+	}
+	return tenants, nil
+}
+
+// readAliases reads groups of equivalent reference names from the file at
+// path.  Each line lists one group, separated by whitespace.  Blank lines and
+// lines starting with # are ignored.
+func readAliases(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var groups [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		groups = append(groups, strings.Fields(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %q: %v", path, err)
+	}
+	return groups, nil
+}
+
+// readBlockTokenKey reads the key used to sign block URLs from the file at
+// path, ignoring surrounding whitespace.
+func readBlockTokenKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%q is empty", path)
+	}
+	return key, nil
+}
+
+// readSigningKey reads the service account email address and PEM encoded
+// private key from the JSON key file at path.
+func readSigningKey(path string) (string, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	var key struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return "", nil, fmt.Errorf("parsing %q: %v", path, err)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return "", nil, fmt.Errorf("%q is not a service account key", path)
+	}
+	return key.ClientEmail, []byte(key.PrivateKey), nil
+}
+
+// readTicketSigningKey reads the PEM encoded ECDSA private key, in either
+// SEC 1 or PKCS #8 form, from the file at path.
+func readTicketSigningKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%q does not contain a PEM encoded key", path)
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %v", path, err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%q is not an ECDSA key", path)
+	}
+	return ecKey, nil
+}
+
+// readPermissions reads the buckets that each identity may read from the file
+// at path.  Each line lists an identity followed by one or more buckets,
+// separated by whitespace.  Blank lines and lines starting with # are ignored.
+func readPermissions(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	permissions := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want an identity and at least one bucket", line)
+		}
+		permissions[fields[0]] = append(permissions[fields[0]], fields[1:]...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %q: %v", path, err)
+	}
+	return permissions, nil
+}
+
+// serve accepts connections on the address (in the form accepted by the
+// -listen flag) and passes requests to handler.
+func serve(address string, handler http.Handler) error {
+	var (
+		network = "tcp"
+		tls     bool
+	)
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+		// Remove any socket left behind by a previous instance.
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing stale socket %q: %v", address, err)
+		}
+	case strings.HasPrefix(address, "https://"):
+		address, tls = strings.TrimPrefix(address, "https://"), true
+	case strings.HasPrefix(address, "h2c://"):
+		// Cleartext HTTP/2 lets clients behind a TLS-terminating proxy multiplex
+		// block requests over a single connection.  HTTP/1.1 requests are still
+		// accepted.
+		address = strings.TrimPrefix(address, "h2c://")
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	default:
+		address = strings.TrimPrefix(address, "http://")
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("listening on %s %q: %v", network, address, err)
+	}
+	log.Printf("Serving on %s %q", network, address)
+
+	if tls {
+		return http.ServeTLS(listener, handler, *httpsCert, *httpsKey)
 	}
+	return http.Serve(listener, handler)
 }
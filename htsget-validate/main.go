@@ -0,0 +1,284 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary checks that an htsget server conforms to the v1.0.0 htsget
+// specification (http://samtools.github.io/hts-specs/htsget.html) and prints
+// a conformance report.  It can be used against any htsget server, not just
+// the one in this repository:
+//
+//	htsget-validate -server=http://localhost:8080 -id=bucket/sample.bam -reference=20
+//
+// The readset identified by -id must exist and -reference must name one of its
+// references.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/ticket"
+)
+
+var (
+	server    = flag.String("server", "http://localhost:80", "base URL of the htsget server")
+	id        = flag.String("id", "", "ID of a readset that exists on the server")
+	reference = flag.String("reference", "", "name of a reference present in the readset")
+
+	bearerToken = flag.String("bearer_token", "", "OAuth2 bearer token to send with each request")
+	fetchData   = flag.Bool("fetch_data", true, "download ticket URLs to check the returned data")
+)
+
+// The error names defined by the specification.
+var errorNames = map[string]int{
+	"InvalidAuthentication": http.StatusUnauthorized,
+	"PermissionDenied":      http.StatusForbidden,
+	"NotFound":              http.StatusNotFound,
+	"UnsupportedFormat":     http.StatusBadRequest,
+	"InvalidInput":          http.StatusBadRequest,
+	"InvalidRange":          http.StatusBadRequest,
+}
+
+type check struct {
+	name string
+	run  func() error
+}
+
+func main() {
+	flag.Parse()
+	if *id == "" || *reference == "" {
+		log.Fatalf("You must specify both -id and -reference.")
+	}
+
+	checks := []check{
+		{"ticket for whole readset", func() error {
+			return expectTicket(readsURL(nil), "BAM")
+		}},
+		{"ticket for explicit BAM format", func() error {
+			return expectTicket(readsURL(url.Values{"format": {"BAM"}}), "BAM")
+		}},
+		{"ticket for reference", func() error {
+			return expectTicket(readsURL(url.Values{"referenceName": {*reference}}), "BAM")
+		}},
+		{"ticket for region", func() error {
+			return expectTicket(readsURL(url.Values{
+				"referenceName": {*reference},
+				"start":         {"0"},
+				"end":           {"100000"},
+			}), "BAM")
+		}},
+		{"ticket for header class", func() error {
+			return expectTicket(readsURL(url.Values{"class": {"header"}}), "BAM")
+		}},
+		{"unsupported format", func() error {
+			return expectError(readsURL(url.Values{"format": {"XYZ"}}), "UnsupportedFormat")
+		}},
+		{"unknown readset", func() error {
+			return expectError(*server+"/reads/"+*id+".does-not-exist", "NotFound")
+		}},
+		{"unknown reference", func() error {
+			return expectError(readsURL(url.Values{"referenceName": {"htsget-validate-missing"}}), "NotFound", "InvalidInput")
+		}},
+		{"start without reference", func() error {
+			return expectError(readsURL(url.Values{"start": {"0"}}), "InvalidInput")
+		}},
+		{"start after end", func() error {
+			return expectError(readsURL(url.Values{
+				"referenceName": {*reference},
+				"start":         {"200"},
+				"end":           {"100"},
+			}), "InvalidRange")
+		}},
+		{"non-numeric start", func() error {
+			return expectError(readsURL(url.Values{
+				"referenceName": {*reference},
+				"start":         {"one"},
+			}), "InvalidInput")
+		}},
+	}
+
+	var failures int
+	for _, c := range checks {
+		if err := c.run(); err != nil {
+			failures++
+			fmt.Printf("FAIL  %s: %v\n", c.name, err)
+		} else {
+			fmt.Printf("PASS  %s\n", c.name)
+		}
+	}
+	fmt.Printf("\n%d of %d checks passed\n", len(checks)-failures, len(checks))
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
+
+func readsURL(query url.Values) string {
+	target := strings.TrimSuffix(*server, "/") + "/reads/" + *id
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	return target
+}
+
+func expectTicket(target, format string) error {
+	status, header, body, err := get(target, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("unexpected status %d: %s", status, body)
+	}
+	if got := header.Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+		return fmt.Errorf("wrong content type %q", got)
+	}
+
+	var response ticket.Response
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&response); err != nil {
+		return fmt.Errorf("ticket does not match the schema: %v", err)
+	}
+	t := response.Ticket
+	if t == nil {
+		return errors.New("missing htsget object")
+	}
+	if got := t.Format; got != format {
+		return fmt.Errorf("wrong format: got %q, want %q", got, format)
+	}
+	if len(t.URLs) == 0 {
+		return errors.New("ticket contains no URLs")
+	}
+
+	var data []byte
+	for i, u := range t.URLs {
+		switch u.Class {
+		case "", ticket.ClassHeader, ticket.ClassBody:
+		default:
+			return fmt.Errorf("URL %d: invalid class %q", i, u.Class)
+		}
+
+		parsed, err := url.Parse(u.URL)
+		if err != nil {
+			return fmt.Errorf("URL %d: %v", i, err)
+		}
+		switch parsed.Scheme {
+		case "http", "https", "data":
+		default:
+			return fmt.Errorf("URL %d: unsupported scheme %q", i, parsed.Scheme)
+		}
+
+		if !*fetchData {
+			continue
+		}
+		blob, err := fetch(u.URL, u.Headers)
+		if err != nil {
+			return fmt.Errorf("URL %d: %v", i, err)
+		}
+		data = append(data, blob...)
+	}
+
+	if *fetchData && !bytes.HasSuffix(data, bgzf.EOFMarker) {
+		return errors.New("data does not end with a BGZF EOF marker")
+	}
+	return nil
+}
+
+func expectError(target string, names ...string) error {
+	status, header, body, err := get(target, nil)
+	if err != nil {
+		return err
+	}
+	if got := header.Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+		return fmt.Errorf("wrong content type %q (status %d)", got, status)
+	}
+
+	var response ticket.ErrorResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("decoding error object: %v", err)
+	}
+	if response.Error == nil {
+		return fmt.Errorf("error object is not wrapped in an htsget object: %s", bytes.TrimSpace(body))
+	}
+
+	name := response.Error.Name
+	if want, ok := errorNames[name]; !ok {
+		return fmt.Errorf("unknown error name %q", name)
+	} else if status != want {
+		return fmt.Errorf("wrong status code for %s: got %d, want %d", name, status, want)
+	}
+	for _, want := range names {
+		if name == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("wrong error: got %q, want %s", name, strings.Join(names, " or "))
+}
+
+func fetch(target string, headers map[string]string) ([]byte, error) {
+	if v := strings.TrimPrefix(target, "data:"); v != target {
+		parts := strings.SplitN(v, ",", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("malformed data URL")
+		}
+		if strings.HasSuffix(parts[0], ";base64") {
+			return base64.StdEncoding.DecodeString(parts[1])
+		}
+		unescaped, err := url.PathUnescape(parts[1])
+		return []byte(unescaped), err
+	}
+
+	status, _, body, err := get(target, headers)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK && status != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected status %d", status)
+	}
+	return body, nil
+}
+
+func get(target string, headers map[string]string) (int, http.Header, []byte, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("creating request: %v", err)
+	}
+	if *bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*bearerToken)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("reading response: %v", err)
+	}
+	return resp.StatusCode, resp.Header, body, nil
+}
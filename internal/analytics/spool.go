@@ -0,0 +1,220 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolPrefix = "hits-"
+	tempPrefix  = "tmp-"
+)
+
+// Spool queues hits in files in a local directory until they have been
+// uploaded, so that hits are not lost when the analytics server cannot be
+// reached or the process restarts.  To create a properly initialized Spool
+// instance, use NewSpool.
+type Spool struct {
+	client   *Client
+	dir      string
+	maxFiles int
+
+	mu  sync.Mutex
+	seq uint64
+
+	// flushing holds a token while a flush is in progress, so that requests
+	// do not queue up behind an upload that another request has started.
+	flushing chan struct{}
+}
+
+// spooledHits is the content of a single spool file.
+type spooledHits struct {
+	Queued time.Time `json:"queued"`
+	Hits   []Hit     `json:"hits"`
+}
+
+// NewSpool returns a Spool that sends hits to client, keeping at most maxFiles
+// files of hits that have not been sent yet in dir (which is created if
+// necessary).  When the limit is reached the oldest hits are dropped.  Hits
+// left in dir by a previous process are sent by the next call to Flush or
+// Send.
+func NewSpool(client *Client, dir string, maxFiles int) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating spool directory: %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading spool directory: %v", err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), tempPrefix) {
+			os.Remove(filepath.Join(dir, file.Name()))
+		}
+	}
+	return &Spool{
+		client:   client,
+		dir:      dir,
+		maxFiles: maxFiles,
+		flushing: make(chan struct{}, 1),
+	}, nil
+}
+
+// Send writes hits to the spool and then attempts to upload all of the hits
+// in the spool.  Hits that cannot be uploaded remain in the spool and are
+// retried by later calls.
+func (s *Spool) Send(hits []Hit) error {
+	if len(hits) == 0 {
+		return nil
+	}
+	if err := s.write(hits); err != nil {
+		return err
+	}
+	return s.Flush()
+}
+
+// write adds hits to the spool, split into files that can each be uploaded in
+// a single request so that a failed upload is never partially repeated.
+func (s *Spool) write(hits []Hit) error {
+	queued := time.Now()
+	for start := 0; start < len(hits); start += s.client.batchSize {
+		end := start + s.client.batchSize
+		if end > len(hits) {
+			end = len(hits)
+		}
+		data, err := json.Marshal(spooledHits{queued, hits[start:end]})
+		if err != nil {
+			return fmt.Errorf("encoding hits: %v", err)
+		}
+
+		f, err := ioutil.TempFile(s.dir, tempPrefix)
+		if err != nil {
+			return fmt.Errorf("creating spool file: %v", err)
+		}
+		_, err = f.Write(data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return fmt.Errorf("writing spool file: %v", err)
+		}
+
+		s.mu.Lock()
+		s.seq++
+		name := fmt.Sprintf("%s%020d-%010d", spoolPrefix, queued.UnixNano(), s.seq)
+		s.mu.Unlock()
+		if err := os.Rename(f.Name(), filepath.Join(s.dir, name)); err != nil {
+			os.Remove(f.Name())
+			return fmt.Errorf("renaming spool file: %v", err)
+		}
+	}
+	return s.trim()
+}
+
+// pending returns the names of the files in the spool, oldest first.
+func (s *Spool) pending() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading spool directory: %v", err)
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), spoolPrefix) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// trim removes the oldest files until at most maxFiles remain.
+func (s *Spool) trim() error {
+	names, err := s.pending()
+	if err != nil {
+		return err
+	}
+	for len(names) > s.maxFiles {
+		if err := os.Remove(filepath.Join(s.dir, names[0])); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("dropping spool file: %v", err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Flush attempts to upload all of the hits in the spool, oldest first.  It
+// stops at the first failure so that hits are sent in order.  If another
+// flush is already in progress, Flush returns immediately.
+func (s *Spool) Flush() error {
+	select {
+	case s.flushing <- struct{}{}:
+		defer func() { <-s.flushing }()
+	default:
+		return nil
+	}
+
+	names, err := s.pending()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		path := filepath.Join(s.dir, name)
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue // Dropped by trim.
+		} else if err != nil {
+			return fmt.Errorf("reading spool file: %v", err)
+		}
+
+		var spooled spooledHits
+		if err := json.Unmarshal(data, &spooled); err != nil {
+			// A corrupt file would otherwise block the spool forever.
+			os.Remove(path)
+			return fmt.Errorf("decoding spool file %s: %v", name, err)
+		}
+		if err := s.client.Send(withQueueTime(spooled.Hits, time.Since(spooled.Queued))); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing spool file: %v", err)
+		}
+	}
+	return nil
+}
+
+// withQueueTime returns copies of hits with the queue time parameter set, so
+// that the analytics server records them at the time they happened rather than
+// the time they were uploaded.
+func withQueueTime(hits []Hit, delay time.Duration) []Hit {
+	queueTime := strconv.FormatInt(int64(delay/time.Millisecond), 10)
+	copies := make([]Hit, len(hits))
+	for i, hit := range hits {
+		copies[i] = Hit{"qt": queueTime}
+		for key, value := range hit {
+			copies[i][key] = value
+		}
+	}
+	return copies
+}
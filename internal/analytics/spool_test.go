@@ -0,0 +1,152 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// recordingBackend returns a client whose uploads fail while *down is true
+// and otherwise record the label of each hit, along with whether it had a
+// queue time.
+func recordingBackend(t *testing.T, down *bool, labels *[]string) (*Client, chan<- struct{}) {
+	return fakeBackend(func(w http.ResponseWriter, req *http.Request) {
+		if *down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		scanner := bufio.NewScanner(req.Body)
+		for scanner.Scan() {
+			payload, err := url.ParseQuery(scanner.Text())
+			if err != nil {
+				t.Errorf("Failed to parse payload: %v", err)
+			}
+			if payload.Get("qt") == "" {
+				t.Errorf("Hit %q has no queue time", payload.Get("el"))
+			}
+			*labels = append(*labels, payload.Get("el"))
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		down   = true
+		labels []string
+	)
+	client, quit := recordingBackend(t, &down, &labels)
+	defer close(quit)
+
+	spool, err := NewSpool(client, dir, 100)
+	if err != nil {
+		t.Fatalf("Failed to create spool: %v", err)
+	}
+	for _, label := range []string{"a", "b"} {
+		if err := spool.Send([]Hit{Event("tests", "test", label, nil)}); err == nil {
+			t.Errorf("Send() succeeded while the backend was down")
+		}
+	}
+
+	// A new spool over the same directory (as after a restart) sends the hits
+	// that were queued, in order, followed by new ones.
+	down = false
+	spool, err = NewSpool(client, dir, 100)
+	if err != nil {
+		t.Fatalf("Failed to reopen spool: %v", err)
+	}
+	if err := spool.Send([]Hit{Event("tests", "test", "c", nil)}); err != nil {
+		t.Fatalf("Send() returned error: %v", err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("Wrong hits sent: got %v, want %v", labels, want)
+	}
+	if names, err := spool.pending(); err != nil || len(names) != 0 {
+		t.Errorf("Spool was not emptied: %v (%v)", names, err)
+	}
+}
+
+func TestSpool_MaxFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		down   = true
+		labels []string
+	)
+	client, quit := recordingBackend(t, &down, &labels)
+	defer close(quit)
+
+	spool, err := NewSpool(client, dir, 2)
+	if err != nil {
+		t.Fatalf("Failed to create spool: %v", err)
+	}
+	for _, label := range []string{"a", "b", "c"} {
+		spool.Send([]Hit{Event("tests", "test", label, nil)})
+	}
+
+	down = false
+	if err := spool.Flush(); err != nil {
+		t.Fatalf("Flush() returned error: %v", err)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("Wrong hits sent: got %v, want %v", labels, want)
+	}
+}
+
+func TestSpool_SplitsBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	down := true
+	client, quit := recordingBackend(t, &down, new([]string))
+	defer close(quit)
+
+	spool, err := NewSpool(client, dir, 100)
+	if err != nil {
+		t.Fatalf("Failed to create spool: %v", err)
+	}
+	hits := make([]Hit, client.batchSize*2+1)
+	for i := range hits {
+		hits[i] = Event("tests", "test", "", nil)
+	}
+	spool.Send(hits)
+
+	names, err := spool.pending()
+	if err != nil {
+		t.Fatalf("Failed to list spool: %v", err)
+	}
+	if got, want := len(names), 3; got != want {
+		t.Errorf("Wrong number of spool files: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit records who accessed which readsets and exports the records
+// for later analysis.
+package audit
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Record describes a single request handled by the server.
+type Record struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	Identity   string    `json:"identity,omitempty"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	// ExpectedBytes is the Content-Length of the response, if it set one.
+	// Aborted is set if fewer bytes were sent, which happens when the
+	// client disconnects part way through a response.
+	ExpectedBytes int64 `json:"expected_bytes,omitempty"`
+	Aborted       bool  `json:"aborted,omitempty"`
+	// Duration is the time taken to serve the request, in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// Handler returns a new http.Handler which wraps the provided handler and
+// calls export with a Record describing each request once it has been served.
+func Handler(handler http.Handler, export func(Record)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		var identity string
+		handler.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), identityKey{}, &identity)))
+
+		remote := req.RemoteAddr
+		if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+			remote = forwarded
+		}
+		var expected int64
+		if req.Method != http.MethodHead {
+			expected, _ = strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+		}
+		export(Record{
+			Time:          start.UTC(),
+			RequestID:     w.Header().Get("X-Request-ID"),
+			RemoteAddr:    remote,
+			UserAgent:     req.UserAgent(),
+			Method:        req.Method,
+			Path:          req.URL.Path,
+			Query:         req.URL.RawQuery,
+			Identity:      identity,
+			Status:        rw.status,
+			Bytes:         rw.bytes,
+			ExpectedBytes: expected,
+			Aborted:       expected > 0 && rw.bytes < expected,
+			Duration:      time.Since(start).Seconds(),
+		})
+	})
+}
+
+type identityKey struct{}
+
+// SetIdentity records the verified identity of the user that made the request
+// with context ctx in its Record.  It does nothing if the request is not being
+// recorded.
+func SetIdentity(ctx context.Context, identity string) {
+	if p, ok := ctx.Value(identityKey{}).(*string); ok {
+		*p = identity
+	}
+}
+
+// responseWriter records the status code and number of bytes written.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
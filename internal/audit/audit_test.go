@@ -0,0 +1,175 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	var records []Record
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Request-ID", "abc")
+		SetIdentity(req.Context(), "user@example.com")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "missing")
+	}), func(r Record) { records = append(records, r) })
+
+	req := httptest.NewRequest("GET", "/reads/bucket/object?referenceName=20", nil)
+	req.Header.Set("User-Agent", "test")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(records) != 1 {
+		t.Fatalf("Wrong number of records: got %d, want 1", len(records))
+	}
+	r := records[0]
+	if got, want := r.RequestID, "abc"; got != want {
+		t.Errorf("Wrong request ID: got %q, want %q", got, want)
+	}
+	if got, want := r.Path, "/reads/bucket/object"; got != want {
+		t.Errorf("Wrong path: got %q, want %q", got, want)
+	}
+	if got, want := r.Query, "referenceName=20"; got != want {
+		t.Errorf("Wrong query: got %q, want %q", got, want)
+	}
+	if got, want := r.Status, http.StatusNotFound; got != want {
+		t.Errorf("Wrong status: got %d, want %d", got, want)
+	}
+	if got, want := r.Bytes, int64(len("missing")); got != want {
+		t.Errorf("Wrong byte count: got %d, want %d", got, want)
+	}
+	if got, want := r.UserAgent, "test"; got != want {
+		t.Errorf("Wrong user agent: got %q, want %q", got, want)
+	}
+	if got, want := r.Identity, "user@example.com"; got != want {
+		t.Errorf("Wrong identity: got %q, want %q", got, want)
+	}
+}
+
+func TestBigQueryExporter(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		paths []string
+		rows  []insertRow
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Rows []insertRow `json:"rows"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		mu.Lock()
+		paths = append(paths, req.URL.Path)
+		rows = append(rows, body.Rows...)
+		mu.Unlock()
+		fmt.Fprint(w, "{}")
+	}))
+	defer server.Close()
+
+	exporter, err := newBigQueryExporter(server.Client(), server.URL, "project:dataset.table")
+	if err != nil {
+		t.Fatalf("Failed to create exporter: %v", err)
+	}
+	exporter.batchSize = 2
+
+	for i := 0; i < 5; i++ {
+		exporter.Export(Record{RequestID: fmt.Sprintf("id%d", i), Time: time.Unix(int64(i), 0), Path: "/reads/x"})
+	}
+	exporter.Close()
+
+	if got, want := len(paths), 3; got != want {
+		t.Errorf("Wrong number of requests: got %d, want %d", got, want)
+	}
+	for _, path := range paths {
+		if want := "/projects/project/datasets/dataset/tables/table/insertAll"; path != want {
+			t.Errorf("Wrong request path: got %q, want %q", path, want)
+		}
+	}
+	if got, want := len(rows), 5; got != want {
+		t.Fatalf("Wrong number of rows: got %d, want %d", got, want)
+	}
+	for i, row := range rows {
+		if !strings.HasPrefix(row.InsertID, row.JSON.RequestID+"-") {
+			t.Errorf("Row %d: insert ID %q does not include request ID %q", i, row.InsertID, row.JSON.RequestID)
+		}
+	}
+}
+
+func TestBigQueryExporter_InsertErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"insertErrors":[{"index":0,"errors":[{"message":"no such field"}]}]}`)
+	}))
+	defer server.Close()
+
+	exporter, err := newBigQueryExporter(server.Client(), server.URL, "project.dataset.table")
+	if err != nil {
+		t.Fatalf("Failed to create exporter: %v", err)
+	}
+	defer exporter.Close()
+
+	err = exporter.insert([]Record{{Path: "/reads/x"}})
+	if err == nil || !strings.Contains(err.Error(), "no such field") {
+		t.Errorf("Wrong error: got %v, want an error mentioning the rejected field", err)
+	}
+}
+
+func TestNewBigQueryExporter_InvalidTable(t *testing.T) {
+	for _, table := range []string{"", "table", "dataset.table", "project..table"} {
+		t.Run(table, func(t *testing.T) {
+			if _, err := NewBigQueryExporter(http.DefaultClient, table); err == nil {
+				t.Errorf("Expected an error for table %q", table)
+			}
+		})
+	}
+}
+
+func TestHandlerAborted(t *testing.T) {
+	testCases := []struct {
+		name     string
+		method   string
+		written  int
+		expected int64
+		aborted  bool
+	}{
+		{"complete", "GET", 10, 10, false},
+		{"partial", "GET", 4, 10, true},
+		{"head", "HEAD", 0, 0, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var record Record
+			handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Length", "10")
+				w.Write(make([]byte, tc.written))
+			}), func(r Record) { record = r })
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tc.method, "/block/bucket/object", nil))
+
+			if got, want := record.ExpectedBytes, tc.expected; got != want {
+				t.Errorf("Wrong expected bytes: got %d, want %d", got, want)
+			}
+			if got, want := record.Aborted, tc.aborted; got != want {
+				t.Errorf("Wrong aborted flag: got %v, want %v", got, want)
+			}
+		})
+	}
+}
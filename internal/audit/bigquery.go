@@ -0,0 +1,176 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// BigQueryScope is the OAuth2 scope required to stream records into a
+	// table.
+	BigQueryScope = "https://www.googleapis.com/auth/bigquery.insertdata"
+
+	defaultBigQueryEndpoint = "https://bigquery.googleapis.com/bigquery/v2"
+	defaultBatchSize        = 500 // The recommended maximum rows per insertAll request.
+	defaultFlushInterval    = 10 * time.Second
+	defaultQueueSize        = 10000
+)
+
+// BigQueryExporter batches records and streams them into a BigQuery table.
+// To create a properly initialized BigQueryExporter, use NewBigQueryExporter.
+type BigQueryExporter struct {
+	client    *http.Client
+	url       string
+	batchSize int
+	interval  time.Duration
+
+	records chan Record
+	done    chan struct{}
+}
+
+// NewBigQueryExporter returns an exporter that inserts records into table,
+// which must be given as project.dataset.table (or project:dataset.table).
+// The client must be authorized with BigQueryScope.  The table must already
+// exist with columns matching the JSON fields of Record.
+func NewBigQueryExporter(client *http.Client, table string) (*BigQueryExporter, error) {
+	return newBigQueryExporter(client, defaultBigQueryEndpoint, table)
+}
+
+func newBigQueryExporter(client *http.Client, endpoint, table string) (*BigQueryExporter, error) {
+	parts := strings.SplitN(strings.Replace(table, ":", ".", 1), ".", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid table %q (want project.dataset.table)", table)
+	}
+
+	exporter := &BigQueryExporter{
+		client:    client,
+		url:       fmt.Sprintf("%s/projects/%s/datasets/%s/tables/%s/insertAll", endpoint, parts[0], parts[1], parts[2]),
+		batchSize: defaultBatchSize,
+		interval:  defaultFlushInterval,
+		records:   make(chan Record, defaultQueueSize),
+		done:      make(chan struct{}),
+	}
+	go exporter.run()
+	return exporter, nil
+}
+
+// Export queues record to be sent with the next batch.  Records are dropped
+// (and a message logged) if the queue is full so that a slow or unavailable
+// BigQuery never delays requests.
+func (e *BigQueryExporter) Export(record Record) {
+	select {
+	case e.records <- record:
+	default:
+		log.Printf("Dropping access record for %s: export queue is full", record.Path)
+	}
+}
+
+// Close sends any queued records and stops the exporter.  Export must not be
+// called after Close.
+func (e *BigQueryExporter) Close() {
+	close(e.records)
+	<-e.done
+}
+
+func (e *BigQueryExporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	var batch []Record
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.insert(batch); err != nil {
+			log.Printf("Failed to export %d access records: %v", len(batch), err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case record, ok := <-e.records:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) >= e.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+type insertRow struct {
+	InsertID string `json:"insertId,omitempty"`
+	JSON     Record `json:"json"`
+}
+
+func (e *BigQueryExporter) insert(records []Record) error {
+	rows := make([]insertRow, len(records))
+	for i, record := range records {
+		rows[i].JSON = record
+		if record.RequestID != "" {
+			// Allows BigQuery to discard duplicates if a batch is retried.
+			rows[i].InsertID = fmt.Sprintf("%s-%d", record.RequestID, record.Time.UnixNano())
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"rows": rows})
+	if err != nil {
+		return fmt.Errorf("encoding rows: %v", err)
+	}
+	response, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("sending request: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status: %v", response.Status)
+	}
+
+	var result struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return fmt.Errorf("decoding response: %v", err)
+	}
+	if n := len(result.InsertErrors); n > 0 {
+		first := result.InsertErrors[0]
+		var message string
+		if len(first.Errors) > 0 {
+			message = first.Errors[0].Message
+		}
+		return fmt.Errorf("%d rows were rejected (row %d: %s)", n, first.Index, message)
+	}
+	return nil
+}
@@ -16,10 +16,13 @@
 package bam
 
 import (
+	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
 
 	"github.com/googlegenomics/htsget/internal/bgzf"
 	"github.com/googlegenomics/htsget/internal/binary"
@@ -30,6 +33,7 @@ import (
 const (
 	baiMagic = "BAI\x01"
 	bamMagic = "BAM\x01"
+	csiMagic = "CSI\x01"
 
 	// This ID is used as a virtual bin ID for (unused) chunk metadata.
 	metadataID = 37450
@@ -43,30 +47,124 @@ const (
 	linearWindowSize = 1 << 14
 )
 
+// Reference describes a single genomic reference from a BAM header.
+type Reference struct {
+	ID     int32
+	Name   string
+	Length uint32
+}
+
 // GetReferenceID attempts to determine the ID for the named genomic reference
 // by reading BAM header data from bam.
 func GetReferenceID(bam io.Reader, reference string) (int32, error) {
+	ref, err := GetReference(bam, reference)
+	if err != nil {
+		return 0, err
+	}
+	return ref.ID, nil
+}
+
+// GetReference reads BAM header data from bam and returns the ID, name and
+// length of the named genomic reference.
+func GetReference(bam io.Reader, reference string) (*Reference, error) {
 	bam, err := gzip.NewReader(bam)
 	if err != nil {
-		return 0, fmt.Errorf("opening archive: %v", err)
+		return nil, fmt.Errorf("opening archive: %v", err)
+	}
+
+	var found *Reference
+	_, err = readReferences(bam, func(ref *Reference) bool {
+		if ref.Name == reference {
+			found = ref
+		}
+		return found == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no reference named %q found", reference)
+	}
+	return found, nil
+}
+
+// SkipHeader reads past the BAM header (including the reference list) in the
+// uncompressed stream r, leaving r positioned at the first alignment record.
+func SkipHeader(r io.Reader) error {
+	_, err := readReferences(r, func(*Reference) bool { return true })
+	return err
+}
+
+// Header holds the contents of a BAM header.
+type Header struct {
+	// Text is the plain text SAM header.
+	Text       string
+	References []*Reference
+}
+
+// GetHeader reads the complete BAM header from bam.
+func GetHeader(bam io.Reader) (*Header, error) {
+	r, err := gzip.NewReader(bam)
+	if err != nil {
+		return nil, fmt.Errorf("opening archive: %v", err)
+	}
+	return ParseHeader(r)
+}
+
+// ParseHeader reads the complete BAM header from the uncompressed stream r,
+// reading no further than the end of the reference list.
+func ParseHeader(r io.Reader) (*Header, error) {
+	var text bytes.Buffer
+	if err := readText(r, &text); err != nil {
+		return nil, err
+	}
+	header := &Header{Text: strings.TrimRight(text.String(), "\x00")}
+	_, err := readReferenceList(r, func(ref *Reference) bool {
+		header.References = append(header.References, ref)
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
+	return header, nil
+}
 
-	if err := binary.ExpectBytes(bam, []byte(bamMagic)); err != nil {
-		return 0, fmt.Errorf("reading magic: %v", err)
+// readReferences reads the BAM header from the uncompressed stream r and calls
+// visit with each reference in turn until visit returns false.  It returns the
+// number of references declared by the header.
+func readReferences(r io.Reader, visit func(*Reference) bool) (int32, error) {
+	if err := readText(r, ioutil.Discard); err != nil {
+		return 0, err
+	}
+	return readReferenceList(r, visit)
+}
+
+// readText reads the magic and plain text SAM header from the uncompressed
+// stream r and copies the text to w.
+func readText(r io.Reader, w io.Writer) error {
+	if err := binary.ExpectBytes(r, []byte(bamMagic)); err != nil {
+		return fmt.Errorf("reading magic: %v", err)
 	}
 	var length int32
-	if err := binary.Read(bam, &length); err != nil {
-		return 0, fmt.Errorf("reading SAM header length: %v", err)
+	if err := binary.Read(r, &length); err != nil {
+		return fmt.Errorf("reading SAM header length: %v", err)
 	}
-	if _, err := io.CopyN(ioutil.Discard, bam, int64(length)); err != nil {
-		return 0, fmt.Errorf("reading past SAM header: %v", err)
+	if _, err := io.CopyN(w, r, int64(length)); err != nil {
+		return fmt.Errorf("reading past SAM header: %v", err)
 	}
+	return nil
+}
+
+// readReferenceList reads the reference list that follows the SAM header text
+// and calls visit with each reference in turn until visit returns false.
+func readReferenceList(r io.Reader, visit func(*Reference) bool) (int32, error) {
 	var count int32
-	if err := binary.Read(bam, &count); err != nil {
+	if err := binary.Read(r, &count); err != nil {
 		return 0, fmt.Errorf("reading references count: %v", err)
 	}
 	for i := int32(0); i < count; i++ {
-		if err := binary.Read(bam, &length); err != nil {
+		var length int32
+		if err := binary.Read(r, &length); err != nil {
 			return 0, fmt.Errorf("reading name length: %v", err)
 		}
 		// The name length includes a null terminating character.
@@ -74,93 +172,265 @@ func GetReferenceID(bam io.Reader, reference string) (int32, error) {
 			return 0, fmt.Errorf("invalid name length (%d bytes)", length)
 		}
 		name := make([]byte, length)
-		if _, err := bam.Read(name); err != nil {
+		if _, err := io.ReadFull(r, name); err != nil {
 			return 0, fmt.Errorf("reading name: %v", err)
 		}
-		if string(name[:length-1]) == reference {
-			return i, nil
-		}
-		// Read and discard the reference length (4 bytes);
-		if err := binary.Read(bam, &length); err != nil {
+		var size uint32
+		if err := binary.Read(r, &size); err != nil {
 			return 0, fmt.Errorf("reading reference length: %v", err)
 		}
+		if !visit(&Reference{ID: i, Name: string(name[:length-1]), Length: size}) {
+			break
+		}
+	}
+	return count, nil
+}
+
+// ErrNoReferenceData is returned by ReadStrict when the index does not
+// contain any entries for the reference selected by the region.
+var ErrNoReferenceData = errors.New("index contains no data for reference")
+
+// Read reads index data from index, which holds a decompressed BAI or CSI
+// index, and returns a set of BGZF chunks covering the header and all mapped
+// reads that fall inside the specified region.  The first chunk is always the
+// BAM header.
+func Read(index io.Reader, region genomics.Region) ([]*bgzf.Chunk, error) {
+	return read(index, region, false, nil)
+}
+
+// ReadStrict is like Read but returns ErrNoReferenceData if region selects a
+// reference for which the index has no entries.
+func ReadStrict(index io.Reader, region genomics.Region) ([]*bgzf.Chunk, error) {
+	return read(index, region, true, nil)
+}
+
+// Bin describes a single bin from the index whose chunks were selected.
+type Bin struct {
+	ReferenceID int32  `json:"referenceId"`
+	ID          uint32 `json:"id"`
+	Chunks      int    `json:"chunks"`
+}
+
+// Trace records the decisions made while selecting chunks from an index.
+type Trace struct {
+	// Bins lists the bins that overlap the region and contain chunks.
+	Bins []Bin `json:"bins"`
+	// Skipped is the number of chunks from Bins that were discarded because
+	// they end before the first read in the region (per the linear index).
+	Skipped int `json:"skippedChunks"`
+
+	// References, BinsScanned, ChunksScanned and IntervalsScanned count
+	// everything read from the index, whether or not it overlaps the region.
+	// The pseudo-bins that hold per-reference metadata are not counted.
+	References       int `json:"referencesScanned"`
+	BinsScanned      int `json:"binsScanned"`
+	ChunksScanned    int `json:"chunksScanned"`
+	IntervalsScanned int `json:"intervalsScanned"`
+
+	// Candidates is the number of chunks in Bins and Selected is the number
+	// that remain once the Skipped chunks are discarded.
+	Candidates int `json:"candidates"`
+	Selected   int `json:"selected"`
+}
+
+// ReadWithTrace is like Read (or ReadStrict, if strict is true) but also
+// returns a Trace describing how the chunks were selected.
+func ReadWithTrace(index io.Reader, region genomics.Region, strict bool) ([]*bgzf.Chunk, *Trace, error) {
+	trace := &Trace{}
+	chunks, err := read(index, region, strict, trace)
+	if err != nil {
+		return nil, nil, err
 	}
-	return 0, fmt.Errorf("no reference named %q found", reference)
+	return chunks, trace, nil
 }
 
-// Read reads index data from bai and returns a set of BGZF chunks covering
-// the header and all mapped reads that fall inside the specified region.  The
-// first chunk is always the BAM header.
-func Read(bai io.Reader, region genomics.Region) ([]*bgzf.Chunk, error) {
-	if err := binary.ExpectBytes(bai, []byte(baiMagic)); err != nil {
+// binningScheme describes the bins of an index.  BAI indexes always use the
+// scheme of BAM, while CSI indexes may use any.
+type binningScheme struct {
+	minShift, depth int32
+	metadataID      uint32
+	// csi is set for CSI indexes, which record the offset of the first read
+	// in each bin rather than a linear index.
+	csi bool
+}
+
+// maximumDepth bounds the depth of CSI binning schemes, so that a corrupt
+// index cannot make the list of bins for a region exhaust memory.
+const maximumDepth = 7
+
+// readScheme reads the magic and, for CSI indexes, the header of the index in
+// r, and returns its binning scheme.
+func readScheme(r io.Reader) (*binningScheme, error) {
+	magic := make([]byte, len(baiMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
 		return nil, fmt.Errorf("reading magic: %v", err)
 	}
+	switch string(magic) {
+	case baiMagic:
+		// BAM uses a 6 level (depth = 5) CSI binning scheme with a minimum width of 14 bits.
+		return &binningScheme{minShift: 14, depth: 5, metadataID: metadataID}, nil
+	case csiMagic:
+		header, err := csi.ReadHeader(io.MultiReader(bytes.NewReader(magic), r))
+		if err != nil {
+			return nil, err
+		}
+		if header.MinShift < 0 || header.MinShift > 32 || header.Depth < 0 || header.Depth > maximumDepth {
+			return nil, fmt.Errorf("unsupported binning scheme (min_shift %d, depth %d)", header.MinShift, header.Depth)
+		}
+		return &binningScheme{minShift: header.MinShift, depth: header.Depth, metadataID: csi.MetadataBin(header.Depth), csi: true}, nil
+	}
+	return nil, fmt.Errorf("reading magic: got %q, want %q or %q", magic, baiMagic, csiMagic)
+}
+
+// firstOffset returns the offset recorded in a CSI index for the smallest bin
+// that contains bin and has an offset in offsets, or zero if there is none.
+// Every read that overlaps bin is at or after that offset.
+func firstOffset(offsets map[uint32]bgzf.Address, bin uint32) bgzf.Address {
+	for {
+		if offset, ok := offsets[bin]; ok {
+			return offset
+		}
+		if bin == 0 {
+			return 0
+		}
+		bin = (bin - 1) >> 3
+	}
+}
+
+func read(index io.Reader, region genomics.Region, strict bool, trace *Trace) ([]*bgzf.Chunk, error) {
+	scheme, err := readScheme(index)
+	if err != nil {
+		return nil, err
+	}
 
 	var references int32
-	if err := binary.Read(bai, &references); err != nil {
+	if err := binary.Read(index, &references); err != nil {
 		return nil, fmt.Errorf("reading reference count: %v", err)
 	}
 
-	// BAM uses a 6 level (depth = 5) CSI binning scheme with a minimum width of 14 bits.
-	bins := csi.BinsForRange(region.Start, region.End, 14, 5)
+	bins := csi.BinsForRange(region.Start, region.End, scheme.minShift, scheme.depth)
 
 	header := &bgzf.Chunk{End: bgzf.LastAddress}
 	chunks := []*bgzf.Chunk{header}
+	unplaced := region == genomics.UnplacedUnmappedReads
+	var found bool
+	var placedEnd bgzf.Address
 	for i := int32(0); i < references; i++ {
 		var binCount int32
-		if err := binary.Read(bai, &binCount); err != nil {
+		if err := binary.Read(index, &binCount); err != nil {
 			return nil, fmt.Errorf("reading bin count: %v", err)
 		}
-		var candidates []*bgzf.Chunk
+		if trace != nil {
+			trace.References++
+		}
+		var (
+			candidates []*bgzf.Chunk
+			offsets    = make(map[uint32]bgzf.Address)
+		)
 		for j := int32(0); j < binCount; j++ {
 			var bin struct {
 				ID     uint32
 				Chunks int32
 			}
-			if err := binary.Read(bai, &bin); err != nil {
+			if scheme.csi {
+				var header struct {
+					ID     uint32
+					Offset uint64
+					Chunks int32
+				}
+				if err := binary.Read(index, &header); err != nil {
+					return nil, fmt.Errorf("reading bin header: %v", err)
+				}
+				bin.ID, bin.Chunks = header.ID, header.Chunks
+				if i == region.ReferenceID {
+					offsets[bin.ID] = bgzf.Address(header.Offset)
+				}
+			} else if err := binary.Read(index, &bin); err != nil {
 				return nil, fmt.Errorf("reading bin header: %v", err)
 			}
 
-			includeChunks := csi.RegionContainsBin(region, i, bin.ID, bins)
+			includeChunks := !unplaced && csi.RegionContainsBin(region, i, bin.ID, bins)
+			if trace != nil && bin.ID != scheme.metadataID {
+				trace.BinsScanned++
+				trace.ChunksScanned += int(bin.Chunks)
+				if includeChunks && bin.Chunks > 0 {
+					trace.Bins = append(trace.Bins, Bin{ReferenceID: i, ID: bin.ID, Chunks: int(bin.Chunks)})
+					trace.Candidates += int(bin.Chunks)
+				}
+			}
 			for k := int32(0); k < bin.Chunks; k++ {
 				var chunk bgzf.Chunk
-				if err := binary.Read(bai, &chunk); err != nil {
+				if err := binary.Read(index, &chunk); err != nil {
 					return nil, fmt.Errorf("reading chunk: %v", err)
 				}
-				if bin.ID == metadataID {
+				if bin.ID == scheme.metadataID {
 					continue
 				}
+				if i == region.ReferenceID {
+					found = true
+				}
 				if includeChunks {
 					candidates = append(candidates, &chunk)
 				}
 				if header.End > chunk.Start {
 					header.End = chunk.Start
 				}
+				if placedEnd < chunk.End {
+					placedEnd = chunk.End
+				}
 			}
 		}
 
-		var intervals int32
-		if err := binary.Read(bai, &intervals); err != nil {
-			return nil, fmt.Errorf("reading interval count: %v", err)
-		}
-		if intervals < 0 {
-			return nil, fmt.Errorf("invalid interval count (%d intervals)", intervals)
-		}
-		offsets := make([]uint64, intervals)
-		if err := binary.Read(bai, &offsets); err != nil {
-			return nil, fmt.Errorf("reading offsets: %v", err)
-		}
-
 		var firstReadOffset bgzf.Address
-		if index := int(region.Start / linearWindowSize); index < len(offsets) {
-			firstReadOffset = bgzf.Address(offsets[index])
+		if scheme.csi {
+			firstReadOffset = firstOffset(offsets, csi.Bin(region.Start, region.Start+1, scheme.minShift, scheme.depth))
+		} else {
+			var intervals int32
+			if err := binary.Read(index, &intervals); err != nil {
+				return nil, fmt.Errorf("reading interval count: %v", err)
+			}
+			if intervals < 0 {
+				return nil, fmt.Errorf("invalid interval count (%d intervals)", intervals)
+			}
+			linear := make([]uint64, intervals)
+			if err := binary.Read(index, &linear); err != nil {
+				return nil, fmt.Errorf("reading offsets: %v", err)
+			}
+			if trace != nil {
+				trace.IntervalsScanned += int(intervals)
+			}
+			if window := int(region.Start / linearWindowSize); window < len(linear) {
+				firstReadOffset = bgzf.Address(linear[window])
+			}
 		}
 
 		for _, chunk := range candidates {
 			if chunk.End < firstReadOffset {
+				if trace != nil {
+					trace.Skipped++
+				}
 				continue
 			}
 			chunks = append(chunks, chunk)
+			if trace != nil {
+				trace.Selected++
+			}
+		}
+	}
+	if strict && region.ReferenceID >= 0 && !found {
+		return nil, ErrNoReferenceData
+	}
+	if unplaced && placedEnd > 0 {
+		// Unplaced unmapped reads follow the last placed read and run to the
+		// end of the file.  Skip them only if the index says there are none;
+		// if there are no placed reads, the header chunk already covers them.
+		var noCoordinate uint64
+		switch err := binary.Read(index, &noCoordinate); {
+		case err == nil && noCoordinate == 0:
+		case err == nil || err == io.EOF:
+			chunks = append(chunks, &bgzf.Chunk{Start: placedEnd, End: bgzf.LastAddress})
+		default:
+			return nil, fmt.Errorf("reading unplaced read count: %v", err)
 		}
 	}
 	return chunks, nil
@@ -16,10 +16,17 @@ package bam
 
 import (
 	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/binary"
 	"github.com/googlegenomics/htsget/internal/genomics"
 )
 
@@ -50,6 +57,90 @@ func TestGetReferenceID_Success(t *testing.T) {
 	}
 }
 
+func TestGetReference(t *testing.T) {
+	testCases := []struct {
+		name   string
+		id     int32
+		length uint32
+	}{
+		{"1", 0, 249250621},
+		{"20", 19, 63025520},
+		{"GL000249.1", 38, 38502},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := os.Open("testdata/multi-reference.bam")
+			if err != nil {
+				t.Fatalf("Failed to open testdata: %v", err)
+			}
+			defer r.Close()
+
+			ref, err := GetReference(r, tc.name)
+			if err != nil {
+				t.Fatalf("GetReference() returned error: %v", err)
+			}
+			if got, want := ref.ID, tc.id; got != want {
+				t.Errorf("Wrong reference ID: got %d, want %d", got, want)
+			}
+			if got, want := ref.Length, tc.length; got != want {
+				t.Errorf("Wrong reference length: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestGetHeader(t *testing.T) {
+	r, err := os.Open("testdata/multi-reference.bam")
+	if err != nil {
+		t.Fatalf("Failed to open testdata: %v", err)
+	}
+	defer r.Close()
+
+	header, err := GetHeader(r)
+	if err != nil {
+		t.Fatalf("GetHeader() returned error: %v", err)
+	}
+	if !strings.HasPrefix(header.Text, "@HD") {
+		t.Errorf("Wrong header text: got %.20q, want prefix %q", header.Text, "@HD")
+	}
+	if got, want := len(header.References), 86; got != want {
+		t.Fatalf("Wrong number of references: got %d, want %d", got, want)
+	}
+	if got, want := *header.References[19], (Reference{ID: 19, Name: "20", Length: 63025520}); got != want {
+		t.Errorf("Wrong reference: got %+v, want %+v", got, want)
+	}
+}
+
+func TestSkipHeader(t *testing.T) {
+	f, err := os.Open("testdata/multi-reference.bam")
+	if err != nil {
+		t.Fatalf("Failed to open testdata: %v", err)
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Failed to open archive: %v", err)
+	}
+	if err := SkipHeader(r); err != nil {
+		t.Fatalf("SkipHeader() returned error: %v", err)
+	}
+
+	// The stream should now be positioned at the first alignment record.
+	var record struct {
+		Size        int32
+		ReferenceID int32
+		Position    int32
+	}
+	if err := binary.Read(r, &record); err != nil {
+		t.Fatalf("Failed to read record: %v", err)
+	}
+	if record.Size < 32 || record.ReferenceID < -1 || record.Position < -1 {
+		t.Errorf("Stream is not positioned at a record: read %+v", record)
+	}
+}
+
 func TestGetReferenceID_Errors(t *testing.T) {
 	testCases := []struct {
 		name      string
@@ -190,3 +281,524 @@ func TestRead_Region(t *testing.T) {
 		})
 	}
 }
+
+func TestRead_UnplacedUnmappedReads(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/multi-reference.bam.bai")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	withCount := append([]byte(nil), data...)
+	withCount[len(withCount)-8] = 5
+
+	testCases := []struct {
+		name   string
+		data   []byte
+		chunks int
+	}{
+		{"no unplaced reads", data, 1},
+		{"some unplaced reads", withCount, 2},
+		{"without unplaced count", data[:len(data)-8], 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks, err := Read(bytes.NewReader(tc.data), genomics.UnplacedUnmappedReads)
+			if err != nil {
+				t.Fatalf("Failed to read test data: %v", err)
+			}
+			if got, want := len(chunks), tc.chunks; got != want {
+				t.Fatalf("Wrong number of chunks: got %d, want %d", got, want)
+			}
+			if tc.chunks == 1 {
+				return
+			}
+			unplaced := chunks[1]
+			if unplaced.Start <= chunks[0].End || unplaced.End != bgzf.LastAddress {
+				t.Errorf("Wrong unplaced chunk: got %s-%s", unplaced.Start, unplaced.End)
+			}
+		})
+	}
+}
+
+func TestReadStrict(t *testing.T) {
+	testCases := []struct {
+		name   string
+		region genomics.Region
+		err    error
+	}{
+		{"all mapped reads", genomics.AllMappedReads, nil},
+		{"chromosome 19, no index data", genomics.Region{ReferenceID: 18}, ErrNoReferenceData},
+		{"chromosome 20, some reads", genomics.Region{
+			ReferenceID: 19,
+			Start:       62500000,
+			End:         63500000,
+		}, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := os.Open("testdata/multi-reference.bam.bai")
+			if err != nil {
+				t.Fatalf("Failed to open test data: %v", err)
+			}
+			defer r.Close()
+
+			if _, err := ReadStrict(r, tc.region); err != tc.err {
+				t.Fatalf("Wrong error: got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+// csiFromBAI converts the BAI index in bai to a CSI index with the given
+// depth (at least 5), placing each bin at the level with the same width.  The
+// offset of each bin is taken from the linear index, as samtools does.
+func csiFromBAI(t *testing.T, bai []byte, depth int32) []byte {
+	r := bytes.NewReader(bai)
+	var w bytes.Buffer
+	write := func(v interface{}) {
+		if err := binary.Write(&w, v); err != nil {
+			t.Fatalf("Failed to write CSI data: %v", err)
+		}
+	}
+	read := func(v interface{}) {
+		if err := binary.Read(r, v); err != nil {
+			t.Fatalf("Failed to read BAI data: %v", err)
+		}
+	}
+
+	if err := binary.ExpectBytes(r, []byte(baiMagic)); err != nil {
+		t.Fatalf("Failed to read BAI magic: %v", err)
+	}
+	write([]byte(csiMagic))
+	write([]int32{14, depth, 0})
+
+	var references int32
+	read(&references)
+	write(references)
+	type bin struct {
+		id     uint32
+		chunks []bgzf.Chunk
+	}
+	for i := int32(0); i < references; i++ {
+		var count int32
+		read(&count)
+		bins := make([]bin, count)
+		for j := range bins {
+			var chunks int32
+			read(&bins[j].id)
+			read(&chunks)
+			bins[j].chunks = make([]bgzf.Chunk, chunks)
+			read(bins[j].chunks)
+		}
+		var intervals int32
+		read(&intervals)
+		linear := make([]uint64, intervals)
+		read(linear)
+
+		write(count)
+		for _, b := range bins {
+			var (
+				id     = uint32((1<<uint(3*(depth+1))-1)/7 + 1)
+				offset uint64
+			)
+			if b.id != metadataID {
+				// Bins on level l have IDs from (8^l-1)/7.
+				level, first := uint(0), uint32(0)
+				for next := uint32(1); b.id >= next; next = next*8 + 1 {
+					level, first = level+1, next
+				}
+				start := (b.id - first) << (14 + 3*(5-level))
+				if window := int(start / linearWindowSize); window < len(linear) {
+					offset = linear[window]
+				}
+				level += uint(depth - 5)
+				id = uint32((1<<(3*level)-1)/7) + b.id - first
+			}
+			write(id)
+			write(offset)
+			write(int32(len(b.chunks)))
+			write(b.chunks)
+		}
+	}
+	rest, _ := ioutil.ReadAll(r)
+	write(rest)
+	return w.Bytes()
+}
+
+func TestRead_CSI(t *testing.T) {
+	bai, err := ioutil.ReadFile("testdata/multi-reference.bam.bai")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+
+	regions := []genomics.Region{
+		genomics.AllMappedReads,
+		genomics.UnplacedUnmappedReads,
+		{ReferenceID: 18},
+		{ReferenceID: 19},
+		{ReferenceID: 19, Start: 62500000, End: 63500000},
+		{ReferenceID: 19, Start: 12500000},
+	}
+	for _, depth := range []int32{5, 6} {
+		index := csiFromBAI(t, bai, depth)
+		for _, region := range regions {
+			t.Run(fmt.Sprintf("depth %d, %s", depth, region), func(t *testing.T) {
+				want, err := ReadStrict(bytes.NewReader(bai), region)
+				if err != nil && err != ErrNoReferenceData {
+					t.Fatalf("Failed to read BAI data: %v", err)
+				}
+				got, csiErr := ReadStrict(bytes.NewReader(index), region)
+				if csiErr != err {
+					t.Fatalf("Wrong error: got %v, want %v", csiErr, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("Wrong chunks: got %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestRead_CSIErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{"wrong magic", []byte("TBI\x01")},
+		{"truncated header", []byte("CSI\x01\x0e\x00")},
+		{"too deep", []byte("CSI\x01\x0e\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Read(bytes.NewReader(tc.data), genomics.AllMappedReads); err == nil {
+				t.Fatalf("Read succeeded for invalid data")
+			}
+		})
+	}
+}
+
+func TestReadWithTrace(t *testing.T) {
+	regions := []genomics.Region{
+		genomics.AllMappedReads,
+		{ReferenceID: 19},
+		{ReferenceID: 19, Start: 62500000, End: 63500000},
+		{ReferenceID: 19, Start: 12500000},
+	}
+
+	var totals *[4]int
+	for _, region := range regions {
+		t.Run(region.String(), func(t *testing.T) {
+			r, err := os.Open("testdata/multi-reference.bam.bai")
+			if err != nil {
+				t.Fatalf("Failed to open test data: %v", err)
+			}
+			defer r.Close()
+
+			chunks, trace, err := ReadWithTrace(r, region, false)
+			if err != nil {
+				t.Fatalf("Failed to read test data: %v", err)
+			}
+
+			var candidates int
+			for _, bin := range trace.Bins {
+				candidates += bin.Chunks
+			}
+			if got, want := trace.Candidates, candidates; got != want {
+				t.Errorf("Wrong number of candidates: got %d, want %d", got, want)
+			}
+			// The first chunk (the header) does not come from any bin.
+			if got, want := candidates-trace.Skipped, len(chunks)-1; got != want {
+				t.Errorf("Wrong number of traced chunks: got %d, want %d", got, want)
+			}
+			if got, want := trace.Selected, len(chunks)-1; got != want {
+				t.Errorf("Wrong number of selected chunks: got %d, want %d", got, want)
+			}
+
+			// The whole index is scanned whatever the region.
+			scanned := [4]int{trace.References, trace.BinsScanned, trace.ChunksScanned, trace.IntervalsScanned}
+			if totals == nil {
+				totals = &scanned
+			} else if scanned != *totals {
+				t.Errorf("Wrong scan totals: got %v, want %v", scanned, *totals)
+			}
+			if scanned[0] == 0 || scanned[1] < len(trace.Bins) || scanned[2] < trace.Candidates || scanned[3] == 0 {
+				t.Errorf("Inconsistent scan totals: %v for %d bins and %d candidates", scanned, len(trace.Bins), trace.Candidates)
+			}
+		})
+	}
+}
+
+func TestReadStats(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/multi-reference.bam.bai")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+
+	testCases := []struct {
+		name         string
+		data         []byte
+		noCoordinate bool
+	}{
+		{"complete", data, true},
+		{"without unplaced count", data[:len(data)-8], false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stats, err := ReadStats(bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatalf("Failed to read stats: %v", err)
+			}
+			if got, want := len(stats.References), 86; got != want {
+				t.Fatalf("Wrong number of references: got %d, want %d", got, want)
+			}
+			for _, ref := range stats.References {
+				want := ReferenceStats{ReferenceID: ref.ReferenceID}
+				if ref.ReferenceID == 19 {
+					want.Mapped, want.Unmapped = 487, 3
+				}
+				if got := (ReferenceStats{ref.ReferenceID, ref.Mapped, ref.Unmapped, nil}); got != want {
+					t.Errorf("Wrong stats for reference %d: got %+v, want %+v", ref.ReferenceID, got, want)
+				}
+				if got, want := ref.Span != nil, ref.ReferenceID == 19; got != want {
+					t.Errorf("Wrong presence of span for reference %d: got %v, want %v", ref.ReferenceID, got, want)
+				}
+			}
+			if got := stats.NoCoordinate != nil; got != tc.noCoordinate {
+				t.Fatalf("Wrong presence of unplaced count: got %v, want %v", got, tc.noCoordinate)
+			}
+			if tc.noCoordinate && *stats.NoCoordinate != 0 {
+				t.Errorf("Wrong unplaced count: got %d, want 0", *stats.NoCoordinate)
+			}
+		})
+	}
+}
+
+func TestReadDensity(t *testing.T) {
+	r, err := os.Open("testdata/multi-reference.bam.bai")
+	if err != nil {
+		t.Fatalf("Failed to open test data: %v", err)
+	}
+	defer r.Close()
+
+	const length = 63025520
+	windows, err := ReadDensity(r, 19, length, 1000000)
+	if err != nil {
+		t.Fatalf("Failed to read density: %v", err)
+	}
+	if got, want := len(windows), 64; got != want {
+		t.Fatalf("Wrong number of windows: got %d, want %d", got, want)
+	}
+	if got, want := windows[0], (Window{Start: 0, End: 1000000, Chunks: 8, Bytes: 6066}); got != want {
+		t.Errorf("Wrong first window: got %+v, want %+v", got, want)
+	}
+	if got, want := windows[63].End, uint32(length); got != want {
+		t.Errorf("Wrong end for last window: got %d, want %d", got, want)
+	}
+
+	var chunks int
+	for _, window := range windows {
+		chunks += window.Chunks
+	}
+	if got, want := chunks, 229; got != want {
+		t.Errorf("Wrong total number of chunks: got %d, want %d", got, want)
+	}
+}
+
+func TestReadDensity_Errors(t *testing.T) {
+	testCases := []struct {
+		name           string
+		referenceID    int32
+		length, window uint32
+	}{
+		{"no window", 19, 100, 0},
+		{"unknown length", 19, 0, 100},
+		{"missing reference", 86, 100, 100},
+		{"negative reference", -1, 100, 100},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := os.Open("testdata/multi-reference.bam.bai")
+			if err != nil {
+				t.Fatalf("Failed to open test data: %v", err)
+			}
+			defer r.Close()
+
+			if _, err := ReadDensity(r, tc.referenceID, tc.length, tc.window); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+func TestEstimateRecords(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/multi-reference.bam.bai")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	stats, err := ReadStats(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to read stats: %v", err)
+	}
+
+	testCases := []struct {
+		region genomics.Region
+		want   uint64
+	}{
+		{genomics.Region{ReferenceID: 19}, 487},
+		{genomics.Region{ReferenceID: 19, Start: 12500000, End: 13500000}, 15},
+		{genomics.Region{ReferenceID: 19, Start: 62500000}, 115},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.region.String(), func(t *testing.T) {
+			chunks, err := Read(bytes.NewReader(data), tc.region)
+			if err != nil {
+				t.Fatalf("Failed to read index: %v", err)
+			}
+			got, ok := EstimateRecords(RegionBytes(chunks), stats.References[19])
+			if !ok {
+				t.Fatalf("EstimateRecords() found no metadata")
+			}
+			if got != tc.want {
+				t.Errorf("Wrong estimate: got %d, want %d", got, tc.want)
+			}
+		})
+	}
+
+	if _, ok := EstimateRecords(100, stats.References[0]); ok {
+		t.Errorf("EstimateRecords() succeeded for a reference without metadata")
+	}
+}
+
+func TestSampleRecords(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/multi-reference.bam")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	index, err := ioutil.ReadFile("testdata/multi-reference.bam.bai")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	chunks, err := Read(bytes.NewReader(index), genomics.Region{ReferenceID: 19})
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	sortChunks(chunks[1:])
+	start := chunks[1].Start
+
+	testCases := []struct {
+		blocks  int
+		records uint64
+	}{
+		{0, 0},
+		{1, 147},
+		{100, 490},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%d blocks", tc.blocks), func(t *testing.T) {
+			records, size, err := SampleRecords(bytes.NewReader(data[start.BlockOffset():]), start, tc.blocks)
+			if err != nil {
+				t.Fatalf("SampleRecords() returned error: %v", err)
+			}
+			if records != tc.records {
+				t.Errorf("Wrong number of records: got %d, want %d", records, tc.records)
+			}
+			if tc.blocks == 0 && size != 0 {
+				t.Errorf("Wrong size for no blocks: got %d, want 0", size)
+			}
+		})
+	}
+}
+
+func TestWriteIndex(t *testing.T) {
+	r, err := os.Open("testdata/multi-reference.bam")
+	if err != nil {
+		t.Fatalf("Failed to open test data: %v", err)
+	}
+	defer r.Close()
+
+	var generated bytes.Buffer
+	if err := WriteIndex(&generated, r); err != nil {
+		t.Fatalf("WriteIndex() returned error: %v", err)
+	}
+
+	// The test data index was generated by samtools.  Bins are not written in
+	// the same order, so compare the chunks selected for a set of regions.
+	original, err := ioutil.ReadFile("testdata/multi-reference.bam.bai")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+
+	regions := []genomics.Region{
+		genomics.AllMappedReads,
+		{ReferenceID: 18},
+		{ReferenceID: 19},
+		{ReferenceID: 19, Start: 62500000, End: 63500000},
+		{ReferenceID: 19, Start: 12500000},
+		{ReferenceID: 19, Start: 33800000, End: 33800001},
+	}
+	for _, region := range regions {
+		t.Run(region.String(), func(t *testing.T) {
+			got, err := Read(bytes.NewReader(generated.Bytes()), region)
+			if err != nil {
+				t.Fatalf("Failed to read generated index: %v", err)
+			}
+			want, err := Read(bytes.NewReader(original), region)
+			if err != nil {
+				t.Fatalf("Failed to read original index: %v", err)
+			}
+			sortChunks(got)
+			sortChunks(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Wrong chunks: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func sortChunks(chunks []*bgzf.Chunk) {
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Start < chunks[j].Start
+	})
+}
+
+func TestWriteIndex_Errors(t *testing.T) {
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{"not BAM", []byte("BAI\x01")},
+		{"truncated record", []byte{
+			'B', 'A', 'M', 1,
+			0, 0, 0, 0,
+			0, 0, 0, 0,
+			40, 0, 0, 0,
+			0, 0, 0, 0,
+		}},
+		{"record too small", []byte{
+			'B', 'A', 'M', 1,
+			0, 0, 0, 0,
+			0, 0, 0, 0,
+			4, 0, 0, 0,
+			0, 0, 0, 0,
+		}},
+		{"invalid reference", []byte{
+			'B', 'A', 'M', 1,
+			0, 0, 0, 0,
+			0, 0, 0, 0,
+			32, 0, 0, 0,
+			1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			block, err := bgzf.EncodeBlock(tc.data)
+			if err != nil {
+				t.Fatalf("EncodeBlock() failed: %v", err)
+			}
+			if err := WriteIndex(ioutil.Discard, bytes.NewReader(block)); err == nil {
+				t.Fatalf("WriteIndex(): expected error, not success")
+			}
+		})
+	}
+}
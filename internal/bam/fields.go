@@ -0,0 +1,227 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Fields is a set of SAM fields.
+type Fields uint16
+
+// The fields of an alignment record, named as in the SAM specification.
+const (
+	FieldQNAME Fields = 1 << iota
+	FieldFLAG
+	FieldRNAME
+	FieldPOS
+	FieldMAPQ
+	FieldCIGAR
+	FieldRNEXT
+	FieldPNEXT
+	FieldTLEN
+	FieldSEQ
+	FieldQUAL
+	FieldTAGS
+
+	// OptionalFields are the fields that can be removed from records.  The
+	// others have a fixed size in BAM and are always kept.
+	OptionalFields = FieldQNAME | FieldCIGAR | FieldSEQ | FieldQUAL | FieldTAGS
+)
+
+var fieldNames = map[string]Fields{
+	"QNAME": FieldQNAME,
+	"FLAG":  FieldFLAG,
+	"RNAME": FieldRNAME,
+	"POS":   FieldPOS,
+	"MAPQ":  FieldMAPQ,
+	"CIGAR": FieldCIGAR,
+	"RNEXT": FieldRNEXT,
+	"PNEXT": FieldPNEXT,
+	"TLEN":  FieldTLEN,
+	"SEQ":   FieldSEQ,
+	"QUAL":  FieldQUAL,
+	"TAGS":  FieldTAGS,
+}
+
+// ParseFields returns the set of fields with the given names.
+func ParseFields(names []string) (Fields, error) {
+	var fields Fields
+	for _, name := range names {
+		field, ok := fieldNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown field %q", name)
+		}
+		fields |= field
+	}
+	return fields, nil
+}
+
+// project returns record, which excludes the block size field, with the
+// optional fields and tags that f omits removed.  Removed names are replaced
+// by "*", as in SAM, and removed qualities by 0xff.  The sequence is only
+// removed along with the qualities, since BAM stores a single length for both.
+func (f Filter) project(record []byte) ([]byte, error) {
+	omit := f.Omit
+	var (
+		nameLength = int(record[8])
+		cigarOps   = int(binary.LittleEndian.Uint16(record[12:14]))
+		seqLength  = int(int32(binary.LittleEndian.Uint32(record[16:20])))
+
+		nameStart  = fixedRecordSize
+		cigarStart = nameStart + nameLength
+		seqStart   = cigarStart + 4*cigarOps
+		qualStart  = seqStart + (seqLength+1)/2
+		tagsStart  = qualStart + seqLength
+	)
+	if seqLength < 0 || tagsStart > len(record) {
+		return nil, fmt.Errorf("invalid record lengths (%d bytes with %d byte name, %d CIGAR operations and %d bases)", len(record), nameLength, cigarOps, seqLength)
+	}
+
+	projected := make([]byte, fixedRecordSize, len(record))
+	copy(projected, record)
+	if omit&FieldQNAME != 0 {
+		projected[8] = 2
+		projected = append(projected, '*', 0)
+	} else {
+		projected = append(projected, record[nameStart:cigarStart]...)
+	}
+	if omit&FieldCIGAR != 0 {
+		binary.LittleEndian.PutUint16(projected[12:14], 0)
+	} else {
+		projected = append(projected, record[cigarStart:seqStart]...)
+	}
+	switch {
+	case omit&FieldSEQ != 0 && omit&FieldQUAL != 0:
+		binary.LittleEndian.PutUint32(projected[16:20], 0)
+	case omit&FieldQUAL != 0:
+		projected = append(projected, record[seqStart:qualStart]...)
+		for i := 0; i < seqLength; i++ {
+			projected = append(projected, 0xff)
+		}
+	default:
+		projected = append(projected, record[seqStart:tagsStart]...)
+	}
+	if omit&FieldTAGS == 0 {
+		tags, err := f.selectTags(record[tagsStart:])
+		if err != nil {
+			return nil, err
+		}
+		projected = append(projected, tags...)
+	}
+	return projected, nil
+}
+
+// ParseTags returns the two character tag names in names concatenated, in
+// the form used by Filter.
+func ParseTags(names []string) (string, error) {
+	var tags []byte
+	for _, name := range names {
+		if !validTag(name) {
+			return "", fmt.Errorf("invalid tag %q", name)
+		}
+		tags = append(tags, name...)
+	}
+	return string(tags), nil
+}
+
+func validTag(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	letter := func(c byte) bool { return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' }
+	return letter(name[0]) && (letter(name[1]) || '0' <= name[1] && name[1] <= '9')
+}
+
+// hasTag reports whether the concatenated tag names in tags include tag.
+func hasTag(tags string, tag []byte) bool {
+	for i := 0; i+2 <= len(tags); i += 2 {
+		if tags[i] == tag[0] && tags[i+1] == tag[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// tagValueSizes holds the size of the values of the fixed size tag types.
+var tagValueSizes = map[byte]int{
+	'A': 1, 'c': 1, 'C': 1,
+	's': 2, 'S': 2,
+	'i': 4, 'I': 4, 'f': 4,
+}
+
+// selectTags returns the tags in data, the optional fields of a record, that
+// are kept by f.
+func (f Filter) selectTags(data []byte) ([]byte, error) {
+	if f.Tags == "" && f.NoTags == "" {
+		return data, nil
+	}
+	var selected []byte
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, fmt.Errorf("truncated tag (%d bytes)", len(data))
+		}
+		size, err := tagSize(data)
+		if err != nil {
+			return nil, fmt.Errorf("tag %s: %v", data[:2], err)
+		}
+		tag := data[:2]
+		if (f.Tags == "" || hasTag(f.Tags, tag)) && !hasTag(f.NoTags, tag) {
+			selected = append(selected, data[:size]...)
+		}
+		data = data[size:]
+	}
+	return selected, nil
+}
+
+// tagSize returns the size of the tag at the start of data, including its
+// name and type.
+func tagSize(data []byte) (int, error) {
+	const prefix = 3
+	switch valueType := data[2]; valueType {
+	case 'Z', 'H':
+		end := bytes.IndexByte(data[prefix:], 0)
+		if end < 0 {
+			return 0, errors.New("unterminated string")
+		}
+		return prefix + end + 1, nil
+	case 'B':
+		if len(data) < prefix+5 {
+			return 0, errors.New("truncated array")
+		}
+		elementSize, ok := tagValueSizes[data[prefix]]
+		if !ok || data[prefix] == 'A' {
+			return 0, fmt.Errorf("invalid array type %q", data[prefix])
+		}
+		count := int64(binary.LittleEndian.Uint32(data[prefix+1 : prefix+5]))
+		size := int64(prefix+5) + count*int64(elementSize)
+		if size > int64(len(data)) {
+			return 0, errors.New("truncated array")
+		}
+		return int(size), nil
+	default:
+		valueSize, ok := tagValueSizes[valueType]
+		if !ok {
+			return 0, fmt.Errorf("invalid type %q", valueType)
+		}
+		if prefix+valueSize > len(data) {
+			return 0, errors.New("truncated value")
+		}
+		return prefix + valueSize, nil
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// fullRecord returns an alignment record, excluding its block size, with a
+// name, one CIGAR operation, three bases with qualities and one tag.
+func fullRecord(name string) []byte {
+	record := make([]byte, fixedRecordSize)
+	record[8] = byte(len(name) + 1)
+	binary.LittleEndian.PutUint16(record[12:14], 1)
+	binary.LittleEndian.PutUint32(record[16:20], 3)
+	record = append(record, name+"\x00"...)
+	record = append(record, 0x30, 0, 0, 0)
+	record = append(record, 0x12, 0x40)
+	record = append(record, 30, 31, 32)
+	return append(record, "NMC\x01"...)
+}
+
+func TestParseFields(t *testing.T) {
+	fields, err := ParseFields([]string{"QNAME", "SEQ", "QUAL"})
+	if err != nil {
+		t.Fatalf("ParseFields() returned error: %v", err)
+	}
+	if got, want := fields, FieldQNAME|FieldSEQ|FieldQUAL; got != want {
+		t.Errorf("Wrong fields: got %b, want %b", got, want)
+	}
+	if _, err := ParseFields([]string{"QNAME", "qual"}); err == nil {
+		t.Errorf("ParseFields() accepted an unknown field")
+	}
+}
+
+func TestProject(t *testing.T) {
+	record := fullRecord("r1")
+	fixed := func(nameLength byte, cigarOps uint16, seqLength uint32) []byte {
+		f := append([]byte(nil), record[:fixedRecordSize]...)
+		f[8] = nameLength
+		binary.LittleEndian.PutUint16(f[12:14], cigarOps)
+		binary.LittleEndian.PutUint32(f[16:20], seqLength)
+		return f
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	var (
+		name  = []byte("r1\x00")
+		cigar = []byte{0x30, 0, 0, 0}
+		seq   = []byte{0x12, 0x40}
+		qual  = []byte{30, 31, 32}
+		tags  = []byte("NMC\x01")
+	)
+
+	testCases := []struct {
+		name string
+		omit Fields
+		want []byte
+	}{
+		{"nothing", 0, record},
+		{"name", FieldQNAME, join(fixed(2, 1, 3), []byte("*\x00"), cigar, seq, qual, tags)},
+		{"CIGAR", FieldCIGAR, join(fixed(3, 0, 3), name, seq, qual, tags)},
+		{"sequence only", FieldSEQ, record},
+		{"qualities", FieldQUAL, join(fixed(3, 1, 3), name, cigar, seq, []byte{0xff, 0xff, 0xff}, tags)},
+		{"sequence and qualities", FieldSEQ | FieldQUAL, join(fixed(3, 1, 0), name, cigar, tags)},
+		{"tags", FieldTAGS, join(fixed(3, 1, 3), name, cigar, seq, qual)},
+		{"all optional fields", OptionalFields, join(fixed(2, 0, 0), []byte("*\x00"))},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := (Filter{Omit: tc.omit}).project(record)
+			if err != nil {
+				t.Fatalf("project() returned error: %v", err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("Wrong record: got %x, want %x", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := (Filter{Omit: FieldTAGS}).project(record[:len(record)-8]); err == nil {
+		t.Errorf("project() accepted a truncated record")
+	}
+}
+
+func TestFilterOmit(t *testing.T) {
+	record := fullRecord("read")
+	input := make([]byte, 4)
+	binary.LittleEndian.PutUint32(input, uint32(len(record)))
+	input = append(input, record...)
+
+	var got bytes.Buffer
+	if err := (Filter{Omit: FieldTAGS}).Apply(&got, bytes.NewReader(input)); err != nil {
+		t.Fatalf("Apply() returned error: %v", err)
+	}
+	want := make([]byte, 4)
+	binary.LittleEndian.PutUint32(want, uint32(len(record)-4))
+	want = append(want, record[:len(record)-4]...)
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("Wrong records: got %x, want %x", got.Bytes(), want)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags([]string{"NM", "MD", "X0"})
+	if err != nil {
+		t.Fatalf("ParseTags() returned error: %v", err)
+	}
+	if got, want := tags, "NMMDX0"; got != want {
+		t.Errorf("Wrong tags: got %q, want %q", got, want)
+	}
+	for _, name := range []string{"N", "NMX", "0M", "N-"} {
+		if _, err := ParseTags([]string{name}); err == nil {
+			t.Errorf("ParseTags() accepted %q", name)
+		}
+	}
+}
+
+func TestSelectTags(t *testing.T) {
+	var (
+		nm = []byte("NMC\x01")
+		md = []byte("MDZ10A5\x00")
+		xa = []byte("XAi\x01\x00\x00\x00")
+		zb = []byte("ZBBc\x02\x00\x00\x00\x01\x02")
+	)
+	data := bytes.Join([][]byte{nm, md, xa, zb}, nil)
+
+	testCases := []struct {
+		name   string
+		filter Filter
+		want   []byte
+	}{
+		{"all", Filter{}, data},
+		{"included", Filter{Tags: "MDZB"}, bytes.Join([][]byte{md, zb}, nil)},
+		{"excluded", Filter{NoTags: "NMXA"}, bytes.Join([][]byte{md, zb}, nil)},
+		{"both", Filter{Tags: "NMMD", NoTags: "MD"}, nm},
+		{"none match", Filter{Tags: "OQ"}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.filter.selectTags(data)
+			if err != nil {
+				t.Fatalf("selectTags() returned error: %v", err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("Wrong tags: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	for _, bad := range [][]byte{[]byte("MDZ10A5"), []byte("ZBBc\x09\x00\x00\x00\x01"), []byte("NMq\x01"), []byte("NM")} {
+		if _, err := (Filter{NoTags: "XX"}).selectTags(bad); err == nil {
+			t.Errorf("selectTags(%q) succeeded, want error", bad)
+		}
+	}
+}
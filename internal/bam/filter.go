@@ -0,0 +1,154 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bam
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	bin "github.com/googlegenomics/htsget/internal/binary"
+	"github.com/googlegenomics/htsget/internal/genomics"
+)
+
+// Filter selects alignment records by their flags and mapping quality, like
+// the -f, -F and -q options of samtools view, and removes fields from the
+// records that it keeps.  The zero Filter keeps every record as it is.
+type Filter struct {
+	// RequireFlags are the flags that every kept record must have set.
+	RequireFlags uint16
+	// ExcludeFlags are the flags that no kept record may have set.
+	ExcludeFlags uint16
+	// MinMappingQuality is the lowest mapping quality of a kept record.
+	MinMappingQuality uint8
+	// Omit are the optional fields that are removed from kept records.
+	Omit Fields
+	// Tags, unless it is empty, holds the names of the only tags that are
+	// kept, and NoTags the names of tags that are removed.  Both concatenate
+	// two character tag names, as returned by ParseTags.
+	Tags, NoTags string
+	// Regions, unless it is empty, lists the regions that kept records must
+	// overlap.  This trims the records outside the requested regions that
+	// share the chunks of an index with those inside them.
+	Regions []genomics.Region
+}
+
+// IsZero reports whether f keeps every record as it is.
+func (f Filter) IsZero() bool {
+	return f.RequireFlags == 0 && f.ExcludeFlags == 0 && f.MinMappingQuality == 0 &&
+		f.Omit == 0 && f.Tags == "" && f.NoTags == "" && len(f.Regions) == 0
+}
+
+// keep reports whether record, which excludes the block size field, passes
+// the filter.
+func (f Filter) keep(record []byte) bool {
+	quality := record[9]
+	flags := binary.LittleEndian.Uint16(record[14:16])
+	return flags&f.RequireFlags == f.RequireFlags && flags&f.ExcludeFlags == 0 && quality >= f.MinMappingQuality
+}
+
+// Apply copies the records read from r that pass the filter to w, without the
+// fields that it omits.  r must hold decompressed BAM data that starts and
+// ends at record boundaries, as the body chunks of an index do.
+func (f Filter) Apply(w io.Writer, r io.Reader) error {
+	for {
+		var size int32
+		if err := bin.Read(r, &size); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading record size: %v", err)
+		}
+		if size < fixedRecordSize {
+			return fmt.Errorf("invalid record size (%d bytes)", size)
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return fmt.Errorf("reading record: %v", err)
+		}
+		if !f.keep(record) {
+			continue
+		}
+		if len(f.Regions) > 0 {
+			overlaps, err := f.overlaps(record)
+			if err != nil {
+				return err
+			}
+			if !overlaps {
+				continue
+			}
+		}
+		if f.Omit&OptionalFields != 0 || f.Tags != "" || f.NoTags != "" {
+			var err error
+			if record, err = f.project(record); err != nil {
+				return err
+			}
+			size = int32(len(record))
+		}
+		if err := bin.Write(w, size); err != nil {
+			return fmt.Errorf("writing record size: %v", err)
+		}
+		if _, err := w.Write(record); err != nil {
+			return fmt.Errorf("writing record: %v", err)
+		}
+	}
+}
+
+// overlaps reports whether record, which excludes the block size field,
+// overlaps one of the regions of the filter.  Unmapped records and records
+// without a CIGAR cover a single base, as when the index is built.
+func (f Filter) overlaps(record []byte) (bool, error) {
+	var (
+		referenceID = int32(binary.LittleEndian.Uint32(record[0:4]))
+		position    = int32(binary.LittleEndian.Uint32(record[4:8]))
+	)
+	var end int64
+	for _, region := range f.Regions {
+		if region == genomics.UnplacedUnmappedReads {
+			if referenceID < 0 {
+				return true, nil
+			}
+			continue
+		}
+		if referenceID < 0 || (region.ReferenceID >= 0 && referenceID != region.ReferenceID) {
+			continue
+		}
+		if region.Start == 0 && region.End == 0 {
+			return true, nil
+		}
+		if position < 0 {
+			continue
+		}
+		if end == 0 {
+			var (
+				nameLength = int(record[8])
+				cigarOps   = int(binary.LittleEndian.Uint16(record[12:14]))
+				flags      = binary.LittleEndian.Uint16(record[14:16])
+				cigar      = fixedRecordSize + nameLength
+			)
+			if cigar+4*cigarOps > len(record) {
+				return false, fmt.Errorf("record too short for CIGAR (%d bytes)", len(record))
+			}
+			length := referenceLength(record[cigar : cigar+4*cigarOps])
+			if flags&unmappedFlag != 0 || length == 0 {
+				length = 1
+			}
+			end = int64(position) + int64(length)
+		}
+		if end > int64(region.Start) && (region.End == 0 || int64(position) < int64(region.End)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/googlegenomics/htsget/internal/genomics"
+)
+
+// testRecord returns an encoded alignment record, including its block size,
+// with the given flags and mapping quality.
+func testRecord(flags uint16, quality uint8) []byte {
+	record := make([]byte, 4+fixedRecordSize)
+	binary.LittleEndian.PutUint32(record, fixedRecordSize)
+	record[4+9] = quality
+	binary.LittleEndian.PutUint16(record[4+14:], flags)
+	return record
+}
+
+func TestFilter(t *testing.T) {
+	records := [][]byte{
+		testRecord(0x0, 60),
+		testRecord(0x400, 60),
+		testRecord(0x40, 10),
+		testRecord(0x41, 30),
+	}
+	var input []byte
+	for _, record := range records {
+		input = append(input, record...)
+	}
+
+	testCases := []struct {
+		name   string
+		filter Filter
+		want   []int
+	}{
+		{"zero", Filter{}, []int{0, 1, 2, 3}},
+		{"exclude duplicates", Filter{ExcludeFlags: 0x400}, []int{0, 2, 3}},
+		{"require flags", Filter{RequireFlags: 0x41}, []int{3}},
+		{"mapping quality", Filter{MinMappingQuality: 20}, []int{0, 1, 3}},
+		{"combined", Filter{ExcludeFlags: 0x400, MinMappingQuality: 20}, []int{0, 3}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got bytes.Buffer
+			if err := tc.filter.Apply(&got, bytes.NewReader(input)); err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+			var want []byte
+			for _, i := range tc.want {
+				want = append(want, records[i]...)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("Wrong records: got %d bytes, want %d bytes", got.Len(), len(want))
+			}
+		})
+	}
+}
+
+func TestFilter_Errors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input []byte
+	}{
+		{"short record", []byte{4, 0, 0, 0, 1, 2, 3, 4}},
+		{"truncated record", testRecord(0, 0)[:20]},
+		{"truncated size", []byte{1, 0}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := (Filter{}).Apply(&out, bytes.NewReader(tc.input)); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+func TestFilterOverlaps(t *testing.T) {
+	// placed returns a record on referenceID at position with the CIGAR 3M,
+	// or unmapped if unmapped is set.
+	placed := func(referenceID, position int32, unmapped bool) []byte {
+		record := fullRecord("r")
+		binary.LittleEndian.PutUint32(record[0:4], uint32(referenceID))
+		binary.LittleEndian.PutUint32(record[4:8], uint32(position))
+		if unmapped {
+			binary.LittleEndian.PutUint16(record[14:16], unmappedFlag)
+		}
+		return record
+	}
+
+	testCases := []struct {
+		name    string
+		record  []byte
+		regions []genomics.Region
+		want    bool
+	}{
+		{"inside", placed(1, 100, false), []genomics.Region{{ReferenceID: 1, Start: 90, End: 110}}, true},
+		{"overlaps start", placed(1, 100, false), []genomics.Region{{ReferenceID: 1, Start: 102, End: 110}}, true},
+		{"ends before start", placed(1, 100, false), []genomics.Region{{ReferenceID: 1, Start: 103, End: 110}}, false},
+		{"starts at end", placed(1, 100, false), []genomics.Region{{ReferenceID: 1, Start: 90, End: 100}}, false},
+		{"open end", placed(1, 100, false), []genomics.Region{{ReferenceID: 1, Start: 50}}, true},
+		{"other reference", placed(2, 100, false), []genomics.Region{{ReferenceID: 1}}, false},
+		{"whole reference", placed(1, 100, false), []genomics.Region{{ReferenceID: 1}}, true},
+		{"second region", placed(1, 100, false), []genomics.Region{{ReferenceID: 2}, {ReferenceID: 1, Start: 100, End: 101}}, true},
+		{"unmapped inside", placed(1, 100, true), []genomics.Region{{ReferenceID: 1, Start: 100, End: 101}}, true},
+		{"unmapped outside", placed(1, 100, true), []genomics.Region{{ReferenceID: 1, Start: 101, End: 110}}, false},
+		{"unplaced", placed(-1, -1, true), []genomics.Region{genomics.UnplacedUnmappedReads}, true},
+		{"placed, unplaced requested", placed(1, 100, false), []genomics.Region{genomics.UnplacedUnmappedReads}, false},
+		{"unplaced, mapped requested", placed(-1, -1, true), []genomics.Region{genomics.AllMappedReads}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := (Filter{Regions: tc.regions}).overlaps(tc.record)
+			if err != nil {
+				t.Fatalf("overlaps() returned error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("Wrong result: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	truncated := placed(1, 100, false)[:fixedRecordSize+3]
+	if _, err := (Filter{Regions: []genomics.Region{{ReferenceID: 1, Start: 1}}}).overlaps(truncated); err == nil {
+		t.Errorf("overlaps() accepted a truncated record")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bam
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/googlegenomics/htsget/internal/binary"
+)
+
+// Encode returns h in the uncompressed binary form used at the start of a BAM
+// file: the magic, the SAM header text and the reference list.
+func (h *Header) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(bamMagic)
+	if err := binary.Write(&buf, int32(len(h.Text))); err != nil {
+		return nil, fmt.Errorf("writing SAM header length: %v", err)
+	}
+	buf.WriteString(h.Text)
+
+	if err := binary.Write(&buf, int32(len(h.References))); err != nil {
+		return nil, fmt.Errorf("writing references count: %v", err)
+	}
+	for _, ref := range h.References {
+		// The name length includes a null terminating character.
+		if err := binary.Write(&buf, int32(len(ref.Name)+1)); err != nil {
+			return nil, fmt.Errorf("writing name length: %v", err)
+		}
+		buf.WriteString(ref.Name)
+		buf.WriteByte(0)
+		if err := binary.Write(&buf, ref.Length); err != nil {
+			return nil, fmt.Errorf("writing reference length: %v", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// TrimReferenceLines returns a copy of h whose text omits the @SQ lines for
+// references after last, leaving all other lines (such as @RG and @PG)
+// intact.  The reference list itself is unchanged because alignment records
+// refer to references by their position in it; readers such as htslib fill in
+// @SQ lines for references that only appear in the list.  The @SQ lines that
+// remain therefore always describe a prefix of the list, in the same order.
+func (h *Header) TrimReferenceLines(last int32) *Header {
+	var (
+		lines []string
+		id    int32
+	)
+	for _, line := range strings.SplitAfter(h.Text, "\n") {
+		if strings.HasPrefix(line, "@SQ\t") {
+			keep := id <= last
+			id++
+			if !keep {
+				continue
+			}
+		}
+		lines = append(lines, line)
+	}
+	return &Header{Text: strings.Join(lines, ""), References: h.References}
+}
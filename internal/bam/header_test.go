@@ -0,0 +1,81 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bam
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+)
+
+func TestHeader_Encode(t *testing.T) {
+	r, err := os.Open("testdata/multi-reference.bam")
+	if err != nil {
+		t.Fatalf("Failed to open testdata: %v", err)
+	}
+	defer r.Close()
+
+	want, err := GetHeader(r)
+	if err != nil {
+		t.Fatalf("GetHeader() returned error: %v", err)
+	}
+	raw, err := want.Encode()
+	if err != nil {
+		t.Fatalf("Encode() returned error: %v", err)
+	}
+	encoded, err := bgzf.EncodeBlocks(raw)
+	if err != nil {
+		t.Fatalf("Failed to compress header: %v", err)
+	}
+	got, err := GetHeader(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("Failed to read encoded header: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Encoded header differs from the original")
+	}
+}
+
+func TestHeader_TrimReferenceLines(t *testing.T) {
+	header := &Header{
+		Text: "@HD\tVN:1.6\n" +
+			"@SQ\tSN:1\tLN:100\n" +
+			"@SQ\tSN:2\tLN:200\n" +
+			"@RG\tID:rg1\n" +
+			"@SQ\tSN:3\tLN:300\n" +
+			"@PG\tID:bwa\n",
+		References: []*Reference{{0, "1", 100}, {1, "2", 200}, {2, "3", 300}},
+	}
+	testCases := []struct {
+		last int32
+		want string
+	}{
+		{0, "@HD\tVN:1.6\n@SQ\tSN:1\tLN:100\n@RG\tID:rg1\n@PG\tID:bwa\n"},
+		{1, "@HD\tVN:1.6\n@SQ\tSN:1\tLN:100\n@SQ\tSN:2\tLN:200\n@RG\tID:rg1\n@PG\tID:bwa\n"},
+		{2, header.Text},
+	}
+	for _, tc := range testCases {
+		got := header.TrimReferenceLines(tc.last)
+		if got.Text != tc.want {
+			t.Errorf("TrimReferenceLines(%d): got text %q, want %q", tc.last, got.Text, tc.want)
+		}
+		if !reflect.DeepEqual(got.References, header.References) {
+			t.Errorf("TrimReferenceLines(%d) changed the reference list", tc.last)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bam
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/binary"
+	"github.com/googlegenomics/htsget/internal/csi"
+)
+
+const (
+	// The size of the fixed length portion of an alignment record (excluding
+	// the block size field).
+	fixedRecordSize = 32
+
+	unmappedFlag = 0x4
+)
+
+// WriteIndex reads the coordinate-sorted BAM file from bam and writes a BAI
+// index describing it to bai.
+func WriteIndex(bai io.Writer, bam io.Reader) error {
+	r := bgzf.NewReader(bam)
+	count, err := readReferences(r, func(*Reference) bool { return true })
+	if err != nil {
+		return fmt.Errorf("reading header: %v", err)
+	}
+
+	references := make([]referenceIndex, count)
+	var (
+		noCoordinate uint64
+		last         = genomicPosition{-1, 0}
+	)
+	for {
+		start := r.Address()
+		var size int32
+		if err := binary.Read(r, &size); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading record size: %v", err)
+		}
+		if size < fixedRecordSize {
+			return fmt.Errorf("invalid record size (%d bytes)", size)
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return fmt.Errorf("reading record: %v", err)
+		}
+		end := r.Address()
+
+		var fields struct {
+			ReferenceID   int32
+			Position      int32
+			NameLength    uint8
+			MappingQual   uint8
+			Bin           uint16
+			CigarOps      uint16
+			Flags         uint16
+			SequenceLen   int32
+			NextReference int32
+			NextPosition  int32
+			TemplateLen   int32
+		}
+		if err := binary.Read(bytes.NewReader(record), &fields); err != nil {
+			return fmt.Errorf("parsing record: %v", err)
+		}
+
+		if fields.ReferenceID < 0 {
+			noCoordinate++
+			continue
+		}
+		if fields.ReferenceID >= count {
+			return fmt.Errorf("invalid reference ID (%d)", fields.ReferenceID)
+		}
+		position := genomicPosition{fields.ReferenceID, fields.Position}
+		if position.less(last) {
+			return fmt.Errorf("records are not sorted by coordinate (%v follows %v)", position, last)
+		}
+		last = position
+
+		begin := uint32(fields.Position)
+		if fields.Position < 0 {
+			begin = 0
+		}
+		cigar := fixedRecordSize + int(fields.NameLength)
+		if cigar+4*int(fields.CigarOps) > len(record) {
+			return fmt.Errorf("record too short for CIGAR (%d bytes)", len(record))
+		}
+		length := referenceLength(record[cigar : cigar+4*int(fields.CigarOps)])
+		unmapped := fields.Flags&unmappedFlag != 0
+		if unmapped || length == 0 {
+			length = 1
+		}
+
+		references[fields.ReferenceID].add(begin, begin+length, &bgzf.Chunk{Start: start, End: end}, unmapped)
+	}
+
+	w := bufio.NewWriter(bai)
+	if err := writeIndex(w, references, noCoordinate); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+type genomicPosition struct {
+	reference, position int32
+}
+
+func (p genomicPosition) less(q genomicPosition) bool {
+	if p.reference != q.reference {
+		return p.reference < q.reference
+	}
+	return p.position < q.position
+}
+
+// referenceLength returns the number of reference bases covered by the
+// encoded CIGAR operations in cigar.
+func referenceLength(cigar []byte) uint32 {
+	var length uint32
+	for i := 0; i+4 <= len(cigar); i += 4 {
+		op := uint32(cigar[i]) | uint32(cigar[i+1])<<8 | uint32(cigar[i+2])<<16 | uint32(cigar[i+3])<<24
+		switch op & 0xf {
+		case 0, 2, 3, 7, 8: // M, D, N, = and X consume the reference.
+			length += op >> 4
+		}
+	}
+	return length
+}
+
+// referenceIndex accumulates the binning and linear index for a single
+// reference.
+type referenceIndex struct {
+	bins             map[uint32][]*bgzf.Chunk
+	offsets          []bgzf.Address
+	span             bgzf.Chunk
+	mapped, unmapped uint64
+}
+
+func (ref *referenceIndex) add(begin, end uint32, chunk *bgzf.Chunk, unmapped bool) {
+	if ref.bins == nil {
+		ref.bins = make(map[uint32][]*bgzf.Chunk)
+		ref.span.Start = chunk.Start
+	}
+	ref.span.End = chunk.End
+
+	// BAM uses a 6 level (depth = 5) CSI binning scheme with a minimum width of 14 bits.
+	bin := csi.Bin(begin, end, 14, 5)
+	chunks := ref.bins[bin]
+	if n := len(chunks); n > 0 && chunks[n-1].End == chunk.Start {
+		chunks[n-1].End = chunk.End
+	} else {
+		ref.bins[bin] = append(chunks, chunk)
+	}
+
+	if unmapped {
+		ref.unmapped++
+		return
+	}
+	ref.mapped++
+
+	// Only mapped reads contribute to the linear index.
+	last := int((end - 1) / linearWindowSize)
+	for len(ref.offsets) <= last {
+		ref.offsets = append(ref.offsets, bgzf.LastAddress)
+	}
+	for i := int(begin / linearWindowSize); i <= last; i++ {
+		if ref.offsets[i] == bgzf.LastAddress {
+			ref.offsets[i] = chunk.Start
+		}
+	}
+}
+
+func writeIndex(w io.Writer, references []referenceIndex, noCoordinate uint64) error {
+	if _, err := w.Write([]byte(baiMagic)); err != nil {
+		return fmt.Errorf("writing magic: %v", err)
+	}
+	if err := binary.Write(w, int32(len(references))); err != nil {
+		return fmt.Errorf("writing reference count: %v", err)
+	}
+	for i := range references {
+		ref := &references[i]
+
+		ids := make([]uint32, 0, len(ref.bins))
+		for id := range ref.bins {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		binCount := int32(len(ids))
+		if binCount > 0 {
+			binCount++ // Include the metadata pseudo-bin.
+		}
+		if err := binary.Write(w, binCount); err != nil {
+			return fmt.Errorf("writing bin count: %v", err)
+		}
+		for _, id := range ids {
+			chunks := ref.bins[id]
+			if err := binary.Write(w, id); err != nil {
+				return fmt.Errorf("writing bin ID: %v", err)
+			}
+			if err := binary.Write(w, int32(len(chunks))); err != nil {
+				return fmt.Errorf("writing chunk count: %v", err)
+			}
+			for _, chunk := range chunks {
+				if err := binary.Write(w, chunk); err != nil {
+					return fmt.Errorf("writing chunk: %v", err)
+				}
+			}
+		}
+		if binCount > 0 {
+			metadata := []interface{}{
+				uint32(metadataID), int32(2), ref.span,
+				ref.mapped, ref.unmapped,
+			}
+			for _, v := range metadata {
+				if err := binary.Write(w, v); err != nil {
+					return fmt.Errorf("writing metadata: %v", err)
+				}
+			}
+		}
+
+		// Windows that precede the first read take the offset of the first
+		// record and any other gaps inherit the offset of the previous window
+		// (matching samtools), so the linear index is always a valid lower bound.
+		previous := ref.span.Start
+		for i, offset := range ref.offsets {
+			if offset == bgzf.LastAddress {
+				ref.offsets[i] = previous
+			}
+			previous = ref.offsets[i]
+		}
+		if err := binary.Write(w, int32(len(ref.offsets))); err != nil {
+			return fmt.Errorf("writing interval count: %v", err)
+		}
+		if err := binary.Write(w, ref.offsets); err != nil {
+			return fmt.Errorf("writing offsets: %v", err)
+		}
+	}
+	if err := binary.Write(w, noCoordinate); err != nil {
+		return fmt.Errorf("writing unplaced read count: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bam
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/binary"
+)
+
+// ReferenceStats holds the read counts recorded by an index for a single
+// reference.  The counts are zero if the index does not record them.
+type ReferenceStats struct {
+	ReferenceID int32  `json:"referenceId"`
+	Mapped      uint64 `json:"mapped"`
+	Unmapped    uint64 `json:"unmapped"`
+	// Span covers the reference's reads in the BAM file, or is nil if the
+	// index does not record it.
+	Span *bgzf.Chunk `json:"-"`
+}
+
+// IndexStats holds the summary statistics recorded by a BAI index.
+type IndexStats struct {
+	References []ReferenceStats `json:"references"`
+	// NoCoordinate is the number of unplaced unmapped reads, or nil if the
+	// index does not record it.
+	NoCoordinate *uint64 `json:"noCoordinate,omitempty"`
+}
+
+// ReadStats reads index data from bai and returns the per-reference read
+// counts from the metadata pseudo-bins and the trailing count of reads
+// without coordinates.
+func ReadStats(bai io.Reader) (*IndexStats, error) {
+	if err := binary.ExpectBytes(bai, []byte(baiMagic)); err != nil {
+		return nil, fmt.Errorf("reading magic: %v", err)
+	}
+
+	var references int32
+	if err := binary.Read(bai, &references); err != nil {
+		return nil, fmt.Errorf("reading reference count: %v", err)
+	}
+	if references < 0 {
+		return nil, fmt.Errorf("invalid reference count (%d references)", references)
+	}
+
+	stats := &IndexStats{References: make([]ReferenceStats, references)}
+	for i := int32(0); i < references; i++ {
+		ref := &stats.References[i]
+		ref.ReferenceID = i
+
+		var binCount int32
+		if err := binary.Read(bai, &binCount); err != nil {
+			return nil, fmt.Errorf("reading bin count: %v", err)
+		}
+		for j := int32(0); j < binCount; j++ {
+			var bin struct {
+				ID     uint32
+				Chunks int32
+			}
+			if err := binary.Read(bai, &bin); err != nil {
+				return nil, fmt.Errorf("reading bin header: %v", err)
+			}
+			if bin.Chunks < 0 {
+				return nil, fmt.Errorf("invalid chunk count (%d chunks)", bin.Chunks)
+			}
+			chunks := make([]uint64, 2*bin.Chunks)
+			if err := binary.Read(bai, &chunks); err != nil {
+				return nil, fmt.Errorf("reading chunks: %v", err)
+			}
+			// The pseudo-bin holds the span of the reference's reads followed by
+			// the number of mapped and unmapped reads.
+			if bin.ID == metadataID && bin.Chunks == 2 {
+				ref.Span = &bgzf.Chunk{Start: bgzf.Address(chunks[0]), End: bgzf.Address(chunks[1])}
+				ref.Mapped, ref.Unmapped = chunks[2], chunks[3]
+			}
+		}
+
+		var intervals int32
+		if err := binary.Read(bai, &intervals); err != nil {
+			return nil, fmt.Errorf("reading interval count: %v", err)
+		}
+		if intervals < 0 {
+			return nil, fmt.Errorf("invalid interval count (%d intervals)", intervals)
+		}
+		if _, err := io.CopyN(ioutil.Discard, bai, 8*int64(intervals)); err != nil {
+			return nil, fmt.Errorf("reading offsets: %v", err)
+		}
+	}
+
+	// The count of reads without coordinates is optional.
+	var noCoordinate uint64
+	switch err := binary.Read(bai, &noCoordinate); err {
+	case nil:
+		stats.NoCoordinate = &noCoordinate
+	case io.EOF:
+	default:
+		return nil, fmt.Errorf("reading unplaced read count: %v", err)
+	}
+	return stats, nil
+}
+
+// The range of bin IDs at the deepest level of the BAM binning scheme, each of
+// which covers linearWindowSize bases.
+const (
+	firstLeafBin = 4681 // ((1 << 15) - 1) / 7
+	lastLeafBin  = 37448
+)
+
+// Window summarizes the index entries for a range of a reference.
+type Window struct {
+	Start  uint32 `json:"start"`
+	End    uint32 `json:"end"`
+	Chunks int    `json:"chunks"`
+	// Bytes estimates the amount of compressed data referenced by the chunks.
+	Bytes uint64 `json:"bytes"`
+}
+
+// ReadDensity reads index data from bai and returns the number of chunks and
+// their approximate size in each windowSize window of the reference with the
+// given ID and length.  Only the smallest (16kbp) bins are counted, so reads
+// that span a bin boundary are not included; the result is intended as a
+// quick estimate of coverage rather than an exact count.
+func ReadDensity(bai io.Reader, referenceID int32, length, windowSize uint32) ([]Window, error) {
+	if windowSize == 0 {
+		return nil, errors.New("window size must be positive")
+	}
+	if length == 0 {
+		return nil, errors.New("reference length is unknown")
+	}
+
+	windows := make([]Window, (uint64(length)+uint64(windowSize)-1)/uint64(windowSize))
+	for i := range windows {
+		windows[i].Start = uint32(i) * windowSize
+		windows[i].End = windows[i].Start + windowSize
+		if windows[i].End > length || windows[i].End < windows[i].Start {
+			windows[i].End = length
+		}
+	}
+
+	if err := binary.ExpectBytes(bai, []byte(baiMagic)); err != nil {
+		return nil, fmt.Errorf("reading magic: %v", err)
+	}
+
+	var references int32
+	if err := binary.Read(bai, &references); err != nil {
+		return nil, fmt.Errorf("reading reference count: %v", err)
+	}
+	if referenceID < 0 || referenceID >= references {
+		return nil, fmt.Errorf("reference %d is not in the index (%d references)", referenceID, references)
+	}
+
+	for i := int32(0); i <= referenceID; i++ {
+		var binCount int32
+		if err := binary.Read(bai, &binCount); err != nil {
+			return nil, fmt.Errorf("reading bin count: %v", err)
+		}
+		for j := int32(0); j < binCount; j++ {
+			var bin struct {
+				ID     uint32
+				Chunks int32
+			}
+			if err := binary.Read(bai, &bin); err != nil {
+				return nil, fmt.Errorf("reading bin header: %v", err)
+			}
+			if bin.Chunks < 0 {
+				return nil, fmt.Errorf("invalid chunk count (%d chunks)", bin.Chunks)
+			}
+			chunks := make([]bgzf.Chunk, bin.Chunks)
+			if err := binary.Read(bai, &chunks); err != nil {
+				return nil, fmt.Errorf("reading chunks: %v", err)
+			}
+			if i != referenceID || bin.ID < firstLeafBin || bin.ID > lastLeafBin {
+				continue
+			}
+
+			index := uint64(bin.ID-firstLeafBin) * linearWindowSize / uint64(windowSize)
+			if index >= uint64(len(windows)) {
+				continue
+			}
+			window := &windows[index]
+			window.Chunks += len(chunks)
+			for i := range chunks {
+				window.Bytes += chunkBytes(&chunks[i])
+			}
+		}
+
+		var intervals int32
+		if err := binary.Read(bai, &intervals); err != nil {
+			return nil, fmt.Errorf("reading interval count: %v", err)
+		}
+		if intervals < 0 {
+			return nil, fmt.Errorf("invalid interval count (%d intervals)", intervals)
+		}
+		if _, err := io.CopyN(ioutil.Discard, bai, 8*int64(intervals)); err != nil {
+			return nil, fmt.Errorf("reading offsets: %v", err)
+		}
+	}
+	return windows, nil
+}
+
+// chunkBytes approximates the amount of compressed data in chunk.  Chunks
+// that lie within a single block are measured in uncompressed bytes.
+func chunkBytes(chunk *bgzf.Chunk) uint64 {
+	if start, end := chunk.Start.BlockOffset(), chunk.End.BlockOffset(); start != end {
+		return end - start
+	}
+	return uint64(chunk.End.DataOffset() - chunk.Start.DataOffset())
+}
+
+// RegionBytes approximates the amount of compressed data referenced by the
+// chunks returned by Read, excluding the leading header chunk.  Overlapping
+// chunks are only counted once.
+func RegionBytes(chunks []*bgzf.Chunk) uint64 {
+	if len(chunks) <= 1 {
+		return 0
+	}
+	body := make([]*bgzf.Chunk, len(chunks)-1)
+	for i, chunk := range chunks[1:] {
+		c := *chunk
+		body[i] = &c
+	}
+	var total uint64
+	for _, chunk := range bgzf.Merge(body, math.MaxUint64) {
+		total += chunkBytes(chunk)
+	}
+	return total
+}
+
+// EstimateRecords estimates the number of mapped reads in size bytes of the
+// reference described by stats (as measured by RegionBytes), assuming that
+// the reads are spread evenly through the reference's compressed data.  It
+// returns false if the index does not record the reference's span and counts.
+func EstimateRecords(size uint64, stats ReferenceStats) (uint64, bool) {
+	if stats.Span == nil {
+		return 0, false
+	}
+	span := chunkBytes(stats.Span)
+	if span == 0 || size >= span {
+		return stats.Mapped, true
+	}
+	return uint64(float64(stats.Mapped) * float64(size) / float64(span)), true
+}
+
+// SampleRecords counts the records that begin in the first blocks BGZF blocks
+// of r, which must start with the block that contains start, and returns that
+// count along with the compressed size of the blocks that were read.  The
+// ratio between them gives the density of records near start.
+func SampleRecords(r io.Reader, start bgzf.Address, blocks int) (records, size uint64, err error) {
+	var sample bytes.Buffer
+	for i := 0; i < blocks; i++ {
+		block, err := bgzf.ReadRawBlock(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("reading block: %v", err)
+		}
+		sample.Write(block)
+	}
+	size = uint64(sample.Len())
+	if size == 0 {
+		return 0, 0, nil
+	}
+
+	br := bgzf.NewReader(&sample)
+	if _, err := io.CopyN(ioutil.Discard, br, int64(start.DataOffset())); err != nil {
+		return 0, 0, fmt.Errorf("skipping to first record: %v", err)
+	}
+	for {
+		var length int32
+		if err := binary.Read(br, &length); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return records, size, nil
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("reading record size: %v", err)
+		}
+		if length < fixedRecordSize {
+			return 0, 0, fmt.Errorf("invalid record size (%d bytes)", length)
+		}
+		records++
+		// The last record may continue beyond the sampled blocks.
+		if _, err := io.CopyN(ioutil.Discard, br, int64(length)); err == io.EOF {
+			return records, size, nil
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("reading record: %v", err)
+		}
+	}
+}
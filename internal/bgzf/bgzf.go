@@ -16,6 +16,7 @@
 package bgzf
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"errors"
@@ -31,6 +32,11 @@ const LastAddress = Address(0xffffffffffffffff)
 // MaximumBlockSize is the maximum BGZF block size.
 const MaximumBlockSize = 65536
 
+// MaximumDataSize is the amount of uncompressed data that EncodeBlocks writes
+// to each block, leaving space for the compression overhead of incompressible
+// data.
+const MaximumDataSize = 0xff00
+
 // Address stores a BGZF "virtual address".  The lower 16 bits store the data
 // offset inside the uncompressed stream and upper 48 bits store the block
 // offset inside the compressed archive set.
@@ -75,6 +81,13 @@ func (v *Chunk) String() string {
 // Merge attempts to merge any intersecting chunks in input.  Merge will not
 // join two chunks if their combined size could exceed sizeLimit.
 func Merge(input []*Chunk, sizeLimit uint64) []*Chunk {
+	return MergeWithin(input, sizeLimit, 0)
+}
+
+// MergeWithin is like Merge, but also joins chunks that are separated by at
+// most gap compressed bytes.  The merged chunks then include the data in the
+// gaps.
+func MergeWithin(input []*Chunk, sizeLimit, gap uint64) []*Chunk {
 	sort.Slice(input, func(i, j int) bool {
 		return input[i].Start < input[j].Start
 	})
@@ -92,7 +105,11 @@ func Merge(input []*Chunk, sizeLimit uint64) []*Chunk {
 			size = input[i].End.BlockOffset() - output.Start.BlockOffset() + MaximumBlockSize
 		}
 
-		if input[i].Start <= output.End && size <= sizeLimit {
+		near := input[i].Start <= output.End
+		if gap > 0 && input[i].Start.BlockOffset() <= output.End.BlockOffset()+gap {
+			near = true
+		}
+		if near && size <= sizeLimit {
 			if output.End < input[i].End {
 				output.End = input[i].End
 			}
@@ -156,3 +173,242 @@ func EncodeBlock(data []byte) ([]byte, error) {
 	encoded[17] = byte(bsize >> 8)
 	return encoded, nil
 }
+
+// EncodeBlocks returns the concatenation of as many BGZF blocks as are needed
+// to encode data, each holding at most MaximumDataSize bytes.  Empty input
+// produces a single empty block.
+func EncodeBlocks(data []byte) ([]byte, error) {
+	var encoded []byte
+	for {
+		n := len(data)
+		if n > MaximumDataSize {
+			n = MaximumDataSize
+		}
+		block, err := EncodeBlock(data[:n])
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, block...)
+		data = data[n:]
+		if len(data) == 0 {
+			return encoded, nil
+		}
+	}
+}
+
+// Writer encodes the data written to it as BGZF blocks, each holding at most
+// MaximumDataSize bytes.  Unlike EncodeBlocks, it writes no blocks for empty
+// input.  Close writes any buffered data but no EOF marker.
+type Writer struct {
+	w      io.Writer
+	buffer []byte
+}
+
+// NewWriter returns a new Writer that writes BGZF blocks to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, buffer: make([]byte, 0, MaximumDataSize)}
+}
+
+// Write buffers p, writing a block each time MaximumDataSize bytes are
+// buffered.
+func (w *Writer) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		copied := copy(w.buffer[len(w.buffer):cap(w.buffer)], p)
+		w.buffer = w.buffer[:len(w.buffer)+copied]
+		n += copied
+		p = p[copied:]
+		if len(w.buffer) == cap(w.buffer) {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes any buffered data as a final block.  It does not close the
+// underlying writer.
+func (w *Writer) Close() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *Writer) flush() error {
+	block, err := EncodeBlock(w.buffer)
+	if err != nil {
+		return err
+	}
+	w.buffer = w.buffer[:0]
+	_, err = w.w.Write(block)
+	return err
+}
+
+// Reader reads the uncompressed contents of a BGZF file while keeping track of
+// the virtual address of the next byte to be read.
+type Reader struct {
+	r      *bufio.Reader
+	block  []byte
+	pos    int
+	length uint16
+	next   uint64
+}
+
+// NewReader returns a new Reader that reads BGZF blocks from r.  The first
+// block in r is assumed to start at block offset zero.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Read reads uncompressed data into p.  It implements the io.Reader interface.
+func (r *Reader) Read(p []byte) (int, error) {
+	if err := r.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.block[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+// Address returns the virtual address of the next byte that will be returned
+// by Read.  When the current block has been consumed, the address refers to
+// the start of the following block.
+func (r *Reader) Address() Address {
+	if r.pos == len(r.block) {
+		return NewAddress(r.next, 0)
+	}
+	return NewAddress(r.next-uint64(r.length), uint16(r.pos))
+}
+
+// fill decodes blocks until there is unread data available, skipping over
+// empty blocks (such as the EOF marker).
+func (r *Reader) fill() error {
+	for r.pos == len(r.block) {
+		if _, err := r.r.Peek(1); err == io.EOF {
+			return io.EOF
+		}
+		block, length, err := DecodeBlock(r.r)
+		if err != nil {
+			return fmt.Errorf("decoding block at offset %d: %v", r.next, err)
+		}
+		r.block, r.pos, r.length = block, 0, length
+		r.next += uint64(length)
+	}
+	return nil
+}
+
+// EOFMarker is the empty block that terminates a BGZF file, as specified in
+// section 4.1.2 of the SAM specification.
+var EOFMarker = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// HeaderSize is the size of a BGZF block header with a single BC subfield,
+// which is all that ReadBlockSize reads.
+const HeaderSize = 18
+
+// ReadRawBlock reads a single complete BGZF block from r without decoding it.
+func ReadRawBlock(r io.Reader) ([]byte, error) {
+	header, size, err := readBlockHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	block := make([]byte, size)
+	copy(block, header)
+	if _, err := io.ReadFull(r, block[HeaderSize:]); err != nil {
+		return nil, fmt.Errorf("reading block: %v", err)
+	}
+	return block, nil
+}
+
+// ReadBlockSize reads the header of the BGZF block at the start of r and
+// returns the compressed size of the whole block, which gives the offset of
+// the following block.
+func ReadBlockSize(r io.Reader) (int, error) {
+	_, size, err := readBlockHeader(r)
+	return size, err
+}
+
+// readBlockHeader reads and validates the header of a BGZF block, returning
+// it along with the size of the whole block.
+func readBlockHeader(r io.Reader) ([]byte, int, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 || header[3]&0x04 == 0 {
+		return nil, 0, fmt.Errorf("invalid gzip header: %x", header[:4])
+	}
+	if header[10] != 6 || header[11] != 0 || header[12] != 0x42 || header[13] != 0x43 || header[14] != 2 || header[15] != 0 {
+		return nil, 0, fmt.Errorf("invalid BGZF extra field: %x", header[10:16])
+	}
+
+	size := (int(header[16]) | int(header[17])<<8) + 1
+	if size < len(EOFMarker) {
+		return nil, 0, fmt.Errorf("invalid block size (%d bytes)", size)
+	}
+	return header, size, nil
+}
+
+// Concatenator joins BGZF streams into a single BGZF file.  Each block is
+// validated and copied unmodified, except that empty blocks (such as the EOF
+// markers that terminate each stream) are dropped.  Close writes the single
+// EOF marker that terminates the output.
+type Concatenator struct {
+	w io.Writer
+}
+
+// NewConcatenator returns a Concatenator that writes to w.
+func NewConcatenator(w io.Writer) *Concatenator {
+	return &Concatenator{w: w}
+}
+
+// Append copies the BGZF stream read from r to the output.  It returns the
+// number of bytes written.
+func (c *Concatenator) Append(r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	var n int64
+	for offset := 0; ; {
+		if _, err := br.Peek(1); err == io.EOF {
+			return n, nil
+		}
+		block, err := ReadRawBlock(br)
+		if err != nil {
+			return n, fmt.Errorf("reading block at offset %d: %v", offset, err)
+		}
+		data, _, err := DecodeBlock(bytes.NewReader(block))
+		if err != nil {
+			return n, fmt.Errorf("validating block at offset %d: %v", offset, err)
+		}
+		offset += len(block)
+		if len(data) == 0 {
+			continue
+		}
+		written, err := c.w.Write(block)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close writes the EOF marker.  It does not close the underlying writer.
+func (c *Concatenator) Close() error {
+	_, err := c.w.Write(EOFMarker)
+	return err
+}
+
+// Concatenate joins the BGZF streams into a single BGZF file written to w (see
+// Concatenator).
+func Concatenate(w io.Writer, streams ...io.Reader) error {
+	c := NewConcatenator(w)
+	for i, r := range streams {
+		if _, err := c.Append(r); err != nil {
+			return fmt.Errorf("stream %d: %v", i, err)
+		}
+	}
+	return c.Close()
+}
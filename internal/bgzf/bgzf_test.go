@@ -17,7 +17,9 @@ package bgzf
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"reflect"
 	"strings"
 	"testing"
@@ -156,6 +158,31 @@ func TestMerge(t *testing.T) {
 	}
 }
 
+func TestMergeWithin(t *testing.T) {
+	testCases := []struct {
+		name   string
+		gap    uint64
+		input  string
+		merged string
+	}{
+		{"no gap", 0, "00000000-00010000,00020000-00030000", "00000000-00010000,00020000-00030000"},
+		{"within gap", 0x1000, "00000000-00010000,00020000-00030000", "00000000-00030000"},
+		{"beyond gap", 0x1000, "00000000-00010000,20000000-20010000", "00000000-00010000,20000000-20010000"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			input, err := parseChunkString(tc.input)
+			if err != nil {
+				t.Fatalf("Bad chunk string: %v", err)
+			}
+			want, err := parseChunkString(tc.merged)
+			if got := MergeWithin(input, 1<<20, tc.gap); !reflect.DeepEqual(got, want) {
+				t.Errorf("MergeWithin: got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
 func TestDecodeBlock(t *testing.T) {
 	// Read test data to memory and use a ByteReader so that the gzip reader
 	// doesn't read too many bytes (it does if the reader only implements Read).
@@ -189,6 +216,36 @@ func TestDecodeBlock(t *testing.T) {
 	}
 }
 
+func TestReader(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/tiny.bam")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	r := NewReader(bytes.NewReader(input))
+
+	steps := []struct {
+		read    int
+		address Address
+	}{
+		{0, NewAddress(0, 0)},
+		{10, NewAddress(0, 10)},
+		{286, NewAddress(223, 0)},
+		{27, NewAddress(223, 27)},
+		{800, NewAddress(643, 0)},
+	}
+	for _, step := range steps {
+		if _, err := io.ReadFull(r, make([]byte, step.read)); err != nil {
+			t.Fatalf("Failed to read %d bytes: %v", step.read, err)
+		}
+		if got, want := r.Address(), step.address; got != want {
+			t.Errorf("Wrong address after reading %d bytes: got %s, want %s", step.read, got, want)
+		}
+	}
+	if n, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() at end of data: got (%d, %v), want EOF", n, err)
+	}
+}
+
 func TestEncodeBlock_ValidInputs(t *testing.T) {
 	testCases := []struct {
 		name       string
@@ -230,6 +287,112 @@ func TestEncodeBlock_BlockSizes(t *testing.T) {
 	}
 }
 
+func TestEncodeBlocks(t *testing.T) {
+	random := make([]byte, 3*MaximumDataSize+7)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	testCases := []struct {
+		name   string
+		data   []byte
+		blocks int
+	}{
+		{"empty", nil, 1},
+		{"single byte", random[:1], 1},
+		{"one full block", random[:MaximumDataSize], 1},
+		{"one byte over", random[:MaximumDataSize+1], 2},
+		{"several blocks", random, 4},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			encoded, err := EncodeBlocks(tc.data)
+			if err != nil {
+				t.Fatalf("EncodeBlocks() returned error: %v", err)
+			}
+
+			var (
+				decoded []byte
+				blocks  int
+				r       = bytes.NewReader(encoded)
+			)
+			for r.Len() > 0 {
+				before := r.Len()
+				data, _, err := DecodeBlock(r)
+				if err != nil {
+					t.Fatalf("Failed to decode block %d: %v", blocks, err)
+				}
+				if size := before - r.Len(); size > MaximumBlockSize {
+					t.Errorf("Block %d too large: %d bytes", blocks, size)
+				}
+				decoded = append(decoded, data...)
+				blocks++
+			}
+			if blocks != tc.blocks {
+				t.Errorf("Wrong number of blocks: got %d, want %d", blocks, tc.blocks)
+			}
+			if !bytes.Equal(decoded, tc.data) {
+				t.Errorf("Wrong decoded data: got %d bytes, want %d bytes", len(decoded), len(tc.data))
+			}
+		})
+	}
+}
+
+func TestWriter(t *testing.T) {
+	random := make([]byte, 3*MaximumDataSize+7)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	testCases := []struct {
+		name   string
+		data   []byte
+		blocks int
+	}{
+		{"empty", nil, 0},
+		{"single byte", random[:1], 1},
+		{"one full block", random[:MaximumDataSize], 1},
+		{"one byte over", random[:MaximumDataSize+1], 2},
+		{"several blocks", random, 4},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var encoded bytes.Buffer
+			w := NewWriter(&encoded)
+			// Write in uneven pieces so that writes straddle block boundaries.
+			for data := tc.data; len(data) > 0; {
+				n := 1000
+				if n > len(data) {
+					n = len(data)
+				}
+				if _, err := w.Write(data[:n]); err != nil {
+					t.Fatalf("Write() returned error: %v", err)
+				}
+				data = data[n:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() returned error: %v", err)
+			}
+
+			var (
+				decoded []byte
+				blocks  int
+				r       = bytes.NewReader(encoded.Bytes())
+			)
+			for r.Len() > 0 {
+				data, _, err := DecodeBlock(r)
+				if err != nil {
+					t.Fatalf("Failed to decode block %d: %v", blocks, err)
+				}
+				decoded = append(decoded, data...)
+				blocks++
+			}
+			if blocks != tc.blocks {
+				t.Errorf("Wrong number of blocks: got %d, want %d", blocks, tc.blocks)
+			}
+			if !bytes.Equal(decoded, tc.data) {
+				t.Errorf("Wrong decoded data: got %d bytes, want %d bytes", len(decoded), len(tc.data))
+			}
+		})
+	}
+}
+
 func parseChunkString(input string) ([]*Chunk, error) {
 	var chunks []*Chunk
 	for _, s := range strings.Split(input, ",") {
@@ -246,3 +409,76 @@ func parseChunkString(input string) ([]*Chunk, error) {
 	}
 	return chunks, nil
 }
+
+func TestConcatenate(t *testing.T) {
+	tiny, err := ioutil.ReadFile("testdata/tiny.bam")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	if !bytes.HasSuffix(tiny, EOFMarker) {
+		t.Fatalf("Test data does not end with an EOF marker")
+	}
+	body := tiny[:len(tiny)-len(EOFMarker)]
+
+	var output bytes.Buffer
+	err = Concatenate(&output,
+		bytes.NewReader(tiny),
+		bytes.NewReader(EOFMarker),
+		bytes.NewReader(nil),
+		bytes.NewReader(tiny))
+	if err != nil {
+		t.Fatalf("Concatenate() returned error: %v", err)
+	}
+
+	want := append(append(append([]byte{}, body...), body...), EOFMarker...)
+	if !bytes.Equal(output.Bytes(), want) {
+		t.Errorf("Wrong output: got %d bytes, want %d bytes", output.Len(), len(want))
+	}
+}
+
+func TestConcatenate_InvalidInputs(t *testing.T) {
+	tiny, err := ioutil.ReadFile("testdata/tiny.bam")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	corrupt := append([]byte{}, tiny...)
+	corrupt[30] ^= 0xff
+
+	testCases := []struct {
+		name  string
+		input []byte
+	}{
+		{"not gzip", []byte("this is not a BGZF file at all")},
+		{"truncated", tiny[:len(tiny)-10]},
+		{"corrupt data", corrupt},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := Concatenate(ioutil.Discard, bytes.NewReader(tc.input)); err == nil {
+				t.Errorf("Concatenate() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestReadBlockSize(t *testing.T) {
+	block, err := EncodeBlock([]byte("some data for a block"))
+	if err != nil {
+		t.Fatalf("Failed to encode block: %v", err)
+	}
+	following := append(append([]byte{}, block...), EOFMarker...)
+
+	size, err := ReadBlockSize(bytes.NewReader(following))
+	if err != nil {
+		t.Fatalf("ReadBlockSize() failed: %v", err)
+	}
+	if got, want := size, len(block); got != want {
+		t.Errorf("Wrong block size: got %d, want %d", got, want)
+	}
+
+	for _, input := range [][]byte{[]byte("this is not a BGZF block"), block[:10]} {
+		if _, err := ReadBlockSize(bytes.NewReader(input)); err == nil {
+			t.Errorf("ReadBlockSize(%q) succeeded, want error", input)
+		}
+	}
+}
@@ -38,3 +38,8 @@ func ExpectBytes(r io.Reader, want []byte) error {
 func Read(r io.Reader, v interface{}) error {
 	return binary.Read(r, binary.LittleEndian, v)
 }
+
+// Write writes the little endian representation of v to w using binary.Write.
+func Write(w io.Writer, v interface{}) error {
+	return binary.Write(w, binary.LittleEndian, v)
+}
@@ -16,12 +16,15 @@
 package csi
 
 import (
+	"sort"
+
 	"github.com/googlegenomics/htsget/internal/genomics"
 )
 
 // RegionContainsBin indicates if the given region contains the bin described by
-// referenceID and binID.
-func RegionContainsBin(region genomics.Region, referenceID int32, binID uint32, bins []uint16) bool {
+// referenceID and binID.  The bins must be sorted, as BinsForRange returns
+// them.
+func RegionContainsBin(region genomics.Region, referenceID int32, binID uint32, bins []uint32) bool {
 	if region.ReferenceID >= 0 && referenceID != region.ReferenceID {
 		return false
 	}
@@ -30,37 +33,32 @@ func RegionContainsBin(region genomics.Region, referenceID int32, binID uint32,
 		return true
 	}
 
-	for _, id := range bins {
-		if uint32(id) == binID {
-			return true
-		}
-	}
-	return false
+	i := sort.Search(len(bins), func(i int) bool { return bins[i] >= binID })
+	return i < len(bins) && bins[i] == binID
 }
 
-// BinsForRange returns the list of bins that may overlap with the zero-based region
-// defined by [start, end). The minShift and depth parameters control the minimum interval width
-// and number of binning levels, respectively.
-func BinsForRange(start, end uint32, minShift, depth int32) []uint16 {
+// BinsForRange returns the sorted list of bins that may overlap with the
+// zero-based region defined by [start, end). The minShift and depth parameters
+// control the minimum interval width and number of binning levels,
+// respectively.
+func BinsForRange(start, end uint32, minShift, depth int32) []uint32 {
 	maxWidth := maximumBinWidth(minShift, depth)
-	if end == 0 || end > maxWidth {
-		end = maxWidth
+	last := uint64(end)
+	if end == 0 || last > maxWidth {
+		last = maxWidth
 	}
-	if end <= start {
-		return nil
-	}
-	if start > maxWidth {
+	if last <= uint64(start) {
 		return nil
 	}
 
 	// This is derived from the C examples in the CSI index specification.
-	end--
-	var bins []uint16
-	for l, t, s := uint(0), uint(0), uint(minShift+depth*3); l <= uint(depth); l++ {
-		b := t + (uint(start) >> s)
-		e := t + (uint(end) >> s)
+	last--
+	var bins []uint32
+	for l, t, s := uint(0), uint64(0), uint(minShift+depth*3); l <= uint(depth); l++ {
+		b := t + (uint64(start) >> s)
+		e := t + (last >> s)
 		for i := b; i <= e; i++ {
-			bins = append(bins, uint16(i))
+			bins = append(bins, uint32(i))
 		}
 		s -= 3
 		t += 1 << (l * 3)
@@ -68,6 +66,33 @@ func BinsForRange(start, end uint32, minShift, depth int32) []uint16 {
 	return bins
 }
 
-func maximumBinWidth(minShift, depth int32) uint32 {
-	return uint32(1 << uint32(minShift+depth*3))
+// Bin returns the ID of the smallest bin that completely contains the
+// zero-based region defined by [start, end).  The minShift and depth
+// parameters have the same meaning as in BinsForRange.
+func Bin(start, end uint32, minShift, depth int32) uint32 {
+	if end <= start {
+		end = start + 1
+	}
+	end--
+	// This is derived from the C examples in the CSI index specification.
+	s, t := uint(minShift), uint32((1<<uint(depth*3)-1)/7)
+	for l := uint(depth); l > 0; l-- {
+		if start>>s == end>>s {
+			return t + start>>s
+		}
+		s += 3
+		t -= 1 << ((l - 1) * 3)
+	}
+	return 0
+}
+
+// MetadataBin returns the ID of the pseudo-bin that holds the metadata of
+// each reference in an index with depth levels below the root bin: one more
+// than the largest bin ID.
+func MetadataBin(depth int32) uint32 {
+	return uint32((1<<uint((depth+1)*3)-1)/7 + 1)
+}
+
+func maximumBinWidth(minShift, depth int32) uint64 {
+	return 1 << uint(minShift+depth*3)
 }
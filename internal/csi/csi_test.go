@@ -19,26 +19,29 @@ import (
 
 	"math"
 	"reflect"
+
+	"github.com/googlegenomics/htsget/internal/genomics"
 )
 
 func TestBinsForRange(t *testing.T) {
 	metadataID := 37450
-	allBins := make([]uint16, metadataID-1)
+	allBins := make([]uint32, metadataID-1)
 	for i := range allBins {
-		allBins[i] = uint16(i)
+		allBins[i] = uint32(i)
 	}
 
 	testCases := []struct {
 		name            string
 		start, end      uint32
 		minShift, depth int32
-		bins            []uint16
+		bins            []uint32
 	}{
 		{"end clamping", 0, math.MaxUint32, 14, 5, allBins},
-		{"end past maximum", 0, maximumBinWidth(14, 5) + 1, 14, 5, allBins},
-		{"start past maximum", maximumBinWidth(14, 5) + 1, maximumBinWidth(14, 5) + 2, 14, 5, nil},
-		{"narrow region", 0, 1, 14, 5, []uint16{0, 1, 9, 73, 585, 4681}},
-		{"narrow depth", 0, 1, 14, 4, []uint16{0, 1, 9, 73, 585}},
+		{"end past maximum", 0, uint32(maximumBinWidth(14, 5)) + 1, 14, 5, allBins},
+		{"start past maximum", uint32(maximumBinWidth(14, 5)) + 1, uint32(maximumBinWidth(14, 5)) + 2, 14, 5, nil},
+		{"narrow region", 0, 1, 14, 5, []uint32{0, 1, 9, 73, 585, 4681}},
+		{"narrow depth", 0, 1, 14, 4, []uint32{0, 1, 9, 73, 585}},
+		{"deep scheme", 1 << 31, 1<<31 + 1, 14, 6, []uint32{0, 5, 41, 329, 2633, 21065, 168521}},
 		{"invalid range (start > end)", math.MaxUint32, 0, 14, 5, nil},
 		{"swapped endpoints", 2, 1, 14, 5, nil},
 		{"zero-width region", 1, 1, 14, 5, nil},
@@ -52,3 +55,65 @@ func TestBinsForRange(t *testing.T) {
 		})
 	}
 }
+
+func TestBin(t *testing.T) {
+	testCases := []struct {
+		name            string
+		start, end      uint32
+		minShift, depth int32
+		bin             uint32
+	}{
+		{"first 16kb window", 0, 1, 14, 5, 4681},
+		{"second 16kb window", 1 << 14, 1<<14 + 1, 14, 5, 4682},
+		{"spans two 16kb windows", 1<<14 - 1, 1<<14 + 1, 14, 5, 585},
+		{"spans two 128kb windows", 1<<17 - 1, 1<<17 + 1, 14, 5, 73},
+		{"whole range", 0, uint32(maximumBinWidth(14, 5)), 14, 5, 0},
+		{"empty region", 10, 10, 14, 5, 4681},
+		{"narrow depth", 0, 1, 14, 4, 585},
+		{"deep scheme", 1 << 31, 1<<31 + 1, 14, 6, 168521},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, want := Bin(tc.start, tc.end, tc.minShift, tc.depth), tc.bin; got != want {
+				t.Fatalf("Bin(%v, %v) = %v, want %v", tc.start, tc.end, got, want)
+			}
+		})
+	}
+}
+
+func TestRegionContainsBin(t *testing.T) {
+	bins := BinsForRange(1<<31, 1<<31+1, 14, 6)
+	testCases := []struct {
+		name   string
+		region genomics.Region
+		bin    uint32
+		want   bool
+	}{
+		{"leaf bin", genomics.Region{ReferenceID: 1, Start: 1 << 31, End: 1<<31 + 1}, 168521, true},
+		{"root bin", genomics.Region{ReferenceID: 1, Start: 1 << 31, End: 1<<31 + 1}, 0, true},
+		{"neighbouring bin", genomics.Region{ReferenceID: 1, Start: 1 << 31, End: 1<<31 + 1}, 168522, false},
+		{"other reference", genomics.Region{ReferenceID: 2, Start: 1 << 31, End: 1<<31 + 1}, 0, false},
+		{"whole reference", genomics.Region{ReferenceID: 1}, 168522, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := RegionContainsBin(tc.region, 1, tc.bin, bins); got != tc.want {
+				t.Fatalf("RegionContainsBin(%v, 1, %d) = %v, want %v", tc.region, tc.bin, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMetadataBin(t *testing.T) {
+	for _, tc := range []struct {
+		depth int32
+		want  uint32
+	}{
+		{5, 37450},
+		{6, 299594},
+	} {
+		if got := MetadataBin(tc.depth); got != tc.want {
+			t.Errorf("MetadataBin(%d) = %d, want %d", tc.depth, got, tc.want)
+		}
+	}
+}
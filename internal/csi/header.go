@@ -0,0 +1,63 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/googlegenomics/htsget/internal/binary"
+)
+
+const (
+	csiMagic = "CSI\x01"
+
+	// maximumAuxSize bounds the auxiliary data that is read, so that a
+	// corrupt index cannot exhaust memory.
+	maximumAuxSize = 64 << 20
+)
+
+// Header holds the binning scheme and auxiliary data at the start of a CSI
+// index.
+type Header struct {
+	// MinShift is the number of bits in the width of the smallest bins and
+	// Depth is the number of levels below the root bin.
+	MinShift, Depth int32
+	// Aux is the auxiliary data, which is not interpreted by CSI.
+	Aux []byte
+}
+
+// ReadHeader reads the header of the decompressed CSI index in r, leaving r
+// positioned at the reference count.
+func ReadHeader(r io.Reader) (*Header, error) {
+	if err := binary.ExpectBytes(r, []byte(csiMagic)); err != nil {
+		return nil, fmt.Errorf("reading magic: %v", err)
+	}
+
+	var fields struct {
+		MinShift, Depth, AuxSize int32
+	}
+	if err := binary.Read(r, &fields); err != nil {
+		return nil, fmt.Errorf("reading binning scheme: %v", err)
+	}
+	if fields.AuxSize < 0 || fields.AuxSize > maximumAuxSize {
+		return nil, fmt.Errorf("invalid auxiliary data size (%d bytes)", fields.AuxSize)
+	}
+	header := &Header{MinShift: fields.MinShift, Depth: fields.Depth, Aux: make([]byte, fields.AuxSize)}
+	if _, err := io.ReadFull(r, header.Aux); err != nil {
+		return nil, fmt.Errorf("reading auxiliary data: %v", err)
+	}
+	return header, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+// testIndex returns the start of a CSI index with the given auxiliary data,
+// followed by a reference count of zero.
+func testIndex(aux []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(csiMagic)
+	binary.Write(&b, binary.LittleEndian, []int32{14, 5, int32(len(aux))})
+	b.Write(aux)
+	binary.Write(&b, binary.LittleEndian, int32(0))
+	return b.Bytes()
+}
+
+func TestReadHeader(t *testing.T) {
+	testCases := []struct {
+		name string
+		aux  []byte
+	}{
+		{"no auxiliary data", nil},
+		{"auxiliary data", []byte{1, 2, 3}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bytes.NewReader(testIndex(tc.aux))
+			header, err := ReadHeader(r)
+			if err != nil {
+				t.Fatalf("ReadHeader() returned error: %v", err)
+			}
+			if header.MinShift != 14 || header.Depth != 5 {
+				t.Errorf("Wrong binning scheme: got %d/%d, want 14/5", header.MinShift, header.Depth)
+			}
+			if got, want := header.Aux, tc.aux; !bytes.Equal(got, want) {
+				t.Errorf("Wrong auxiliary data: got %v, want %v", got, want)
+			}
+			if rest, _ := ioutil.ReadAll(r); len(rest) != 4 {
+				t.Errorf("Reader is not positioned at the reference count: %d bytes remain", len(rest))
+			}
+		})
+	}
+}
+
+func TestReadHeader_Errors(t *testing.T) {
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{"wrong magic", append([]byte("TBI\x01"), testIndex(nil)[4:]...)},
+		{"negative aux size", testIndex(nil)},
+		{"truncated aux", testIndex([]byte{1, 2, 3, 4, 5, 6, 7, 8})[:20]},
+	}
+	binary.LittleEndian.PutUint32(testCases[1].data[12:], 0xffffffff)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ReadHeader(bytes.NewReader(tc.data)); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fasta locates regions of reference sequences in indexed FASTA files,
+// using the .fai indexes written by samtools faidx and, for files compressed
+// with bgzip, the accompanying .gzi indexes.
+package fasta
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/binary"
+)
+
+// Sequence describes where a single sequence is stored in a FASTA file.
+type Sequence struct {
+	Name string
+	// Length is the number of bases in the sequence.
+	Length uint64
+	// Offset is the position of the first base in the (uncompressed) file.
+	Offset uint64
+	// LineBases and LineWidth are the number of bases on each line and the
+	// number of bytes in each line, including the line terminator.
+	LineBases, LineWidth uint64
+}
+
+// ReadIndex reads the sequences listed by the .fai index in r.
+func ReadIndex(r io.Reader) ([]*Sequence, error) {
+	var sequences []*Sequence
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("line %d: expected at least 5 fields, found %d", line, len(fields))
+		}
+		var numbers [4]uint64
+		for i := range numbers {
+			n, err := strconv.ParseUint(fields[i+1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: parsing field %d: %v", line, i+2, err)
+			}
+			numbers[i] = n
+		}
+		sequence := &Sequence{
+			Name:      fields[0],
+			Length:    numbers[0],
+			Offset:    numbers[1],
+			LineBases: numbers[2],
+			LineWidth: numbers[3],
+		}
+		if sequence.LineBases == 0 || sequence.LineWidth < sequence.LineBases {
+			return nil, fmt.Errorf("line %d: invalid line length (%d bases in %d bytes)", line, sequence.LineBases, sequence.LineWidth)
+		}
+		sequences = append(sequences, sequence)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading index: %v", err)
+	}
+	return sequences, nil
+}
+
+// Range returns the offsets in the uncompressed file of the first byte of the
+// base at start and the byte after the base at end-1, so that the bytes in
+// between hold bases start to end-1 along with any line terminators between
+// them.  start and end must not exceed the length of the sequence.
+func (s *Sequence) Range(start, end uint64) (uint64, uint64) {
+	if end <= start {
+		return s.position(start), s.position(start)
+	}
+	return s.position(start), s.position(end-1) + 1
+}
+
+func (s *Sequence) position(base uint64) uint64 {
+	return s.Offset + base/s.LineBases*s.LineWidth + base%s.LineBases
+}
+
+// Block records where a BGZF block starts in both the compressed and the
+// uncompressed file.
+type Block struct {
+	Compressed, Uncompressed uint64
+}
+
+// ReadGZI reads the block offsets from the .gzi index in r.  The first block,
+// which always starts at offset zero, is included in the result although the
+// index does not list it.
+func ReadGZI(r io.Reader) ([]Block, error) {
+	var count uint64
+	if err := binary.Read(r, &count); err != nil {
+		return nil, fmt.Errorf("reading block count: %v", err)
+	}
+	if count > 1<<32 {
+		return nil, fmt.Errorf("invalid block count (%d blocks)", count)
+	}
+	blocks := []Block{{}}
+	for i := uint64(0); i < count; i++ {
+		var block Block
+		if err := binary.Read(r, &block); err != nil {
+			return nil, fmt.Errorf("reading block %d: %v", i, err)
+		}
+		if last := blocks[len(blocks)-1]; block.Compressed <= last.Compressed || block.Uncompressed < last.Uncompressed {
+			return nil, fmt.Errorf("block %d is out of order", i)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// Address converts offset, a position in the uncompressed file, to a virtual
+// address in the compressed file described by blocks (as returned by
+// ReadGZI).
+func Address(blocks []Block, offset uint64) (bgzf.Address, error) {
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].Uncompressed > offset
+	}) - 1
+	if i < 0 {
+		return 0, errors.New("no blocks")
+	}
+	within := offset - blocks[i].Uncompressed
+	if within >= bgzf.MaximumBlockSize {
+		return 0, fmt.Errorf("offset %d lies beyond the last indexed block", offset)
+	}
+	return bgzf.NewAddress(blocks[i].Compressed, uint16(within)), nil
+}
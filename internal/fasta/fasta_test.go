@@ -0,0 +1,135 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fasta
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/binary"
+)
+
+// testFASTA holds two sequences, the first wrapped at 4 bases per line.
+const testFASTA = ">one\nACGT\nACGT\nAC\n>two\nTTTTT\n"
+
+const testIndex = "one\t10\t5\t4\t5\ntwo\t5\t23\t5\t6\n"
+
+func TestReadIndex(t *testing.T) {
+	sequences, err := ReadIndex(strings.NewReader(testIndex))
+	if err != nil {
+		t.Fatalf("ReadIndex() returned error: %v", err)
+	}
+	want := []Sequence{
+		{Name: "one", Length: 10, Offset: 5, LineBases: 4, LineWidth: 5},
+		{Name: "two", Length: 5, Offset: 23, LineBases: 5, LineWidth: 6},
+	}
+	if got := len(sequences); got != len(want) {
+		t.Fatalf("Wrong number of sequences: got %d, want %d", got, len(want))
+	}
+	for i := range want {
+		if got := *sequences[i]; got != want[i] {
+			t.Errorf("Wrong sequence %d: got %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestReadIndex_Errors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		index string
+	}{
+		{"too few fields", "one\t10\t5\t4\n"},
+		{"invalid number", "one\t10\tx\t4\t5\n"},
+		{"no bases per line", "one\t10\t5\t0\t1\n"},
+		{"line narrower than bases", "one\t10\t5\t4\t3\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ReadIndex(strings.NewReader(tc.index)); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+func TestRange(t *testing.T) {
+	sequences, err := ReadIndex(strings.NewReader(testIndex))
+	if err != nil {
+		t.Fatalf("ReadIndex() returned error: %v", err)
+	}
+
+	testCases := []struct {
+		sequence   int
+		start, end uint64
+		want       string
+	}{
+		{0, 0, 10, "ACGT\nACGT\nAC"},
+		{0, 0, 4, "ACGT"},
+		{0, 3, 5, "T\nA"},
+		{0, 8, 10, "AC"},
+		{0, 5, 5, ""},
+		{1, 1, 5, "TTTT"},
+	}
+	for _, tc := range testCases {
+		s := sequences[tc.sequence]
+		begin, end := s.Range(tc.start, tc.end)
+		if got := testFASTA[begin:end]; got != tc.want {
+			t.Errorf("Wrong data for %s:%d-%d: got %q, want %q", s.Name, tc.start, tc.end, got, tc.want)
+		}
+	}
+}
+
+func TestReadGZI(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, []uint64{2, 100, 65280, 180, 130560})
+	blocks, err := ReadGZI(&buf)
+	if err != nil {
+		t.Fatalf("ReadGZI() returned error: %v", err)
+	}
+	if got, want := len(blocks), 3; got != want {
+		t.Fatalf("Wrong number of blocks: got %d, want %d", got, want)
+	}
+
+	testCases := []struct {
+		offset uint64
+		want   bgzf.Address
+	}{
+		{0, bgzf.NewAddress(0, 0)},
+		{65279, bgzf.NewAddress(0, 65279)},
+		{65280, bgzf.NewAddress(100, 0)},
+		{130561, bgzf.NewAddress(180, 1)},
+	}
+	for _, tc := range testCases {
+		got, err := Address(blocks, tc.offset)
+		if err != nil {
+			t.Errorf("Address(%d) returned error: %v", tc.offset, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Wrong address for %d: got %v, want %v", tc.offset, got, tc.want)
+		}
+	}
+	if _, err := Address(blocks, 130560+bgzf.MaximumBlockSize); err == nil {
+		t.Errorf("Address() succeeded for an offset beyond the last block")
+	}
+
+	buf.Reset()
+	binary.Write(&buf, []uint64{2, 100, 65280, 50, 130560})
+	if _, err := ReadGZI(&buf); err == nil {
+		t.Errorf("ReadGZI() succeeded for blocks out of order")
+	}
+}
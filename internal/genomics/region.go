@@ -6,10 +6,15 @@ import "fmt"
 // AllMappedReads defines a Region that matches all mapped reads.
 var AllMappedReads = Region{ReferenceID: -1}
 
+// UnplacedUnmappedReads defines a Region that matches the unmapped reads that
+// have no reference or position, which sort after all other reads.
+var UnplacedUnmappedReads = Region{ReferenceID: -2}
+
 // Region defines a region of genomic interest.
 type Region struct {
 	// ReferenceID specifies the reference to match.  If it is negative, any
-	// reference matches the region.
+	// reference matches the region, except for UnplacedUnmappedReads, which
+	// matches no reference.
 	ReferenceID int32
 	// Start and End specify the open range (in base pairs) relative to the
 	// reference.  If End is zero, it is treated as though it was set to the last
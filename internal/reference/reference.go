@@ -0,0 +1,286 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reference fetches reference sequences by MD5 checksum, as needed to
+// decode CRAM data.  Sequences are located using the REF_PATH and REF_CACHE
+// conventions defined by htslib (see the samtools(1) manual), so the same
+// configuration can be shared with other tools.
+package reference
+
+import (
+	"container/list"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultPath is the REF_PATH used by htslib when none is configured.
+	DefaultPath = "https://www.ebi.ac.uk/ena/cram/md5/%s"
+
+	// defaultMemoryLimit bounds the total size of the sequences held in memory.
+	defaultMemoryLimit = 512 * 1024 * 1024
+)
+
+// Source fetches reference sequences.  It is safe for concurrent use.  To
+// create a properly initialized Source, use NewSource.
+type Source struct {
+	path     []string
+	cache    string
+	client   *http.Client
+	maxBytes int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int
+}
+
+type entry struct {
+	md5      string
+	sequence []byte
+}
+
+// NewSource returns a Source that searches the colon-separated list of
+// directories and URL templates in refPath and, if refCache is not empty,
+// stores sequences fetched from elsewhere in the local directory template
+// refCache.  In each template %s is replaced by the remaining characters of
+// the MD5 checksum and %Ns by the next N characters; a template without any
+// %s has "/%s" appended.  Sequences are also cached in memory.
+func NewSource(refPath, refCache string) *Source {
+	return &Source{
+		path:     splitPath(refPath),
+		cache:    refCache,
+		client:   http.DefaultClient,
+		maxBytes: defaultMemoryLimit,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// NewSourceFromEnvironment returns a Source configured with the REF_PATH and
+// REF_CACHE environment variables, using DefaultPath if REF_PATH is not set.
+func NewSourceFromEnvironment() *Source {
+	refPath := os.Getenv("REF_PATH")
+	if refPath == "" {
+		refPath = DefaultPath
+	}
+	return NewSource(refPath, os.Getenv("REF_CACHE"))
+}
+
+// splitPath splits a REF_PATH value on colons, except those that are part of
+// a URL scheme.
+func splitPath(refPath string) []string {
+	var (
+		parts   = strings.Split(refPath, ":")
+		entries []string
+	)
+	for i := 0; i < len(parts); i++ {
+		part := parts[i]
+		if (part == "http" || part == "https" || part == "ftp") && i+1 < len(parts) && strings.HasPrefix(parts[i+1], "//") {
+			part += ":" + parts[i+1]
+			i++
+			// A port number is part of the same URL.
+			for i+1 < len(parts) && len(parts[i+1]) > 0 && parts[i+1][0] >= '0' && parts[i+1][0] <= '9' {
+				part += ":" + parts[i+1]
+				i++
+			}
+		}
+		if part != "" {
+			entries = append(entries, part)
+		}
+	}
+	return entries
+}
+
+// expand substitutes md5 into template.
+func expand(template, md5 string) string {
+	if !strings.Contains(template, "%") {
+		template += "/%s"
+	}
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' || i+1 >= len(template) {
+			b.WriteByte(template[i])
+			continue
+		}
+		j := i + 1
+		for j < len(template) && template[j] >= '0' && template[j] <= '9' {
+			j++
+		}
+		if j >= len(template) || template[j] != 's' {
+			b.WriteByte(template[i])
+			continue
+		}
+		n := len(md5)
+		if j > i+1 {
+			n, _ = strconv.Atoi(template[i+1 : j])
+			if n > len(md5) {
+				n = len(md5)
+			}
+		}
+		b.WriteString(md5[:n])
+		md5 = md5[n:]
+		i = j
+	}
+	return b.String()
+}
+
+// Get returns the sequence whose MD5 checksum (as a hexadecimal string, as
+// found in M5 header tags) is md5.
+func (s *Source) Get(ctx context.Context, md5 string) ([]byte, error) {
+	md5 = strings.ToLower(md5)
+	if _, err := hex.DecodeString(md5); err != nil || len(md5) != 32 {
+		return nil, fmt.Errorf("invalid MD5 checksum %q", md5)
+	}
+
+	if sequence := s.lookup(md5); sequence != nil {
+		return sequence, nil
+	}
+
+	if s.cache != "" {
+		if sequence, err := readFile(expand(s.cache, md5), md5); err == nil {
+			s.store(md5, sequence)
+			return sequence, nil
+		}
+	}
+
+	var errs []string
+	for _, template := range s.path {
+		location := expand(template, md5)
+		var (
+			sequence []byte
+			err      error
+		)
+		if strings.Contains(location, "://") {
+			sequence, err = s.fetch(ctx, location, md5)
+		} else {
+			sequence, err = readFile(location, md5)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		if s.cache != "" {
+			if err := writeFile(expand(s.cache, md5), sequence); err != nil {
+				return nil, fmt.Errorf("caching sequence: %v", err)
+			}
+		}
+		s.store(md5, sequence)
+		return sequence, nil
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no reference locations configured for %s", md5)
+	}
+	return nil, fmt.Errorf("fetching reference %s: %s", md5, strings.Join(errs, "; "))
+}
+
+func (s *Source) fetch(ctx context.Context, location, md5 string) ([]byte, error) {
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %v", err)
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", location, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: unexpected response status: %v", location, resp.Status)
+	}
+	sequence, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", location, err)
+	}
+	return sequence, verify(location, sequence, md5)
+}
+
+func readFile(name, md5 string) ([]byte, error) {
+	sequence, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return sequence, verify(name, sequence, md5)
+}
+
+// writeFile atomically writes sequence to name, creating any missing
+// directories.
+func writeFile(name string, sequence []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(sequence); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// verify returns an error if the checksum of sequence is not md5.
+func verify(location string, sequence []byte, want string) error {
+	sum := md5.Sum(sequence)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return fmt.Errorf("%s: checksum mismatch (got %s)", location, got)
+	}
+	return nil
+}
+
+func (s *Source) lookup(md5 string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.entries[md5]; ok {
+		s.lru.MoveToFront(element)
+		return element.Value.(*entry).sequence
+	}
+	return nil
+}
+
+// store adds sequence to the memory cache, evicting the least recently used
+// sequences to stay within the memory limit.
+func (s *Source) store(md5 string, sequence []byte) {
+	if len(sequence) > s.maxBytes {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[md5]; ok {
+		return
+	}
+	s.entries[md5] = s.lru.PushFront(&entry{md5, sequence})
+	s.bytes += len(sequence)
+	for s.bytes > s.maxBytes {
+		oldest := s.lru.Back()
+		e := s.lru.Remove(oldest).(*entry)
+		delete(s.entries, e.md5)
+		s.bytes -= len(e.sequence)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reference
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func checksum(sequence string) string {
+	sum := md5.Sum([]byte(sequence))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSplitPath(t *testing.T) {
+	testCases := []struct {
+		input string
+		want  []string
+	}{
+		{"/refs/%2s/%s", []string{"/refs/%2s/%s"}},
+		{"/a:/b", []string{"/a", "/b"}},
+		{"http://example.com/%s:/local", []string{"http://example.com/%s", "/local"}},
+		{"https://example.com:8443/md5/%s:/local", []string{"https://example.com:8443/md5/%s", "/local"}},
+		{"", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			if got := splitPath(tc.input); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Wrong entries: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	const md5 = "0123456789abcdef0123456789abcdef"
+	testCases := []struct {
+		template, want string
+	}{
+		{"/refs/%s", "/refs/" + md5},
+		{"/refs/%2s/%2s/%s", "/refs/01/23/456789abcdef0123456789abcdef"},
+		{"/refs", "/refs/" + md5},
+		{"http://example.com/sequence/%s?format=raw", "http://example.com/sequence/" + md5 + "?format=raw"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.template, func(t *testing.T) {
+			if got := expand(tc.template, md5); got != tc.want {
+				t.Errorf("Wrong location: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGet_LocalAndCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reference")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const sequence = "ACGTACGTNN"
+	sum := checksum(sequence)
+	if err := writeFile(filepath.Join(dir, "refs", sum[:2], sum[2:]), []byte(sequence)); err != nil {
+		t.Fatalf("Failed to write sequence: %v", err)
+	}
+
+	cache := filepath.Join(dir, "cache", "%2s", "%s")
+	source := NewSource(filepath.Join(dir, "missing")+":"+filepath.Join(dir, "refs", "%2s", "%s"), cache)
+	got, err := source.Get(context.Background(), strings.ToUpper(sum))
+	if err != nil {
+		t.Fatalf("Failed to get sequence: %v", err)
+	}
+	if string(got) != sequence {
+		t.Errorf("Wrong sequence: got %q, want %q", got, sequence)
+	}
+
+	cached, err := ioutil.ReadFile(expand(cache, sum))
+	if err != nil {
+		t.Fatalf("Sequence was not written to the cache: %v", err)
+	}
+	if string(cached) != sequence {
+		t.Errorf("Wrong cached sequence: got %q, want %q", cached, sequence)
+	}
+}
+
+func TestGet_HTTP(t *testing.T) {
+	const sequence = "GATTACA"
+	sum := checksum(sequence)
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		switch req.URL.Path {
+		case "/sequence/" + sum:
+			w.Write([]byte(sequence))
+		case "/corrupt/" + sum:
+			w.Write([]byte("GATTACC"))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	source := NewSource(server.URL+"/corrupt/%s:"+server.URL+"/sequence/%s", "")
+	for i := 0; i < 2; i++ {
+		got, err := source.Get(context.Background(), sum)
+		if err != nil {
+			t.Fatalf("Failed to get sequence: %v", err)
+		}
+		if string(got) != sequence {
+			t.Errorf("Wrong sequence: got %q, want %q", got, sequence)
+		}
+	}
+	if got, want := requests, 2; got != want {
+		t.Errorf("Wrong number of requests: got %d, want %d (second lookup should be cached)", got, want)
+	}
+
+	if _, err := source.Get(context.Background(), checksum("missing")); err == nil {
+		t.Errorf("Expected an error for a missing sequence")
+	}
+	if _, err := source.Get(context.Background(), "not-a-checksum"); err == nil {
+		t.Errorf("Expected an error for an invalid checksum")
+	}
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	source := NewSource("", "")
+	source.maxBytes = 10
+
+	source.store("a", []byte("AAAA"))
+	source.store("b", []byte("CCCC"))
+	source.lookup("a")
+	source.store("c", []byte("GGGG"))
+	source.store("d", []byte("TTTTTTTTTTTT"))
+
+	for md5, want := range map[string]bool{"a": true, "b": false, "c": true, "d": false} {
+		if got := source.lookup(md5) != nil; got != want {
+			t.Errorf("Wrong cache state for %q: got %v, want %v", md5, got, want)
+		}
+	}
+}
@@ -6,39 +6,139 @@ import (
 	"fmt"
 	"io"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
-var tagRe = regexp.MustCompile(`\b(SN|AN):(\S+)\b`)
+var tagRe = regexp.MustCompile(`\b(SN|AN|LN|M5|UR):(\S+)\b`)
 
-// GetReferenceID returns the ID of the provided reference name from a SAM file.
-func GetReferenceID(r io.Reader, reference string) (int32, error) {
-	var current int32
+// Reference describes a single reference sequence from a SAM header.
+type Reference struct {
+	ID             int32
+	Name           string
+	AlternateNames []string
+	// Length is zero if the header does not specify a length.
+	Length uint32
+	// MD5 is the checksum of the reference sequence (the M5 tag) and URI is
+	// its location (the UR tag).  Both are empty if not specified.
+	MD5, URI string
+}
+
+// GetReferences returns all of the references declared by @SQ lines in the SAM
+// header read from r, in order.
+func GetReferences(r io.Reader) ([]Reference, error) {
+	var references []Reference
 
 	// @SQ SN:foo LN:5 AN:bar,baz ...
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		if strings.HasPrefix(scanner.Text(), "@SQ") {
-			for _, tag := range tagRe.FindAllStringSubmatch(scanner.Text(), -1) {
-				switch tag[1] {
-				case "SN":
-					if tag[2] == reference {
-						return current, nil
-					}
-				case "AN":
-					for _, ref := range strings.Split(tag[2], ",") {
-						if reference == ref {
-							return current, nil
-						}
-					}
+		if !strings.HasPrefix(scanner.Text(), "@SQ") {
+			continue
+		}
+		ref := Reference{ID: int32(len(references))}
+		for _, tag := range tagRe.FindAllStringSubmatch(scanner.Text(), -1) {
+			switch tag[1] {
+			case "SN":
+				ref.Name = tag[2]
+			case "AN":
+				ref.AlternateNames = append(ref.AlternateNames, strings.Split(tag[2], ",")...)
+			case "LN":
+				length, err := strconv.ParseUint(tag[2], 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("parsing length of reference %d: %v", ref.ID, err)
 				}
+				ref.Length = uint32(length)
+			case "M5":
+				ref.MD5 = strings.ToLower(tag[2])
+			case "UR":
+				ref.URI = tag[2]
 			}
-			current++
 		}
+		references = append(references, ref)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	return references, nil
+}
+
+// GetReference returns the reference from a SAM header whose name (or one of
+// its alternate names) matches reference.
+func GetReference(r io.Reader, reference string) (*Reference, error) {
+	references, err := GetReferences(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := range references {
+		ref := &references[i]
+		if ref.Name == reference {
+			return ref, nil
+		}
+		for _, name := range ref.AlternateNames {
+			if name == reference {
+				return ref, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("reference %q not found", reference)
+}
+
+// GetReferenceID returns the ID of the provided reference name from a SAM file.
+func GetReferenceID(r io.Reader, reference string) (int32, error) {
+	ref, err := GetReference(r, reference)
+	if err != nil {
+		return 0, err
+	}
+	return ref.ID, nil
+}
+
+// ReadGroup describes a single read group from a SAM header.
+type ReadGroup struct {
+	ID, Sample, Library, Platform, Center, Description string
+}
+
+// GetReadGroups returns the read groups declared by @RG lines in the SAM header
+// read from r, in order.
+func GetReadGroups(r io.Reader) ([]ReadGroup, error) {
+	var groups []ReadGroup
+
+	// @RG	ID:foo	SM:sample	LB:library	PL:ILLUMINA ...
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if fields[0] != "@RG" {
+			continue
+		}
+		var group ReadGroup
+		for _, field := range fields[1:] {
+			if len(field) < 3 || field[2] != ':' {
+				continue
+			}
+			value := field[3:]
+			switch field[:2] {
+			case "ID":
+				group.ID = value
+			case "SM":
+				group.Sample = value
+			case "LB":
+				group.Library = value
+			case "PL":
+				group.Platform = value
+			case "CN":
+				group.Center = value
+			case "DS":
+				group.Description = value
+			}
+		}
+		if group.ID == "" {
+			return nil, fmt.Errorf("read group %d has no ID", len(groups))
+		}
+		groups = append(groups, group)
 	}
 
 	if err := scanner.Err(); err != nil {
-		return 0, fmt.Errorf("reading header: %v", err)
+		return nil, fmt.Errorf("reading header: %v", err)
 	}
-	return 0, fmt.Errorf("reference %q not found", reference)
+	return groups, nil
 }
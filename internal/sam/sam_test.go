@@ -3,6 +3,8 @@ package sam
 import (
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -54,3 +56,74 @@ func TestGetReferenceID(t *testing.T) {
 		}
 	}
 }
+
+func TestGetReferences(t *testing.T) {
+	f, err := os.Open("testdata/complex.header")
+	if err != nil {
+		t.Fatalf("Error reading test file: %v", err)
+	}
+	defer f.Close()
+
+	references, err := GetReferences(f)
+	if err != nil {
+		t.Fatalf("Error getting references: %v", err)
+	}
+	const uri = "ftp://ftp.1000genomes.ebi.ac.uk/vol1/ftp/technical/reference/phase2_reference_assembly_sequence/hs37d5.fa.gz"
+	want := []Reference{
+		{ID: 0, Name: "1", Length: 249250621, MD5: "1b22b98cdeb4a9304cb5d48026a85128", URI: uri},
+		{ID: 1, Name: "2", AlternateNames: []string{"testA", "testB"}, Length: 243199373, MD5: "a0d9851da00400dec1098a9255ac712e", URI: uri},
+		{ID: 2, Name: "5", Length: 180915260, MD5: "0740173db9ffd264d728f32784845cd7", URI: uri},
+	}
+	if len(references) < len(want) {
+		t.Fatalf("Wrong number of references: got %d, want at least %d", len(references), len(want))
+	}
+	for i, want := range want {
+		if got := references[i]; !reflect.DeepEqual(got, want) {
+			t.Errorf("Wrong reference %d: got %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestGetReferences_InvalidLength(t *testing.T) {
+	if _, err := GetReferences(strings.NewReader("@SQ\tSN:1\tLN:abc\n")); err == nil {
+		t.Errorf("Expected an error for an invalid length")
+	}
+}
+
+func TestGetReferences_MissingTags(t *testing.T) {
+	references, err := GetReferences(strings.NewReader("@SQ\tSN:1\tM5:1B22B98CDEB4A9304CB5D48026A85128\n@SQ\tSN:2\n"))
+	if err != nil {
+		t.Fatalf("Error getting references: %v", err)
+	}
+	want := []Reference{
+		{ID: 0, Name: "1", MD5: "1b22b98cdeb4a9304cb5d48026a85128"},
+		{ID: 1, Name: "2"},
+	}
+	if !reflect.DeepEqual(references, want) {
+		t.Errorf("Wrong references: got %+v, want %+v", references, want)
+	}
+}
+
+func TestGetReadGroups(t *testing.T) {
+	header := "@HD\tVN:1.4\n" +
+		"@RG\tID:SRR098401\tPL:ILLUMINA\tLB:Solexa-51024\tDS:paired end\tSM:NA12878\tCN:BI\n" +
+		"@SQ\tSN:1\tLN:100\n" +
+		"@RG\tID:2\n"
+	groups, err := GetReadGroups(strings.NewReader(header))
+	if err != nil {
+		t.Fatalf("Error getting read groups: %v", err)
+	}
+	want := []ReadGroup{
+		{ID: "SRR098401", Sample: "NA12878", Library: "Solexa-51024", Platform: "ILLUMINA", Center: "BI", Description: "paired end"},
+		{ID: "2"},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("Wrong read groups: got %+v, want %+v", groups, want)
+	}
+}
+
+func TestGetReadGroups_MissingID(t *testing.T) {
+	if _, err := GetReadGroups(strings.NewReader("@RG\tSM:NA12878\n")); err == nil {
+		t.Errorf("Expected an error for a read group without an ID")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ticket
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// SignatureHeader is the response header that holds the signature of a
+// ticket, if the server signs them.  The signature is a JWS (RFC 7515) with a
+// detached payload: the exact bytes of the response body.
+const SignatureHeader = "X-Htsget-Signature"
+
+// signatureAlgorithm is the only JWS algorithm used for tickets (ECDSA with
+// P-256 and SHA-256).
+const signatureAlgorithm = "ES256"
+
+// signatureHeader is the JWS protected header of a ticket signature.
+type signatureHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// Sign returns the detached JWS of body, signed with key (which must use the
+// P-256 curve) and naming keyID, in the compact form
+// header..signature.
+func Sign(body []byte, key *ecdsa.PrivateKey, keyID string) (string, error) {
+	if key.Curve != elliptic.P256() {
+		return "", errors.New("signing keys must use the P-256 curve")
+	}
+	header, err := json.Marshal(&signatureHeader{Algorithm: signatureAlgorithm, KeyID: keyID})
+	if err != nil {
+		return "", fmt.Errorf("encoding header: %v", err)
+	}
+	protected := base64.RawURLEncoding.EncodeToString(header)
+
+	digest := sha256.Sum256([]byte(protected + "." + base64.RawURLEncoding.EncodeToString(body)))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing: %v", err)
+	}
+	signature := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rb):32], rb)
+	copy(signature[64-len(sb):], sb)
+	return protected + ".." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks that signature, as returned by Sign, is a valid signature of
+// body by key.  It returns the key ID named by the signature.
+func Verify(body []byte, signature string, key *ecdsa.PublicKey) (string, error) {
+	parts := strings.Split(signature, ".")
+	if len(parts) != 3 || parts[1] != "" {
+		return "", errors.New("malformed detached signature")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("decoding header: %v", err)
+	}
+	var header signatureHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return "", fmt.Errorf("decoding header: %v", err)
+	}
+	if header.Algorithm != signatureAlgorithm {
+		return "", fmt.Errorf("unsupported algorithm %q", header.Algorithm)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return "", errors.New("malformed signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + base64.RawURLEncoding.EncodeToString(body)))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		return "", errors.New("invalid signature")
+	}
+	return header.KeyID, nil
+}
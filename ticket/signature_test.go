@@ -0,0 +1,81 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ticket
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	body := []byte(`{"htsget":{"format":"BAM","urls":[{"url":"data:;base64,"}]}}` + "\n")
+	signature, err := Sign(body, key, "key-1")
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		body      []byte
+		signature string
+		key       *ecdsa.PublicKey
+		ok        bool
+	}{
+		{"valid", body, signature, &key.PublicKey, true},
+		{"modified body", append([]byte(" "), body...), signature, &key.PublicKey, false},
+		{"wrong key", body, signature, &other.PublicKey, false},
+		{"attached payload", body, signature[:len(signature)/2] + "." + signature[len(signature)/2:], &key.PublicKey, false},
+		{"malformed header", body, "!.." + signature, &key.PublicKey, false},
+		{"empty", body, "", &key.PublicKey, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keyID, err := Verify(tc.body, tc.signature, tc.key)
+			if !tc.ok {
+				if err == nil {
+					t.Fatalf("Expected an error, got key ID %q", keyID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to verify: %v", err)
+			}
+			if keyID != "key-1" {
+				t.Errorf("Wrong key ID: got %q, want %q", keyID, "key-1")
+			}
+		})
+	}
+}
+
+func TestSign_WrongCurve(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	if _, err := Sign(nil, key, ""); err == nil {
+		t.Fatal("Expected an error for a P-384 key")
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ticket defines the JSON objects that htsget servers return, as
+// described by the htsget specification.  They are shared by the server and
+// the tools that read its responses.
+package ticket
+
+// URL classes, which tell clients whether the data at a URL holds the header
+// or the body of the file.
+const (
+	ClassHeader = "header"
+	ClassBody   = "body"
+)
+
+// Response is the body of a successful response to a reads request.
+type Response struct {
+	Ticket *Ticket `json:"htsget"`
+}
+
+// Ticket lists the URLs whose data must be concatenated to produce the
+// requested part of a file.
+type Ticket struct {
+	Format string `json:"format"`
+	URLs   []URL  `json:"urls"`
+	// MD5 is the checksum of the concatenated data, if the server knows it.
+	MD5 string `json:"md5,omitempty"`
+}
+
+// URL is a single URL from a ticket, along with any headers that must be
+// sent when fetching it.  Headers may hold only a single value per name.
+type URL struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Class   string            `json:"class,omitempty"`
+}
+
+// ErrorResponse is the body of a response to a request that failed.
+type ErrorResponse struct {
+	Error *Error `json:"htsget"`
+}
+
+// Error describes why a request failed.  Name is one of the error types
+// defined by the specification, such as "InvalidInput" or "NotFound".
+type Error struct {
+	Name    string `json:"error"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ticket
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEncoding(t *testing.T) {
+	testCases := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"ticket", &Response{&Ticket{
+			Format: "BAM",
+			URLs: []URL{
+				{URL: "https://example.com/block", Headers: map[string]string{"Authorization": "Bearer x"}, Class: ClassHeader},
+				{URL: "data:;base64,", Class: ClassBody},
+			},
+		}}, `{"htsget":{"format":"BAM","urls":[{"url":"https://example.com/block","headers":{"Authorization":"Bearer x"},"class":"header"},{"url":"data:;base64,","class":"body"}]}}`},
+		{"checksum", &Response{&Ticket{Format: "BAM", URLs: []URL{{URL: "data:;base64,"}}, MD5: "abc"}},
+			`{"htsget":{"format":"BAM","urls":[{"url":"data:;base64,"}],"md5":"abc"}}`},
+		{"error", &ErrorResponse{&Error{Name: "NotFound", Message: "no such readset"}},
+			`{"htsget":{"error":"NotFound","message":"no such readset"}}`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := json.Marshal(tc.value)
+			if err != nil {
+				t.Fatalf("Failed to encode: %v", err)
+			}
+			if got := string(data); got != tc.want {
+				t.Errorf("Wrong encoding:\ngot  %s\nwant %s", got, tc.want)
+			}
+		})
+	}
+}